@@ -0,0 +1,87 @@
+// Package acl decides which books a user can see, and keeps a rendered view of the library
+// for each set of rules, so servers can give each user their own filesystem.
+package acl
+
+import (
+	"path"
+	"strings"
+
+	"github.com/liclac/sharlayan/calibre"
+	"github.com/liclac/sharlayan/config"
+)
+
+// Returns the name of the rule that applies to a user (blank for anonymous users), and false
+// if no rule applies. If no rules are configured at all, the "" rule applies to everyone.
+func RuleName(cfg *config.Config, user string) (string, bool) {
+	if len(cfg.ACL) == 0 {
+		return "", true
+	}
+	if _, ok := cfg.ACL[user]; ok && user != "" {
+		return user, true
+	}
+	if _, ok := cfg.ACL["*"]; ok {
+		return "*", true
+	}
+	return "", false
+}
+
+// Returns whether a rule allows a user to see a book.
+func Allowed(rule config.ACLRule, book *calibre.Book) bool {
+	if !isEmpty(rule.Allow) && !Match(rule.Allow, book) {
+		return false
+	}
+	return !Match(rule.Deny, book)
+}
+
+// Returns whether a book matches any of a filter's conditions. Names are compared
+// case-insensitively, like Calibre does.
+func Match(f config.ACLFilter, book *calibre.Book) bool {
+	for _, tag := range book.Tags {
+		if containsFold(f.Tags, tag.Name) {
+			return true
+		}
+	}
+	for _, author := range book.Authors {
+		if containsFold(f.Authors, author.Name) {
+			return true
+		}
+	}
+	for _, pattern := range f.Paths {
+		if matchPath(pattern, book.Path) {
+			return true
+		}
+	}
+	for label, values := range f.Columns {
+		for _, v := range book.Custom[strings.TrimPrefix(label, "#")] {
+			if containsFold(values, v) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func isEmpty(f config.ACLFilter) bool {
+	return len(f.Tags) == 0 && len(f.Authors) == 0 && len(f.Paths) == 0 && len(f.Columns) == 0
+}
+
+func containsFold(list []string, s string) bool {
+	for _, v := range list {
+		if strings.EqualFold(v, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// Matches a glob against a path, or any of its parent directories, so "Terry Pratchett"
+// matches "Terry Pratchett/The Fifth Elephant (1)".
+func matchPath(pattern, p string) bool {
+	pattern = strings.Trim(pattern, "/")
+	for p = strings.Trim(p, "/"); p != "." && p != ""; p = path.Dir(p) {
+		if ok, _ := path.Match(pattern, p); ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,140 @@
+package acl
+
+import (
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/liclac/sharlayan/calibre"
+	"github.com/liclac/sharlayan/config"
+)
+
+func testLibrary() *calibre.Metadata {
+	pratchett := &calibre.Author{ID: 1, Name: "Terry Pratchett"}
+	gaiman := &calibre.Author{ID: 2, Name: "Neil Gaiman"}
+	fantasy := &calibre.Tag{ID: 1, Name: "Fantasy"}
+	secret := &calibre.Tag{ID: 2, Name: "work-confidential"}
+	books := []*calibre.Book{
+		{ID: 1, Title: "Guards! Guards!", Path: "Terry Pratchett/Guards! Guards! (1)",
+			Authors: []*calibre.Author{pratchett}, Tags: []*calibre.Tag{fantasy}},
+		{ID: 2, Title: "Good Omens", Path: "Neil Gaiman/Good Omens (2)",
+			Authors: []*calibre.Author{pratchett, gaiman}, Tags: []*calibre.Tag{fantasy}},
+		{ID: 3, Title: "Quarterly Report", Path: "Work/Quarterly Report (3)",
+			Tags: []*calibre.Tag{secret}, Custom: map[string][]string{"shelf": {"office"}}},
+	}
+	pratchett.Books = books[:2]
+	gaiman.Books = books[1:2]
+	fantasy.Books = books[:2]
+	secret.Books = books[2:]
+	return &calibre.Metadata{
+		Books:   books,
+		Authors: []*calibre.Author{pratchett, gaiman},
+		Tags:    []*calibre.Tag{fantasy, secret},
+	}
+}
+
+func titles(books []*calibre.Book) []string {
+	out := []string{}
+	for _, b := range books {
+		out = append(out, b.Title)
+	}
+	return out
+}
+
+func TestAllowed(t *testing.T) {
+	testdata := map[string]struct {
+		rule   config.ACLRule
+		titles []string
+	}{
+		"Empty":          {config.ACLRule{}, []string{"Guards! Guards!", "Good Omens", "Quarterly Report"}},
+		"Deny/Tag":       {config.ACLRule{Deny: config.ACLFilter{Tags: []string{"Work-Confidential"}}}, []string{"Guards! Guards!", "Good Omens"}},
+		"Deny/Author":    {config.ACLRule{Deny: config.ACLFilter{Authors: []string{"neil gaiman"}}}, []string{"Guards! Guards!", "Quarterly Report"}},
+		"Deny/Path":      {config.ACLRule{Deny: config.ACLFilter{Paths: []string{"Work"}}}, []string{"Guards! Guards!", "Good Omens"}},
+		"Deny/PathGlob":  {config.ACLRule{Deny: config.ACLFilter{Paths: []string{"*/Good*"}}}, []string{"Guards! Guards!", "Quarterly Report"}},
+		"Deny/Column":    {config.ACLRule{Deny: config.ACLFilter{Columns: map[string][]string{"#shelf": {"office"}}}}, []string{"Guards! Guards!", "Good Omens"}},
+		"Allow/Tag":      {config.ACLRule{Allow: config.ACLFilter{Tags: []string{"work-confidential"}}}, []string{"Quarterly Report"}},
+		"Allow/Any":      {config.ACLRule{Allow: config.ACLFilter{Tags: []string{"work-confidential"}, Authors: []string{"Neil Gaiman"}}}, []string{"Good Omens", "Quarterly Report"}},
+		"Allow/AndDeny":  {config.ACLRule{Allow: config.ACLFilter{Tags: []string{"Fantasy"}}, Deny: config.ACLFilter{Authors: []string{"Neil Gaiman"}}}, []string{"Guards! Guards!"}},
+		"Allow/NoMatch":  {config.ACLRule{Allow: config.ACLFilter{Tags: []string{"Horror"}}}, []string{}},
+		"Deny/PathNoDir": {config.ACLRule{Deny: config.ACLFilter{Paths: []string{"Terry"}}}, []string{"Guards! Guards!", "Good Omens", "Quarterly Report"}},
+	}
+	for name, tdata := range testdata {
+		t.Run(name, func(t *testing.T) {
+			meta := testLibrary().Filter(func(b *calibre.Book) bool { return Allowed(tdata.rule, b) })
+			assert.Equal(t, tdata.titles, titles(meta.Books))
+		})
+	}
+}
+
+func TestRuleName(t *testing.T) {
+	cfg := &config.Config{}
+	name, ok := RuleName(cfg, "alice")
+	assert.True(t, ok, "no rules = everything for everyone")
+	assert.Equal(t, "", name)
+
+	cfg.ACL = map[string]config.ACLRule{"alice": {}}
+	name, ok = RuleName(cfg, "alice")
+	assert.True(t, ok)
+	assert.Equal(t, "alice", name)
+	_, ok = RuleName(cfg, "bob")
+	assert.False(t, ok, "no default rule = nothing")
+	_, ok = RuleName(cfg, "")
+	assert.False(t, ok)
+
+	cfg.ACL["*"] = config.ACLRule{}
+	name, ok = RuleName(cfg, "bob")
+	assert.True(t, ok)
+	assert.Equal(t, "*", name)
+	name, ok = RuleName(cfg, "")
+	assert.True(t, ok)
+	assert.Equal(t, "*", name)
+}
+
+func TestViews(t *testing.T) {
+	cfg := &config.Config{ACL: map[string]config.ACLRule{
+		"*":     {Deny: config.ACLFilter{Tags: []string{"work-confidential"}}},
+		"alice": {},
+		"eve":   {Allow: config.ACLFilter{Authors: []string{"Neil Gaiman"}}},
+	}}
+	var renders []string
+	v, err := NewViews(cfg, testLibrary(), func(meta *calibre.Metadata) (afero.Fs, error) {
+		fs := afero.NewMemMapFs()
+		for _, b := range meta.Books {
+			if err := afero.WriteFile(fs, b.Title, nil, 0644); err != nil {
+				return nil, err
+			}
+		}
+		renders = append(renders, titles(meta.Books)...)
+		renders = append(renders, "-")
+		return fs, nil
+	})
+	require.NoError(t, err)
+
+	exists := func(fs afero.Fs, name string) bool {
+		ok, err := afero.Exists(fs, name)
+		require.NoError(t, err)
+		return ok
+	}
+	assert.True(t, exists(v, "Good Omens"), "anonymous view")
+	assert.False(t, exists(v, "Quarterly Report"), "anonymous view")
+
+	for _, user := range []string{"alice", "alice", "bob", "eve"} {
+		_, err := v.ForUser(user)
+		require.NoError(t, err)
+	}
+	assert.Equal(t, []string{
+		"Guards! Guards!", "Good Omens", "-", // "*"; shared by "" and bob.
+		"Guards! Guards!", "Good Omens", "Quarterly Report", "-", // alice; only rendered once.
+		"Good Omens", "-", // eve.
+	}, renders)
+	for _, rule := range []string{"*", "alice", "eve"} {
+		assert.NotZero(t, renderSeconds.Value(rule), rule)
+	}
+
+	_, err = NewViews(&config.Config{ACL: map[string]config.ACLRule{
+		"*": {Deny: config.ACLFilter{Paths: []string{"[Work"}}},
+	}}, testLibrary(), nil)
+	assert.Error(t, err, "invalid glob")
+}
@@ -0,0 +1,11 @@
+package acl
+
+import (
+	"github.com/liclac/sharlayan/metrics"
+)
+
+var (
+	renderSeconds = metrics.NewGauge("sharlayan_render_seconds",
+		"Time taken to render each view of the library, by ACL rule; views are rendered the first "+
+			"time they're needed. The rule is \"\" without acl, or \"-\" for users no rule applies to.", "rule")
+)
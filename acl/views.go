@@ -0,0 +1,107 @@
+package acl
+
+import (
+	"fmt"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/spf13/afero"
+	"go.uber.org/zap"
+
+	"github.com/liclac/sharlayan/calibre"
+	"github.com/liclac/sharlayan/config"
+)
+
+// Renders a (possibly filtered) library into a filesystem.
+type RenderFunc func(meta *calibre.Metadata) (afero.Fs, error)
+
+// Views is a filesystem showing what anonymous users may see, which can be narrowed down to
+// what another user may see with ForUser(). Each rule's view is rendered the first time it's
+// needed, then cached; users who share a rule share a view.
+type Views struct {
+	afero.Fs
+
+	L      *zap.Logger
+	cfg    *config.Config
+	meta   *calibre.Metadata
+	render RenderFunc
+
+	mu    sync.Mutex      // Also serialises rendering; builders aren't concurrency-safe.
+	views map[string]view // By rule name.
+}
+
+type view struct {
+	Fs   afero.Fs
+	Meta *calibre.Metadata
+}
+
+func NewViews(cfg *config.Config, meta *calibre.Metadata, render RenderFunc) (*Views, error) {
+	for name, rule := range cfg.ACL {
+		for _, patterns := range [][]string{rule.Allow.Paths, rule.Deny.Paths} {
+			for _, pattern := range patterns {
+				if _, err := path.Match(pattern, ""); err != nil {
+					return nil, fmt.Errorf("acl: %s: %q: %w", name, pattern, err)
+				}
+			}
+		}
+	}
+	v := &Views{
+		L:      zap.L().Named("acl"),
+		cfg:    cfg,
+		meta:   meta,
+		render: render,
+		views:  make(map[string]view),
+	}
+	fs, err := v.ForUser("")
+	if err != nil {
+		return nil, err
+	}
+	v.Fs = fs
+	return v, nil
+}
+
+// Returns a filesystem with only what the given user may see; "" is anonymous.
+func (v *Views) ForUser(user string) (afero.Fs, error) {
+	vw, err := v.view(user)
+	return vw.Fs, err
+}
+
+// Returns the part of the library the given user may see; "" is anonymous.
+func (v *Views) MetadataForUser(user string) (*calibre.Metadata, error) {
+	vw, err := v.view(user)
+	return vw.Meta, err
+}
+
+func (v *Views) view(user string) (view, error) {
+	name, ok := RuleName(v.cfg, user)
+	if !ok {
+		v.L.Debug("No rule applies, library is empty", zap.String("user", user))
+		name = "-" // Not a valid username, so it can't clash with a real rule.
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if vw, ok := v.views[name]; ok {
+		return vw, nil
+	}
+
+	meta := v.meta
+	if ok && len(v.cfg.ACL) > 0 {
+		rule := v.cfg.ACL[name]
+		meta = meta.Filter(func(b *calibre.Book) bool { return Allowed(rule, b) })
+	} else if !ok {
+		meta = meta.Filter(func(*calibre.Book) bool { return false })
+	}
+	v.L.Info("Rendering view", zap.String("rule", name), zap.String("user", user),
+		zap.Int("books", len(meta.Books)))
+	start := time.Now()
+	fs, err := v.render(meta)
+	if err != nil {
+		return view{}, fmt.Errorf("acl: couldn't render view for %q: %w", name, err)
+	}
+	renderSeconds.Set(time.Since(start).Seconds(), name)
+	vw := view{fs, meta}
+	v.views[name] = vw
+	return vw, nil
+}
@@ -0,0 +1,174 @@
+package afhack
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/spf13/afero"
+)
+
+// Returned by Symlink() if a filesystem doesn't support symlinks.
+var ErrNoSymlink = errors.New("symlinks not supported")
+
+// Implemented by filesystems that support symlinks to files on disk.
+type Symlinker interface {
+	Symlink(oldname, newname string) error
+	Readlink(name string) (string, error)
+}
+
+var (
+	_ afero.Fs      = &LinkFs{}
+	_ afero.Lstater = &LinkFs{}
+	_ Symlinker     = &LinkFs{}
+)
+
+// A LinkFs adds symlinks to files on disk to a filesystem that doesn't support them, eg. a
+// MemMapFs, so a rendered tree can include book files without reading them all into memory.
+//
+// A link is an empty placeholder file in the underlying filesystem, which Open() and Stat()
+// transparently replace with the file on disk. Readdir() also follows links, so directory
+// listings show the files' real sizes; use LstatIfPossible() or Readlink() to tell them apart.
+// Links are read-only, and can't be renamed or removed.
+type LinkFs struct {
+	afero.Fs
+
+	mu    sync.RWMutex
+	links map[string]string // Clean path -> absolute path on disk.
+}
+
+func NewLinkFs(fs afero.Fs) *LinkFs {
+	return &LinkFs{Fs: fs, links: make(map[string]string)}
+}
+
+func (fs *LinkFs) Symlink(oldname, newname string) error {
+	oldname, err := filepath.Abs(oldname)
+	if err != nil {
+		return &os.LinkError{Op: "symlink", Old: oldname, New: newname, Err: err}
+	}
+	if err := afero.WriteFile(fs.Fs, newname, nil, 0644); err != nil {
+		return &os.LinkError{Op: "symlink", Old: oldname, New: newname, Err: err}
+	}
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.links[filepath.Clean(newname)] = oldname
+	return nil
+}
+
+func (fs *LinkFs) Readlink(name string) (string, error) {
+	if target, ok := fs.target(name); ok {
+		return target, nil
+	}
+	return "", &os.PathError{Op: "readlink", Path: name, Err: os.ErrInvalid}
+}
+
+func (fs *LinkFs) target(name string) (string, bool) {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+	target, ok := fs.links[filepath.Clean(name)]
+	return target, ok
+}
+
+func (fs *LinkFs) Open(name string) (afero.File, error) {
+	if target, ok := fs.target(name); ok {
+		return os.Open(target)
+	}
+	f, err := fs.Fs.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return &linkDir{f, fs, name}, nil
+}
+
+func (fs *LinkFs) OpenFile(name string, flag int, perm os.FileMode) (afero.File, error) {
+	if _, ok := fs.target(name); ok {
+		if flag&(os.O_WRONLY|os.O_RDWR|os.O_APPEND|os.O_CREATE|os.O_TRUNC) != 0 {
+			return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrPermission}
+		}
+		return fs.Open(name)
+	}
+	return fs.Fs.OpenFile(name, flag, perm)
+}
+
+func (fs *LinkFs) Stat(name string) (os.FileInfo, error) {
+	if target, ok := fs.target(name); ok {
+		info, err := os.Stat(target)
+		if err != nil {
+			return nil, err
+		}
+		return renamedInfo{info, filepath.Base(name)}, nil
+	}
+	return fs.Fs.Stat(name)
+}
+
+func (fs *LinkFs) LstatIfPossible(name string) (os.FileInfo, bool, error) {
+	if target, ok := fs.target(name); ok {
+		return linkInfo{filepath.Base(name), target}, true, nil
+	}
+	info, err := fs.Fs.Stat(name)
+	return info, true, err
+}
+
+func (fs *LinkFs) Remove(name string) error {
+	if _, ok := fs.target(name); ok {
+		return &os.PathError{Op: "remove", Path: name, Err: os.ErrPermission}
+	}
+	return fs.Fs.Remove(name)
+}
+
+func (fs *LinkFs) Rename(oldname, newname string) error {
+	if _, ok := fs.target(oldname); ok {
+		return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: os.ErrPermission}
+	}
+	return fs.Fs.Rename(oldname, newname)
+}
+
+// Wraps a file from the underlying filesystem, so listing a directory follows links.
+type linkDir struct {
+	afero.File
+	fs   *LinkFs
+	name string
+}
+
+func (d *linkDir) Readdir(count int) ([]os.FileInfo, error) {
+	infos, err := d.File.Readdir(count)
+	for i, info := range infos {
+		if target, ok := d.fs.target(filepath.Join(d.name, info.Name())); ok {
+			if tinfo, terr := os.Stat(target); terr == nil {
+				infos[i] = renamedInfo{tinfo, info.Name()}
+			}
+		}
+	}
+	return infos, err
+}
+
+func (d *linkDir) Readdirnames(n int) ([]string, error) {
+	infos, err := d.Readdir(n)
+	names := make([]string, len(infos))
+	for i, info := range infos {
+		names[i] = info.Name()
+	}
+	return names, err
+}
+
+// A followed link has the link's name, but the target's everything else.
+type renamedInfo struct {
+	os.FileInfo
+	name string
+}
+
+func (i renamedInfo) Name() string { return i.name }
+
+// Describes a link itself, like os.Lstat().
+type linkInfo struct {
+	name, target string
+}
+
+func (i linkInfo) Name() string       { return i.name }
+func (i linkInfo) Size() int64        { return int64(len(i.target)) }
+func (i linkInfo) Mode() os.FileMode  { return os.ModeSymlink | 0777 }
+func (i linkInfo) ModTime() time.Time { return time.Time{} }
+func (i linkInfo) IsDir() bool        { return false }
+func (i linkInfo) Sys() interface{}   { return nil }
@@ -0,0 +1,44 @@
+package afhack
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/spf13/afero"
+)
+
+var _ Symlinker = &OsLinkFs{}
+
+// An OsLinkFs is a directory on disk, like an afero.BasePathFs over an afero.OsFs, but with real
+// symlinks, so a rendered tree can link to book files instead of copying them.
+type OsLinkFs struct {
+	*afero.BasePathFs
+}
+
+func NewOsLinkFs(dir string) *OsLinkFs {
+	return &OsLinkFs{afero.NewBasePathFs(afero.NewOsFs(), dir).(*afero.BasePathFs)}
+}
+
+// Links newname to oldname, replacing anything already there, eg. from a previous build.
+func (fs *OsLinkFs) Symlink(oldname, newname string) error {
+	oldname, err := filepath.Abs(oldname)
+	if err != nil {
+		return &os.LinkError{Op: "symlink", Old: oldname, New: newname, Err: err}
+	}
+	real, err := fs.RealPath(newname)
+	if err != nil {
+		return &os.LinkError{Op: "symlink", Old: oldname, New: newname, Err: err}
+	}
+	if err := os.Remove(real); err != nil && !os.IsNotExist(err) {
+		return &os.LinkError{Op: "symlink", Old: oldname, New: newname, Err: err}
+	}
+	return os.Symlink(oldname, real)
+}
+
+func (fs *OsLinkFs) Readlink(name string) (string, error) {
+	real, err := fs.RealPath(name)
+	if err != nil {
+		return "", &os.PathError{Op: "readlink", Path: name, Err: err}
+	}
+	return os.Readlink(real)
+}
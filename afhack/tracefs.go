@@ -10,7 +10,10 @@ import (
 	"go.uber.org/zap/zapcore"
 )
 
-var _ afero.Fs = &TraceFs{}
+var (
+	_ afero.Fs  = &TraceFs{}
+	_ Symlinker = &TraceFs{}
+)
 
 // A TraceFs wraps an afero.Fs filesystem and logs all IO operations.
 // As with all low level tracing, it adds overhead, and the output is quite noisy.
@@ -140,6 +143,32 @@ func (fs *TraceFs) Chtimes(name string, atime time.Time, mtime time.Time) error
 	return err
 }
 
+// Passed through if the underlying filesystem supports symlinks, see Symlinker.
+func (fs *TraceFs) Symlink(oldname, newname string) error {
+	err := ErrNoSymlink
+	if l, ok := fs.FS.(Symlinker); ok {
+		err = l.Symlink(oldname, newname)
+	}
+	if le := fs.L.Check(debugOrWarn(err), ""); le != nil {
+		le.Message = fmt.Sprintf(`Symlink("%s", "%s")`, oldname, newname)
+		le.Write(zap.Error(err))
+	}
+	return err
+}
+
+func (fs *TraceFs) Readlink(name string) (string, error) {
+	l, ok := fs.FS.(Symlinker)
+	if !ok {
+		return "", &os.PathError{Op: "readlink", Path: name, Err: ErrNoSymlink}
+	}
+	target, err := l.Readlink(name)
+	if le := fs.L.Check(debugOrWarn(err), ""); le != nil {
+		le.Message = fmt.Sprintf(`Readlink("%s") "%s"`, name, target)
+		le.Write(zap.Error(err))
+	}
+	return target, err
+}
+
 func debugOrWarn(err error) zapcore.Level {
 	if err != nil {
 		return zapcore.WarnLevel
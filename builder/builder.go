@@ -1,22 +1,85 @@
 package builder
 
 import (
+	"fmt"
+
+	"github.com/liclac/sharlayan/builder/gemini"
+	"github.com/liclac/sharlayan/builder/gopher"
 	"github.com/liclac/sharlayan/builder/html"
+	"github.com/liclac/sharlayan/builder/tree"
 	"github.com/liclac/sharlayan/config"
 )
 
+// A Format renders pages into a tree, eg. HTML or gemtext. Every directory gets a page from
+// each format, so one tree can be served over several protocols.
+type Format interface {
+	Pages(tmpl string, item interface{}) []tree.Node       // An item's page(s), eg. a book's.
+	Index(dir tree.NodeInfo, nodes ...tree.Node) tree.Node // A list of a directory's contents.
+}
+
 type Builder struct {
-	Cfg  *config.Config
-	HTML *html.Builder
+	Cfg     *config.Config
+	HTML    *html.Builder   // nil if not rendering HTML.
+	Gemini  *gemini.Builder // nil if not rendering gemtext.
+	Gopher  *gopher.Builder // nil if not rendering gophermaps.
+	Formats []Format
 }
 
-func New(cfg *config.Config) (*Builder, error) {
-	htmlBuilder, err := html.New(cfg)
-	if err != nil {
-		return nil, err
+// Creates a builder for the given formats, any of "html", "gemini" and "gopher"; by default,
+// just HTML.
+func New(cfg *config.Config, formats ...string) (*Builder, error) {
+	if len(formats) == 0 {
+		formats = []string{"html"}
+	}
+	b := &Builder{Cfg: cfg}
+	for _, format := range formats {
+		switch format {
+		case "html":
+			if b.HTML != nil {
+				continue
+			}
+			htmlBuilder, err := html.New(cfg)
+			if err != nil {
+				return nil, err
+			}
+			b.HTML = htmlBuilder
+			b.Formats = append(b.Formats, htmlBuilder)
+		case "gemini":
+			if b.Gemini != nil {
+				continue
+			}
+			b.Gemini = gemini.New(cfg)
+			b.Formats = append(b.Formats, b.Gemini)
+		case "gopher":
+			if b.Gopher != nil {
+				continue
+			}
+			b.Gopher = gopher.New(cfg)
+			b.Formats = append(b.Formats, b.Gopher)
+		default:
+			return nil, fmt.Errorf("unknown format: %s", format)
+		}
+	}
+	return b, nil
+}
+
+// Returns the item's pages in each format.
+func (b *Builder) pages(tmpl string, item interface{}) []tree.Node {
+	var nodes []tree.Node
+	for _, f := range b.Formats {
+		nodes = append(nodes, f.Pages(tmpl, item)...)
+	}
+	return nodes
+}
+
+// Adds an index page in each format to a directory's contents, unless it's empty.
+func (b *Builder) addIndex(dir tree.NodeInfo, nodes ...tree.Node) []tree.Node {
+	if len(nodes) == 0 {
+		return nodes
+	}
+	out := append([]tree.Node(nil), nodes...)
+	for _, f := range b.Formats {
+		out = append(out, f.Index(dir, nodes...))
 	}
-	return &Builder{
-		Cfg:  cfg,
-		HTML: htmlBuilder,
-	}, nil
+	return out
 }
@@ -0,0 +1,103 @@
+// Package gemini renders the library as gemtext, for Gemini clients; see
+// https://gemini.circumlunar.space/docs/gemtext.gmi. Unlike the HTML output, pages aren't
+// templated, as there's nothing to style.
+package gemini
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/spf13/afero"
+
+	"github.com/liclac/sharlayan/builder/html"
+	"github.com/liclac/sharlayan/builder/tree"
+	"github.com/liclac/sharlayan/calibre"
+	"github.com/liclac/sharlayan/config"
+)
+
+// Pages are named like this, and Gemini servers serve them for their directory.
+const IndexFile = "index.gmi"
+
+type Builder struct {
+	Config *config.Config
+	Funcs  html.Funcs // For formatting dates, sizes, etc. the same way as HTML pages.
+}
+
+func New(cfg *config.Config) *Builder {
+	return &Builder{Config: cfg, Funcs: html.NewFuncs(cfg)}
+}
+
+// Renders a page into a file; kind is "book", "author", "series", "tag" or "_nav", like the
+// HTML templates. The path must be from the root of the tree, as links are relative to it.
+func (b *Builder) Render(fs afero.Fs, ns tree.NamingScheme, path, kind string, v interface{}) error {
+	p := &page{b: b, ns: ns, path: path}
+	switch item := v.(type) {
+	case *calibre.Book:
+		p.book(item)
+	case *calibre.Author:
+		p.books(item.Name, item.Books)
+	case *calibre.Series:
+		p.books(item.Name, item.Books)
+	case *calibre.Tag:
+		p.books(item.Name, item.Books)
+	case html.Nav:
+		p.nav(item)
+	default:
+		return fmt.Errorf("gemini: can't render %T as %s", v, kind)
+	}
+	if err := afero.WriteFile(fs, path, p.buf.Bytes(), 0644); err != nil {
+		return fmt.Errorf("gemini: writing output (%s): %w", path, err)
+	}
+
+	// A book's page only changes when the book does, like the HTML one.
+	if book, ok := v.(*calibre.Book); ok && !book.LastModified.IsZero() {
+		if err := fs.Chtimes(path, book.LastModified, book.LastModified); err != nil {
+			return fmt.Errorf("gemini: setting modification time (%s): %w", path, err)
+		}
+	}
+	return nil
+}
+
+// Returns a book's, author's, etc. page, for builder.Format.
+func (b *Builder) Pages(kind string, item interface{}) []tree.Node {
+	return []tree.Node{b.page(kind, item)}
+}
+
+func (b *Builder) page(kind string, item interface{}) tree.Node {
+	return &PageNode{tree.NodeInfo{ID: IndexFile}, b, kind, item}
+}
+
+// Returns a directory's index page, for builder.Format.
+func (b *Builder) Index(dir tree.NodeInfo, nodes ...tree.Node) tree.Node {
+	infos := make([]tree.NodeInfo, 0, len(nodes))
+	for _, node := range nodes {
+		if node != nil {
+			infos = append(infos, node.Info())
+		}
+	}
+	return b.page("_nav", html.Nav{NodeInfo: dir, Items: infos})
+}
+
+var _ tree.Node = PageNode{}
+
+// A gemtext page to be rendered.
+type PageNode struct {
+	tree.NodeInfo
+	Builder *Builder
+	Kind    string
+	Item    interface{}
+}
+
+func (p PageNode) Info() tree.NodeInfo { return p.NodeInfo }
+
+func (p PageNode) Render(fs afero.Fs, ns tree.NamingScheme, path string) error {
+	return p.Builder.Render(fs, ns, path, p.Kind, p.Item)
+}
+
+// A page being rendered.
+type page struct {
+	b    *Builder
+	ns   tree.NamingScheme
+	path string
+	buf  bytes.Buffer
+}
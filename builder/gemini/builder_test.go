@@ -0,0 +1,114 @@
+package gemini
+
+import (
+	"testing"
+	"time"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/liclac/sharlayan/builder/html"
+	"github.com/liclac/sharlayan/builder/tree"
+	"github.com/liclac/sharlayan/calibre"
+	"github.com/liclac/sharlayan/config"
+)
+
+func testBook() *calibre.Book {
+	pubDate := time.Date(1999, 10, 1, 0, 0, 0, 0, time.UTC)
+	book := &calibre.Book{
+		ID: 4, Title: "The Fifth Elephant", PubDate: &pubDate, HasCover: true, SeriesIndex: 24,
+		Comment:     "A novel about dwarfs.\n\n=> not a link\n```\n* A list item",
+		Identifiers: []calibre.Identifier{{Type: "isbn", Val: "9780552146166"}},
+		Authors:     []*calibre.Author{{ID: 1, Name: "Terry Pratchett"}},
+		Series:      []*calibre.Series{{ID: 2, Name: "Discworld"}},
+		Tags:        []*calibre.Tag{{ID: 3, Name: "Fantasy"}},
+		Data: []*calibre.Data{
+			{Format: "EPUB", Name: "The Fifth Elephant - Terry Pratchett", UncompressedSize: 345678},
+		},
+		LastModified: time.Date(2020, 5, 1, 12, 0, 0, 0, time.UTC),
+	}
+	book.Rating.Int32, book.Rating.Valid = 8, true
+	return book
+}
+
+func TestRender(t *testing.T) {
+	cfg := &config.Config{}
+	cfg.HTML.Title = "Test Library"
+	b := New(cfg)
+	book := testBook()
+
+	testdata := map[string]struct {
+		path string
+		ns   tree.NamingScheme
+		item interface{}
+		out  string
+	}{
+		"Book": {"/books/4/index.gmi", tree.ByID, book, `# The Fifth Elephant
+
+=> ../../authors/1/ by Terry Pratchett
+
+## Description
+A novel about dwarfs.
+
+ => not a link
+` + " ```" + `
+* A list item
+
+## Downloads
+=> 4.epub EPUB (345.7 kB)
+=> cover.jpg Cover
+
+## Details
+=> ../../series/2/ Series: Discworld (book 24)
+* Published: 1 October 1999
+* Rating: ★★★★☆ (4 out of 5)
+=> ../../tags/3/ Tag: Fantasy
+=> https://www.worldcat.org/isbn/9780552146166 ISBN: 9780552146166
+`},
+		"Author": {"/authors/1/index.gmi", tree.ByID, &calibre.Author{Name: "Terry Pratchett", Books: []*calibre.Book{book}}, `# Terry Pratchett
+
+## 1 Book
+=> ../../books/4/ The Fifth Elephant
+`},
+		"Nav/Root": {"/index.gmi", tree.ByID, html.Nav{Items: []tree.NodeInfo{tree.BookDirInfo, tree.AuthorDirInfo}}, `# Test Library
+
+=> books/ Books
+=> authors/ Authors
+`},
+		"Nav/ByName": {"/Series/index.gmi", tree.ByName, html.Nav{NodeInfo: tree.SeriesDirInfo, Items: []tree.NodeInfo{{ID: "5", Name: "Re: Zero"}}}, `# Series
+
+=> ./Re:%20Zero/ Re: Zero
+`},
+		"Nav/Empty": {"/tags/index.gmi", tree.ByID, html.Nav{NodeInfo: tree.TagDirInfo}, `# Tags
+
+Nothing here yet.
+`},
+	}
+	for name, tdata := range testdata {
+		t.Run(name, func(t *testing.T) {
+			fs := afero.NewMemMapFs()
+			require.NoError(t, b.Render(fs, tdata.ns, tdata.path, "", tdata.item))
+			data, err := afero.ReadFile(fs, tdata.path)
+			require.NoError(t, err)
+			assert.Equal(t, tdata.out, string(data))
+		})
+	}
+
+	t.Run("Book/ByName", func(t *testing.T) {
+		fs := afero.NewMemMapFs()
+		p := "/Books/The Fifth Elephant/index.gmi"
+		require.NoError(t, b.Render(fs, tree.ByName, p, "book", book))
+		data, err := afero.ReadFile(fs, p)
+		require.NoError(t, err)
+		assert.Contains(t, string(data), "=> ../../Authors/Terry%20Pratchett/ by Terry Pratchett\n")
+		assert.Contains(t, string(data), "=> The%20Fifth%20Elephant%20-%20Terry%20Pratchett.epub EPUB (345.7 kB)\n")
+
+		info, err := fs.Stat(p)
+		require.NoError(t, err)
+		assert.Equal(t, book.LastModified, info.ModTime().UTC())
+	})
+	t.Run("Unknown", func(t *testing.T) {
+		assert.Error(t, b.Render(afero.NewMemMapFs(), tree.ByID, "/index.gmi", "book", 42))
+	})
+}
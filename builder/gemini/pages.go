@@ -0,0 +1,151 @@
+package gemini
+
+import (
+	"fmt"
+	"net/url"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/liclac/sharlayan/builder/html"
+	"github.com/liclac/sharlayan/builder/tree"
+	"github.com/liclac/sharlayan/calibre"
+)
+
+func (p *page) book(book *calibre.Book) {
+	p.heading("#", book.Title)
+	if len(book.Authors) > 0 {
+		p.line("")
+		for _, author := range book.Authors {
+			p.link(p.dirPath(tree.AuthorDirInfo, tree.AuthorInfo(author)), "by "+author.Name)
+		}
+	}
+
+	if book.Comment != "" {
+		p.line("")
+		p.heading("##", "Description")
+		p.text(book.Comment)
+	}
+
+	if len(book.Data) > 0 || book.HasCover {
+		p.line("")
+		p.heading("##", "Downloads")
+		for _, data := range book.Data {
+			size, _ := p.b.Funcs.Filesize(data.UncompressedSize)
+			p.link(tree.DataInfo(book, data).Filename(p.ns), fmt.Sprintf("%s (%s)", data.Format, size))
+		}
+		if book.HasCover {
+			p.link(tree.CoverInfo.Filename(p.ns), "Cover")
+		}
+	}
+
+	p.line("")
+	p.heading("##", "Details")
+	for _, series := range book.Series {
+		p.link(p.dirPath(tree.SeriesDirInfo, tree.SeriesInfo(series)),
+			fmt.Sprintf("Series: %s (book %g)", series.Name, book.SeriesIndex))
+	}
+	if date, _ := p.b.Funcs.Date("2 January 2006", book.PubDate); date != "" {
+		p.line("* Published: " + date)
+	}
+	if book.Rating.Valid {
+		stars, _ := p.b.Funcs.Stars(book.Rating)
+		rating, _ := p.b.Funcs.Rating(book.Rating)
+		p.line(fmt.Sprintf("* Rating: %s (%g out of 5)", stars, rating))
+	}
+	for _, tag := range book.Tags {
+		p.link(p.dirPath(tree.TagDirInfo, tree.TagInfo(tag)), "Tag: "+tag.Name)
+	}
+	for _, ident := range p.b.Funcs.Identifiers(book) {
+		text := ident.Label + ": " + ident.Val
+		if ident.Err != nil {
+			text += fmt.Sprintf(" (invalid: %s)", ident.Err)
+		}
+		if ident.URL != "" {
+			p.line("=> " + ident.URL + " " + oneLine(text))
+		} else {
+			p.line("* " + oneLine(text))
+		}
+	}
+}
+
+// An author's, series' or tag's page, which is a list of books.
+func (p *page) books(name string, books []*calibre.Book) {
+	p.heading("#", name)
+	p.line("")
+	p.heading("##", fmt.Sprintf("%d %s", len(books), p.b.Funcs.Plural(len(books), "Book", "Books")))
+	for _, book := range books {
+		p.link(p.dirPath(tree.BookDirInfo, tree.BookInfo(book)), book.Title)
+	}
+}
+
+// A list of a directory's contents.
+func (p *page) nav(nav html.Nav) {
+	title := nav.Name
+	if title == "" {
+		if title = p.b.Config.HTML.Title; title == "" {
+			title = "Library"
+		}
+	}
+	p.heading("#", title)
+	p.line("")
+	if len(nav.Items) == 0 {
+		p.line("Nothing here yet.")
+	}
+	for _, info := range nav.Items {
+		p.link(info.Filename(p.ns)+"/", info.Name)
+	}
+}
+
+// Returns the absolute path to an item's directory, eg. "/authors/4/".
+func (p *page) dirPath(infos ...tree.NodeInfo) string {
+	return "/" + tree.Path(p.ns, infos...) + "/"
+}
+
+func (p *page) line(s string) {
+	p.buf.WriteString(s)
+	p.buf.WriteString("\n")
+}
+
+func (p *page) heading(level, s string) {
+	p.line(level + " " + oneLine(s))
+}
+
+// Writes a link line. Absolute targets (eg. "/authors/4/") are made relative to the page, so
+// the output works wherever it's served from; targets with a scheme are left alone.
+func (p *page) link(target, text string) {
+	trailing := strings.HasSuffix(target, "/")
+	if strings.HasPrefix(target, "/") {
+		rel, err := filepath.Rel(path.Dir(p.path), target)
+		if err == nil {
+			target = filepath.ToSlash(rel)
+		}
+		if trailing && !strings.HasSuffix(target, "/") {
+			target += "/"
+		}
+	}
+	href := (&url.URL{Path: target}).String() // Escapes spaces, and "Re: Zero" -> "./Re:%20Zero".
+	if text == "" {
+		p.line("=> " + href)
+		return
+	}
+	p.line("=> " + href + " " + oneLine(text))
+}
+
+// Writes free text, eg. a book's description. Gemtext has no escaping, so lines that would
+// be read as links or preformatting toggles are indented; other markdown-ish syntax, like
+// lists and quotes, means the same thing in gemtext, and is left alone.
+func (p *page) text(s string) {
+	for _, line := range strings.Split(strings.TrimSpace(s), "\n") {
+		line = strings.TrimRight(line, " \t\r")
+		if strings.HasPrefix(line, "=>") || strings.HasPrefix(line, "```") {
+			line = " " + line
+		}
+		p.line(line)
+	}
+}
+
+// Collapses newlines, which would end a heading or link line early.
+func oneLine(s string) string {
+	return strings.Join(strings.Fields(s), " ")
+}
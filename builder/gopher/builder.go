@@ -0,0 +1,118 @@
+// Package gopher renders the library for Gopher clients (RFC 1436), eg. Lynx: a gophermap
+// (menu) for every directory, and a plain text page about each book.
+//
+// Gophermaps are written the way Gophernicus and friends read them, with a tab between an
+// item's type and name, and its selector; the server fills in its own host and port. Selectors
+// are absolute, so the tree must be served from the root of a Gopher server.
+package gopher
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/spf13/afero"
+
+	"github.com/liclac/sharlayan/builder/html"
+	"github.com/liclac/sharlayan/builder/tree"
+	"github.com/liclac/sharlayan/calibre"
+	"github.com/liclac/sharlayan/config"
+)
+
+const (
+	MapFile   = "gophermap" // Every directory's menu; Gopher servers serve it for the directory.
+	AboutFile = "about.txt" // A book's details and description, as plain text.
+)
+
+// Gopher clients tend to assume 80-column terminals, and vintage ones don't wrap.
+const textWidth = 70
+
+type Builder struct {
+	Config *config.Config
+	Funcs  html.Funcs // For formatting dates, sizes, etc. the same way as HTML pages.
+}
+
+func New(cfg *config.Config) *Builder {
+	return &Builder{Config: cfg, Funcs: html.NewFuncs(cfg)}
+}
+
+// Renders a page into a file; kind is "book", "author", "series", "tag" or "_nav", like the
+// HTML templates, or "_about" for a book's text page.
+func (b *Builder) Render(fs afero.Fs, ns tree.NamingScheme, path, kind string, v interface{}) error {
+	p := &page{b: b, ns: ns}
+	switch item := v.(type) {
+	case *calibre.Book:
+		if kind == "_about" {
+			p.about(item)
+		} else {
+			p.book(item)
+		}
+	case *calibre.Author:
+		p.books(item.Name, item.Books)
+	case *calibre.Series:
+		p.books(item.Name, item.Books)
+	case *calibre.Tag:
+		p.books(item.Name, item.Books)
+	case html.Nav:
+		p.nav(item)
+	default:
+		return fmt.Errorf("gopher: can't render %T as %s", v, kind)
+	}
+	if err := afero.WriteFile(fs, path, p.buf.Bytes(), 0644); err != nil {
+		return fmt.Errorf("gopher: writing output (%s): %w", path, err)
+	}
+
+	// A book's pages only change when the book does, like the HTML one.
+	if book, ok := v.(*calibre.Book); ok && !book.LastModified.IsZero() {
+		if err := fs.Chtimes(path, book.LastModified, book.LastModified); err != nil {
+			return fmt.Errorf("gopher: setting modification time (%s): %w", path, err)
+		}
+	}
+	return nil
+}
+
+// Returns a book's, author's, etc. gophermap, plus a text page for books, for builder.Format.
+func (b *Builder) Pages(kind string, item interface{}) []tree.Node {
+	nodes := []tree.Node{b.page(MapFile, kind, item)}
+	if kind == "book" {
+		nodes = append(nodes, b.page(AboutFile, "_about", item))
+	}
+	return nodes
+}
+
+func (b *Builder) page(id, kind string, item interface{}) tree.Node {
+	return &PageNode{tree.NodeInfo{ID: id}, b, kind, item}
+}
+
+// Returns a directory's gophermap, for builder.Format.
+func (b *Builder) Index(dir tree.NodeInfo, nodes ...tree.Node) tree.Node {
+	infos := make([]tree.NodeInfo, 0, len(nodes))
+	for _, node := range nodes {
+		if node != nil {
+			infos = append(infos, node.Info())
+		}
+	}
+	return b.page(MapFile, "_nav", html.Nav{NodeInfo: dir, Items: infos})
+}
+
+var _ tree.Node = PageNode{}
+
+// A gophermap or text page to be rendered.
+type PageNode struct {
+	tree.NodeInfo
+	Builder *Builder
+	Kind    string
+	Item    interface{}
+}
+
+func (p PageNode) Info() tree.NodeInfo { return p.NodeInfo }
+
+func (p PageNode) Render(fs afero.Fs, ns tree.NamingScheme, path string) error {
+	return p.Builder.Render(fs, ns, path, p.Kind, p.Item)
+}
+
+// A page being rendered.
+type page struct {
+	b   *Builder
+	ns  tree.NamingScheme
+	buf bytes.Buffer
+}
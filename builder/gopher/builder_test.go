@@ -0,0 +1,137 @@
+package gopher
+
+import (
+	"testing"
+	"time"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/liclac/sharlayan/builder/html"
+	"github.com/liclac/sharlayan/builder/tree"
+	"github.com/liclac/sharlayan/calibre"
+	"github.com/liclac/sharlayan/config"
+)
+
+func testBook() *calibre.Book {
+	pubDate := time.Date(1999, 10, 1, 0, 0, 0, 0, time.UTC)
+	book := &calibre.Book{
+		ID: 4, Title: "The Fifth Elephant", PubDate: &pubDate, HasCover: true, SeriesIndex: 24,
+		Comment: "A novel about dwarfs, werewolves, and a great deal of fat, which goes on for long enough " +
+			"to need wrapping.\n\n* A list item",
+		Identifiers: []calibre.Identifier{{Type: "isbn", Val: "9780552146166"}},
+		Authors:     []*calibre.Author{{ID: 1, Name: "Terry Pratchett"}},
+		Series:      []*calibre.Series{{ID: 2, Name: "Discworld"}},
+		Tags:        []*calibre.Tag{{ID: 3, Name: "Fantasy"}, {ID: 5, Name: "Humour"}},
+		Data: []*calibre.Data{
+			{Format: "EPUB", Name: "The Fifth Elephant - Terry Pratchett", UncompressedSize: 345678},
+			{Format: "TXT", Name: "The Fifth Elephant - Terry Pratchett", UncompressedSize: 123456},
+		},
+		LastModified: time.Date(2020, 5, 1, 12, 0, 0, 0, time.UTC),
+	}
+	book.Rating.Int32, book.Rating.Valid = 8, true
+	return book
+}
+
+func TestRender(t *testing.T) {
+	cfg := &config.Config{}
+	cfg.HTML.Title = "Test Library"
+	b := New(cfg)
+	book := testBook()
+
+	testdata := map[string]struct {
+		path string
+		ns   tree.NamingScheme
+		kind string
+		item interface{}
+		out  string
+	}{
+		"Book": {"/books/4/gophermap", tree.ByID, "book", book, "" +
+			"iThe Fifth Elephant\t\n" +
+			"1by Terry Pratchett\t/authors/1/\n" +
+			"i\t\n" +
+			"0About this book\t/books/4/about.txt\n" +
+			"i\t\n" +
+			"iDownloads:\t\n" +
+			"9EPUB (345.7 kB)\t/books/4/4.epub\n" +
+			"0TXT (123.5 kB)\t/books/4/4.txt\n" +
+			"ICover\t/books/4/cover.jpg\n" +
+			"i\t\n" +
+			"1Series: Discworld (book 24)\t/series/2/\n" +
+			"1Tag: Fantasy\t/tags/3/\n" +
+			"1Tag: Humour\t/tags/5/\n" +
+			"hISBN: 9780552146166\tURL:https://www.worldcat.org/isbn/9780552146166\n"},
+		"Book/About": {"/books/4/about.txt", tree.ByID, "_about", book, `The Fifth Elephant
+by Terry Pratchett
+
+Series: Discworld (book 24)
+Published: 1 October 1999
+Rating: 4 out of 5
+Tags: Fantasy, Humour
+ISBN: 9780552146166
+
+A novel about dwarfs, werewolves, and a great deal of fat, which goes
+on for long enough to need wrapping.
+
+* A list item
+`},
+		"Author": {"/authors/1/gophermap", tree.ByID, "author", &calibre.Author{Name: "Terry Pratchett", Books: []*calibre.Book{book}}, "" +
+			"iTerry Pratchett\t\n" +
+			"i\t\n" +
+			"i1 Book:\t\n" +
+			"1The Fifth Elephant\t/books/4/\n"},
+		"Nav/Root": {"/gophermap", tree.ByID, "_nav", html.Nav{Items: []tree.NodeInfo{tree.BookDirInfo, tree.AuthorDirInfo}}, "" +
+			"iTest Library\t\n" +
+			"i\t\n" +
+			"1Books\t/books/\n" +
+			"1Authors\t/authors/\n"},
+		"Nav/ByName": {"/Series/gophermap", tree.ByName, "_nav", html.Nav{NodeInfo: tree.SeriesDirInfo, Items: []tree.NodeInfo{{ID: "5", Name: "Re: Zero"}}}, "" +
+			"iSeries\t\n" +
+			"i\t\n" +
+			"1Re: Zero\t/Series/Re: Zero/\n"},
+		"Nav/Empty": {"/tags/gophermap", tree.ByID, "_nav", html.Nav{NodeInfo: tree.TagDirInfo}, "" +
+			"iTags\t\n" +
+			"i\t\n" +
+			"iNothing here yet.\t\n"},
+	}
+	for name, tdata := range testdata {
+		t.Run(name, func(t *testing.T) {
+			fs := afero.NewMemMapFs()
+			require.NoError(t, b.Render(fs, tdata.ns, tdata.path, tdata.kind, tdata.item))
+			data, err := afero.ReadFile(fs, tdata.path)
+			require.NoError(t, err)
+			assert.Equal(t, tdata.out, string(data))
+		})
+	}
+
+	t.Run("Pages", func(t *testing.T) {
+		var ids []string
+		for _, node := range b.Pages("book", book) {
+			ids = append(ids, node.Info().ID)
+		}
+		assert.Equal(t, []string{MapFile, AboutFile}, ids)
+		assert.Len(t, b.Pages("author", book.Authors[0]), 1)
+	})
+	t.Run("Unknown", func(t *testing.T) {
+		assert.Error(t, b.Render(afero.NewMemMapFs(), tree.ByID, "/gophermap", "book", 42))
+	})
+}
+
+func TestWrap(t *testing.T) {
+	testdata := map[string]struct {
+		in  string
+		out []string
+	}{
+		"Empty":    {"", []string{""}},
+		"Short":    {"a b  c", []string{"a b c"}},
+		"Wrapped":  {"aaa bbb ccc", []string{"aaa bbb", "ccc"}},
+		"LongWord": {"aaaaaaaaaa b", []string{"aaaaaaaaaa", "b"}},
+		"Unicode":  {"ééé ééé ééé", []string{"ééé ééé", "ééé"}},
+	}
+	for name, tdata := range testdata {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, tdata.out, wrap(tdata.in, 8))
+		})
+	}
+}
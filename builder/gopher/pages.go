@@ -0,0 +1,191 @@
+package gopher
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/liclac/sharlayan/builder/html"
+	"github.com/liclac/sharlayan/builder/tree"
+	"github.com/liclac/sharlayan/calibre"
+)
+
+// Item types used in gophermaps; see RFC 1436, section 3.8, and common extensions.
+const (
+	itemText   = '0'
+	itemMenu   = '1'
+	itemBinary = '9'
+	itemImage  = 'I'
+	itemHTML   = 'h' // Selectors like "URL:https://...", for links to the web.
+	itemInfo   = 'i' // Text shown in the menu, not a link.
+)
+
+func (p *page) book(book *calibre.Book) {
+	dir := p.dirPath(tree.BookDirInfo, tree.BookInfo(book))
+	p.info(book.Title)
+	for _, author := range book.Authors {
+		p.item(itemMenu, "by "+author.Name, p.dirPath(tree.AuthorDirInfo, tree.AuthorInfo(author)))
+	}
+	p.info("")
+	p.item(itemText, "About this book", dir+AboutFile)
+
+	if len(book.Data) > 0 || book.HasCover {
+		p.info("")
+		p.info("Downloads:")
+		for _, data := range book.Data {
+			typ := byte(itemBinary)
+			if data.Format == "TXT" {
+				typ = itemText
+			}
+			size, _ := p.b.Funcs.Filesize(data.UncompressedSize)
+			p.item(typ, fmt.Sprintf("%s (%s)", data.Format, size), dir+tree.DataInfo(book, data).Filename(p.ns))
+		}
+		if book.HasCover {
+			p.item(itemImage, "Cover", dir+tree.CoverInfo.Filename(p.ns))
+		}
+	}
+
+	idents := p.b.Funcs.Identifiers(book)
+	if len(book.Series) > 0 || len(book.Tags) > 0 || len(idents) > 0 {
+		p.info("")
+	}
+	for _, series := range book.Series {
+		p.item(itemMenu, fmt.Sprintf("Series: %s (book %g)", series.Name, book.SeriesIndex),
+			p.dirPath(tree.SeriesDirInfo, tree.SeriesInfo(series)))
+	}
+	for _, tag := range book.Tags {
+		p.item(itemMenu, "Tag: "+tag.Name, p.dirPath(tree.TagDirInfo, tree.TagInfo(tag)))
+	}
+	for _, ident := range idents {
+		if ident.URL != "" && ident.Err == nil {
+			p.item(itemHTML, ident.Label+": "+ident.Val, "URL:"+ident.URL)
+		}
+	}
+}
+
+// A book's details and description, as plain text, wrapped for narrow terminals.
+func (p *page) about(book *calibre.Book) {
+	p.text(book.Title)
+	for _, author := range book.Authors {
+		p.text("by " + author.Name)
+	}
+	p.line("")
+
+	for _, series := range book.Series {
+		p.text(fmt.Sprintf("Series: %s (book %g)", series.Name, book.SeriesIndex))
+	}
+	if date, _ := p.b.Funcs.Date("2 January 2006", book.PubDate); date != "" {
+		p.text("Published: " + date)
+	}
+	if book.Rating.Valid {
+		rating, _ := p.b.Funcs.Rating(book.Rating)
+		p.text(fmt.Sprintf("Rating: %g out of 5", rating))
+	}
+	if len(book.Tags) > 0 {
+		names := make([]string, len(book.Tags))
+		for i, tag := range book.Tags {
+			names[i] = tag.Name
+		}
+		p.text("Tags: " + strings.Join(names, ", "))
+	}
+	for _, ident := range p.b.Funcs.Identifiers(book) {
+		text := ident.Label + ": " + ident.Val
+		if ident.Err != nil {
+			text += fmt.Sprintf(" (invalid: %s)", ident.Err)
+		}
+		p.text(text)
+	}
+
+	if comment := strings.TrimSpace(book.Comment); comment != "" {
+		p.line("")
+		for _, line := range strings.Split(comment, "\n") {
+			p.text(line)
+		}
+	}
+}
+
+// An author's, series' or tag's gophermap, which is a list of books.
+func (p *page) books(name string, books []*calibre.Book) {
+	p.info(name)
+	p.info("")
+	p.info(fmt.Sprintf("%d %s:", len(books), p.b.Funcs.Plural(len(books), "Book", "Books")))
+	for _, book := range books {
+		p.item(itemMenu, book.Title, p.dirPath(tree.BookDirInfo, tree.BookInfo(book)))
+	}
+}
+
+// A list of a directory's contents.
+func (p *page) nav(nav html.Nav) {
+	title := nav.Name
+	if title == "" {
+		if title = p.b.Config.HTML.Title; title == "" {
+			title = "Library"
+		}
+	}
+	p.info(title)
+	p.info("")
+	if len(nav.Items) == 0 {
+		p.info("Nothing here yet.")
+	}
+	dir := p.dirPath(nav.NodeInfo)
+	for _, info := range nav.Items {
+		p.item(itemMenu, info.Name, dir+info.Filename(p.ns)+"/")
+	}
+}
+
+// Returns the selector for an item's directory, eg. "/authors/4/", or "/" for the root.
+func (p *page) dirPath(infos ...tree.NodeInfo) string {
+	if dir := tree.Path(p.ns, infos...); dir != "" {
+		return "/" + dir + "/"
+	}
+	return "/"
+}
+
+func (p *page) line(s string) {
+	p.buf.WriteString(s)
+	p.buf.WriteString("\n")
+}
+
+// Writes a menu item. Tabs and newlines would break the line up, so they're collapsed.
+func (p *page) item(typ byte, name, selector string) {
+	p.line(string(typ) + oneLine(name) + "\t" + selector)
+}
+
+// Writes a line of text into a menu. The trailing tab keeps servers from reading it as one of
+// their own directives, eg. a "#" comment.
+func (p *page) info(s string) {
+	for _, line := range wrap(oneLine(s), textWidth) {
+		p.item(itemInfo, line, "")
+	}
+}
+
+// Writes a line of plain text, wrapped.
+func (p *page) text(s string) {
+	for _, line := range wrap(strings.TrimRight(s, " \t\r"), textWidth) {
+		p.line(line)
+	}
+}
+
+// Wraps a line at spaces, so no line is longer than width, unless a word is; an empty line
+// stays a single empty line.
+func wrap(s string, width int) []string {
+	words := strings.Fields(s)
+	if len(words) == 0 {
+		return []string{""}
+	}
+	var lines []string
+	line := words[0]
+	for _, word := range words[1:] {
+		if len([]rune(line))+1+len([]rune(word)) > width {
+			lines = append(lines, line)
+			line = word
+			continue
+		}
+		line += " " + word
+	}
+	return append(lines, line)
+}
+
+// Collapses tabs and newlines, which would end a menu line early.
+func oneLine(s string) string {
+	return strings.Join(strings.Fields(s), " ")
+}
@@ -0,0 +1,80 @@
+package builder
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/afero"
+)
+
+// Files smaller than this aren't worth compressing.
+const gzipMinSize = 512
+
+// Extensions of files worth compressing; books and images are already compressed.
+var gzipExts = map[string]bool{
+	".html": true,
+	".css":  true,
+	".js":   true,
+	".json": true,
+	".xml":  true,
+	".svg":  true,
+	".txt":  true,
+}
+
+// Writes a gzipped copy next to every text file in a rendered tree, eg. index.html.gz, for
+// web servers that can serve them directly (eg. nginx's gzip_static).
+func Gzip(fs afero.Fs, root string) error {
+	return afero.Walk(fs, root, func(path string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			return nil // A stale .gz file we removed below.
+		} else if err != nil {
+			return err
+		}
+		if info.IsDir() || !gzipExts[strings.ToLower(filepath.Ext(path))] {
+			return nil
+		}
+		if info.Size() < gzipMinSize {
+			// Don't leave one behind from a previous build.
+			if err := fs.Remove(path + ".gz"); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			return nil
+		}
+		if err := gzipFile(fs, path, info); err != nil {
+			return fmt.Errorf("gzip: %s: %w", path, err)
+		}
+		return nil
+	})
+}
+
+func gzipFile(fs afero.Fs, path string, info os.FileInfo) error {
+	src, err := fs.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := fs.Create(path + ".gz")
+	if err != nil {
+		return err
+	}
+	zw, _ := gzip.NewWriterLevel(dst, gzip.BestCompression) // Only fails for invalid levels.
+	zw.Name = filepath.Base(path)
+	zw.ModTime = info.ModTime()
+	if _, err := io.Copy(zw, src); err != nil {
+		dst.Close()
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		dst.Close()
+		return err
+	}
+	if err := dst.Close(); err != nil {
+		return err
+	}
+	// Servers compare these to tell whether the compressed file is up to date.
+	return fs.Chtimes(path+".gz", info.ModTime(), info.ModTime())
+}
@@ -0,0 +1,44 @@
+package builder
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGzip(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	page := strings.Repeat("<p>Hello, world!</p>\n", 100)
+	mtime := time.Date(2020, 5, 1, 12, 0, 0, 0, time.UTC)
+	require.NoError(t, afero.WriteFile(fs, "/books/1/index.html", []byte(page), 0644))
+	require.NoError(t, fs.Chtimes("/books/1/index.html", mtime, mtime))
+	require.NoError(t, afero.WriteFile(fs, "/books/1/book.epub", []byte(page), 0644))
+	require.NoError(t, afero.WriteFile(fs, "/books/index.html", []byte("<p>Hi</p>"), 0644))
+	require.NoError(t, afero.WriteFile(fs, "/books/index.html.gz", []byte("stale"), 0644))
+
+	require.NoError(t, Gzip(fs, "/"))
+
+	f, err := fs.Open("/books/1/index.html.gz")
+	require.NoError(t, err)
+	defer f.Close()
+	zr, err := gzip.NewReader(f)
+	require.NoError(t, err)
+	data, err := ioutil.ReadAll(zr)
+	require.NoError(t, err)
+	assert.Equal(t, page, string(data))
+	info, err := fs.Stat("/books/1/index.html.gz")
+	require.NoError(t, err)
+	assert.Equal(t, mtime, info.ModTime().UTC())
+
+	for _, p := range []string{"/books/1/book.epub.gz", "/books/index.html.gz"} {
+		ok, err := afero.Exists(fs, p)
+		require.NoError(t, err)
+		assert.False(t, ok, p)
+	}
+}
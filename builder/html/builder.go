@@ -97,18 +97,33 @@ func (b *Builder) listTemplates() ([]string, error) {
 	return names, err
 }
 
+// Renders a template into a file. The path must be from the root of the site, as it's also
+// used to resolve relative links from the page.
 func (b *Builder) Render(fs afero.Fs, ns tree.NamingScheme, path, name string, v interface{}) error {
 	b.Funcs.Naming = ns
+	b.Funcs.Page = path
 	f, err := fs.Create(path)
 	if err != nil {
 		return fmt.Errorf("html: creating output (%s): %w", path, err)
 	}
-	defer f.Close()
-	if t, ok := b.Templates[name]; ok {
-		if err := t.ExecuteTemplate(f, name, v); err != nil {
-			return fmt.Errorf("html: executing template (%s): %w", name, err)
+	t, ok := b.Templates[name]
+	if !ok {
+		f.Close()
+		return fmt.Errorf("no such template: %s", name)
+	}
+	if err := t.ExecuteTemplate(f, name, v); err != nil {
+		f.Close()
+		return fmt.Errorf("html: executing template (%s): %w", name, err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("html: closing output (%s): %w", path, err)
+	}
+
+	// A book's page only changes when the book does, so servers can tell clients it hasn't.
+	if book, ok := v.(*calibre.Book); ok && !book.LastModified.IsZero() {
+		if err := fs.Chtimes(path, book.LastModified, book.LastModified); err != nil {
+			return fmt.Errorf("html: setting modification time (%s): %w", path, err)
 		}
-		return nil
 	}
-	return fmt.Errorf("no such template: %s", name)
+	return nil
 }
@@ -1,8 +1,14 @@
 package html
 
 import (
+	"database/sql"
 	"fmt"
 	"html/template"
+	"math"
+	"net/url"
+	"path"
+	"strings"
+	"time"
 
 	"github.com/russross/blackfriday/v2"
 
@@ -18,7 +24,9 @@ type Link struct {
 	Infos []tree.NodeInfo
 }
 
-func (l Link) Href() string {
+// Returns the path to the link target; from the root of the site (eg. "/books/4") for
+// absolute links, or from the current directory (eg. "4") for relative ones.
+func (l Link) Path() string {
 	href := tree.Path(l.f.Naming, l.Infos...)
 	if l.Abs {
 		href = "/" + href
@@ -26,33 +34,79 @@ func (l Link) Href() string {
 	return href
 }
 
+// Returns a URL-escaped href for the link. Normally, absolute links are prefixed with html.root,
+// but in relative mode (html.relative), they're relative to the current page, and point to the
+// target's index.html, so the output works without a web server, eg. "../../books/4/index.html".
+func (l Link) Href() string {
+	href := l.Path()
+	if l.f.Config.HTML.Relative {
+		if l.Abs {
+			href = l.f.relativeTo(href)
+		}
+		href = path.Join(href, "index.html")
+	} else if l.Abs {
+		href = l.f.Config.HTML.Root + href
+	}
+	return (&url.URL{Path: href}).String() // Not EscapedPath(); handles "Re: Zero" -> "./Re:%20Zero".
+}
+
 func (l Link) Text() string {
+	if len(l.Infos) == 0 {
+		return l.f.Config.HTML.Title
+	}
 	return l.Infos[len(l.Infos)-1].Name
 }
 
+// Template functions; see templates/README.md for documentation.
+//
+// Map() must be called on the same *Funcs that the Builder later updates (eg. Naming),
+// otherwise the template functions will be bound to a stale copy.
 type Funcs struct {
 	Config *config.Config
 	Naming tree.NamingScheme
+	Page   string // Path to the page being rendered, from the root of the site.
 }
 
 func NewFuncs(cfg *config.Config) Funcs {
 	return Funcs{Config: cfg}
 }
 
-func (f Funcs) Map() template.FuncMap {
+func (f *Funcs) Map() template.FuncMap {
 	return template.FuncMap{
 		"cfg":      f.Cfg,
 		"markdown": f.Markdown,
 		"linkTo":   f.LinkTo,
 		"linksTo":  f.LinksTo,
+		"home":     f.Home,
+		"relURL":   f.RelURL,
+		"absURL":   f.AbsURL,
+
+		"date":     f.Date,
+		"rating":   f.Rating,
+		"stars":    f.Stars,
+		"filesize": f.Filesize,
+		"plural":   f.Plural,
+
+		"sortBy":  f.SortBy,
+		"groupBy": f.GroupBy,
+		"first":   f.First,
+		"limit":   f.Limit,
+
+		"downloads":   f.Downloads,
+		"identifiers": f.Identifiers,
+		"isbn10":      f.ISBN10,
+		"isbn13":      f.ISBN13,
+
+		"openGraph": f.OpenGraph,
+		"schemaOrg": f.SchemaOrg,
 	}
 }
 
-func (f Funcs) Cfg() *config.Config {
+func (f *Funcs) Cfg() *config.Config {
 	return f.Config
 }
 
-func (f Funcs) Markdown(v string) template.HTML {
+func (f *Funcs) Markdown(v string) template.HTML {
 	return template.HTML(blackfriday.Run([]byte(v)))
 }
 
@@ -62,6 +116,11 @@ func (f *Funcs) LinkTo(iv interface{}) (Link, error) {
 		return v, nil
 	case tree.NodeInfo:
 		return Link{f, false, []tree.NodeInfo{v}}, nil
+	case Nav:
+		if v.ID == "" {
+			return f.Home(), nil
+		}
+		return Link{f, true, []tree.NodeInfo{v.NodeInfo}}, nil
 	case *calibre.Book:
 		return Link{f, true, []tree.NodeInfo{tree.BookDirInfo, tree.BookInfo(v)}}, nil
 	case *calibre.Author:
@@ -71,12 +130,56 @@ func (f *Funcs) LinkTo(iv interface{}) (Link, error) {
 	case *calibre.Tag:
 		return Link{f, true, []tree.NodeInfo{tree.TagDirInfo, tree.TagInfo(v)}}, nil
 	}
-	return Link{}, fmt.Errorf("linkTo supports Link, *Book, *Author, *Series and *Tag, not %T", iv)
+	return Link{}, fmt.Errorf("linkTo supports Link, Nav, *Book, *Author, *Series and *Tag, not %T", iv)
 }
 
-func (f Funcs) LinksTo(ivs ...interface{}) ([]Link, error) {
-	links := make([]Link, len(ivs))
-	for i, iv := range links {
+// A book file that can be downloaded, for the book template.
+type Download struct {
+	Format   string // eg. "EPUB".
+	Type     string // MIME type, eg. "application/epub+zip"; blank if unknown.
+	Filename string // Calibre's name for it, eg. "The Fifth Elephant - Terry Pratchett.epub".
+	Href     string // URL-escaped link to the file.
+	Size     int    // In bytes.
+}
+
+// Returns a book's files, in the order Calibre lists them.
+func (f *Funcs) Downloads(book *calibre.Book) []Download {
+	downloads := make([]Download, len(book.Data))
+	for i, data := range book.Data {
+		info := tree.DataInfo(book, data)
+		href := "/" + tree.Path(f.Naming, tree.BookDirInfo, tree.BookInfo(book), info)
+		if f.Config.HTML.Relative {
+			href = f.relativeTo(href)
+		} else {
+			href = f.Config.HTML.Root + href
+		}
+		downloads[i] = Download{
+			Format:   data.Format,
+			Type:     calibre.FormatMIMEType(data.Format),
+			Filename: info.Name,
+			Href:     (&url.URL{Path: href}).String(),
+			Size:     data.UncompressedSize,
+		}
+	}
+	return downloads
+}
+
+// Returns a link to the root of the site.
+func (f *Funcs) Home() Link {
+	return Link{f, true, nil}
+}
+
+// Like LinkTo, but for several items. Slices are flattened, so both of these work:
+//
+//	{{range linksTo .Authors}}...{{end}}
+//	{{range linksTo .Authors .Series}}...{{end}}
+func (f *Funcs) LinksTo(ivs ...interface{}) ([]Link, error) {
+	items, err := flatten(ivs)
+	if err != nil {
+		return nil, fmt.Errorf("linksTo: %w", err)
+	}
+	links := make([]Link, len(items))
+	for i, iv := range items {
 		link, err := f.LinkTo(iv)
 		if err != nil {
 			return nil, err
@@ -85,3 +188,148 @@ func (f Funcs) LinksTo(ivs ...interface{}) ([]Link, error) {
 	}
 	return links, nil
 }
+
+// Returns a URL to a path from the root of the site, eg. "style.css" -> "/library/style.css".
+// In relative mode (html.relative), it's relative to the current page, eg. "../../style.css".
+func (f *Funcs) RelURL(p string) string {
+	p = "/" + strings.TrimPrefix(p, "/")
+	if f.Config.HTML.Relative {
+		return f.relativeTo(p)
+	}
+	return f.Config.HTML.Root + p
+}
+
+// Returns an absolute URL, eg. "style.css" -> "https://example.com/library/style.css".
+// If no public URL (html.url) is configured, this is the same as relURL.
+func (f *Funcs) AbsURL(p string) string {
+	if f.Config.HTML.URL == "" {
+		return f.RelURL(p)
+	}
+	return strings.TrimSuffix(f.Config.HTML.URL, "/") + f.Config.HTML.Root + "/" + strings.TrimPrefix(p, "/")
+}
+
+// Returns a path from the root of the site as relative to the current page.
+func (f *Funcs) relativeTo(target string) string {
+	page := f.Page
+	if page == "" {
+		page = "/"
+	}
+	// These are URLs, not files, so filepath.Rel would use the wrong separators on Windows.
+	from, to := splitURLPath(path.Dir(page)), splitURLPath(target)
+	i := 0
+	for i < len(from) && i < len(to) && from[i] == to[i] {
+		i++
+	}
+	parts := make([]string, 0, len(from)-i+len(to)-i)
+	for range from[i:] {
+		parts = append(parts, "..")
+	}
+	parts = append(parts, to[i:]...)
+	if len(parts) == 0 {
+		return "."
+	}
+	return strings.Join(parts, "/")
+}
+
+// Splits an absolute URL path into its segments; "/" has none.
+func splitURLPath(p string) []string {
+	p = strings.Trim(path.Clean(p), "/")
+	if p == "" {
+		return nil
+	}
+	return strings.Split(p, "/")
+}
+
+// Formats a date using a Go time layout, eg. {{date "2 January 2006" .PubDate}}.
+// Accepts time.Time or *time.Time; nil, zero and Calibre's "unknown" placeholder (0101-01-01)
+// dates are rendered as an empty string.
+func (f *Funcs) Date(layout string, iv interface{}) (string, error) {
+	var t time.Time
+	switch v := iv.(type) {
+	case time.Time:
+		t = v
+	case *time.Time:
+		if v == nil {
+			return "", nil
+		}
+		t = *v
+	case nil:
+		return "", nil
+	default:
+		return "", fmt.Errorf("date supports time.Time and *time.Time, not %T", iv)
+	}
+	if t.IsZero() || t.Year() <= 101 {
+		return "", nil
+	}
+	return t.Format(layout), nil
+}
+
+// Converts a Calibre rating (0-10) to a number of stars (0-5, in steps of 0.5).
+// Accepts Book.Rating (sql.NullInt32) or a plain integer; an unset rating is 0.
+func (f *Funcs) Rating(iv interface{}) (float64, error) {
+	switch v := iv.(type) {
+	case sql.NullInt32:
+		if !v.Valid {
+			return 0, nil
+		}
+		return float64(v.Int32) / 2, nil
+	case int:
+		return float64(v) / 2, nil
+	case int32:
+		return float64(v) / 2, nil
+	case int64:
+		return float64(v) / 2, nil
+	}
+	return 0, fmt.Errorf("rating supports sql.NullInt32 and integers, not %T", iv)
+}
+
+// Renders a Calibre rating as stars, eg. 7 -> "★★★½☆". Screen readers don't do well with
+// these, so give them an alternative, eg. <span role="img" aria-label="{{rating .Rating}} stars">.
+func (f *Funcs) Stars(iv interface{}) (string, error) {
+	stars, err := f.Rating(iv)
+	if err != nil {
+		return "", err
+	}
+	stars = math.Max(0, math.Min(5, stars)) // Bad data, or a custom column with another scale.
+	full := int(math.Floor(stars))
+	half := stars-float64(full) >= 0.5
+	s := strings.Repeat("★", full)
+	if half {
+		s += "½"
+		full++
+	}
+	return s + strings.Repeat("☆", 5-full), nil
+}
+
+// Formats a size in bytes for humans, eg. 345678 -> "345.7 kB".
+func (f *Funcs) Filesize(iv interface{}) (string, error) {
+	var n float64
+	switch v := iv.(type) {
+	case int:
+		n = float64(v)
+	case int64:
+		n = float64(v)
+	case uint64:
+		n = float64(v)
+	default:
+		return "", fmt.Errorf("filesize supports integers, not %T", iv)
+	}
+	if n < 1000 {
+		return fmt.Sprintf("%d B", int64(n)), nil
+	}
+	units := []string{"kB", "MB", "GB", "TB"}
+	unit := -1
+	for n >= 1000 && unit < len(units)-1 {
+		n /= 1000
+		unit++
+	}
+	return fmt.Sprintf("%.1f %s", n, units[unit]), nil
+}
+
+// Returns singular if n == 1, else plural, eg. {{len .Books}} {{plural (len .Books) "book" "books"}}.
+func (f *Funcs) Plural(n int, singular, plural string) string {
+	if n == 1 {
+		return singular
+	}
+	return plural
+}
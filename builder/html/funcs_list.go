@@ -0,0 +1,313 @@
+package html
+
+import (
+	"database/sql"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+// A group of items sharing a key, see Funcs.GroupBy.
+type Group struct {
+	Key   interface{}
+	Items []interface{}
+}
+
+// Sorts a list by a field or method, which may be a dotted path, eg. "PubDate" or "Series.Name".
+// Prefix the field with "-" to sort in descending order. The sort is stable, and the input
+// list is not modified.
+//
+//	{{range sortBy "-PubDate" .Books}}...{{end}}
+func (f *Funcs) SortBy(field string, list interface{}) ([]interface{}, error) {
+	desc := strings.HasPrefix(field, "-")
+	field = strings.TrimPrefix(field, "-")
+
+	items, err := toList(list)
+	if err != nil {
+		return nil, fmt.Errorf("sortBy: %w", err)
+	}
+	keys := make([]reflect.Value, len(items))
+	for i, item := range items {
+		if keys[i], err = lookup(item, field); err != nil {
+			return nil, fmt.Errorf("sortBy: %w", err)
+		}
+	}
+
+	// Sort an index rather than the items, so keys and items stay in step.
+	idx := make([]int, len(items))
+	for i := range idx {
+		idx[i] = i
+	}
+	sort.SliceStable(idx, func(i, j int) bool {
+		c := compare(keys[idx[i]], keys[idx[j]])
+		if desc {
+			return c > 0
+		}
+		return c < 0
+	})
+	sorted := make([]interface{}, len(items))
+	for i, j := range idx {
+		sorted[i] = items[j]
+	}
+	return sorted, nil
+}
+
+// Groups a list by a field or method (see SortBy), in order of first appearance; combine
+// with sortBy to get sorted groups. Keys that are slices (eg. "Series") put the item in
+// one group per element; an empty slice puts it in a group with a nil key.
+//
+//	{{range groupBy "Series" .Books}}<h2>{{with .Key}}{{.Name}}{{end}}</h2>...{{end}}
+func (f *Funcs) GroupBy(field string, list interface{}) ([]Group, error) {
+	items, err := toList(list)
+	if err != nil {
+		return nil, fmt.Errorf("groupBy: %w", err)
+	}
+	var groups []Group
+	index := map[interface{}]int{}
+	add := func(key, item interface{}) {
+		i, ok := index[key]
+		if !ok {
+			i = len(groups)
+			index[key] = i
+			groups = append(groups, Group{Key: key})
+		}
+		groups[i].Items = append(groups[i].Items, item)
+	}
+	for _, item := range items {
+		v, err := lookup(item, field)
+		if err != nil {
+			return nil, fmt.Errorf("groupBy: %w", err)
+		}
+		if v.Kind() == reflect.Slice {
+			if v.Len() == 0 {
+				add(nil, item)
+			}
+			if !v.Type().Elem().Comparable() {
+				return nil, fmt.Errorf("groupBy: %s is not comparable: %s", field, v.Type().Elem())
+			}
+			for i := 0; i < v.Len(); i++ {
+				add(keyOf(v.Index(i)), item)
+			}
+			continue
+		}
+		if v.IsValid() && !v.Type().Comparable() {
+			return nil, fmt.Errorf("groupBy: %s is not comparable: %s", field, v.Type())
+		}
+		add(keyOf(v), item)
+	}
+	return groups, nil
+}
+
+// Returns the first item in a list, or nil if it's empty.
+func (f *Funcs) First(list interface{}) (interface{}, error) {
+	v := reflect.ValueOf(list)
+	if !v.IsValid() {
+		return nil, nil
+	}
+	if v.Kind() != reflect.Slice && v.Kind() != reflect.Array {
+		return nil, fmt.Errorf("first: not a list: %T", list)
+	}
+	if v.Len() == 0 {
+		return nil, nil
+	}
+	return v.Index(0).Interface(), nil
+}
+
+// Returns at most the first n items in a list.
+func (f *Funcs) Limit(n int, list interface{}) ([]interface{}, error) {
+	items, err := toList(list)
+	if err != nil {
+		return nil, fmt.Errorf("limit: %w", err)
+	}
+	if n < 0 {
+		return nil, fmt.Errorf("limit: negative limit: %d", n)
+	}
+	if n < len(items) {
+		items = items[:n]
+	}
+	return items, nil
+}
+
+// Converts any slice or array to a []interface{}; nil becomes an empty list.
+func toList(list interface{}) ([]interface{}, error) {
+	if items, ok := list.([]interface{}); ok {
+		return items, nil
+	}
+	v := reflect.ValueOf(list)
+	if !v.IsValid() {
+		return nil, nil
+	}
+	if v.Kind() != reflect.Slice && v.Kind() != reflect.Array {
+		return nil, fmt.Errorf("not a list: %T", list)
+	}
+	items := make([]interface{}, v.Len())
+	for i := range items {
+		items[i] = v.Index(i).Interface()
+	}
+	return items, nil
+}
+
+// Flattens any lists in ivs into a single list, eg. for linksTo.
+func flatten(ivs []interface{}) ([]interface{}, error) {
+	var items []interface{}
+	for _, iv := range ivs {
+		if v := reflect.ValueOf(iv); v.Kind() == reflect.Slice || v.Kind() == reflect.Array {
+			list, err := toList(iv)
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, list...)
+		} else {
+			items = append(items, iv)
+		}
+	}
+	return items, nil
+}
+
+// Looks up a dotted path of fields or zero-argument methods on an item, eg. "Series.Name".
+// A nil pointer along the way results in an invalid value, which sorts first.
+func lookup(item interface{}, path string) (reflect.Value, error) {
+	v := reflect.ValueOf(item)
+	for _, name := range strings.Split(path, ".") {
+		if !v.IsValid() {
+			return v, nil
+		}
+		if m := v.MethodByName(name); m.IsValid() {
+			if m.Type().NumIn() != 0 || m.Type().NumOut() != 1 {
+				return reflect.Value{}, fmt.Errorf("%s: method must take no arguments and return one value", name)
+			}
+			v = m.Call(nil)[0]
+			continue
+		}
+		for v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface {
+			if v.IsNil() {
+				return reflect.Value{}, nil
+			}
+			v = v.Elem()
+		}
+		if v.Kind() != reflect.Struct {
+			return reflect.Value{}, fmt.Errorf("%s: can't look up a field on a %s", name, v.Type())
+		}
+		field := v.FieldByName(name)
+		if !field.IsValid() {
+			return reflect.Value{}, fmt.Errorf("%s: no such field on %s", name, v.Type())
+		}
+		v = field
+	}
+	return v, nil
+}
+
+// Returns a hashable, template-friendly key for a value.
+func keyOf(v reflect.Value) interface{} {
+	if !v.IsValid() {
+		return nil
+	}
+	return v.Interface()
+}
+
+var (
+	timeType      = reflect.TypeOf(time.Time{})
+	nullInt32Type = reflect.TypeOf(sql.NullInt32{})
+)
+
+// Compares two values of the same type, returning -1, 0 or 1. Invalid values and nil pointers
+// sort first; strings are compared case-insensitively, as a human would expect.
+func compare(a, b reflect.Value) int {
+	a, b = deref(a), deref(b)
+	switch {
+	case !a.IsValid() && !b.IsValid():
+		return 0
+	case !a.IsValid():
+		return -1
+	case !b.IsValid():
+		return 1
+	case a.Type() != b.Type():
+		return strings.Compare(a.Type().String(), b.Type().String())
+	}
+
+	switch a.Type() {
+	case timeType:
+		ta, tb := a.Interface().(time.Time), b.Interface().(time.Time)
+		switch {
+		case ta.Before(tb):
+			return -1
+		case ta.After(tb):
+			return 1
+		}
+		return 0
+	case nullInt32Type:
+		na, nb := a.Interface().(sql.NullInt32), b.Interface().(sql.NullInt32)
+		return compareInts(int64(na.Int32), int64(nb.Int32))
+	}
+
+	switch a.Kind() {
+	case reflect.String:
+		la, lb := strings.ToLower(a.String()), strings.ToLower(b.String())
+		if la == lb {
+			return strings.Compare(a.String(), b.String())
+		}
+		return strings.Compare(la, lb)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return compareInts(a.Int(), b.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return compareInts(int64(a.Uint()), int64(b.Uint()))
+	case reflect.Float32, reflect.Float64:
+		switch fa, fb := a.Float(), b.Float(); {
+		case fa < fb:
+			return -1
+		case fa > fb:
+			return 1
+		}
+		return 0
+	case reflect.Bool:
+		return compareInts(boolToInt(a.Bool()), boolToInt(b.Bool()))
+	case reflect.Slice, reflect.Array:
+		// Compare by first element, eg. a book's first author; empty lists sort first.
+		switch {
+		case a.Len() == 0 && b.Len() == 0:
+			return 0
+		case a.Len() == 0:
+			return -1
+		case b.Len() == 0:
+			return 1
+		}
+		return compare(a.Index(0), b.Index(0))
+	case reflect.Struct:
+		// Most of our structs have a Sort field (Author, Series, ...), else try a Name.
+		for _, name := range []string{"Sort", "Name"} {
+			if fa := a.FieldByName(name); fa.IsValid() {
+				return compare(fa, b.FieldByName(name))
+			}
+		}
+	}
+	return 0
+}
+
+func deref(v reflect.Value) reflect.Value {
+	for v.IsValid() && (v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface) {
+		if v.IsNil() {
+			return reflect.Value{}
+		}
+		v = v.Elem()
+	}
+	return v
+}
+
+func compareInts(a, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+func boolToInt(b bool) int64 {
+	if b {
+		return 1
+	}
+	return 0
+}
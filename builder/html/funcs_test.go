@@ -0,0 +1,336 @@
+package html
+
+import (
+	"bytes"
+	"database/sql"
+	"html/template"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/liclac/sharlayan/builder/tree"
+	"github.com/liclac/sharlayan/calibre"
+	"github.com/liclac/sharlayan/config"
+)
+
+func testFuncs() *Funcs {
+	cfg := &config.Config{}
+	cfg.HTML.Title = "Test Library"
+	cfg.HTML.Root = "/library"
+	cfg.HTML.URL = "https://example.com/"
+	f := NewFuncs(cfg)
+	f.Naming = tree.ByID
+	return &f
+}
+
+// Executes a template snippet with the test funcs, returning the output.
+func execute(t *testing.T, f *Funcs, src string, data interface{}) string {
+	tmpl, err := template.New("").Funcs(f.Map()).Parse(src)
+	require.NoError(t, err)
+	var buf bytes.Buffer
+	require.NoError(t, tmpl.Execute(&buf, data))
+	return buf.String()
+}
+
+func date(s string) *time.Time {
+	t, err := time.Parse("2006-01-02", s)
+	if err != nil {
+		panic(err)
+	}
+	return &t
+}
+
+var (
+	testAuthorPratchett = &calibre.Author{ID: 1, Name: "Terry Pratchett", Sort: "Pratchett, Terry"}
+	testAuthorGaiman    = &calibre.Author{ID: 2, Name: "Neil Gaiman", Sort: "Gaiman, Neil"}
+	testSeriesDiscworld = &calibre.Series{ID: 1, Name: "Discworld", Sort: "Discworld"}
+
+	testBooks = []*calibre.Book{
+		{ID: 1, Title: "The Fifth Elephant", Sort: "Fifth Elephant, The", PubDate: date("1999-01-01"),
+			Authors: []*calibre.Author{testAuthorPratchett}, Series: []*calibre.Series{testSeriesDiscworld}},
+		{ID: 2, Title: "Good Omens", Sort: "Good Omens", PubDate: date("1990-05-01"),
+			Authors: []*calibre.Author{testAuthorPratchett, testAuthorGaiman}},
+		{ID: 3, Title: "Night Watch", Sort: "Night Watch", PubDate: date("2002-11-01"),
+			Authors: []*calibre.Author{testAuthorPratchett}, Series: []*calibre.Series{testSeriesDiscworld}},
+		{ID: 4, Title: "anansi boys", Sort: "anansi boys", PubDate: nil,
+			Authors: []*calibre.Author{testAuthorGaiman}},
+	}
+)
+
+func bookIDs(items []interface{}) []int {
+	ids := make([]int, len(items))
+	for i, item := range items {
+		ids[i] = item.(*calibre.Book).ID
+	}
+	return ids
+}
+
+func TestFuncsLinksTo(t *testing.T) {
+	f := testFuncs()
+	links, err := f.LinksTo(testBooks[0], []*calibre.Author{testAuthorPratchett, testAuthorGaiman})
+	require.NoError(t, err)
+	require.Len(t, links, 3)
+	assert.Equal(t, "/library/books/1", links[0].Href())
+	assert.Equal(t, "/library/authors/1", links[1].Href())
+	assert.Equal(t, "/library/authors/2", links[2].Href())
+	assert.Equal(t, "/authors/2", links[2].Path())
+	assert.Equal(t, "Neil Gaiman", links[2].Text())
+
+	_, err = f.LinksTo("nope")
+	assert.Error(t, err)
+}
+
+func TestFuncsURLs(t *testing.T) {
+	f := testFuncs()
+	assert.Equal(t, "/library/style.css", f.RelURL("style.css"))
+	assert.Equal(t, "/library/style.css", f.RelURL("/style.css"))
+	assert.Equal(t, "https://example.com/library/style.css", f.AbsURL("style.css"))
+
+	f.Config.HTML.URL = ""
+	assert.Equal(t, "/library/style.css", f.AbsURL("style.css"))
+}
+
+func TestFuncsRelative(t *testing.T) {
+	f := testFuncs()
+	f.Config.HTML.Relative = true
+
+	testdata := map[string]struct {
+		page   string
+		naming tree.NamingScheme
+		item   interface{}
+		href   string
+	}{
+		"Root":          {"/index.html", tree.ByID, testBooks[0], "books/1/index.html"},
+		"Book/Self":     {"/books/1/index.html", tree.ByID, testBooks[0], "index.html"},
+		"Book/Sibling":  {"/books/2/index.html", tree.ByID, testBooks[0], "../1/index.html"},
+		"Book/Author":   {"/books/1/index.html", tree.ByID, testAuthorPratchett, "../../authors/1/index.html"},
+		"Index/Child":   {"/books/index.html", tree.ByID, tree.BookInfo(testBooks[0]), "1/index.html"},
+		"ByName/Escape": {"/Books/Good Omens/index.html", tree.ByName, testAuthorGaiman, "../../Authors/Neil%20Gaiman/index.html"},
+		"ByName/Colon":  {"/index.html", tree.ByName, tree.NodeInfo{ID: "1", Name: "Re: Zero"}, "./Re:%20Zero/index.html"},
+	}
+	for name, tdata := range testdata {
+		t.Run(name, func(t *testing.T) {
+			f.Page, f.Naming = tdata.page, tdata.naming
+			link, err := f.LinkTo(tdata.item)
+			require.NoError(t, err)
+			assert.Equal(t, tdata.href, link.Href())
+		})
+	}
+
+	f.Page = "/books/1/index.html"
+	assert.Equal(t, "../../style.css", f.RelURL("style.css"))
+	assert.Equal(t, "https://example.com/library/style.css", f.AbsURL("style.css"))
+	f.Page = "/index.html"
+	assert.Equal(t, "style.css", f.RelURL("/style.css"))
+	f.Page = "/books/1/covers/index.html"
+	assert.Equal(t, "../../2/covers/cover.jpg", f.RelURL("/books/2/covers/cover.jpg"))
+	assert.Equal(t, "thumb/cover.jpg", f.RelURL("/books/1/covers/thumb/cover.jpg"))
+	assert.Equal(t, "../../../style.css", f.RelURL("/style.css"))
+	assert.Equal(t, ".", f.RelURL("/books/1/covers"))
+}
+
+func TestFuncsDownloads(t *testing.T) {
+	book := &calibre.Book{ID: 1, Title: "The Fifth Elephant", Data: []*calibre.Data{
+		{Format: "EPUB", Name: "The Fifth Elephant - Terry Pratchett", UncompressedSize: 345678},
+		{Format: "AZW3", Name: "The Fifth Elephant - Terry Pratchett", UncompressedSize: 456789},
+		{Format: "XYZ", Name: "The Fifth Elephant - Terry Pratchett", UncompressedSize: 1},
+	}}
+	testdata := map[string]struct {
+		page     string
+		naming   tree.NamingScheme
+		relative bool
+		hrefs    []string
+	}{
+		"ByID":              {"/books/1/index.html", tree.ByID, false, []string{"/library/books/1/1.epub", "/library/books/1/1.azw3", "/library/books/1/1.xyz"}},
+		"ByID/Relative":     {"/books/1/index.html", tree.ByID, true, []string{"1.epub", "1.azw3", "1.xyz"}},
+		"ByName":            {"/Books/The Fifth Elephant/index.html", tree.ByName, false, []string{"/library/Books/The%20Fifth%20Elephant/The%20Fifth%20Elephant%20-%20Terry%20Pratchett.epub", "/library/Books/The%20Fifth%20Elephant/The%20Fifth%20Elephant%20-%20Terry%20Pratchett.azw3", "/library/Books/The%20Fifth%20Elephant/The%20Fifth%20Elephant%20-%20Terry%20Pratchett.xyz"}},
+		"ByName/Relative":   {"/Books/The Fifth Elephant/index.html", tree.ByName, true, []string{"The%20Fifth%20Elephant%20-%20Terry%20Pratchett.epub", "The%20Fifth%20Elephant%20-%20Terry%20Pratchett.azw3", "The%20Fifth%20Elephant%20-%20Terry%20Pratchett.xyz"}},
+		"ByID/Relative/Far": {"/index.html", tree.ByID, true, []string{"books/1/1.epub", "books/1/1.azw3", "books/1/1.xyz"}},
+	}
+	for name, tdata := range testdata {
+		t.Run(name, func(t *testing.T) {
+			f := testFuncs()
+			f.Page, f.Naming, f.Config.HTML.Relative = tdata.page, tdata.naming, tdata.relative
+			downloads := f.Downloads(book)
+			require.Len(t, downloads, 3)
+			for i, d := range downloads {
+				assert.Equal(t, tdata.hrefs[i], d.Href)
+			}
+		})
+	}
+
+	downloads := testFuncs().Downloads(book)
+	assert.Equal(t, Download{
+		Format:   "EPUB",
+		Type:     "application/epub+zip",
+		Filename: "The Fifth Elephant - Terry Pratchett.epub",
+		Href:     "/library/books/1/1.epub",
+		Size:     345678,
+	}, downloads[0])
+	assert.Equal(t, "application/vnd.amazon.mobi8-ebook", downloads[1].Type)
+	assert.Equal(t, "", downloads[2].Type)
+}
+
+func TestFuncsDate(t *testing.T) {
+	f := testFuncs()
+	testdata := map[string]struct {
+		in  interface{}
+		out string
+	}{
+		"Time":        {*date("2000-02-01"), "1 February 2000"},
+		"Ptr":         {date("2000-02-01"), "1 February 2000"},
+		"Ptr/Nil":     {(*time.Time)(nil), ""},
+		"Nil":         {nil, ""},
+		"Zero":        {time.Time{}, ""},
+		"Placeholder": {date("0101-01-01"), ""},
+	}
+	for name, tdata := range testdata {
+		t.Run(name, func(t *testing.T) {
+			out, err := f.Date("2 January 2006", tdata.in)
+			assert.NoError(t, err)
+			assert.Equal(t, tdata.out, out)
+		})
+	}
+	_, err := f.Date("2006", "2000-01-01")
+	assert.Error(t, err)
+}
+
+func TestFuncsStars(t *testing.T) {
+	f := testFuncs()
+	testdata := map[string]struct {
+		in  interface{}
+		out string
+	}{
+		"Unset": {sql.NullInt32{}, "☆☆☆☆☆"},
+		"Zero":  {sql.NullInt32{Int32: 0, Valid: true}, "☆☆☆☆☆"},
+		"Half":  {sql.NullInt32{Int32: 1, Valid: true}, "½☆☆☆☆"},
+		"Four":  {sql.NullInt32{Int32: 8, Valid: true}, "★★★★☆"},
+		"Seven": {7, "★★★½☆"},
+		"Full":  {10, "★★★★★"},
+		"Int32": {int32(6), "★★★☆☆"},
+		"Int64": {int64(9), "★★★★½"},
+		"Over":  {12, "★★★★★"},
+		"Under": {-3, "☆☆☆☆☆"},
+	}
+	for name, tdata := range testdata {
+		t.Run(name, func(t *testing.T) {
+			out, err := f.Stars(tdata.in)
+			assert.NoError(t, err)
+			assert.Equal(t, tdata.out, out)
+		})
+	}
+	_, err := f.Stars("five")
+	assert.Error(t, err)
+}
+
+func TestFuncsFilesize(t *testing.T) {
+	f := testFuncs()
+	testdata := map[string]struct {
+		in  interface{}
+		out string
+	}{
+		"Zero":  {0, "0 B"},
+		"Bytes": {999, "999 B"},
+		"kB":    {345678, "345.7 kB"},
+		"MB":    {int64(1234567), "1.2 MB"},
+		"GB":    {uint64(5000000000), "5.0 GB"},
+		"TB":    {int64(7000000000000000), "7000.0 TB"},
+	}
+	for name, tdata := range testdata {
+		t.Run(name, func(t *testing.T) {
+			out, err := f.Filesize(tdata.in)
+			assert.NoError(t, err)
+			assert.Equal(t, tdata.out, out)
+		})
+	}
+}
+
+func TestFuncsPlural(t *testing.T) {
+	f := testFuncs()
+	assert.Equal(t, "books", f.Plural(0, "book", "books"))
+	assert.Equal(t, "book", f.Plural(1, "book", "books"))
+	assert.Equal(t, "books", f.Plural(2, "book", "books"))
+}
+
+func TestFuncsSortBy(t *testing.T) {
+	f := testFuncs()
+	testdata := map[string]struct {
+		field string
+		ids   []int
+	}{
+		"Sort":         {"Sort", []int{4, 1, 2, 3}},
+		"Sort/Desc":    {"-Sort", []int{3, 2, 1, 4}},
+		"PubDate":      {"PubDate", []int{4, 2, 1, 3}},
+		"PubDate/Desc": {"-PubDate", []int{3, 1, 2, 4}},
+		"Method":       {"Published", []int{4, 2, 1, 3}},
+		"Authors":      {"Authors", []int{4, 1, 2, 3}},
+		"ID":           {"ID", []int{1, 2, 3, 4}},
+	}
+	for name, tdata := range testdata {
+		t.Run(name, func(t *testing.T) {
+			sorted, err := f.SortBy(tdata.field, testBooks)
+			require.NoError(t, err)
+			assert.Equal(t, tdata.ids, bookIDs(sorted))
+		})
+	}
+
+	_, err := f.SortBy("Nope", testBooks)
+	assert.Error(t, err)
+	_, err = f.SortBy("Title", "not a list")
+	assert.Error(t, err)
+}
+
+func TestFuncsGroupBy(t *testing.T) {
+	f := testFuncs()
+
+	groups, err := f.GroupBy("Series", testBooks)
+	require.NoError(t, err)
+	require.Len(t, groups, 2)
+	assert.Equal(t, testSeriesDiscworld, groups[0].Key)
+	assert.Equal(t, []int{1, 3}, bookIDs(groups[0].Items))
+	assert.Nil(t, groups[1].Key)
+	assert.Equal(t, []int{2, 4}, bookIDs(groups[1].Items))
+
+	groups, err = f.GroupBy("Authors", testBooks)
+	require.NoError(t, err)
+	require.Len(t, groups, 2)
+	assert.Equal(t, testAuthorPratchett, groups[0].Key)
+	assert.Equal(t, []int{1, 2, 3}, bookIDs(groups[0].Items))
+	assert.Equal(t, testAuthorGaiman, groups[1].Key)
+	assert.Equal(t, []int{2, 4}, bookIDs(groups[1].Items))
+
+	groups, err = f.GroupBy("Title", testBooks[:2])
+	require.NoError(t, err)
+	require.Len(t, groups, 2)
+	assert.Equal(t, "The Fifth Elephant", groups[0].Key)
+}
+
+func TestFuncsFirstLimit(t *testing.T) {
+	f := testFuncs()
+
+	first, err := f.First(testBooks)
+	require.NoError(t, err)
+	assert.Equal(t, testBooks[0], first)
+	first, err = f.First([]*calibre.Book{})
+	require.NoError(t, err)
+	assert.Nil(t, first)
+
+	items, err := f.Limit(2, testBooks)
+	require.NoError(t, err)
+	assert.Equal(t, []int{1, 2}, bookIDs(items))
+	items, err = f.Limit(10, testBooks)
+	require.NoError(t, err)
+	assert.Len(t, items, 4)
+	_, err = f.Limit(-1, testBooks)
+	assert.Error(t, err)
+}
+
+// Make sure the functions actually work from a template, not just from Go.
+func TestFuncsTemplate(t *testing.T) {
+	f := testFuncs()
+	out := execute(t, f, `{{range limit 2 (sortBy "-PubDate" .)}}{{.Title}} ({{date "2006" .PubDate}}), {{end}}`+
+		`{{range linksTo (first .).Authors}}<a href="{{.Href}}">{{.Text}}</a>{{end}}`, testBooks)
+	assert.Equal(t, `Night Watch (2002), The Fifth Elephant (1999), <a href="/library/authors/1">Terry Pratchett</a>`, out)
+}
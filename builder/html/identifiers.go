@@ -0,0 +1,55 @@
+package html
+
+import (
+	"github.com/liclac/sharlayan/calibre"
+)
+
+// An identifier as displayed on a book page, eg. an ISBN linking to WorldCat.
+type IdentifierLink struct {
+	calibre.Identifier
+	Label string // Display label, eg. "ISBN"; the raw type if unknown.
+	URL   string // Link to an external site, or "" for unlinked or invalid identifiers.
+	Err   error  // Validation error, if any; see calibre.Identifier.Validate.
+}
+
+// Returns display information for an identifier type; see config.Config.Identifiers.
+func (f *Funcs) IdentifierType(typ string) calibre.IdentifierType {
+	if t, ok := f.Config.Identifiers[typ]; ok {
+		return calibre.IdentifierType{Label: t.Label, URL: t.URL}
+	}
+	if t, ok := calibre.IdentifierTypes[typ]; ok {
+		return t
+	}
+	return calibre.IdentifierType{Label: typ}
+}
+
+// Returns a book's identifiers, with labels and links. Invalid identifiers are included,
+// but not linked, so you can tell there's something wrong without following a dead link.
+func (f *Funcs) Identifiers(book *calibre.Book) []IdentifierLink {
+	links := make([]IdentifierLink, 0, len(book.Identifiers))
+	for _, ident := range book.Identifiers {
+		typ := f.IdentifierType(ident.Type)
+		link := IdentifierLink{Identifier: ident, Label: typ.Label, Err: ident.Validate()}
+		if link.Err == nil {
+			val := ident.Val
+			if ident.Type == "isbn" {
+				val = calibre.NormalizeISBN(val)
+			}
+			link.URL = typ.Link(val)
+		}
+		links = append(links, link)
+	}
+	return links
+}
+
+// Converts an ISBN to an ISBN-10, or returns "" if not possible.
+func (f *Funcs) ISBN10(isbn string) string {
+	s, _ := calibre.ISBN10(isbn)
+	return s
+}
+
+// Converts an ISBN to an ISBN-13, or returns "" if it's invalid.
+func (f *Funcs) ISBN13(isbn string) string {
+	s, _ := calibre.ISBN13(isbn)
+	return s
+}
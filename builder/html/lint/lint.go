@@ -0,0 +1,258 @@
+// Package lint checks rendered HTML for well-formedness and common accessibility problems.
+//
+// It's not a full validator - it's meant to catch the mistakes that are easy to make in a
+// template and hard to spot in a browser, eg. a missing alt text or a skipped heading level.
+package lint
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/afero"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// A Problem found in a document.
+type Problem struct {
+	Line    int    // 1-indexed line number.
+	Rule    string // Short, stable identifier, eg. "img-alt".
+	Message string // Human-readable description.
+}
+
+func (p Problem) String() string {
+	return fmt.Sprintf("%d: %s: %s", p.Line, p.Rule, p.Message)
+}
+
+// Elements which never have a closing tag.
+var voidElements = map[atom.Atom]bool{
+	atom.Area: true, atom.Base: true, atom.Br: true, atom.Col: true, atom.Embed: true,
+	atom.Hr: true, atom.Img: true, atom.Input: true, atom.Link: true, atom.Meta: true,
+	atom.Param: true, atom.Source: true, atom.Track: true, atom.Wbr: true,
+}
+
+// Elements whose closing tags may legally be omitted; these are implicitly closed by their
+// parent's closing tag, and never reported as unclosed.
+var optionalEndElements = map[atom.Atom]bool{
+	atom.Html: true, atom.Head: true, atom.Body: true, atom.P: true, atom.Li: true,
+	atom.Dt: true, atom.Dd: true, atom.Option: true, atom.Optgroup: true, atom.Colgroup: true,
+	atom.Thead: true, atom.Tbody: true, atom.Tfoot: true, atom.Tr: true, atom.Td: true,
+	atom.Th: true, atom.Rb: true, atom.Rt: true, atom.Rtc: true, atom.Rp: true,
+}
+
+var headingLevels = map[atom.Atom]int{
+	atom.H1: 1, atom.H2: 2, atom.H3: 3, atom.H4: 4, atom.H5: 5, atom.H6: 6,
+}
+
+type element struct {
+	atom atom.Atom
+	name string
+	line int
+
+	// For links: whether it has an accessible name (text, alt text or an aria-label).
+	isLink, hasName bool
+}
+
+type checker struct {
+	problems []Problem
+	line     int
+	stack    []*element
+
+	hasHTML, hasTitle bool
+	inTitle           bool
+	titleText         string
+	lastHeading       int
+	numH1             int
+}
+
+func (c *checker) report(line int, rule, format string, args ...interface{}) {
+	c.problems = append(c.problems, Problem{line, rule, fmt.Sprintf(format, args...)})
+}
+
+// Checks an HTML document, returning any problems found. An error is only returned if the
+// document couldn't be read at all; malformed markup is reported as a Problem.
+func Check(r io.Reader) ([]Problem, error) {
+	c := &checker{line: 1}
+	z := html.NewTokenizer(r)
+	for {
+		tt := z.Next()
+		if tt == html.ErrorToken {
+			if err := z.Err(); err != io.EOF {
+				return nil, err
+			}
+			break
+		}
+		line := c.line
+		c.line += strings.Count(string(z.Raw()), "\n")
+		tok := z.Token()
+		switch tt {
+		case html.StartTagToken, html.SelfClosingTagToken:
+			c.start(line, tok, tt == html.SelfClosingTagToken)
+		case html.EndTagToken:
+			c.end(line, tok)
+		case html.TextToken:
+			c.text(tok)
+		}
+	}
+	c.finish()
+	return c.problems, nil
+}
+
+func (c *checker) start(line int, tok html.Token, selfClosing bool) {
+	attrs := make(map[string]string, len(tok.Attr))
+	for _, attr := range tok.Attr {
+		attrs[attr.Key] = attr.Val
+	}
+	_, hasLabel := attrs["aria-label"]
+	_, hasLabelledBy := attrs["aria-labelledby"]
+
+	switch tok.DataAtom {
+	case atom.Html:
+		c.hasHTML = true
+		if strings.TrimSpace(attrs["lang"]) == "" {
+			c.report(line, "html-lang", "<html> has no lang attribute")
+		}
+	case atom.Title:
+		c.hasTitle, c.inTitle = true, true
+	case atom.Img, atom.Area:
+		if _, ok := attrs["alt"]; !ok && !hasLabel && !hasLabelledBy && attrs["role"] != "presentation" {
+			c.report(line, "img-alt", "<%s> has no alt text; use alt=\"\" for decorative images", tok.Data)
+		}
+		// An image with alt text gives its link a name.
+		if strings.TrimSpace(attrs["alt"]) != "" {
+			c.nameLink()
+		}
+	case atom.Input:
+		if attrs["type"] == "image" && strings.TrimSpace(attrs["alt"]) == "" && !hasLabel {
+			c.report(line, "img-alt", "<input type=\"image\"> has no alt text")
+		}
+	}
+
+	if level, ok := headingLevels[tok.DataAtom]; ok {
+		if level == 1 {
+			c.numH1++
+		}
+		if c.lastHeading == 0 && level != 1 {
+			c.report(line, "heading-order", "first heading is <%s>, not <h1>", tok.Data)
+		} else if c.lastHeading != 0 && level > c.lastHeading+1 {
+			c.report(line, "heading-order", "<%s> follows <h%d>, skipping a level", tok.Data, c.lastHeading)
+		}
+		c.lastHeading = level
+	}
+
+	if voidElements[tok.DataAtom] || selfClosing {
+		return
+	}
+	el := &element{atom: tok.DataAtom, name: tok.Data, line: line}
+	if tok.DataAtom == atom.A {
+		if _, ok := attrs["href"]; ok {
+			el.isLink = true
+			el.hasName = strings.TrimSpace(attrs["aria-label"]) != "" || hasLabelledBy
+		}
+	}
+	c.stack = append(c.stack, el)
+}
+
+func (c *checker) end(line int, tok html.Token) {
+	if voidElements[tok.DataAtom] {
+		return
+	}
+	if tok.DataAtom == atom.Title {
+		c.inTitle = false
+	}
+
+	// Find the matching start tag; if there is none, this is a stray end tag.
+	i := len(c.stack) - 1
+	for ; i >= 0; i-- {
+		if c.stack[i].name == tok.Data {
+			break
+		}
+	}
+	if i < 0 {
+		c.report(line, "stray-end-tag", "</%s> has no matching start tag", tok.Data)
+		return
+	}
+
+	// Anything opened after the matching tag is implicitly closed, which is only okay
+	// for elements whose end tags are optional - anything else was mis-nested.
+	for _, el := range c.stack[i+1:] {
+		if !optionalEndElements[el.atom] {
+			c.report(el.line, "unclosed", "<%s> is not closed before </%s> on line %d", el.name, tok.Data, line)
+		}
+		c.close(el)
+	}
+	c.close(c.stack[i])
+	c.stack = c.stack[:i]
+}
+
+func (c *checker) close(el *element) {
+	if el.isLink && !el.hasName {
+		c.report(el.line, "link-name", "<a> has no text, alt text or aria-label")
+	}
+}
+
+func (c *checker) text(tok html.Token) {
+	if c.inTitle {
+		c.titleText += tok.Data
+	}
+	if strings.TrimSpace(tok.Data) != "" {
+		c.nameLink()
+	}
+}
+
+// Marks any links we're currently inside as having an accessible name.
+func (c *checker) nameLink() {
+	for _, el := range c.stack {
+		if el.isLink {
+			el.hasName = true
+		}
+	}
+}
+
+func (c *checker) finish() {
+	for _, el := range c.stack {
+		if !optionalEndElements[el.atom] {
+			c.report(el.line, "unclosed", "<%s> is never closed", el.name)
+		}
+		c.close(el)
+	}
+	c.stack = nil
+
+	if !c.hasHTML {
+		c.report(1, "html-lang", "no <html> element, so no document language")
+	}
+	if !c.hasTitle || strings.TrimSpace(c.titleText) == "" {
+		c.report(1, "title", "document has no title")
+	}
+	if c.numH1 == 0 {
+		c.report(1, "heading-order", "document has no <h1>")
+	}
+}
+
+// Checks all .html files in a filesystem, returning problems by path. Files without any
+// problems are omitted, so an empty map means everything is fine.
+func CheckFs(fs afero.Fs, root string) (map[string][]Problem, error) {
+	report := make(map[string][]Problem)
+	err := afero.Walk(fs, root, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() || filepath.Ext(path) != ".html" {
+			return err
+		}
+		f, err := fs.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		problems, err := Check(f)
+		if err != nil {
+			return fmt.Errorf("lint: %s: %w", path, err)
+		}
+		if len(problems) > 0 {
+			report[path] = problems
+		}
+		return nil
+	})
+	return report, err
+}
@@ -0,0 +1,113 @@
+package lint
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/liclac/sharlayan/builder"
+	"github.com/liclac/sharlayan/builder/tree"
+	"github.com/liclac/sharlayan/calibre"
+	"github.com/liclac/sharlayan/config"
+)
+
+// Wraps a snippet of body content in an otherwise valid document.
+func doc(body string) string {
+	return `<!DOCTYPE html><html lang="en"><head><title>Test</title></head><body>` + body + `</body></html>`
+}
+
+func rules(problems []Problem) []string {
+	out := []string{}
+	for _, p := range problems {
+		out = append(out, p.Rule)
+	}
+	return out
+}
+
+func TestCheck(t *testing.T) {
+	testdata := map[string]struct {
+		html  string
+		rules []string
+	}{
+		"OK":                {doc(`<h1>Hi</h1><h2>There</h2><p>Text<p>More text`), []string{}},
+		"OK/OptionalEnd":    {doc(`<h1>Hi</h1><ul><li>One<li>Two</ul><dl><dt>A<dd>B</dl>`), []string{}},
+		"OK/VoidElements":   {doc(`<h1>Hi</h1><br><hr/><img src="a.png" alt=""><meta charset="utf-8">`), []string{}},
+		"Lang/Missing":      {`<html><head><title>T</title></head><body><h1>Hi</h1></body></html>`, []string{"html-lang"}},
+		"Lang/Empty":        {`<html lang=""><head><title>T</title></head><body><h1>Hi</h1></body></html>`, []string{"html-lang"}},
+		"Lang/NoHTML":       {`<title>T</title><h1>Hi</h1>`, []string{"html-lang"}},
+		"Title/Missing":     {`<html lang="en"><body><h1>Hi</h1></body></html>`, []string{"title"}},
+		"Title/Empty":       {`<html lang="en"><head><title> </title></head><body><h1>Hi</h1></body></html>`, []string{"title"}},
+		"Img/NoAlt":         {doc(`<h1>Hi</h1><img src="a.png">`), []string{"img-alt"}},
+		"Img/AriaLabel":     {doc(`<h1>Hi</h1><img src="a.png" aria-label="A">`), []string{}},
+		"Img/Presentation":  {doc(`<h1>Hi</h1><img src="a.png" role="presentation">`), []string{}},
+		"Input/Image":       {doc(`<h1>Hi</h1><input type="image" src="a.png">`), []string{"img-alt"}},
+		"Heading/NoH1":      {doc(`<h2>Hi</h2>`), []string{"heading-order", "heading-order"}},
+		"Heading/Skip":      {doc(`<h1>Hi</h1><h3>There</h3>`), []string{"heading-order"}},
+		"Heading/Up":        {doc(`<h1>Hi</h1><h2>A</h2><h3>B</h3><h2>C</h2>`), []string{}},
+		"Unclosed/EOF":      {doc(`<h1>Hi</h1><div>`), []string{"unclosed"}},
+		"Unclosed/Misnest":  {doc(`<h1>Hi</h1><div><span>Text</div>`), []string{"unclosed"}},
+		"Unclosed/Stray":    {doc(`<h1>Hi</h1>Text</a>`), []string{"stray-end-tag"}},
+		"Link/Empty":        {doc(`<h1>Hi</h1><a href="/"></a>`), []string{"link-name"}},
+		"Link/Whitespace":   {doc(`<h1>Hi</h1><a href="/">  </a>`), []string{"link-name"}},
+		"Link/Text":         {doc(`<h1>Hi</h1><a href="/"><span>Home</span></a>`), []string{}},
+		"Link/ImgAlt":       {doc(`<h1>Hi</h1><a href="/"><img src="a.png" alt="Home"></a>`), []string{}},
+		"Link/AriaLabel":    {doc(`<h1>Hi</h1><a href="/" aria-label="Home"></a>`), []string{}},
+		"Link/Anchor":       {doc(`<h1>Hi</h1><a id="top"></a>`), []string{}},
+		"Link/Misnested":    {doc(`<h1>Hi</h1><ul><li><a href="/">Text</li></a></ul>`), []string{"unclosed", "stray-end-tag"}},
+		"Script/NotMarkup":  {doc(`<h1>Hi</h1><script>if (a < b) { x = "</div>"; }</script>`), []string{}},
+		"Heading/MultiLine": {"<html lang=\"en\">\n<head>\n<title>T</title>\n</head>\n<body>\n<h3>Hi</h3>", []string{"heading-order", "heading-order"}},
+	}
+	for name, tdata := range testdata {
+		t.Run(name, func(t *testing.T) {
+			problems, err := Check(strings.NewReader(tdata.html))
+			require.NoError(t, err)
+			assert.Equal(t, tdata.rules, rules(problems), "%v", problems)
+		})
+	}
+}
+
+func TestCheckLineNumbers(t *testing.T) {
+	problems, err := Check(strings.NewReader("<html lang=\"en\">\n<head>\n<title>T</title>\n</head>\n<body>\n<h1>Hi</h1>\n\n<img src=\"a.png\">\n"))
+	require.NoError(t, err)
+	require.Len(t, problems, 1)
+	assert.Equal(t, Problem{8, "img-alt", `<img> has no alt text; use alt="" for decorative images`}, problems[0])
+}
+
+// The default templates should always pass their own checks.
+func TestDefaultTemplates(t *testing.T) {
+	cfg := &config.Config{}
+	cfg.HTML.Templates = filepath.Join("..", "..", "..", "templates")
+	cfg.HTML.Title = "Test Library"
+	cfg.HTML.Lang = "en"
+
+	pubDate := time.Date(2000, 2, 1, 0, 0, 0, 0, time.UTC)
+	author := &calibre.Author{ID: 1, Name: "Terry Pratchett"}
+	series := &calibre.Series{ID: 1, Name: "Discworld"}
+	tag := &calibre.Tag{ID: 1, Name: "Fantasy"}
+	book := &calibre.Book{
+		ID: 1, Title: "The Fifth Elephant", PubDate: &pubDate,
+		Comment: "A *novel* about dwarfs & vampires.", SeriesIndex: 24,
+		Identifiers: []calibre.Identifier{{Type: "isbn", Val: "9780552146166"}},
+		Authors:     []*calibre.Author{author}, Series: []*calibre.Series{series}, Tags: []*calibre.Tag{tag},
+	}
+	book.Rating.Int32, book.Rating.Valid = 8, true
+	author.Books, series.Books, tag.Books = []*calibre.Book{book}, []*calibre.Book{book}, []*calibre.Book{book}
+	meta := &calibre.Metadata{
+		Books: []*calibre.Book{book}, Authors: []*calibre.Author{author},
+		Series: []*calibre.Series{series}, Tags: []*calibre.Tag{tag},
+	}
+
+	bld, err := builder.New(cfg)
+	require.NoError(t, err)
+	fs := afero.NewMemMapFs()
+	require.NoError(t, builder.Root(bld, meta).Render(fs, tree.ByID, "/"))
+
+	report, err := CheckFs(fs, "/")
+	require.NoError(t, err)
+	assert.Empty(t, report)
+}
@@ -0,0 +1,231 @@
+package html
+
+import (
+	"fmt"
+	"html"
+	"regexp"
+	"strings"
+	"unicode"
+
+	"github.com/russross/blackfriday/v2"
+
+	"github.com/liclac/sharlayan/calibre"
+)
+
+// Maximum length of a description in link previews; most sites truncate around here anyway.
+const descriptionLength = 200
+
+// A <meta> tag, used for OpenGraph and Twitter Cards. OpenGraph uses the "property"
+// attribute, while most other things (including Twitter) use "name" - set one or the other.
+type Meta struct {
+	Property string
+	Name     string
+	Content  string
+}
+
+// Returns OpenGraph and Twitter Card tags for a page, which are used for link previews in
+// chat clients, social media, etc. Anything other than a book is treated as a plain website.
+func (f *Funcs) OpenGraph(iv interface{}) ([]Meta, error) {
+	title, hasURL := f.Config.HTML.Title, true
+	switch v := iv.(type) {
+	case *calibre.Book:
+		return f.bookOpenGraph(v)
+	case *calibre.Author:
+		title = v.Name
+	case *calibre.Series:
+		title = v.Name
+	case *calibre.Tag:
+		title = v.Name
+	case Nav:
+		if v.Name != "" {
+			title = v.Name
+		}
+	default:
+		hasURL = false // Generic lists don't know where they are.
+	}
+	var url string
+	if hasURL {
+		var err error
+		if url, err = f.canonicalURL(iv); err != nil {
+			return nil, err
+		}
+	}
+	meta := []Meta{
+		{Property: "og:type", Content: "website"},
+		{Property: "og:site_name", Content: f.Config.HTML.Title},
+		{Property: "og:title", Content: title},
+	}
+	if url != "" {
+		meta = append(meta, Meta{Property: "og:url", Content: url})
+	}
+	return append(meta,
+		Meta{Name: "twitter:card", Content: "summary"},
+		Meta{Name: "twitter:title", Content: title},
+	), nil
+}
+
+func (f *Funcs) bookOpenGraph(book *calibre.Book) ([]Meta, error) {
+	desc := summarize(book.Comment, descriptionLength)
+	meta := []Meta{
+		{Property: "og:type", Content: "book"},
+		{Property: "og:site_name", Content: f.Config.HTML.Title},
+		{Property: "og:title", Content: book.Title},
+	}
+	if desc != "" {
+		meta = append(meta, Meta{Property: "og:description", Content: desc})
+	}
+	url, err := f.canonicalURL(book)
+	if err != nil {
+		return nil, err
+	}
+	if url != "" {
+		meta = append(meta, Meta{Property: "og:url", Content: url})
+	}
+	if isbn := book.Identifier("isbn"); isbn != "" {
+		meta = append(meta, Meta{Property: "book:isbn", Content: isbn})
+	}
+	if pub := book.Published(); pub != nil {
+		meta = append(meta, Meta{Property: "book:release_date", Content: pub.Format("2006-01-02")})
+	}
+	for _, tag := range book.Tags {
+		meta = append(meta, Meta{Property: "book:tag", Content: tag.Name})
+	}
+	meta = append(meta,
+		Meta{Name: "twitter:card", Content: "summary"},
+		Meta{Name: "twitter:title", Content: book.Title},
+	)
+	if desc != "" {
+		meta = append(meta, Meta{Name: "twitter:description", Content: desc})
+	}
+	return meta, nil
+}
+
+// Returns schema.org structured data for a book, to be rendered as JSON-LD, eg:
+//
+//	<script type="application/ld+json">{{schemaOrg .}}</script>
+//
+// html/template takes care of encoding it as JSON when used inside a <script> tag.
+func (f *Funcs) SchemaOrg(iv interface{}) (map[string]interface{}, error) {
+	book, ok := iv.(*calibre.Book)
+	if !ok {
+		return nil, fmt.Errorf("schemaOrg supports *Book, not %T", iv)
+	}
+	data := map[string]interface{}{
+		"@context": "https://schema.org",
+		"@type":    "Book",
+		"name":     book.Title,
+	}
+	url, err := f.canonicalURL(book)
+	if err != nil {
+		return nil, err
+	}
+	if url != "" {
+		data["url"] = url
+	}
+	if desc := summarize(book.Comment, descriptionLength); desc != "" {
+		data["description"] = desc
+	}
+	if isbn := book.Identifier("isbn"); isbn != "" {
+		data["isbn"] = isbn
+	}
+	if pub := book.Published(); pub != nil {
+		data["datePublished"] = pub.Format("2006-01-02")
+	}
+	if len(book.Languages) > 0 {
+		data["inLanguage"] = languageTag(book.Languages[0])
+	}
+
+	if len(book.Authors) > 0 {
+		authors := make([]map[string]interface{}, 0, len(book.Authors))
+		for _, author := range book.Authors {
+			person := map[string]interface{}{"@type": "Person", "name": author.Name}
+			url, err := f.canonicalURL(author)
+			if err != nil {
+				return nil, err
+			}
+			if url != "" {
+				person["url"] = url
+			}
+			authors = append(authors, person)
+		}
+		data["author"] = authors
+	}
+
+	// A book only has a single series index, see calibre.Book.SeriesIndex.
+	if len(book.Series) > 0 {
+		series := make([]map[string]interface{}, 0, len(book.Series))
+		for _, s := range book.Series {
+			series = append(series, map[string]interface{}{"@type": "BookSeries", "name": s.Name})
+		}
+		data["isPartOf"] = series
+		data["position"] = book.SeriesIndex
+	}
+
+	// Calibre ratings are 0-10, but displayed as 0-5 stars (with halves).
+	if book.Rating.Valid && book.Rating.Int32 > 0 {
+		data["review"] = map[string]interface{}{
+			"@type": "Review",
+			"reviewRating": map[string]interface{}{
+				"@type":       "Rating",
+				"ratingValue": float64(book.Rating.Int32) / 2,
+				"bestRating":  5,
+				"worstRating": 0,
+			},
+		}
+	}
+
+	return data, nil
+}
+
+// Returns an absolute URL to an item, or "" if no public URL (html.url) is configured.
+func (f *Funcs) canonicalURL(iv interface{}) (string, error) {
+	if f.Config.HTML.URL == "" {
+		return "", nil
+	}
+	link, err := f.LinkTo(iv)
+	if err != nil || !link.Abs {
+		return "", err
+	}
+	return f.AbsURL(link.Path()), nil
+}
+
+// Matches HTML tags in blackfriday's output, which is well-formed enough for this to be safe.
+var tagRegexp = regexp.MustCompile(`<[^>]*>`)
+
+// Renders a Markdown comment as plain text, collapses whitespace and truncates it to at most
+// n runes, cutting at a word boundary.
+func summarize(md string, n int) string {
+	s := html.UnescapeString(tagRegexp.ReplaceAllString(string(blackfriday.Run([]byte(md))), " "))
+	s = strings.Join(strings.Fields(s), " ")
+	if r := []rune(s); len(r) > n {
+		cut := strings.LastIndexFunc(string(r[:n]), unicode.IsSpace)
+		if cut <= 0 {
+			cut = len(string(r[:n]))
+		}
+		s = strings.TrimRightFunc(s[:cut], unicode.IsPunct) + "…"
+	}
+	return s
+}
+
+// Calibre stores languages as ISO 639-2 codes ("eng"), but the web wants BCP 47 tags, which
+// use ISO 639-1 codes ("en") where one exists. This covers the languages you're most likely
+// to find in a library; anything else is passed through as-is, which is still valid BCP 47
+// for languages without a two-letter code.
+var iso6391 = map[string]string{
+	"ara": "ar", "bul": "bg", "cat": "ca", "ces": "cs", "cze": "cs", "dan": "da",
+	"deu": "de", "ger": "de", "ell": "el", "gre": "el", "eng": "en", "spa": "es",
+	"est": "et", "fas": "fa", "per": "fa", "fin": "fi", "fra": "fr", "fre": "fr",
+	"gle": "ga", "heb": "he", "hin": "hi", "hrv": "hr", "hun": "hu", "ind": "id",
+	"isl": "is", "ice": "is", "ita": "it", "jpn": "ja", "kor": "ko", "lit": "lt",
+	"lav": "lv", "nld": "nl", "dut": "nl", "nor": "no", "nob": "nb", "nno": "nn",
+	"pol": "pl", "por": "pt", "ron": "ro", "rum": "ro", "rus": "ru", "slk": "sk",
+	"slo": "sk", "slv": "sl", "srp": "sr", "swe": "sv", "tha": "th", "tur": "tr",
+	"ukr": "uk", "vie": "vi", "zho": "zh", "chi": "zh",
+}
+
+func languageTag(code string) string {
+	if tag, ok := iso6391[code]; ok {
+		return tag
+	}
+	return code
+}
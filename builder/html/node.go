@@ -31,18 +31,35 @@ func (p PageNode) Render(fs afero.Fs, ns tree.NamingScheme, path string) error {
 	return p.Builder.Render(fs, ns, path, p.Template, p.Item)
 }
 
-func Index(b *Builder, nodes ...tree.Node) *PageNode {
+// The item for a generic '_nav' list of a directory's contents.
+type Nav struct {
+	tree.NodeInfo                 // The directory being listed; blank for the root.
+	Items         []tree.NodeInfo // The directory's contents.
+}
+
+func Index(b *Builder, dir tree.NodeInfo, nodes ...tree.Node) *PageNode {
 	infos := make([]tree.NodeInfo, 0, len(nodes))
 	for _, node := range nodes {
 		if node != nil {
 			infos = append(infos, node.Info())
 		}
 	}
-	return Page(b, "index.html", "_nav", infos)
+	return Page(b, "index.html", "_nav", Nav{dir, infos})
+}
+
+// Returns a book's, author's, etc. page, for builder.Format.
+func (b *Builder) Pages(tmpl string, item interface{}) []tree.Node {
+	return []tree.Node{Page(b, "index.html", tmpl, item)}
 }
-func AddIndex(b *Builder, nodes ...tree.Node) []tree.Node {
+
+// Returns a directory's index page, for builder.Format.
+func (b *Builder) Index(dir tree.NodeInfo, nodes ...tree.Node) tree.Node {
+	return Index(b, dir, nodes...)
+}
+
+func AddIndex(b *Builder, dir tree.NodeInfo, nodes ...tree.Node) []tree.Node {
 	if len(nodes) != 0 {
-		nodes = append(nodes, Index(b, nodes...))
+		nodes = append(nodes, Index(b, dir, nodes...))
 	}
 	return nodes
 }
@@ -1,13 +1,15 @@
 package builder
 
 import (
-	"github.com/liclac/sharlayan/builder/html"
+	"path/filepath"
+	"strings"
+
 	"github.com/liclac/sharlayan/builder/tree"
 	"github.com/liclac/sharlayan/calibre"
 )
 
 func Root(b *Builder, meta *calibre.Metadata) *tree.DirNode {
-	return tree.Dir("", "", html.AddIndex(b.HTML,
+	return tree.Dir("", "", b.addIndex(tree.NodeInfo{},
 		BookDir(b, meta.Books),
 		AuthorDir(b, meta.Authors),
 		SeriesDir(b, meta.Series),
@@ -20,12 +22,20 @@ func BookDir(b *Builder, books []*calibre.Book) tree.Node {
 	for i, book := range books {
 		nodes[i] = BookNode(b, book)
 	}
-	return tree.DirInfo(tree.BookDirInfo, html.AddIndex(b.HTML, nodes...)...)
+	return tree.DirInfo(tree.BookDirInfo, b.addIndex(tree.BookDirInfo, nodes...)...)
 }
 
 func BookNode(b *Builder, book *calibre.Book) tree.Node {
-	// TODO: Copy/Link data files.
-	return tree.DirInfo(tree.BookInfo(book), html.Page(b.HTML, "index.html", "book", book))
+	nodes := b.pages("book", book)
+	dir := filepath.Join(b.Cfg.Library, book.Path)
+	if book.HasCover {
+		nodes = append(nodes, tree.File(tree.CoverInfo, filepath.Join(dir, "cover.jpg")))
+	}
+	for _, data := range book.Data {
+		filename := data.Name + "." + strings.ToLower(data.Format)
+		nodes = append(nodes, tree.File(tree.DataInfo(book, data), filepath.Join(dir, filename)))
+	}
+	return tree.DirInfo(tree.BookInfo(book), nodes...)
 }
 
 func AuthorDir(b *Builder, authors []*calibre.Author) tree.Node {
@@ -33,11 +43,11 @@ func AuthorDir(b *Builder, authors []*calibre.Author) tree.Node {
 	for i, author := range authors {
 		nodes[i] = AuthorNode(b, author)
 	}
-	return tree.DirInfo(tree.AuthorDirInfo, html.AddIndex(b.HTML, nodes...)...)
+	return tree.DirInfo(tree.AuthorDirInfo, b.addIndex(tree.AuthorDirInfo, nodes...)...)
 }
 
 func AuthorNode(b *Builder, author *calibre.Author) tree.Node {
-	return tree.DirInfo(tree.AuthorInfo(author), html.Page(b.HTML, "index.html", "author", author))
+	return tree.DirInfo(tree.AuthorInfo(author), b.pages("author", author)...)
 }
 
 func SeriesDir(b *Builder, series []*calibre.Series) tree.Node {
@@ -45,11 +55,11 @@ func SeriesDir(b *Builder, series []*calibre.Series) tree.Node {
 	for i, series := range series {
 		nodes[i] = SeriesNode(b, series)
 	}
-	return tree.DirInfo(tree.SeriesDirInfo, html.AddIndex(b.HTML, nodes...)...)
+	return tree.DirInfo(tree.SeriesDirInfo, b.addIndex(tree.SeriesDirInfo, nodes...)...)
 }
 
 func SeriesNode(b *Builder, series *calibre.Series) tree.Node {
-	return tree.DirInfo(tree.SeriesInfo(series), html.Page(b.HTML, "index.html", "series", series))
+	return tree.DirInfo(tree.SeriesInfo(series), b.pages("series", series)...)
 }
 
 func TagDir(b *Builder, tags []*calibre.Tag) tree.Node {
@@ -57,9 +67,9 @@ func TagDir(b *Builder, tags []*calibre.Tag) tree.Node {
 	for i, tag := range tags {
 		nodes[i] = TagNode(b, tag)
 	}
-	return tree.DirInfo(tree.TagDirInfo, html.AddIndex(b.HTML, nodes...)...)
+	return tree.DirInfo(tree.TagDirInfo, b.addIndex(tree.TagDirInfo, nodes...)...)
 }
 
 func TagNode(b *Builder, tag *calibre.Tag) tree.Node {
-	return tree.DirInfo(tree.TagInfo(tag), html.Page(b.HTML, "index.html", "tag", tag))
+	return tree.DirInfo(tree.TagInfo(tag), b.pages("tag", tag)...)
 }
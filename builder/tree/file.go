@@ -0,0 +1,60 @@
+package tree
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/spf13/afero"
+	"go.uber.org/zap"
+
+	"github.com/liclac/sharlayan/afhack"
+)
+
+var _ Node = FileNode{}
+
+// A FileNode is a file on disk, eg. a book file from the Calibre library. It's symlinked into
+// the output if the filesystem supports it (see afhack.Symlinker), or copied if not.
+type FileNode struct {
+	NodeInfo
+	Path string // Path on disk.
+}
+
+func File(info NodeInfo, path string) FileNode {
+	return FileNode{info, path}
+}
+
+func (f FileNode) Info() NodeInfo { return f.NodeInfo }
+
+func (f FileNode) Render(fs afero.Fs, ns NamingScheme, path string) error {
+	// Libraries with missing files are common enough; `sharlayan check` can find them.
+	if _, err := os.Stat(f.Path); os.IsNotExist(err) {
+		zap.L().Warn("Skipping missing file", zap.String("path", f.Path))
+		return nil
+	}
+	if l, ok := fs.(afhack.Symlinker); ok {
+		if err := l.Symlink(f.Path, path); !errors.Is(err, afhack.ErrNoSymlink) {
+			return err
+		}
+	}
+
+	src, err := os.Open(f.Path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	// Don't write through a symlink from a previous build, into the library!
+	if err := fs.Remove(path); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("couldn't replace file: %w", err)
+	}
+	dst, err := fs.Create(path)
+	if err != nil {
+		return fmt.Errorf("couldn't create file: %w", err)
+	}
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close()
+		return fmt.Errorf("couldn't copy %s: %w", f.Path, err)
+	}
+	return dst.Close()
+}
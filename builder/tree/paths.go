@@ -3,6 +3,7 @@ package tree
 import (
 	"path/filepath"
 	"strconv"
+	"strings"
 
 	"github.com/liclac/sharlayan/calibre"
 )
@@ -19,6 +20,16 @@ func AuthorInfo(a *calibre.Author) NodeInfo { return NodeInfo{ID: strconv.Itoa(a
 func SeriesInfo(s *calibre.Series) NodeInfo { return NodeInfo{ID: strconv.Itoa(s.ID), Name: s.Name} }
 func TagInfo(t *calibre.Tag) NodeInfo       { return NodeInfo{ID: strconv.Itoa(t.ID), Name: t.Name} }
 
+// Data files are named after their book in the ByID scheme (eg. "4.epub"), and keep the
+// name Calibre gave them in the ByName scheme (eg. "The Fifth Elephant - Terry Pratchett.epub").
+func DataInfo(b *calibre.Book, d *calibre.Data) NodeInfo {
+	ext := "." + strings.ToLower(d.Format)
+	return NodeInfo{ID: strconv.Itoa(b.ID) + ext, Name: d.Name + ext}
+}
+
+// Covers are always named "cover.jpg", like in the Calibre library.
+var CoverInfo = NodeInfo{ID: "cover.jpg", Name: "cover.jpg"}
+
 func Path(ns NamingScheme, infos ...NodeInfo) string {
 	parts := make([]string, len(infos))
 	for i, info := range infos {
@@ -34,7 +34,15 @@ func (fs FileStatus) MarshalJSON() ([]byte, error) {
 }
 
 type CheckReport struct {
-	Files map[string]FileStatus
+	Files       map[string]FileStatus
+	Identifiers []IdentifierProblem
+}
+
+// An identifier which failed validation, see Identifier.Validate.
+type IdentifierProblem struct {
+	Book       *Book
+	Identifier Identifier
+	Err        error
 }
 
 func (m *Metadata) Check() (*CheckReport, error) {
@@ -68,5 +76,14 @@ func (m *Metadata) Check() (*CheckReport, error) {
 		}
 	}
 
+	// Validate identifiers; a typo'd ISBN is easy to miss, but links to the wrong book.
+	for _, book := range m.Books {
+		for _, ident := range book.Identifiers {
+			if err := ident.Validate(); err != nil {
+				report.Identifiers = append(report.Identifiers, IdentifierProblem{book, ident, err})
+			}
+		}
+	}
+
 	return report, nil
 }
@@ -0,0 +1,67 @@
+package calibre
+
+// Returns a copy of the library containing only books for which keep returns true, and the
+// authors, series and tags of those books. Everything that links between items is copied, so
+// eg. an author's Books only lists visible books; the original Metadata is left untouched.
+func (m *Metadata) Filter(keep func(*Book) bool) *Metadata {
+	out := &Metadata{Path: m.Path, Columns: m.Columns}
+	authors := make(map[*Author]*Author)
+	series := make(map[*Series]*Series)
+	tags := make(map[*Tag]*Tag)
+
+	for _, b := range m.Books {
+		if !keep(b) {
+			continue
+		}
+		book := *b
+		book.Authors, book.AuthorIDs = nil, IDs{}
+		for _, a := range b.Authors {
+			author, ok := authors[a]
+			if !ok {
+				author = &Author{ID: a.ID, Name: a.Name, Sort: a.Sort, Link: a.Link, BookIDs: IDs{}}
+				authors[a] = author
+			}
+			author.Books, author.BookIDs = append(author.Books, &book), append(author.BookIDs, book.ID)
+			book.Authors, book.AuthorIDs = append(book.Authors, author), append(book.AuthorIDs, author.ID)
+		}
+		book.Series, book.SeriesIDs = nil, IDs{}
+		for _, s := range b.Series {
+			ser, ok := series[s]
+			if !ok {
+				ser = &Series{ID: s.ID, Name: s.Name, Sort: s.Sort, BookIDs: IDs{}}
+				series[s] = ser
+			}
+			ser.Books, ser.BookIDs = append(ser.Books, &book), append(ser.BookIDs, book.ID)
+			book.Series, book.SeriesIDs = append(book.Series, ser), append(book.SeriesIDs, ser.ID)
+		}
+		book.Tags, book.TagIDs = nil, IDs{}
+		for _, t := range b.Tags {
+			tag, ok := tags[t]
+			if !ok {
+				tag = &Tag{ID: t.ID, Name: t.Name, BookIDs: IDs{}}
+				tags[t] = tag
+			}
+			tag.Books, tag.BookIDs = append(tag.Books, &book), append(tag.BookIDs, book.ID)
+			book.Tags, book.TagIDs = append(book.Tags, tag), append(book.TagIDs, tag.ID)
+		}
+		out.Books = append(out.Books, &book)
+	}
+
+	// Keep the original order, rather than order of first appearance.
+	for _, a := range m.Authors {
+		if author, ok := authors[a]; ok {
+			out.Authors = append(out.Authors, author)
+		}
+	}
+	for _, s := range m.Series {
+		if ser, ok := series[s]; ok {
+			out.Series = append(out.Series, ser)
+		}
+	}
+	for _, t := range m.Tags {
+		if tag, ok := tags[t]; ok {
+			out.Tags = append(out.Tags, tag)
+		}
+	}
+	return out
+}
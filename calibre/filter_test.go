@@ -0,0 +1,39 @@
+package calibre
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFilter(t *testing.T) {
+	author := &Author{ID: 1, Name: "Terry Pratchett", BookIDs: IDs{1, 2}}
+	other := &Author{ID: 2, Name: "Neil Gaiman", BookIDs: IDs{2}}
+	tag := &Tag{ID: 1, Name: "Fantasy", BookIDs: IDs{1, 2}}
+	b1 := &Book{ID: 1, Title: "Guards! Guards!", AuthorIDs: IDs{1}, Authors: []*Author{author},
+		TagIDs: IDs{1}, Tags: []*Tag{tag}}
+	b2 := &Book{ID: 2, Title: "Good Omens", AuthorIDs: IDs{1, 2}, Authors: []*Author{author, other},
+		TagIDs: IDs{1}, Tags: []*Tag{tag}}
+	author.Books, other.Books, tag.Books = []*Book{b1, b2}, []*Book{b2}, []*Book{b1, b2}
+	meta := &Metadata{Books: []*Book{b1, b2}, Authors: []*Author{author, other}, Tags: []*Tag{tag}}
+
+	out := meta.Filter(func(b *Book) bool { return b.ID == 1 })
+	require.Len(t, out.Books, 1)
+	require.Len(t, out.Authors, 1)
+	require.Len(t, out.Tags, 1)
+	assert.Empty(t, out.Series)
+
+	book := out.Books[0]
+	assert.Equal(t, "Guards! Guards!", book.Title)
+	assert.Equal(t, []*Author{out.Authors[0]}, book.Authors)
+	assert.Equal(t, []*Book{book}, out.Authors[0].Books)
+	assert.Equal(t, IDs{1}, out.Authors[0].BookIDs)
+	assert.Equal(t, []*Book{book}, out.Tags[0].Books)
+
+	// The original is untouched.
+	assert.Len(t, meta.Books, 2)
+	assert.Equal(t, []*Book{b1, b2}, author.Books)
+	assert.Equal(t, IDs{1, 2}, author.BookIDs)
+	assert.Same(t, author, b1.Authors[0])
+}
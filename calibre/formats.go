@@ -0,0 +1,41 @@
+package calibre
+
+import (
+	"strings"
+)
+
+// MIME types for the formats Calibre stores books in, by format (as in Data.Format). Go's
+// own table doesn't know most of these, and e-readers won't open a book served as
+// application/octet-stream. Registered IANA types are used where they exist, otherwise the
+// ones Calibre and most readers use.
+var FormatMIMETypes = map[string]string{
+	"AZW":   "application/vnd.amazon.ebook",
+	"AZW3":  "application/vnd.amazon.mobi8-ebook",
+	"CB7":   "application/x-cb7",
+	"CBR":   "application/vnd.comicbook-rar",
+	"CBZ":   "application/vnd.comicbook+zip",
+	"DJV":   "image/vnd.djvu",
+	"DJVU":  "image/vnd.djvu",
+	"DOCX":  "application/vnd.openxmlformats-officedocument.wordprocessingml.document",
+	"EPUB":  "application/epub+zip",
+	"FB2":   "application/x-fictionbook+xml",
+	"FBZ":   "application/x-zip-compressed-fb2",
+	"HTMLZ": "application/zip",
+	"KEPUB": "application/kepub+zip",
+	"LIT":   "application/x-ms-reader",
+	"LRF":   "application/x-sony-bbeb",
+	"MOBI":  "application/x-mobipocket-ebook",
+	"ODT":   "application/vnd.oasis.opendocument.text",
+	"PDB":   "application/vnd.palm",
+	"PDF":   "application/pdf",
+	"PRC":   "application/x-mobipocket-ebook",
+	"RTF":   "application/rtf",
+	"TXT":   "text/plain; charset=utf-8",
+	"TXTZ":  "application/zip",
+}
+
+// Returns the MIME type for a format or file extension, eg. "EPUB", "epub" or ".epub", or ""
+// if it isn't a known book format.
+func FormatMIMEType(format string) string {
+	return FormatMIMETypes[strings.ToUpper(strings.TrimPrefix(format, "."))]
+}
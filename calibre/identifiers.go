@@ -0,0 +1,179 @@
+package calibre
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// Display information about a type of Identifier, eg. "isbn".
+type IdentifierType struct {
+	Label string // eg. "ISBN".
+	URL   string // URL template, "{id}" is replaced with the value; eg. "https://example.com/{id}".
+}
+
+// Returns a link to the given identifier value, or "" if there's no URL template. A template
+// that's just "{id}" uses the value as-is, as long as it's an http(s) URL.
+func (t IdentifierType) Link(val string) string {
+	switch t.URL {
+	case "":
+		return ""
+	case "{id}":
+		if u, err := url.Parse(val); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			return ""
+		}
+		return val
+	}
+	// In a query string, escape everything, so the value can't add parameters of its own.
+	if i := strings.Index(t.URL, "?"); i != -1 && i < strings.Index(t.URL, "{id}") {
+		return strings.ReplaceAll(t.URL, "{id}", url.QueryEscape(val))
+	}
+	// In a path, escape the value, but leave slashes alone; DOIs are paths, eg. "10.1000/182".
+	return strings.ReplaceAll(t.URL, "{id}", strings.ReplaceAll(url.PathEscape(val), "%2F", "/"))
+}
+
+// Well-known identifier types, mostly the same ones Calibre's own UI knows how to link to.
+// Unknown types are displayed using their raw type names, with no links.
+var IdentifierTypes = map[string]IdentifierType{
+	"isbn":        {"ISBN", "https://www.worldcat.org/isbn/{id}"},
+	"issn":        {"ISSN", "https://www.worldcat.org/issn/{id}"},
+	"oclc":        {"OCLC", "https://www.worldcat.org/oclc/{id}"},
+	"lccn":        {"LCCN", "https://lccn.loc.gov/{id}"},
+	"doi":         {"DOI", "https://doi.org/{id}"},
+	"amazon":      {"Amazon", "https://www.amazon.com/dp/{id}"},
+	"mobi-asin":   {"Amazon", "https://www.amazon.com/dp/{id}"},
+	"google":      {"Google Books", "https://books.google.com/books?id={id}"},
+	"goodreads":   {"Goodreads", "https://www.goodreads.com/book/show/{id}"},
+	"openlibrary": {"Open Library", "https://openlibrary.org/books/{id}"},
+	"isfdb":       {"ISFDB", "https://www.isfdb.org/cgi-bin/pl.cgi?{id}"},
+	"uri":         {"URI", "{id}"},
+}
+
+var (
+	ErrInvalidChecksum = errors.New("invalid checksum")
+	ErrInvalidLength   = errors.New("invalid length")
+	ErrInvalidChar     = errors.New("invalid character")
+)
+
+// Checks that an identifier's value is well-formed, where we know how to tell.
+func (i Identifier) Validate() error {
+	switch i.Type {
+	case "isbn":
+		return ValidateISBN(i.Val)
+	case "doi":
+		if !strings.HasPrefix(i.Val, "10.") || !strings.ContainsRune(i.Val, '/') {
+			return fmt.Errorf("not a DOI: %q", i.Val)
+		}
+	}
+	return nil
+}
+
+// Strips hyphens and spaces from an ISBN, and uppercases a trailing "x".
+// The result is not guaranteed to be valid; see ValidateISBN.
+func NormalizeISBN(s string) string {
+	return strings.ToUpper(strings.NewReplacer("-", "", " ", "").Replace(s))
+}
+
+// Checks an ISBN-10 or ISBN-13 for length, characters and checksum.
+// Hyphens and spaces are ignored, see NormalizeISBN.
+func ValidateISBN(s string) error {
+	s = NormalizeISBN(s)
+	switch len(s) {
+	case 10:
+		sum, err := isbn10Sum(s[:9])
+		if err != nil {
+			return err
+		}
+		if isbn10Check(sum) != s[9] {
+			return ErrInvalidChecksum
+		}
+	case 13:
+		sum, err := isbn13Sum(s[:12])
+		if err != nil {
+			return err
+		}
+		if isbn13Check(sum) != s[12] {
+			return ErrInvalidChecksum
+		}
+	default:
+		return ErrInvalidLength
+	}
+	return nil
+}
+
+// Converts a valid ISBN-10 to an ISBN-13, by adding the "978" prefix and recalculating the
+// check digit. An ISBN-13 is normalised and returned as-is.
+func ISBN13(s string) (string, error) {
+	if err := ValidateISBN(s); err != nil {
+		return "", err
+	}
+	s = NormalizeISBN(s)
+	if len(s) == 13 {
+		return s, nil
+	}
+	s = "978" + s[:9]
+	sum, _ := isbn13Sum(s)
+	return s + string(isbn13Check(sum)), nil
+}
+
+// Converts a valid ISBN-13 to an ISBN-10; only possible for ones with the "978" prefix.
+// An ISBN-10 is normalised and returned as-is.
+func ISBN10(s string) (string, error) {
+	if err := ValidateISBN(s); err != nil {
+		return "", err
+	}
+	s = NormalizeISBN(s)
+	if len(s) == 10 {
+		return s, nil
+	}
+	if !strings.HasPrefix(s, "978") {
+		return "", fmt.Errorf("%s has no ISBN-10 equivalent", s)
+	}
+	s = s[3:12]
+	sum, _ := isbn10Sum(s)
+	return s + string(isbn10Check(sum)), nil
+}
+
+// Weighted sum of the first 9 digits of an ISBN-10, 10 for the first digit down to 2.
+func isbn10Sum(s string) (int, error) {
+	sum := 0
+	for i, c := range s {
+		if c < '0' || c > '9' {
+			return 0, ErrInvalidChar
+		}
+		sum += (10 - i) * int(c-'0')
+	}
+	return sum, nil
+}
+
+// The check digit makes the total sum divisible by 11; a value of 10 is written as "X".
+func isbn10Check(sum int) byte {
+	switch check := (11 - sum%11) % 11; check {
+	case 10:
+		return 'X'
+	default:
+		return byte('0' + check)
+	}
+}
+
+// Weighted sum of the first 12 digits of an ISBN-13, alternating weights of 1 and 3.
+func isbn13Sum(s string) (int, error) {
+	sum := 0
+	for i, c := range s {
+		if c < '0' || c > '9' {
+			return 0, ErrInvalidChar
+		}
+		weight := 1
+		if i%2 == 1 {
+			weight = 3
+		}
+		sum += weight * int(c-'0')
+	}
+	return sum, nil
+}
+
+// The check digit makes the total sum divisible by 10.
+func isbn13Check(sum int) byte {
+	return byte('0' + (10-sum%10)%10)
+}
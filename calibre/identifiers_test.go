@@ -0,0 +1,96 @@
+package calibre
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateISBN(t *testing.T) {
+	testdata := map[string]struct {
+		isbn string
+		err  error
+	}{
+		"10":                {"0552146161", nil},
+		"10/Hyphens":        {"0-552-14616-1", nil},
+		"10/X":              {"080442957X", nil},
+		"10/x":              {"080442957x", nil},
+		"10/Checksum":       {"0552146162", ErrInvalidChecksum},
+		"10/Char":           {"05521A6161", ErrInvalidChar},
+		"13":                {"9780552146166", nil},
+		"13/Hyphens":        {"978-0-552-14616-6", nil},
+		"13/Spaces":         {"978 0 552 14616 6", nil},
+		"13/Checksum":       {"9780552146167", ErrInvalidChecksum},
+		"13/Char":           {"97805521461X6", ErrInvalidChar},
+		"Empty":             {"", ErrInvalidLength},
+		"TooShort":          {"055214616", ErrInvalidLength},
+		"TooLong":           {"97805521461660", ErrInvalidLength},
+		"13/CheckDigitZero": {"9780306406157", nil},
+	}
+	for name, tdata := range testdata {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, tdata.err, ValidateISBN(tdata.isbn))
+		})
+	}
+}
+
+func TestISBN13(t *testing.T) {
+	testdata := map[string]struct {
+		in, out string
+		err     bool
+	}{
+		"10":      {"0-552-14616-1", "9780552146166", false},
+		"10/X":    {"080442957X", "9780804429573", false},
+		"13":      {"978-0-552-14616-6", "9780552146166", false},
+		"Invalid": {"0552146162", "", true},
+	}
+	for name, tdata := range testdata {
+		t.Run(name, func(t *testing.T) {
+			out, err := ISBN13(tdata.in)
+			assert.Equal(t, tdata.out, out)
+			assert.Equal(t, tdata.err, err != nil)
+		})
+	}
+}
+
+func TestISBN10(t *testing.T) {
+	testdata := map[string]struct {
+		in, out string
+		err     bool
+	}{
+		"13":      {"978-0-552-14616-6", "0552146161", false},
+		"13/X":    {"9780804429573", "080442957X", false},
+		"13/979":  {"9791034304523", "", true}, // Valid, but no ISBN-10.
+		"10":      {"0-552-14616-1", "0552146161", false},
+		"Invalid": {"9780552146167", "", true},
+	}
+	for name, tdata := range testdata {
+		t.Run(name, func(t *testing.T) {
+			out, err := ISBN10(tdata.in)
+			assert.Equal(t, tdata.out, out)
+			assert.Equal(t, tdata.err, err != nil)
+		})
+	}
+}
+
+func TestIdentifierTypeLink(t *testing.T) {
+	testdata := map[string]struct {
+		typ, val, link string
+	}{
+		"ISBN":        {"isbn", "9780552146166", "https://www.worldcat.org/isbn/9780552146166"},
+		"DOI":         {"doi", "10.1000/182", "https://doi.org/10.1000/182"},
+		"Escaped":     {"goodreads", "a b?c", "https://www.goodreads.com/book/show/a%20b%3Fc"},
+		"Query":       {"google", "abc&foo=bar", "https://books.google.com/books?id=abc%26foo%3Dbar"},
+		"Query/ISFDB": {"isfdb", "1234 5", "https://www.isfdb.org/cgi-bin/pl.cgi?1234+5"},
+		"URI":         {"uri", "https://example.com/?a=b", "https://example.com/?a=b"},
+		"URI/HTTP":    {"uri", "http://example.com/book", "http://example.com/book"},
+		"URI/Script":  {"uri", "javascript:alert(1)", ""},
+		"URI/URN":     {"uri", "urn:isbn:9780552146166", ""},
+		"Unknown":     {"nope", "1234", ""},
+	}
+	for name, tdata := range testdata {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, tdata.link, IdentifierTypes[tdata.typ].Link(tdata.val))
+		})
+	}
+}
@@ -1,7 +1,9 @@
 package calibre
 
 import (
+	"fmt"
 	"path/filepath"
+	"strings"
 	"time"
 
 	"github.com/jmoiron/sqlx"
@@ -11,11 +13,15 @@ import (
 )
 
 type Metadata struct {
-	Path    string    `json:"path"`
-	Tags    []*Tag    `json:"tags"`
-	Series  []*Series `json:"series"`
-	Authors []*Author `json:"authors"`
-	Books   []*Book   `json:"books"`
+	Path    string          `json:"path"`
+	Tags    []*Tag          `json:"tags"`
+	Series  []*Series       `json:"series"`
+	Authors []*Author       `json:"authors"`
+	Books   []*Book         `json:"books"`
+	Columns []*CustomColumn `json:"columns"`
+
+	// How long each stage of Read took, eg. "authors", and "total" for the whole thing.
+	Timings map[string]time.Duration `json:"-"`
 }
 
 func Read(path string) (*Metadata, error) {
@@ -34,7 +40,7 @@ func Read(path string) (*Metadata, error) {
 		return nil, err
 	}
 
-	m := Metadata{Path: path}
+	m := Metadata{Path: path, Timings: map[string]time.Duration{}}
 
 	L.Debug("Loading: Authors...")
 	startAuthors := time.Now()
@@ -46,6 +52,7 @@ func Read(path string) (*Metadata, error) {
 	}
 	L.Info("Loaded: Authors", zap.Int("num", len(m.Authors)),
 		zap.Duration("t", time.Since(startAuthors)))
+	m.Timings["authors"] = time.Since(startAuthors)
 
 	L.Debug("Loading: Series...")
 	startSeries := time.Now()
@@ -57,6 +64,7 @@ func Read(path string) (*Metadata, error) {
 	}
 	L.Info("Loaded: Series", zap.Int("num", len(m.Series)),
 		zap.Duration("t", time.Since(startSeries)))
+	m.Timings["series"] = time.Since(startSeries)
 
 	L.Debug("Loading: Tags...")
 	startTags := time.Now()
@@ -68,6 +76,7 @@ func Read(path string) (*Metadata, error) {
 	}
 	L.Info("Loaded: Tags", zap.Int("num", len(m.Tags)),
 		zap.Duration("t", time.Since(startTags)))
+	m.Timings["tags"] = time.Since(startTags)
 
 	L.Debug("Loading: Books...")
 	startBooks := time.Now()
@@ -108,6 +117,7 @@ func Read(path string) (*Metadata, error) {
 	}
 	L.Debug("Loaded: Book objects", zap.Int("num", len(m.Books)),
 		zap.Duration("t", time.Since(startBooks)))
+	m.Timings["book_objects"] = time.Since(startBooks)
 
 	L.Debug("Loading: Book associations...")
 	startBookAssocs := time.Now()
@@ -162,6 +172,16 @@ func Read(path string) (*Metadata, error) {
 		zap.Int("idents", numBookIdent), zap.Int("files", numBookData),
 		zap.Int("plugin_data", numBookPluginData), zap.Int("langs", numBookLang),
 		zap.Duration("t", time.Since(startBookAssocs)))
+	m.Timings["book_assocs"] = time.Since(startBookAssocs)
+
+	L.Debug("Loading: Custom columns...")
+	startColumns := time.Now()
+	if err := readCustomColumns(db, &m); err != nil {
+		return nil, err
+	}
+	L.Debug("Loaded: Custom columns", zap.Int("num", len(m.Columns)),
+		zap.Duration("t", time.Since(startColumns)))
+	m.Timings["columns"] = time.Since(startColumns)
 
 	L.Debug("Sanitising comments...")
 	startBookComments := time.Now()
@@ -183,14 +203,87 @@ func Read(path string) (*Metadata, error) {
 	}
 	L.Debug("Sanitised comments", zap.Int("num", numComments),
 		zap.Duration("t", time.Since(startBookComments)))
+	m.Timings["comments"] = time.Since(startBookComments)
 
 	L.Info("Loaded: Books", zap.Int("num", len(m.Books)),
 		zap.Duration("t", time.Since(startBooks)))
 
+	m.Timings["total"] = time.Since(start)
 	L.Debug("Done", zap.Duration("t", time.Since(start)))
 	return &m, nil
 }
 
+// Loads custom column definitions and their values. Each column has its own table(s), which
+// look different depending on whether the column is normalized or not.
+func readCustomColumns(db *sqlx.DB, m *Metadata) error {
+	if err := db.Select(&m.Columns, `
+        SELECT id, label, name, datatype, is_multiple, normalized
+        FROM custom_columns WHERE NOT mark_for_delete ORDER BY id
+    `); err != nil {
+		return err
+	}
+	for _, col := range m.Columns {
+		query := fmt.Sprintf(`SELECT book, CAST(value AS TEXT) AS value FROM custom_column_%d
+            WHERE value IS NOT NULL ORDER BY id`, col.ID)
+		if col.Normalized {
+			query = fmt.Sprintf(`
+                SELECT link.book, CAST(col.value AS TEXT) AS value
+                FROM books_custom_column_%d_link AS link
+                INNER JOIN custom_column_%d AS col ON col.id = link.value
+                ORDER BY link.id`, col.ID, col.ID)
+		}
+		var values []struct {
+			Book  int    `db:"book"`
+			Value string `db:"value"`
+		}
+		if err := db.Select(&values, query); err != nil {
+			return fmt.Errorf("custom column #%s: %w", col.Label, err)
+		}
+		for _, v := range values {
+			book := m.GetBook(v.Book)
+			if book == nil {
+				continue
+			}
+			if book.Custom == nil {
+				book.Custom = make(map[string][]string)
+			}
+			book.Custom[col.Label] = append(book.Custom[col.Label], v.Value)
+		}
+	}
+	return nil
+}
+
+// Returns books matching every word in a query, ignoring case. Words may match the title, or
+// the name of an author, series or tag.
+func (m *Metadata) Search(q string) []*Book {
+	words := strings.Fields(strings.ToLower(q))
+	var out []*Book
+	for _, book := range m.Books {
+		haystack := []string{book.Title}
+		for _, a := range book.Authors {
+			haystack = append(haystack, a.Name)
+		}
+		for _, s := range book.Series {
+			haystack = append(haystack, s.Name)
+		}
+		for _, t := range book.Tags {
+			haystack = append(haystack, t.Name)
+		}
+		text := strings.ToLower(strings.Join(haystack, "\n"))
+		match := true
+		for _, word := range words {
+			if !strings.Contains(text, word) {
+				match = false
+				break
+			}
+		}
+		if match {
+			out = append(out, book)
+		}
+	}
+	return out
+}
+
 func (m Metadata) GetTag(id int) *Tag {
 	for _, t := range m.Tags {
 		if t.ID == id {
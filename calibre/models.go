@@ -46,6 +46,9 @@ type Book struct {
 	TagIDs IDs    `json:"tags" db:"_tags"`
 	Tags   []*Tag `json:"-" db:"-"`
 
+	// Values of user-defined columns, by label, eg. {"shelf": ["office"]}. See CustomColumn.
+	Custom map[string][]string `json:"custom" db:"-"`
+
 	PluginData   []*PluginData `json:"plugin_data" db:"-"`
 	LastModified time.Time     `json:"last_modified" db:"last_modified"`
 }
@@ -67,6 +70,19 @@ type Data struct {
 	Name             string `json:"name" db:"name"`
 }
 
+// A user-defined column, eg. "#shelf". Values are stored as text in Book.Custom, regardless
+// of the column's datatype.
+type CustomColumn struct {
+	ID         int    `json:"id" db:"id"`
+	Label      string `json:"label" db:"label"`       // eg. "shelf"; no leading "#".
+	Name       string `json:"name" db:"name"`         // eg. "Shelf"
+	Datatype   string `json:"datatype" db:"datatype"` // eg. "text", "int", "bool", "datetime".
+	IsMultiple bool   `json:"is_multiple" db:"is_multiple"`
+
+	// Normalized columns store values in a separate table, shared between books.
+	Normalized bool `json:"normalized" db:"normalized"`
+}
+
 // Usually a blob of JSON data added by a plugin.
 type PluginData struct {
 	ID     int    `json:"id" db:"id"`
@@ -106,3 +122,26 @@ type Tag struct {
 	BookIDs IDs     `json:"books" db:"_books"` // many-to-many
 	Books   []*Book `json:"-" db:"-"`
 }
+
+// Returns the value of the book's first identifier of the given type, eg. "isbn".
+// For ISBNs, falls back to the deprecated ISBN field if no identifier is present.
+func (b *Book) Identifier(typ string) string {
+	for _, ident := range b.Identifiers {
+		if ident.Type == typ {
+			return ident.Val
+		}
+	}
+	if typ == "isbn" {
+		return b.ISBN
+	}
+	return ""
+}
+
+// Returns the book's publication date, or nil if it's unset. Calibre uses 0101-01-01
+// as a placeholder for "unknown", rather than leaving the column NULL.
+func (b *Book) Published() *time.Time {
+	if b.PubDate == nil || b.PubDate.Year() <= 101 {
+		return nil
+	}
+	return b.PubDate
+}
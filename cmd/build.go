@@ -2,26 +2,32 @@ package cmd
 
 import (
 	"fmt"
+	"path/filepath"
+	"sort"
 
 	"github.com/spf13/afero"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
+	"go.uber.org/zap"
 
+	"github.com/liclac/sharlayan/afhack"
 	"github.com/liclac/sharlayan/builder"
+	"github.com/liclac/sharlayan/builder/html/lint"
 	"github.com/liclac/sharlayan/builder/tree"
 	"github.com/liclac/sharlayan/calibre"
+	"github.com/liclac/sharlayan/config"
 )
 
 var buildCmd = &cobra.Command{
 	Use:   "build",
 	Short: "Build a static website",
-	Long:  `Build a static website.`,
+	Long:  `Build a static website, Gemini capsule, or Gopher hole.`,
 	RunE: func(cmd *cobra.Command, args []string) error {
 		meta, err := calibre.Read(cfg.Library)
 		if err != nil {
 			return err
 		}
-		bld, err := builder.New(cfg)
+		bld, err := builder.New(cfg, cfg.Build.Formats...)
 		if err != nil {
 			return err
 		}
@@ -29,18 +35,65 @@ var buildCmd = &cobra.Command{
 		if root == nil {
 			return fmt.Errorf("root == nil, nothing to render")
 		}
-		fs := traceFS(cfg, afero.NewBasePathFs(afero.NewOsFs(), cfg.Build.Out))
-		if err := root.Render(fs, tree.ByID, "/_id/"); err != nil {
+		// Pages are rendered from the root of the site, so they can link relative to it.
+		out := filepath.Join(cfg.Build.Out, "_id")
+		var base afero.Fs = afhack.NewOsLinkFs(out)
+		if cfg.Build.CopyFiles {
+			base = afero.NewBasePathFs(afero.NewOsFs(), out)
+		}
+		fs := traceFS(cfg, base)
+		if err := root.Render(fs, tree.ByID, "/"); err != nil {
 			return err
 		}
+		if bld.HTML != nil {
+			if err := lintHTML(cfg, fs); err != nil {
+				return err
+			}
+		}
+		if cfg.Build.Gzip {
+			return builder.Gzip(fs, "/")
+		}
 		return nil
 	},
 }
 
+// Checks rendered HTML for well-formedness and accessibility problems, see html.lint.
+func lintHTML(cfg *config.Config, fs afero.Fs) error {
+	if cfg.HTML.Lint == "off" {
+		return nil
+	}
+	L := zap.L().Named("lint")
+	report, err := lint.CheckFs(fs, "/")
+	if err != nil {
+		return err
+	}
+
+	var paths []string
+	var num int
+	for path, problems := range report {
+		paths = append(paths, path)
+		num += len(problems)
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		for _, p := range report[path] {
+			L.Warn(p.Message, zap.String("path", path), zap.Int("line", p.Line), zap.String("rule", p.Rule))
+		}
+	}
+	if num > 0 && cfg.HTML.Lint == "error" {
+		return fmt.Errorf("html: %d problems in %d files", num, len(paths))
+	}
+	return nil
+}
+
 func init() {
 	rootCmd.AddCommand(buildCmd)
 
 	buildCmd.Flags().StringP("build.out", "o", "out", "path to output")
+	buildCmd.Flags().StringSlice("build.formats", []string{"html"}, "output formats: any of html, gemini and gopher")
+	buildCmd.Flags().Bool("build.copy-files", false, "copy book files into the output, instead of symlinking to the library")
+	buildCmd.Flags().Bool("build.gzip", true, "write .gz files next to text files, for servers that can use them")
+	buildCmd.Flags().String("html.lint", "warn", "check rendered HTML for accessibility problems (off, warn, error)")
 
 	viper.BindPFlags(buildCmd.Flags())
 }
@@ -46,6 +46,11 @@ var checkCmd = &cobra.Command{
 			}
 			fn("%s %s\n", status, path)
 		}
+
+		// Identifiers are already in book order.
+		for _, p := range report.Identifiers {
+			color.Red("! %s: %s:%s: %s\n", p.Book.Path, p.Identifier.Type, p.Identifier.Val, p.Err)
+		}
 		return nil
 	},
 }
@@ -0,0 +1,57 @@
+package cmd
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/liclac/sharlayan/server"
+)
+
+var httpCmd = &cobra.Command{
+	Use:   "http",
+	Short: "Manage the HTTP server",
+	Long:  `Manage the HTTP server.`,
+}
+
+var httpShareCmd = &cobra.Command{
+	Use:   "share user",
+	Short: "Make a share link",
+	Long: `Make a link that lets whoever has it browse the library as the given user,
+without a password. The server needs --http.auth.tokens for it to work.
+
+Links can't be revoked individually; to revoke all of them, delete the token
+secret and restart the server.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		expiresIn, err := cmd.Flags().GetDuration("expires")
+		if err != nil {
+			return err
+		}
+		var expires time.Time
+		if expiresIn > 0 {
+			expires = time.Now().Add(expiresIn)
+		}
+		tokens, err := server.LoadOrGenerateShareTokens(cfg)
+		if err != nil {
+			return err
+		}
+		query := url.Values{"token": {tokens.Sign(args[0], expires)}}.Encode()
+		if cfg.HTML.URL == "" {
+			fmt.Printf("%s/?%s\n", cfg.HTML.Root, query)
+		} else {
+			fmt.Printf("%s%s/?%s\n", strings.TrimSuffix(cfg.HTML.URL, "/"), cfg.HTML.Root, query)
+		}
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(httpCmd)
+	httpCmd.AddCommand(httpShareCmd)
+
+	httpShareCmd.Flags().Duration("expires", 7*24*time.Hour, "how long the link works for (0 = forever)")
+}
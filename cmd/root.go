@@ -99,12 +99,22 @@ func init() {
 	rootCmd.PersistentFlags().String("html.templates", "templates", "path to templates")
 	rootCmd.PersistentFlags().String("html.root", "", "public path to library root")
 	rootCmd.PersistentFlags().String("html.title", "My Library", "title for rendered site")
+	rootCmd.PersistentFlags().String("html.lang", "en", "language of the rendered site")
+	rootCmd.PersistentFlags().String("html.url", "", "public URL of the site, eg. \"https://example.com\"")
+	rootCmd.PersistentFlags().Bool("html.relative", false, "use relative links, so the site works without a server")
 
 	rootCmd.PersistentFlags().String("books.path", "/books", "output path to books")
 	rootCmd.PersistentFlags().String("authors.path", "/authors", "output path to authors")
 	rootCmd.PersistentFlags().String("series.path", "/series", "output path to series")
 	rootCmd.PersistentFlags().String("tags.path", "/tags", "output path to tags")
 
+	// Used by both `serve` and `ssh fingerprints`.
+	rootCmd.PersistentFlags().String("ssh.host-key", "", "path to a single host private key")
+	rootCmd.PersistentFlags().String("ssh.host-keys", "", "path to a directory of host private keys (default \"${config.dir}/host_keys\")")
+
+	// Used by both `serve` and `http share`.
+	rootCmd.PersistentFlags().String("http.auth.token-secret", "", "path to secret for signing share links (default \"${config.dir}/token_secret\")")
+
 	viper.BindPFlags(rootCmd.PersistentFlags())
 	cobra.OnInitialize(initConfig)
 }
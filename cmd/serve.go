@@ -6,6 +6,7 @@ import (
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
 	"github.com/hashicorp/go-multierror"
 	"github.com/spf13/afero"
@@ -13,9 +14,12 @@ import (
 	"github.com/spf13/viper"
 	"go.uber.org/zap"
 
+	"github.com/liclac/sharlayan/acl"
+	"github.com/liclac/sharlayan/afhack"
 	"github.com/liclac/sharlayan/builder"
 	"github.com/liclac/sharlayan/builder/tree"
 	"github.com/liclac/sharlayan/calibre"
+	"github.com/liclac/sharlayan/metrics"
 	"github.com/liclac/sharlayan/server"
 	"github.com/liclac/sharlayan/server/ssh"
 )
@@ -27,25 +31,6 @@ var serveCmd = &cobra.Command{
 	RunE: func(cmd *cobra.Command, args []string) error {
 		L := zap.L().Named("serve")
 
-		// Render a ByName tree into an in-memory, read-only filesystem.
-		meta, err := calibre.Read(cfg.Library)
-		if err != nil {
-			return err
-		}
-		bld, err := builder.New(cfg)
-		if err != nil {
-			return err
-		}
-		root := builder.Root(bld, meta)
-		if root == nil {
-			return fmt.Errorf("root == nil, nothing to render")
-		}
-		fs := traceFS(cfg, afero.NewMemMapFs())
-		if err := root.Render(fs, tree.ByID, "/"); err != nil {
-			return err
-		}
-		fs = afero.NewReadOnlyFs(fs)
-
 		// Make a context, and cancel it if we receive a signal.
 		ctx, cancel := context.WithCancel(context.Background())
 		defer cancel() // Prevent context goroutine leak.
@@ -66,11 +51,72 @@ var serveCmd = &cobra.Command{
 			}
 		}()
 
+		// Start the metrics server first, so health checks are answered while rendering; it
+		// takes everything else down with it if it fails.
+		metrics.NotReady("library")
+		metricsErrC := make(chan error, 1)
+		if srv := server.Metrics(cfg); srv != nil {
+			go func() {
+				err := srv.Run(ctx, nil)
+				if err != nil {
+					cancel()
+				}
+				metricsErrC <- err
+			}()
+		} else {
+			metricsErrC <- nil
+		}
+
+		// Render each user's view of the library into an in-memory, read-only filesystem.
+		meta, err := calibre.Read(cfg.Library)
+		if err != nil {
+			return err
+		}
+		server.ObserveLibrary(meta)
+		formats := []string{"html"}
+		if cfg.Gemini.Enable {
+			formats = append(formats, "gemini")
+		}
+		if cfg.Gopher.Enable {
+			formats = append(formats, "gopher")
+		}
+		bld, err := builder.New(cfg, formats...)
+		if err != nil {
+			return err
+		}
+		fs, err := acl.NewViews(cfg, meta, func(meta *calibre.Metadata) (afero.Fs, error) {
+			root := builder.Root(bld, meta)
+			if root == nil {
+				return nil, fmt.Errorf("root == nil, nothing to render")
+			}
+			fs := afhack.NewLinkFs(traceFS(cfg, afero.NewMemMapFs()))
+			if err := root.Render(fs, tree.ByID, "/"); err != nil {
+				return nil, err
+			}
+			return afero.NewReadOnlyFs(fs), nil
+		})
+		if err != nil {
+			return err
+		}
+		metrics.Ready("library")
+
 		// Spawn some servers, wait for them to finish, return their error(s).
-		return collect(server.Serve(ctx, fs,
-			server.HTTP(cfg),
-			ssh.Server(cfg, ssh.SFTP(cfg)),
-		))
+		var rerr error
+		if ctx.Err() == nil { // Not if we were interrupted while rendering.
+			rerr = collect(server.Serve(ctx, fs,
+				server.HTTP(cfg),
+				server.WebDAV(cfg),
+				server.Gemini(cfg),
+				server.Gopher(cfg),
+				server.FTP(cfg),
+				ssh.Server(cfg, append(ssh.Commands(cfg), ssh.SFTP(cfg), ssh.SCP(cfg))...),
+			))
+		}
+		cancel()
+		if err := <-metricsErrC; err != nil {
+			rerr = multierror.Append(rerr, err)
+		}
+		return rerr
 	},
 }
 
@@ -85,13 +131,77 @@ func init() {
 	rootCmd.AddCommand(serveCmd)
 
 	serveCmd.Flags().Bool("http.enable", true, "enable the HTTP server")
-	serveCmd.Flags().StringP("http.addr", "a", "127.0.0.1:3300", "address for the HTTP server")
+	serveCmd.Flags().StringSliceP("http.addr", "a", []string{"127.0.0.1:3300"}, "addresses for the HTTP server: host:port, unix:/path or systemd:name")
+	serveCmd.Flags().Duration("http.grace", 60*time.Second, "time to let requests finish when shutting down")
+	serveCmd.Flags().String("http.access-log", "on", "log requests: off, on, or combined for Apache's format")
+	serveCmd.Flags().String("http.access-log-file", "", "where combined access logs go (default stdout)")
+	serveCmd.Flags().Bool("http.compress", true, "compress text responses with brotli or gzip")
+	serveCmd.Flags().Bool("http.tls.enable", false, "serve HTTPS, with a self-signed certificate unless one is configured")
+	serveCmd.Flags().String("http.tls.cert", "", "path to TLS certificate, reloaded when it changes (default \"${config.dir}/tls.crt\")")
+	serveCmd.Flags().String("http.tls.key", "", "path to TLS private key (default \"${config.dir}/tls.key\")")
+	serveCmd.Flags().Bool("http.auth.anonymous", true, "allow access without logging in")
+	serveCmd.Flags().Bool("http.auth.basic", false, "allow logging in with users.*.password and Basic auth")
+	serveCmd.Flags().String("http.auth.htpasswd", "", "path to htpasswd file with more users, bcrypt only")
+	serveCmd.Flags().String("http.auth.proxy-header", "", "header a reverse proxy puts the logged-in user in, eg. \"X-Remote-User\"")
+	serveCmd.Flags().StringSlice("http.auth.trusted-proxies", []string{"127.0.0.1", "::1"}, "addresses allowed to set the proxy header, or \"unix\" for anything on a Unix socket")
+	serveCmd.Flags().Bool("http.auth.tokens", false, "allow share links made with `sharlayan http share`")
+	serveCmd.Flags().String("http.tls.redirect", "", "address to redirect plain HTTP to HTTPS from, eg. \":80\"")
+
+	serveCmd.Flags().Bool("webdav.enable", false, "enable the read-only WebDAV server")
+	serveCmd.Flags().StringSlice("webdav.addr", []string{"127.0.0.1:3380"}, "addresses for the WebDAV server")
+	serveCmd.Flags().Duration("webdav.grace", 60*time.Second, "time to let requests finish when shutting down")
+	serveCmd.Flags().Bool("webdav.tls.enable", false, "serve WebDAV over HTTPS, with the certificate from http.tls.*")
+
+	serveCmd.Flags().Bool("gemini.enable", false, "enable the Gemini server")
+	serveCmd.Flags().StringSlice("gemini.addr", []string{"127.0.0.1:1965"}, "addresses for the Gemini server")
+	serveCmd.Flags().String("gemini.hostname", "", "public hostname, for the certificate; requests for other hosts are refused")
+	serveCmd.Flags().String("gemini.cert", "", "path to TLS certificate, reloaded when it changes (default \"${config.dir}/gemini.crt\")")
+	serveCmd.Flags().String("gemini.key", "", "path to TLS private key (default \"${config.dir}/gemini.key\")")
+	serveCmd.Flags().Duration("gemini.grace", 60*time.Second, "time to let responses finish when shutting down")
+
+	serveCmd.Flags().Bool("gopher.enable", false, "enable the Gopher server")
+	serveCmd.Flags().StringSlice("gopher.addr", []string{"127.0.0.1:7070"}, "addresses for the Gopher server")
+	serveCmd.Flags().String("gopher.hostname", "", "public hostname menus point to (default from gopher.addr)")
+	serveCmd.Flags().Int("gopher.port", 0, "public port menus point to, eg. 70 behind a port forward (default from gopher.addr)")
+	serveCmd.Flags().Duration("gopher.grace", 60*time.Second, "time to let responses finish when shutting down")
+
+	serveCmd.Flags().Bool("ftp.enable", false, "enable the read-only FTP server")
+	serveCmd.Flags().StringSlice("ftp.addr", []string{"127.0.0.1:2121"}, "addresses for the FTP server; TCP only")
+	serveCmd.Flags().Bool("ftp.anonymous", false, "allow logging in as \"anonymous\" or \"ftp\", with any password")
+	serveCmd.Flags().String("ftp.passive-ports", "", "port range for passive data connections, eg. \"50000-50100\" (default any)")
+	serveCmd.Flags().String("ftp.public-ip", "", "IPv4 address to tell clients to connect to, if behind NAT")
+	serveCmd.Flags().Duration("ftp.idle-timeout", 5*time.Minute, "disconnect clients after this long without a command")
+	serveCmd.Flags().Duration("ftp.grace", 60*time.Second, "time to let transfers finish when shutting down")
+	serveCmd.Flags().Bool("ftp.tls.enable", false, "allow AUTH TLS (explicit FTPS), with the certificate from http.tls.*")
+	serveCmd.Flags().Bool("ftp.tls.require", false, "refuse logins and transfers without TLS")
+
+	serveCmd.Flags().String("sockets.mode", "0660", "permissions for Unix sockets")
+	serveCmd.Flags().String("sockets.group", "", "group to own Unix sockets, eg. the reverse proxy's (default ours)")
+
+	serveCmd.Flags().Bool("metrics.enable", false, "serve Prometheus metrics, /healthz and /readyz")
+	serveCmd.Flags().StringSlice("metrics.addr", []string{"127.0.0.1:3390"}, "addresses for the metrics server")
 
 	serveCmd.Flags().Bool("ssh.enable", false, "enable the SSH server")
-	serveCmd.Flags().String("ssh.addr", "127.0.0.1:3322", "address for the SSH server")
+	serveCmd.Flags().StringSlice("ssh.addr", []string{"127.0.0.1:3322"}, "addresses for the SSH server")
 	serveCmd.Flags().Bool("ssh.trace", false, "enable trace logging")
-	serveCmd.Flags().String("ssh.host-key", "", "path to host private key (default \"${config.dir}/host_key.pem\")")
+	serveCmd.Flags().Duration("ssh.grace", 60*time.Second, "time to let sessions finish when shutting down")
+	serveCmd.Flags().String("ssh.authorized-keys", "", "path to authorized_keys file (default \"${config.dir}/authorized_keys\")")
+	serveCmd.Flags().Bool("ssh.keyboard-interactive", false, "allow keyboard-interactive password auth")
+	serveCmd.Flags().Bool("ssh.anonymous", false, "allow unknown users to log in without credentials")
+	serveCmd.Flags().Int("ssh.max-conns", 100, "max concurrent connections (0 = unlimited)")
+	serveCmd.Flags().Int("ssh.max-conns-per-ip", 10, "max concurrent connections per IP (0 = unlimited)")
+	serveCmd.Flags().Int("ssh.max-sessions", 10, "max concurrent sessions per connection (0 = unlimited)")
+	serveCmd.Flags().Int("ssh.max-auth-tries", 6, "max login attempts per connection (0 = unlimited)")
+	serveCmd.Flags().Duration("ssh.handshake-timeout", 30*time.Second, "time allowed to log in (0 = unlimited)")
+	serveCmd.Flags().Duration("ssh.idle-timeout", 15*time.Minute, "disconnect after this long without traffic (0 = never)")
+	serveCmd.Flags().Duration("ssh.auth-backoff", 500*time.Millisecond, "delay after a failed password, doubling each time (0 = none)")
 	serveCmd.Flags().Bool("ssh.sftp.enable", true, "enable the SFTP subsystem")
+	serveCmd.Flags().Bool("ssh.sftp.inbox.enable", false, "let logged-in users upload books to /inbox")
+	serveCmd.Flags().String("ssh.sftp.inbox.dir", "", "where to put uploaded books, eg. calibre's auto-add folder (default \"${config.dir}/inbox\")")
+	serveCmd.Flags().Int64("ssh.sftp.inbox.max-size", 100<<20, "max upload size in bytes (0 = unlimited)")
+	serveCmd.Flags().Bool("ssh.shell.enable", true, "enable the built-in shell")
+	serveCmd.Flags().Bool("ssh.scp.enable", true, "enable downloads over SCP")
+	serveCmd.Flags().Bool("ssh.exec.enable", true, "enable search, meta and get commands")
 
 	viper.BindPFlags(serveCmd.Flags())
 }
@@ -0,0 +1,39 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/spf13/cobra"
+
+	"github.com/liclac/sharlayan/server/ssh"
+)
+
+var sshCmd = &cobra.Command{
+	Use:   "ssh",
+	Short: "Manage the SSH server",
+	Long:  `Manage the SSH server.`,
+}
+
+var sshFingerprintsCmd = &cobra.Command{
+	Use:   "fingerprints",
+	Short: "Print host key fingerprints",
+	Long: `Print host key fingerprints, generating any missing keys.
+
+Publish these somewhere users can see them, so they can check they're connecting
+to the right server the first time they do.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		keys, err := ssh.LoadOrGenerateHostKeys(cfg)
+		if err != nil {
+			return err
+		}
+		for _, key := range keys {
+			fmt.Printf("%s %s %s\n", key.PublicKey().Type(), key.Fingerprint(), key.Path)
+		}
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(sshCmd)
+	sshCmd.AddCommand(sshFingerprintsCmd)
+}
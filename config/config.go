@@ -17,34 +17,204 @@ type Config struct {
 		TraceFS bool `mapstructure:"trace-fs"` // Log all filesystem operations.
 	} `mapstructure:"debug"`
 
+	// Display labels and URL templates for book identifiers, eg. "isbn".
+	// These are merged with calibre.IdentifierTypes, overriding same-named types.
+	Identifiers map[string]struct {
+		Label string `mapstructure:"label"` // Display label, eg. "ISBN".
+		URL   string `mapstructure:"url"`   // URL template, eg. "https://example.com/{id}".
+	} `mapstructure:"identifiers"`
+
+	// Users who may log in to servers, by username.
+	Users map[string]User `mapstructure:"users"`
+
+	// Which books each user can see when serving, by username. Anyone without their own rule,
+	// including anonymous users, gets the "*" rule, or nothing if there isn't one. If no
+	// rules are configured at all, everyone can see everything.
+	ACL map[string]ACLRule `mapstructure:"acl"`
+
 	// Build command specific.
 	Build struct {
-		Out string `mapstructure:"out"` // Output directory.
+		Out       string   `mapstructure:"out"`        // Output directory.
+		Formats   []string `mapstructure:"formats"`    // Output formats: "html", "gemini", "gopher".
+		Gzip      bool     `mapstructure:"gzip"`       // Write .gz files next to text files.
+		CopyFiles bool     `mapstructure:"copy-files"` // Copy book files into the output, instead of symlinking.
 	} `mapstructure:"build"`
 
 	// Serve command specific.
 	HTTP struct {
 		Enable bool          `mapstructure:"enable"` // Enable the HTTP server.
-		Addr   string        `mapstructure:"addr"`   // Address to listen on.
+		Addrs  []string      `mapstructure:"addr"`   // Addresses to listen on, see server.Listen.
 		Grace  time.Duration `mapstructure:"grace"`  // Shutdown grace period.
+
+		TLS struct {
+			Enable   bool   `mapstructure:"enable"`   // Serve HTTPS instead of HTTP.
+			Cert     string `mapstructure:"cert"`     // Path to certificate (chain), PEM.
+			Key      string `mapstructure:"key"`      // Path to private key, PEM.
+			Redirect string `mapstructure:"redirect"` // Address to redirect plain HTTP from.
+		} `mapstructure:"tls"`
+
+		// Middleware.
+		AccessLog     string      `mapstructure:"access-log"`      // "off", "on" or "combined".
+		AccessLogFile string      `mapstructure:"access-log-file"` // Where combined logs go; default stdout.
+		Compress      bool        `mapstructure:"compress"`        // Compress text responses.
+		Cache         []CacheRule `mapstructure:"cache"`           // Cache-Control by path; first match wins.
+
+		// Authentication; users see the same part of the library as they would over SSH.
+		Auth struct {
+			Anonymous      bool     `mapstructure:"anonymous"`       // Allow access without logging in.
+			Basic          bool     `mapstructure:"basic"`           // Allow Basic auth with passwords.
+			Htpasswd       string   `mapstructure:"htpasswd"`        // Path to htpasswd file with more users.
+			ProxyHeader    string   `mapstructure:"proxy-header"`    // Header with a user from a reverse proxy.
+			TrustedProxies []string `mapstructure:"trusted-proxies"` // IPs or CIDRs allowed to set ProxyHeader, or "unix" for Unix sockets.
+			Tokens         bool     `mapstructure:"tokens"`          // Allow share links with tokens.
+			TokenSecret    string   `mapstructure:"token-secret"`    // Path to secret for signing tokens.
+		} `mapstructure:"auth"`
 	} `mapstructure:"http"`
 
+	// A read-only WebDAV server; users log in as configured in HTTP.Auth.
+	WebDAV struct {
+		Enable bool          `mapstructure:"enable"` // Enable the WebDAV server.
+		Addrs  []string      `mapstructure:"addr"`   // Addresses to listen on, see server.Listen.
+		Grace  time.Duration `mapstructure:"grace"`  // Shutdown grace period.
+
+		// HTTPS, with the same certificate as HTTP.TLS.
+		TLS struct {
+			Enable bool `mapstructure:"enable"` // Serve WebDAV over HTTPS.
+		} `mapstructure:"tls"`
+	} `mapstructure:"webdav"`
+
+	// A Gemini server, for the library rendered as gemtext.
+	Gemini struct {
+		Enable   bool          `mapstructure:"enable"`   // Enable the Gemini server.
+		Addrs    []string      `mapstructure:"addr"`     // Addresses to listen on, see server.Listen.
+		Hostname string        `mapstructure:"hostname"` // Public hostname; others are refused.
+		Cert     string        `mapstructure:"cert"`     // Path to certificate (chain), PEM.
+		Key      string        `mapstructure:"key"`      // Path to private key, PEM.
+		Grace    time.Duration `mapstructure:"grace"`    // Shutdown grace period.
+	} `mapstructure:"gemini"`
+
+	// A Gopher server, for the library rendered as gophermaps.
+	Gopher struct {
+		Enable   bool          `mapstructure:"enable"`   // Enable the Gopher server.
+		Addrs    []string      `mapstructure:"addr"`     // Addresses to listen on, see server.Listen.
+		Hostname string        `mapstructure:"hostname"` // Public hostname, for menus.
+		Port     int           `mapstructure:"port"`     // Public port, for menus.
+		Grace    time.Duration `mapstructure:"grace"`    // Shutdown grace period.
+	} `mapstructure:"gopher"`
+
+	// A read-only FTP server, for e-readers and tools that don't speak anything else.
+	FTP struct {
+		Enable       bool          `mapstructure:"enable"`        // Enable the FTP server.
+		Addrs        []string      `mapstructure:"addr"`          // Addresses to listen on, see server.Listen.
+		Anonymous    bool          `mapstructure:"anonymous"`     // Allow logging in as "anonymous".
+		PassivePorts string        `mapstructure:"passive-ports"` // Port range for data connections, eg. "50000-50100".
+		PublicIP     string        `mapstructure:"public-ip"`     // IPv4 address sent for PASV, if behind NAT.
+		IdleTimeout  time.Duration `mapstructure:"idle-timeout"`  // Disconnect after this long without a command.
+		Grace        time.Duration `mapstructure:"grace"`         // Shutdown grace period.
+
+		// Explicit FTPS (AUTH TLS), with the same certificate as HTTP.TLS.
+		TLS struct {
+			Enable  bool `mapstructure:"enable"`  // Allow upgrading connections to TLS.
+			Require bool `mapstructure:"require"` // Refuse logins and transfers without TLS.
+		} `mapstructure:"tls"`
+	} `mapstructure:"ftp"`
+
 	SSH struct {
-		Enable  bool   `mapstructure:"enable"`   // Enable the SSH server.
-		Addr    string `mapstructure:"addr"`     // Address to listen on.
-		HostKey string `mapstructure:"host-key"` // Path to host private key.
-		Trace   bool   `mapstructure:"trace"`    // Log all SSH operations.
+		Enable   bool          `mapstructure:"enable"`    // Enable the SSH server.
+		Addrs    []string      `mapstructure:"addr"`      // Addresses to listen on, see server.Listen.
+		HostKey  string        `mapstructure:"host-key"`  // Path to a single host private key.
+		HostKeys string        `mapstructure:"host-keys"` // Path to a directory of host private keys.
+		Trace    bool          `mapstructure:"trace"`     // Log all SSH operations.
+		Grace    time.Duration `mapstructure:"grace"`     // Shutdown grace period.
+
+		// Authentication.
+		AuthorizedKeys      string `mapstructure:"authorized-keys"`      // Path to authorized_keys file.
+		KeyboardInteractive bool   `mapstructure:"keyboard-interactive"` // Allow keyboard-interactive passwords.
+		Anonymous           bool   `mapstructure:"anonymous"`            // Allow unknown users without credentials.
+
+		// Limits; 0 means unlimited.
+		MaxConns         int           `mapstructure:"max-conns"`         // Max concurrent connections.
+		MaxConnsPerIP    int           `mapstructure:"max-conns-per-ip"`  // Max concurrent connections per IP.
+		MaxSessions      int           `mapstructure:"max-sessions"`      // Max concurrent sessions per connection.
+		MaxAuthTries     int           `mapstructure:"max-auth-tries"`    // Max login attempts per connection.
+		HandshakeTimeout time.Duration `mapstructure:"handshake-timeout"` // Time allowed to log in.
+		IdleTimeout      time.Duration `mapstructure:"idle-timeout"`      // Disconnect after this long without traffic.
+		AuthBackoff      time.Duration `mapstructure:"auth-backoff"`      // Delay after a failed password, doubling each time.
 
 		// SSH subsystems.
 		SFTP struct {
 			Enable bool `mapstructure:"enable"` // Enable the SFTP subsystem.
+
+			// Lets logged-in users upload books, eg. into Calibre's auto-add folder.
+			Inbox struct {
+				Enable  bool   `mapstructure:"enable"`   // Enable the /inbox directory.
+				Dir     string `mapstructure:"dir"`      // Where to put uploaded books.
+				MaxSize int64  `mapstructure:"max-size"` // Max upload size in bytes.
+			}
+		}
+
+		// SSH commands.
+		Shell struct {
+			Enable bool `mapstructure:"enable"` // Enable the built-in shell.
+		}
+		SCP struct {
+			Enable bool `mapstructure:"enable"` // Enable downloads over SCP.
+		}
+		Exec struct {
+			Enable bool `mapstructure:"enable"` // Enable search, meta and get commands.
 		}
 	}
 
+	// Unix sockets listened on, eg. for addresses like "unix:/run/sharlayan/http.sock".
+	Sockets struct {
+		Mode  string `mapstructure:"mode"`  // Permissions, in octal, eg. "0660".
+		Group string `mapstructure:"group"` // Group to own them, eg. so a reverse proxy can connect.
+	} `mapstructure:"sockets"`
+
+	// Prometheus metrics and health checks, on their own address.
+	Metrics struct {
+		Enable bool     `mapstructure:"enable"` // Enable the metrics server.
+		Addrs  []string `mapstructure:"addr"`   // Addresses to listen on, see server.Listen.
+	} `mapstructure:"metrics"`
+
 	// Output formats.
 	HTML struct {
 		Templates string `mapstructure:"templates"` // Template source directory.
 		Root      string `mapstructure:"root"`      // Prefix from the root of your site.
 		Title     string `mapstructure:"title"`     // Site title.
+		Lang      string `mapstructure:"lang"`      // Site language, eg. "en".
+		URL       string `mapstructure:"url"`       // Public URL, for link previews.
+		Relative  bool   `mapstructure:"relative"`  // Use relative links, for file:// browsing.
+		Lint      string `mapstructure:"lint"`      // Check output: "off", "warn" or "error".
 	} `mapstructure:"html"`
 }
+
+// A CacheRule sets Cache-Control for matching paths, eg.
+//
+//	[[http.cache]]
+//	path = "/books/*/*.epub"
+//	control = "public, max-age=86400"
+type CacheRule struct {
+	Path    string `mapstructure:"path"`    // A glob, see path.Match; ending in "/" matches everything under it.
+	Control string `mapstructure:"control"` // The Cache-Control header, eg. "no-cache".
+}
+
+// A User who may log in to servers.
+type User struct {
+	Password       string   `mapstructure:"password"`        // bcrypt hash, eg. from `htpasswd -nB`.
+	AuthorizedKeys []string `mapstructure:"authorized-keys"` // SSH public keys, authorized_keys format.
+}
+
+// An ACLRule decides which books a user can see.
+type ACLRule struct {
+	Allow ACLFilter `mapstructure:"allow"` // If non-empty, only matching books are visible.
+	Deny  ACLFilter `mapstructure:"deny"`  // Matching books are hidden, even if allowed.
+}
+
+// An ACLFilter matches books which match any of its conditions.
+type ACLFilter struct {
+	Tags    []string            `mapstructure:"tags"`    // Tag names, eg. "work-confidential".
+	Authors []string            `mapstructure:"authors"` // Author names, eg. "Terry Pratchett".
+	Paths   []string            `mapstructure:"paths"`   // Globs for paths in the library, eg. "Work/*".
+	Columns map[string][]string `mapstructure:"columns"` // Custom column values, eg. {"shelf": ["office"]}.
+}
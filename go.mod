@@ -3,6 +3,7 @@ module github.com/liclac/sharlayan
 go 1.14
 
 require (
+	github.com/andybalholm/brotli v1.0.4
 	github.com/fatih/color v1.9.0
 	github.com/hashicorp/go-multierror v1.1.0
 	github.com/jmoiron/sqlx v1.2.0
@@ -11,16 +12,16 @@ require (
 	github.com/mattn/go-sqlite3 v2.0.3+incompatible
 	github.com/niemeyer/pretty v0.0.0-20200227124842-a10e7caefd8e // indirect
 	github.com/olekukonko/tablewriter v0.0.4 // indirect
-	github.com/pkg/sftp v1.11.0
+	github.com/pkg/sftp v1.13.0
 	github.com/russross/blackfriday/v2 v2.0.1
 	github.com/spf13/afero v1.2.2
 	github.com/spf13/cobra v1.0.0
 	github.com/spf13/viper v1.7.0
 	github.com/ssor/bom v0.0.0-20170718123548-6386211fdfcf // indirect
-	github.com/stretchr/testify v1.5.1
+	github.com/stretchr/testify v1.6.1
 	go.uber.org/zap v1.15.0
-	golang.org/x/crypto v0.0.0-20200429183012-4b2356b1ed79
-	golang.org/x/sys v0.0.0-20200515095857-1151b9dac4a9 // indirect
+	golang.org/x/crypto v0.0.0-20201221181555-eec23a3978ad
+	golang.org/x/net v0.0.0-20190620200207-3b0461eec859
 	gopkg.in/check.v1 v1.0.0-20200227125254-8fa46927fb4f // indirect
 	jaytaylor.com/html2text v0.0.0-20200412013138-3577fbdbcff7
 )
@@ -0,0 +1,220 @@
+// Package metrics keeps counters and gauges, and writes them out in Prometheus' text format.
+//
+// It's deliberately tiny: sharlayan only needs a handful of metrics, and the official client
+// would pull in more dependencies than the rest of the program put together.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// The registry everything registers with, and the metrics server serves.
+var Default = &Registry{}
+
+// A Registry is a set of metrics, written out in the order they were registered.
+type Registry struct {
+	mu      sync.Mutex
+	metrics []*metric
+}
+
+// Registers a counter with the default registry; see Registry.Counter.
+func NewCounter(name, help string, labels ...string) *Counter {
+	return Default.Counter(name, help, labels...)
+}
+
+// Registers a gauge with the default registry; see Registry.Gauge.
+func NewGauge(name, help string, labels ...string) *Gauge {
+	return Default.Gauge(name, help, labels...)
+}
+
+// Registers a counter, a value that only goes up, eg. the number of requests served. If
+// labels are given, there's one value for each combination of label values.
+func (r *Registry) Counter(name, help string, labels ...string) *Counter {
+	return &Counter{r.register(name, help, "counter", labels)}
+}
+
+// Registers a gauge, a value that goes up and down, eg. the number of open connections.
+func (r *Registry) Gauge(name, help string, labels ...string) *Gauge {
+	return &Gauge{r.register(name, help, "gauge", labels)}
+}
+
+func (r *Registry) register(name, help, typ string, labels []string) *metric {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, m := range r.metrics {
+		if m.name == name {
+			panic(fmt.Sprintf("metrics: %s registered twice", name))
+		}
+	}
+	m := &metric{name: name, help: help, typ: typ, labels: labels, values: map[string]float64{}}
+	r.metrics = append(r.metrics, m)
+	return m
+}
+
+// Writes every metric in Prometheus' text exposition format.
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.mu.Lock()
+	metrics := append([]*metric(nil), r.metrics...)
+	r.mu.Unlock()
+
+	bw := bufio.NewWriter(w)
+	cw := &countingWriter{w: bw}
+	for _, m := range metrics {
+		m.writeTo(cw)
+	}
+	if cw.err == nil {
+		cw.err = bw.Flush()
+	}
+	return cw.n, cw.err
+}
+
+// A Counter is a value that only goes up.
+type Counter struct{ m *metric }
+
+// Adds 1 to the value for the given label values.
+func (c *Counter) Inc(labels ...string) { c.Add(1, labels...) }
+
+// Adds a positive number to the value for the given label values.
+func (c *Counter) Add(v float64, labels ...string) {
+	if v < 0 {
+		panic(fmt.Sprintf("metrics: %s: counters can't go down", c.m.name))
+	}
+	c.m.add(v, labels)
+}
+
+// Returns the value for the given label values.
+func (c *Counter) Value(labels ...string) float64 { return c.m.get(labels) }
+
+// A Gauge is a value that goes up and down.
+type Gauge struct{ m *metric }
+
+// Sets the value for the given label values.
+func (g *Gauge) Set(v float64, labels ...string) { g.m.set(v, labels) }
+
+// Adds a (possibly negative) number to the value for the given label values.
+func (g *Gauge) Add(v float64, labels ...string) { g.m.add(v, labels) }
+
+// Returns the value for the given label values.
+func (g *Gauge) Value(labels ...string) float64 { return g.m.get(labels) }
+
+type metric struct {
+	name, help, typ string
+	labels          []string
+
+	mu     sync.Mutex
+	values map[string]float64 // By label values, joined with labelSep.
+}
+
+// Can't appear in label values that are valid UTF-8.
+const labelSep = "\xff"
+
+func (m *metric) key(labels []string) string {
+	if len(labels) != len(m.labels) {
+		panic(fmt.Sprintf("metrics: %s: expected %d label values, got %d", m.name, len(m.labels), len(labels)))
+	}
+	return strings.Join(labels, labelSep)
+}
+
+func (m *metric) add(v float64, labels []string) {
+	k := m.key(labels)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.values[k] += v
+}
+
+func (m *metric) set(v float64, labels []string) {
+	k := m.key(labels)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.values[k] = v
+}
+
+func (m *metric) get(labels []string) float64 {
+	k := m.key(labels)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.values[k]
+}
+
+func (m *metric) writeTo(w io.Writer) {
+	m.mu.Lock()
+	keys := make([]string, 0, len(m.values))
+	for k := range m.values {
+		keys = append(keys, k)
+	}
+	values := make(map[string]float64, len(m.values))
+	for k, v := range m.values {
+		values[k] = v
+	}
+	m.mu.Unlock()
+	sort.Strings(keys)
+
+	fmt.Fprintf(w, "# HELP %s %s\n", m.name, escapeHelp(m.help))
+	fmt.Fprintf(w, "# TYPE %s %s\n", m.name, m.typ)
+	if len(m.labels) == 0 && len(keys) == 0 {
+		fmt.Fprintf(w, "%s 0\n", m.name) // An unlabelled metric always has a value.
+	}
+	for _, k := range keys {
+		fmt.Fprintf(w, "%s%s %s\n", m.name, formatLabels(m.labels, k), formatValue(values[k]))
+	}
+}
+
+func formatLabels(names []string, key string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, v := range strings.Split(key, labelSep) {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		fmt.Fprintf(&b, `%s="%s"`, names[i], escapeLabel(v))
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+func formatValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var (
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+func escapeHelp(s string) string  { return helpEscaper.Replace(s) }
+func escapeLabel(s string) string { return labelEscaper.Replace(s) }
+
+// Counts bytes written, and remembers the first error, so writeTo doesn't have to.
+type countingWriter struct {
+	w   io.Writer
+	n   int64
+	err error
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	n, err := w.w.Write(p)
+	w.n += int64(n)
+	w.err = err
+	return n, err
+}
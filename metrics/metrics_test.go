@@ -0,0 +1,78 @@
+package metrics
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRegistry(t *testing.T) {
+	r := &Registry{}
+	reqs := r.Counter("test_requests_total", "Requests, by code.", "code", "path")
+	conns := r.Gauge("test_conns", "Open connections.\nOr \\ so.")
+	r.Gauge("test_unused", "Never set.", "kind")
+
+	reqs.Inc("2xx", "/")
+	reqs.Add(2, "2xx", "/")
+	reqs.Inc("4xx", `C:\ "quoted"`+"\n")
+	conns.Add(3)
+	conns.Add(-1)
+	assert.Equal(t, float64(3), reqs.Value("2xx", "/"))
+	assert.Equal(t, float64(0), reqs.Value("5xx", "/"))
+	assert.Equal(t, float64(2), conns.Value())
+
+	var buf bytes.Buffer
+	n, err := r.WriteTo(&buf)
+	require.NoError(t, err)
+	assert.Equal(t, int64(buf.Len()), n)
+	assert.Equal(t, `# HELP test_requests_total Requests, by code.
+# TYPE test_requests_total counter
+test_requests_total{code="2xx",path="/"} 3
+test_requests_total{code="4xx",path="C:\\ \"quoted\"\n"} 1
+# HELP test_conns Open connections.\nOr \\ so.
+# TYPE test_conns gauge
+test_conns 2
+# HELP test_unused Never set.
+# TYPE test_unused gauge
+`, buf.String())
+
+	t.Run("Empty", func(t *testing.T) {
+		var buf bytes.Buffer
+		_, err := (&Registry{}).WriteTo(&buf)
+		require.NoError(t, err)
+		assert.Equal(t, "", buf.String())
+	})
+	t.Run("Unlabelled", func(t *testing.T) {
+		r := &Registry{}
+		r.Counter("test_total", "Nothing yet.")
+		var buf bytes.Buffer
+		_, err := r.WriteTo(&buf)
+		require.NoError(t, err)
+		assert.Contains(t, buf.String(), "\ntest_total 0\n")
+	})
+	t.Run("Twice", func(t *testing.T) {
+		assert.Panics(t, func() { r.Counter("test_conns", "Again.") })
+	})
+	t.Run("WrongLabels", func(t *testing.T) {
+		assert.Panics(t, func() { reqs.Inc("2xx") })
+	})
+	t.Run("CounterDown", func(t *testing.T) {
+		assert.Panics(t, func() { reqs.Add(-1, "2xx", "/") })
+	})
+}
+
+func TestReadiness(t *testing.T) {
+	r := &Readiness{}
+	assert.Empty(t, r.Pending())
+	r.Ready("nothing") // Fine, if pointless.
+	r.NotReady("library")
+	r.NotReady("http")
+	r.NotReady("http")
+	assert.Equal(t, []string{"http", "library"}, r.Pending())
+	r.Ready("library")
+	assert.Equal(t, []string{"http"}, r.Pending())
+	r.Ready("http")
+	assert.Empty(t, r.Pending())
+}
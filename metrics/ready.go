@@ -0,0 +1,53 @@
+package metrics
+
+import (
+	"sort"
+	"sync"
+)
+
+var defaultReadiness = &Readiness{}
+
+// Marks something as not ready in the default readiness; see Readiness.NotReady.
+func NotReady(name string) { defaultReadiness.NotReady(name) }
+
+// Marks something as ready in the default readiness; see Readiness.Ready.
+func Ready(name string) { defaultReadiness.Ready(name) }
+
+// Returns what isn't ready in the default readiness; see Readiness.Pending.
+func Pending() []string { return defaultReadiness.Pending() }
+
+// Readiness tracks whether the program is ready to serve, as opposed to merely running; eg.
+// not while the library is being rendered, or once servers have started shutting down.
+type Readiness struct {
+	mu      sync.Mutex
+	pending map[string]bool
+}
+
+// Marks something (eg. "http") as not ready, until Ready is called for it.
+func (r *Readiness) NotReady(name string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.pending == nil {
+		r.pending = map[string]bool{}
+	}
+	r.pending[name] = true
+}
+
+// Marks something as ready.
+func (r *Readiness) Ready(name string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.pending, name)
+}
+
+// Returns the names of everything that isn't ready, sorted; if empty, we're ready.
+func (r *Readiness) Pending() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	names := make([]string, 0, len(r.pending))
+	for name := range r.pending {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,183 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Header request IDs are read from and written to.
+const requestIDHeader = "X-Request-ID"
+
+type requestIDKey struct{}
+
+// Returns the ID of the request a context belongs to, or "" if it doesn't have one.
+func RequestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// Gives every request an ID, which is sent back in a response header and logged, so problems
+// can be tracked down. If a reverse proxy has already given it one, that's used instead.
+func withRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		id := req.Header.Get(requestIDHeader)
+		if !validRequestID(id) {
+			var buf [8]byte
+			_, _ = rand.Read(buf[:])
+			id = hex.EncodeToString(buf[:])
+		}
+		rw.Header().Set(requestIDHeader, id)
+		next.ServeHTTP(rw, req.WithContext(context.WithValue(req.Context(), requestIDKey{}, id)))
+	})
+}
+
+// Only short, printable IDs are accepted from clients, so they can't mess up the logs.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 64 {
+		return false
+	}
+	for _, c := range id {
+		if c <= ' ' || c > '~' || c == '"' {
+			return false
+		}
+	}
+	return true
+}
+
+// What's logged about a request. Handlers further down the chain fill in the user.
+type accessEntry struct {
+	User   string
+	Status int
+	Size   int64
+}
+
+type accessEntryKey struct{}
+
+// Records the user in the access log entry, if there is one; goes after the auth middleware.
+func noteUser(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if e, ok := req.Context().Value(accessEntryKey{}).(*accessEntry); ok {
+			e.User = UserFromContext(req.Context())
+		}
+		next.ServeHTTP(rw, req)
+	})
+}
+
+// Logs every request, either to a zap logger, or in Apache's "combined" format, which log
+// analysers understand; if w is non-nil, it's the latter.
+func logRequests(L *zap.Logger, w io.Writer, next http.Handler) http.Handler {
+	var mu sync.Mutex // Serialises writes to w.
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+		e := &accessEntry{}
+		srw := &statusResponseWriter{ResponseWriter: rw, entry: e}
+		next.ServeHTTP(srw, req.WithContext(context.WithValue(req.Context(), accessEntryKey{}, e)))
+		if e.Status == 0 {
+			e.Status = http.StatusOK // Nothing was written.
+		}
+
+		if w != nil {
+			line := combinedLogLine(req, e, start)
+			mu.Lock()
+			defer mu.Unlock()
+			if _, err := io.WriteString(w, line); err != nil {
+				L.Error("Couldn't write access log", zap.Error(err))
+			}
+			return
+		}
+		L.Info("Request",
+			zap.String("id", RequestIDFromContext(req.Context())),
+			zap.String("addr", req.RemoteAddr),
+			zap.String("user", e.User),
+			zap.String("method", req.Method),
+			zap.String("uri", req.RequestURI),
+			zap.Int("status", e.Status),
+			zap.Int64("size", e.Size),
+			zap.Duration("t", time.Since(start)),
+			zap.String("referer", req.Referer()),
+			zap.String("user_agent", req.UserAgent()),
+		)
+	})
+}
+
+// Formats a line in Apache's combined log format.
+func combinedLogLine(req *http.Request, e *accessEntry, t time.Time) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+	user := e.User
+	if user == "" {
+		user = "-"
+	}
+	size := "-"
+	if e.Size > 0 {
+		size = fmt.Sprint(e.Size)
+	}
+	return fmt.Sprintf("%s - %s [%s] \"%s %s %s\" %d %s \"%s\" \"%s\"\n",
+		host, escapeLogField(user), t.Format("02/Jan/2006:15:04:05 -0700"),
+		req.Method, escapeLogField(req.RequestURI), req.Proto, e.Status, size,
+		escapeLogField(req.Referer()), escapeLogField(req.UserAgent()))
+}
+
+func escapeLogField(s string) string {
+	var b strings.Builder
+	for _, c := range []byte(s) {
+		switch {
+		case c == '"' || c == '\\':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c < ' ' || c > '~':
+			fmt.Fprintf(&b, "\\x%02x", c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// Records the status and size of a response.
+type statusResponseWriter struct {
+	http.ResponseWriter
+	entry *accessEntry
+}
+
+func (w *statusResponseWriter) WriteHeader(status int) {
+	if w.entry.Status == 0 {
+		w.entry.Status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusResponseWriter) Write(data []byte) (int, error) {
+	if w.entry.Status == 0 {
+		w.entry.Status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(data)
+	w.entry.Size += int64(n)
+	return n, err
+}
+
+func (w *statusResponseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *statusResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if h, ok := w.ResponseWriter.(http.Hijacker); ok {
+		return h.Hijack()
+	}
+	return nil, nil, fmt.Errorf("http: response can't be hijacked")
+}
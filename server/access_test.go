@@ -0,0 +1,78 @@
+package server
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestRequestID(t *testing.T) {
+	var id string
+	h := withRequestID(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		id = RequestIDFromContext(req.Context())
+	}))
+
+	rw := httptest.NewRecorder()
+	h.ServeHTTP(rw, httptest.NewRequest("GET", "/", nil))
+	assert.Regexp(t, `^[0-9a-f]{16}$`, id)
+	assert.Equal(t, id, rw.Header().Get(requestIDHeader))
+
+	for given, ok := range map[string]bool{
+		"abc-123":                   true,
+		"has space":                 false,
+		"has\"quote":                false,
+		string(make([]byte, 65)):    false,
+		"7a1c0f7e-2b0b-4c55-9aa4-1": true,
+	} {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set(requestIDHeader, given)
+		h.ServeHTTP(httptest.NewRecorder(), req)
+		assert.Equal(t, ok, id == given, "%q", given)
+	}
+}
+
+func TestLogRequests(t *testing.T) {
+	// The handler that identifies the user is between the logger and the one that responds.
+	handler := func(status int, body string) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			noteUser(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				rw.WriteHeader(status)
+				_, _ = rw.Write([]byte(body))
+			})).ServeHTTP(rw, req.WithContext(WithUser(req.Context(), "alice")))
+		})
+	}
+
+	t.Run("Zap", func(t *testing.T) {
+		core, logs := observer.New(zap.InfoLevel)
+		h := withRequestID(logRequests(zap.New(core), nil, handler(http.StatusNotFound, "not found")))
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/books/?q=1", nil))
+
+		entries := logs.All()
+		if assert.Len(t, entries, 1) {
+			fields := entries[0].ContextMap()
+			assert.Equal(t, "alice", fields["user"])
+			assert.Equal(t, "GET", fields["method"])
+			assert.Equal(t, "/books/?q=1", fields["uri"])
+			assert.Equal(t, int64(http.StatusNotFound), fields["status"])
+			assert.Equal(t, int64(9), fields["size"])
+			assert.Len(t, fields["id"], 16)
+		}
+	})
+
+	t.Run("Combined", func(t *testing.T) {
+		var buf bytes.Buffer
+		h := logRequests(zap.NewNop(), &buf, handler(http.StatusOK, "hello"))
+		req := httptest.NewRequest("GET", "/books/", nil)
+		req.Header.Set("User-Agent", `Evil "Agent"`)
+		h.ServeHTTP(httptest.NewRecorder(), req)
+		assert.Regexp(t, regexp.MustCompile(
+			`^192\.0\.2\.1 - alice \[\d{2}/\w{3}/\d{4}:\d{2}:\d{2}:\d{2} [+-]\d{4}\] "GET /books/ HTTP/1\.1" 200 5 "" "Evil \\"Agent\\""\n$`,
+		), buf.String())
+	})
+}
@@ -0,0 +1,250 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+
+	"go.uber.org/zap"
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/liclac/sharlayan/config"
+)
+
+// Query parameter and cookie share tokens are passed in.
+const (
+	tokenParam  = "token"
+	tokenCookie = "sharlayan_token"
+)
+
+// Compared against when a user doesn't exist, so failed logins take the same amount of time
+// whether the user exists or not. This is the bcrypt hash of an empty string.
+var dummyHash = []byte("$2a$10$Wtvu5rcksmw/EIwklONbou3NguOHPxvdkw4dsNx03nJOaifD3h64.")
+
+// Works out who's making a request, and puts it in the request's context (see WithUser). Users
+// can be identified, in order of precedence, by:
+//
+//   - A header set by a trusted reverse proxy, eg. X-Remote-User.
+//   - HTTP Basic auth, with passwords from users.*.password or an htpasswd file.
+//   - A share token, from a link's query string, or a cookie set when following one.
+//
+// Anyone else is anonymous, if that's allowed.
+type httpAuth struct {
+	L   *zap.Logger
+	cfg *config.Config
+
+	passwords map[string][]byte // bcrypt hashes, by username.
+	proxies   []*net.IPNet      // Trusted to set ProxyHeader.
+	proxyUnix bool              // Whether anything on a Unix socket may set ProxyHeader.
+	tokens    *ShareTokens      // If share tokens are enabled.
+}
+
+func newHTTPAuth(L *zap.Logger, cfg *config.Config) (*httpAuth, error) {
+	a := &httpAuth{L: L, cfg: cfg, passwords: make(map[string][]byte)}
+	if cfg.HTTP.Auth.Basic {
+		for name, user := range cfg.Users {
+			if user.Password != "" {
+				a.passwords[name] = []byte(user.Password)
+			}
+		}
+		if path := cfg.HTTP.Auth.Htpasswd; path != "" {
+			data, err := ioutil.ReadFile(path)
+			if err != nil {
+				return nil, fmt.Errorf("auth: %w", err)
+			}
+			hashes, err := parseHtpasswd(data)
+			if err != nil {
+				return nil, fmt.Errorf("auth: %s: %w", path, err)
+			}
+			for name, hash := range hashes {
+				if _, ok := a.passwords[name]; ok {
+					return nil, fmt.Errorf("auth: %s: %s already has a password in users.%s.password", path, name, name)
+				}
+				a.passwords[name] = hash
+			}
+			L.Debug("Loaded htpasswd", zap.String("path", path), zap.Int("num", len(hashes)))
+		}
+	}
+	if cfg.HTTP.Auth.ProxyHeader != "" {
+		for _, s := range cfg.HTTP.Auth.TrustedProxies {
+			if s == "unix" {
+				a.proxyUnix = true
+				continue
+			}
+			if !strings.Contains(s, "/") {
+				if ip := net.ParseIP(s); ip != nil && ip.To4() != nil {
+					s += "/32"
+				} else {
+					s += "/128"
+				}
+			}
+			_, ipnet, err := net.ParseCIDR(s)
+			if err != nil {
+				return nil, fmt.Errorf("auth: trusted proxy: %w", err)
+			}
+			a.proxies = append(a.proxies, ipnet)
+		}
+	}
+	if cfg.HTTP.Auth.Tokens {
+		tokens, err := LoadOrGenerateShareTokens(cfg)
+		if err != nil {
+			return nil, err
+		}
+		a.tokens = tokens
+	}
+	return a, nil
+}
+
+// Parses an htpasswd file, eg. from `htpasswd -nB`. Only bcrypt hashes are supported; the
+// other formats htpasswd can write are far too easy to crack.
+func parseHtpasswd(data []byte) (map[string][]byte, error) {
+	hashes := make(map[string][]byte)
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("line %d: expected user:hash", n)
+		}
+		if _, err := bcrypt.Cost([]byte(parts[1])); err != nil {
+			return nil, fmt.Errorf("line %d: %s: not a bcrypt hash (use `htpasswd -B`)", n, parts[0])
+		}
+		hashes[parts[0]] = []byte(parts[1])
+	}
+	return hashes, sc.Err()
+}
+
+// Wraps a handler, which will only be called for requests from someone who's allowed in.
+func (a *httpAuth) Wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		L := a.L.With(zap.String("addr", req.RemoteAddr))
+
+		// Trusted reverse proxies have already logged the user in.
+		if user := a.proxyUser(L, req); user != "" {
+			next.ServeHTTP(rw, req.WithContext(WithUser(req.Context(), user)))
+			return
+		}
+
+		// Basic auth; a wrong password is an error, rather than falling back to anonymous.
+		if name, password, ok := req.BasicAuth(); ok && a.cfg.HTTP.Auth.Basic {
+			if err := a.checkPassword(name, password); err != nil {
+				L.Info("Auth Failure", zap.String("user", name), zap.String("method", "basic"), zap.Error(err))
+				a.challenge(rw)
+				return
+			}
+			next.ServeHTTP(rw, req.WithContext(WithUser(req.Context(), name)))
+			return
+		}
+
+		// Share links carry a token in the query string. Put it in a cookie, and redirect to
+		// the same URL without it, so it stays out of bookmarks, history and Referer headers.
+		if token := req.URL.Query().Get(tokenParam); token != "" && a.tokens != nil {
+			user, err := a.tokens.Verify(token)
+			if err != nil {
+				L.Info("Auth Failure", zap.String("method", "token"), zap.Error(err))
+				http.Error(rw, "This link is invalid or has expired.", http.StatusForbidden)
+				return
+			}
+			L.Info("Auth Success", zap.String("user", user), zap.String("method", "token"))
+			http.SetCookie(rw, &http.Cookie{
+				Name:     tokenCookie,
+				Value:    token,
+				Path:     "/",
+				Secure:   req.TLS != nil,
+				HttpOnly: true,
+				SameSite: http.SameSiteLaxMode,
+			})
+			q := req.URL.Query()
+			q.Del(tokenParam)
+			http.Redirect(rw, req, (&url.URL{Path: localPath(req.URL.Path), RawQuery: q.Encode()}).String(), http.StatusFound)
+			return
+		}
+		if c, err := req.Cookie(tokenCookie); err == nil && a.tokens != nil {
+			if user, err := a.tokens.Verify(c.Value); err == nil {
+				next.ServeHTTP(rw, req.WithContext(WithUser(req.Context(), user)))
+				return
+			}
+			// Probably expired; forget it, and carry on as if it wasn't there.
+			http.SetCookie(rw, &http.Cookie{Name: tokenCookie, Path: "/", MaxAge: -1})
+		}
+
+		if !a.cfg.HTTP.Auth.Anonymous {
+			a.challenge(rw)
+			return
+		}
+		next.ServeHTTP(rw, req.WithContext(WithUser(req.Context(), "")))
+	})
+}
+
+// Cleans a request path for redirecting to, keeping a trailing slash. Leading slashes (and
+// backslashes, which browsers treat the same) are collapsed, so "//evil.example/x" can't turn
+// into a link to another site.
+func localPath(p string) string {
+	clean := "/" + strings.TrimLeft(path.Clean(p), "/\\")
+	if strings.HasSuffix(p, "/") && clean != "/" {
+		clean += "/"
+	}
+	return clean
+}
+
+// Returns the user set by a trusted reverse proxy, if any.
+func (a *httpAuth) proxyUser(L *zap.Logger, req *http.Request) string {
+	header := a.cfg.HTTP.Auth.ProxyHeader
+	if header == "" {
+		return ""
+	}
+	user := req.Header.Get(header)
+	if user == "" {
+		return ""
+	}
+	if isUnixRequest(req) {
+		// There's no address to check; the socket's permissions decide who can connect.
+		if a.proxyUnix {
+			return user
+		}
+	} else if host, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+		ip := net.ParseIP(host)
+		for _, ipnet := range a.proxies {
+			if ip != nil && ipnet.Contains(ip) {
+				return user
+			}
+		}
+	}
+	L.Warn("Ignoring user header from untrusted address", zap.String("header", header),
+		zap.String("user", user), zap.String("addr", req.RemoteAddr))
+	return ""
+}
+
+// Returns whether a request came in over a Unix socket; see Listen.
+func isUnixRequest(req *http.Request) bool {
+	_, ok := req.Context().Value(http.LocalAddrContextKey).(*net.UnixAddr)
+	return ok
+}
+
+func (a *httpAuth) checkPassword(name, password string) error {
+	hash, ok := a.passwords[name]
+	if !ok {
+		_ = bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+		return fmt.Errorf("no password set for %s", name)
+	}
+	return bcrypt.CompareHashAndPassword(hash, []byte(password))
+}
+
+// Asks the client to log in, if it can; otherwise just says no.
+func (a *httpAuth) challenge(rw http.ResponseWriter) {
+	if !a.cfg.HTTP.Auth.Basic {
+		http.Error(rw, "Forbidden", http.StatusForbidden)
+		return
+	}
+	rw.Header().Set("WWW-Authenticate", fmt.Sprintf("Basic realm=%q, charset=\"UTF-8\"", a.cfg.HTML.Title))
+	http.Error(rw, "Unauthorized", http.StatusUnauthorized)
+}
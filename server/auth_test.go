@@ -0,0 +1,250 @@
+package server
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/liclac/sharlayan/config"
+)
+
+func TestShareTokens(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	tokens := NewShareTokens([]byte("0123456789abcdef0123456789abcdef"))
+	tokens.now = func() time.Time { return now }
+
+	user, err := tokens.Verify(tokens.Sign("alice", time.Time{}))
+	require.NoError(t, err)
+	assert.Equal(t, "alice", user)
+
+	user, err = tokens.Verify(tokens.Sign("alice", now.Add(time.Hour)))
+	require.NoError(t, err)
+	assert.Equal(t, "alice", user)
+
+	_, err = tokens.Verify(tokens.Sign("alice", now))
+	assert.Equal(t, errTokenExpired, err)
+
+	other := NewShareTokens([]byte("fedcba9876543210fedcba9876543210"))
+	for _, token := range []string{"", "garbage", "a.b", other.Sign("alice", time.Time{})} {
+		_, err := tokens.Verify(token)
+		assert.Equal(t, errTokenInvalid, err, token)
+	}
+
+	t.Run("LoadOrGenerate", func(t *testing.T) {
+		cfg := &config.Config{}
+		cfg.Config.Dir = t.TempDir()
+		t1, err := LoadOrGenerateShareTokens(cfg)
+		require.NoError(t, err)
+		assert.FileExists(t, filepath.Join(cfg.Config.Dir, "token_secret"))
+		t2, err := LoadOrGenerateShareTokens(cfg)
+		require.NoError(t, err)
+		user, err := t2.Verify(t1.Sign("bob", time.Time{}))
+		require.NoError(t, err)
+		assert.Equal(t, "bob", user)
+	})
+}
+
+func TestParseHtpasswd(t *testing.T) {
+	hashes, err := parseHtpasswd([]byte("# Comment\n\nalice:$2y$05$Kw0aDf8nF0fJ7ueQNOgVO.bVlXkzd3mjgjRWKMsQtLdPBkShOr4VK\n"))
+	require.NoError(t, err)
+	assert.Contains(t, hashes, "alice")
+
+	_, err = parseHtpasswd([]byte("bob:$apr1$abcdefgh$abcdefghijklmnopqrstuv\n"))
+	assert.EqualError(t, err, "line 1: bob: not a bcrypt hash (use `htpasswd -B`)")
+	_, err = parseHtpasswd([]byte("bob\n"))
+	assert.EqualError(t, err, "line 1: expected user:hash")
+}
+
+func TestHTTPAuth(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("hunter2"), bcrypt.MinCost)
+	require.NoError(t, err)
+
+	testdata := map[string]struct {
+		configure func(cfg *config.Config)
+		request   func(req *http.Request, tokens *ShareTokens)
+		code      int    // Expected status.
+		user      string // Expected user, if code is 200.
+	}{
+		"Anonymous": {nil, nil, http.StatusOK, ""},
+		"Anonymous/Disabled": {
+			func(cfg *config.Config) { cfg.HTTP.Auth.Anonymous = false },
+			nil, http.StatusForbidden, "",
+		},
+		"Anonymous/Disabled/Basic": {
+			func(cfg *config.Config) { cfg.HTTP.Auth.Anonymous = false; cfg.HTTP.Auth.Basic = true },
+			nil, http.StatusUnauthorized, "",
+		},
+		"Basic": {
+			func(cfg *config.Config) { cfg.HTTP.Auth.Basic = true },
+			func(req *http.Request, _ *ShareTokens) { req.SetBasicAuth("alice", "hunter2") },
+			http.StatusOK, "alice",
+		},
+		"Basic/WrongPassword": {
+			func(cfg *config.Config) { cfg.HTTP.Auth.Basic = true },
+			func(req *http.Request, _ *ShareTokens) { req.SetBasicAuth("alice", "hunter3") },
+			http.StatusUnauthorized, "",
+		},
+		"Basic/UnknownUser": {
+			func(cfg *config.Config) { cfg.HTTP.Auth.Basic = true },
+			func(req *http.Request, _ *ShareTokens) { req.SetBasicAuth("mallory", "hunter2") },
+			http.StatusUnauthorized, "",
+		},
+		"Basic/Disabled": {
+			nil,
+			func(req *http.Request, _ *ShareTokens) { req.SetBasicAuth("alice", "hunter2") },
+			http.StatusOK, "",
+		},
+		"Proxy": {
+			func(cfg *config.Config) { cfg.HTTP.Auth.ProxyHeader = "X-Remote-User" },
+			func(req *http.Request, _ *ShareTokens) { req.Header.Set("X-Remote-User", "bob") },
+			http.StatusOK, "bob",
+		},
+		"Proxy/Untrusted": {
+			func(cfg *config.Config) {
+				cfg.HTTP.Auth.ProxyHeader = "X-Remote-User"
+				cfg.HTTP.Auth.TrustedProxies = []string{"10.0.0.0/8"}
+			},
+			func(req *http.Request, _ *ShareTokens) { req.Header.Set("X-Remote-User", "bob") },
+			http.StatusOK, "",
+		},
+		"Token/Cookie": {
+			func(cfg *config.Config) { cfg.HTTP.Auth.Tokens = true },
+			func(req *http.Request, tokens *ShareTokens) {
+				req.AddCookie(&http.Cookie{Name: tokenCookie, Value: tokens.Sign("carol", time.Time{})})
+			},
+			http.StatusOK, "carol",
+		},
+		"Token/Cookie/Expired": {
+			func(cfg *config.Config) { cfg.HTTP.Auth.Tokens = true },
+			func(req *http.Request, tokens *ShareTokens) {
+				req.AddCookie(&http.Cookie{Name: tokenCookie, Value: tokens.Sign("carol", time.Now().Add(-time.Hour))})
+			},
+			http.StatusOK, "",
+		},
+		"Token/Query/Invalid": {
+			func(cfg *config.Config) { cfg.HTTP.Auth.Tokens = true },
+			func(req *http.Request, _ *ShareTokens) { req.URL.RawQuery = "token=garbage" },
+			http.StatusForbidden, "",
+		},
+		"Token/Disabled": {
+			nil,
+			func(req *http.Request, _ *ShareTokens) { req.URL.RawQuery = "token=garbage" },
+			http.StatusOK, "",
+		},
+	}
+	for name, tdata := range testdata {
+		t.Run(name, func(t *testing.T) {
+			cfg := &config.Config{Users: map[string]config.User{"alice": {Password: string(hash)}}}
+			cfg.Config.Dir = t.TempDir()
+			cfg.HTTP.Auth.Anonymous = true
+			cfg.HTTP.Auth.TrustedProxies = []string{"192.0.2.1"} // httptest's RemoteAddr.
+			if tdata.configure != nil {
+				tdata.configure(cfg)
+			}
+			auth, err := newHTTPAuth(zap.NewNop(), cfg)
+			require.NoError(t, err)
+
+			user := "(not called)"
+			h := auth.Wrap(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				user = UserFromContext(req.Context())
+			}))
+			req := httptest.NewRequest("GET", "/books/", nil)
+			if tdata.request != nil {
+				tdata.request(req, auth.tokens)
+			}
+			rw := httptest.NewRecorder()
+			h.ServeHTTP(rw, req)
+			assert.Equal(t, tdata.code, rw.Code)
+			if tdata.code == http.StatusOK {
+				assert.Equal(t, tdata.user, user)
+			} else {
+				assert.Equal(t, "(not called)", user)
+			}
+			if tdata.code == http.StatusUnauthorized {
+				assert.NotEmpty(t, rw.Header().Get("WWW-Authenticate"))
+			}
+		})
+	}
+
+	t.Run("Token/Query", func(t *testing.T) {
+		cfg := &config.Config{}
+		cfg.Config.Dir = t.TempDir()
+		cfg.HTTP.Auth.Tokens = true
+		auth, err := newHTTPAuth(zap.NewNop(), cfg)
+		require.NoError(t, err)
+		token := auth.tokens.Sign("carol", time.Time{})
+
+		rw := httptest.NewRecorder()
+		auth.Wrap(http.NotFoundHandler()).ServeHTTP(rw,
+			httptest.NewRequest("GET", "/books/?sort=title&token="+token, nil))
+		assert.Equal(t, http.StatusFound, rw.Code)
+		assert.Equal(t, "/books/?sort=title", rw.Header().Get("Location"))
+		cookies := rw.Result().Cookies()
+		require.Len(t, cookies, 1)
+		assert.Equal(t, tokenCookie, cookies[0].Name)
+		assert.Equal(t, token, cookies[0].Value)
+		assert.True(t, cookies[0].HttpOnly)
+
+		for p, location := range map[string]string{
+			"//evil.example/x":  "/evil.example/x",
+			"/\\evil.example/x": "/evil.example/x",
+			"/books/../x":       "/x",
+			"///":               "/",
+		} {
+			rw := httptest.NewRecorder()
+			req := httptest.NewRequest("GET", "/", nil)
+			req.URL.Path, req.URL.RawQuery = p, "token="+token
+			auth.Wrap(http.NotFoundHandler()).ServeHTTP(rw, req)
+			assert.Equal(t, http.StatusFound, rw.Code, p)
+			assert.Equal(t, location, rw.Header().Get("Location"), p)
+		}
+	})
+}
+
+func TestHTTPAuthProxyUnix(t *testing.T) {
+	for proxies, user := range map[string]string{"unix": "bob", "127.0.0.1": ""} {
+		t.Run(proxies, func(t *testing.T) {
+			cfg := &config.Config{}
+			cfg.HTTP.Auth.Anonymous = true
+			cfg.HTTP.Auth.ProxyHeader = "X-Remote-User"
+			cfg.HTTP.Auth.TrustedProxies = []string{proxies}
+			auth, err := newHTTPAuth(zap.NewNop(), cfg)
+			require.NoError(t, err)
+
+			path := filepath.Join(t.TempDir(), "http.sock")
+			l, err := Listen(context.Background(), cfg, "unix:"+path)
+			require.NoError(t, err)
+			srv := &http.Server{Handler: auth.Wrap(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				_, _ = io.WriteString(rw, UserFromContext(req.Context()))
+			}))}
+			go func() { _ = srv.Serve(l) }()
+			defer srv.Close()
+
+			client := &http.Client{Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					return (&net.Dialer{}).DialContext(ctx, "unix", path)
+				},
+			}}
+			req, err := http.NewRequest("GET", "http://localhost/books/", nil)
+			require.NoError(t, err)
+			req.Header.Set("X-Remote-User", "bob")
+			resp, err := client.Do(req)
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			body, err := ioutil.ReadAll(resp.Body)
+			require.NoError(t, err)
+			assert.Equal(t, user, string(body))
+		})
+	}
+}
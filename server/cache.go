@@ -0,0 +1,98 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/spf13/afero"
+
+	"github.com/liclac/sharlayan/calibre"
+	"github.com/liclac/sharlayan/config"
+)
+
+// Returns an ETag for a file, from its size and modification time. Pages are stamped with
+// the time they were rendered, or their book's last modification (see html.Builder), and book
+// files with their time on disk. It's weak if the response may be compressed, which changes
+// the bytes; book files need a strong one, or clients can't resume downloads with If-Range.
+func etag(info os.FileInfo, weak bool) string {
+	tag := fmt.Sprintf(`"%x-%x"`, info.Size(), info.ModTime().UnixNano())
+	if weak {
+		return "W/" + tag
+	}
+	return tag
+}
+
+// Sets an ETag for the file a request is for, which http.FileServer then checks against
+// If-None-Match and If-Range; it already does Last-Modified on its own.
+func withETag(fs afero.Fs, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		p := path.Clean("/" + req.URL.Path)
+		info, err := fs.Stat(p)
+		if err == nil && info.IsDir() {
+			info, err = fs.Stat(path.Join(p, "index.html"))
+		}
+		if err == nil && !info.IsDir() {
+			typ := calibre.FormatMIMEType(path.Ext(info.Name()))
+			rw.Header().Set("ETag", etag(info, typ == "" || compressible(typ)))
+		}
+		next.ServeHTTP(rw, req)
+	})
+}
+
+// Sets Cache-Control from the first rule matching a request's path, if any. Responses for
+// logged-in users are always private, so shared caches don't give them to anyone else.
+func withCacheControl(rules []config.CacheRule, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if cc := cacheControl(rules, req.URL.Path); cc != "" {
+			if UserFromContext(req.Context()) != "" {
+				cc = privateCacheControl(cc)
+			}
+			rw.Header().Set("Cache-Control", cc)
+		}
+		next.ServeHTTP(rw, req)
+	})
+}
+
+// Makes a Cache-Control value private, unless it's already private or no-store.
+func privateCacheControl(cc string) string {
+	directives := []string{"private"}
+	for _, d := range strings.Split(cc, ",") {
+		switch d = strings.TrimSpace(d); d {
+		case "private", "no-store":
+			return cc
+		case "public", "":
+		default:
+			directives = append(directives, d)
+		}
+	}
+	return strings.Join(directives, ", ")
+}
+
+// Returns the Cache-Control value for a path. Patterns are as in path.Match, except that a
+// pattern ending in "/" matches everything under it, eg. "/books/" or "/books/*/".
+func cacheControl(rules []config.CacheRule, p string) string {
+	for _, rule := range rules {
+		if cacheRuleMatches(rule.Path, p) {
+			return rule.Control
+		}
+	}
+	return ""
+}
+
+func cacheRuleMatches(pattern, p string) bool {
+	if !strings.HasSuffix(pattern, "/") {
+		ok, _ := path.Match(pattern, p)
+		return ok
+	}
+	// Match the pattern against each of the path's parent directories.
+	depth := strings.Count(pattern, "/")
+	parts := strings.SplitAfter(p, "/")
+	if len(parts) < depth {
+		return false
+	}
+	ok, _ := path.Match(pattern, strings.Join(parts[:depth], ""))
+	return ok
+}
@@ -0,0 +1,80 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/liclac/sharlayan/config"
+)
+
+func TestCacheControl(t *testing.T) {
+	rules := []config.CacheRule{
+		{Path: "/books/*/*.epub", Control: "public, max-age=86400"},
+		{Path: "/books/*/", Control: "no-cache"},
+		{Path: "/static/", Control: "public, max-age=3600, immutable"},
+	}
+	testdata := map[string]string{
+		"/":                   "",
+		"/index.html":         "",
+		"/books/":             "",
+		"/books/1/":           "no-cache",
+		"/books/1/index.html": "no-cache",
+		"/books/1/book.epub":  "public, max-age=86400",
+		"/books/1/book.pdf":   "no-cache",
+		"/static/style.css":   "public, max-age=3600, immutable",
+		"/static/a/b/c.png":   "public, max-age=3600, immutable",
+		"/staticky":           "",
+	}
+	for p, cc := range testdata {
+		t.Run(p, func(t *testing.T) {
+			assert.Equal(t, cc, cacheControl(rules, p))
+		})
+	}
+
+	t.Run("Private", func(t *testing.T) {
+		assert.Equal(t, "private, max-age=60", privateCacheControl("public, max-age=60"))
+		assert.Equal(t, "private, no-cache", privateCacheControl("no-cache"))
+		assert.Equal(t, "no-store", privateCacheControl("no-store"))
+		assert.Equal(t, "private", privateCacheControl("private"))
+
+		h := withCacheControl(rules, http.NotFoundHandler())
+		req := httptest.NewRequest("GET", "/static/style.css", nil)
+		rw := httptest.NewRecorder()
+		h.ServeHTTP(rw, req.WithContext(WithUser(req.Context(), "alice")))
+		assert.Equal(t, "private, max-age=3600, immutable", rw.Header().Get("Cache-Control"))
+	})
+}
+
+func TestETag(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	require.NoError(t, afero.WriteFile(fs, "/books/1/index.html", []byte("<p>Hi</p>"), 0644))
+	mtime := time.Date(2020, 5, 1, 12, 0, 0, 0, time.UTC)
+	require.NoError(t, fs.Chtimes("/books/1/index.html", mtime, mtime))
+	h := withETag(fs, http.FileServer(afero.NewHttpFs(fs)))
+
+	rw := httptest.NewRecorder()
+	h.ServeHTTP(rw, httptest.NewRequest("GET", "/books/1/", nil))
+	require.Equal(t, http.StatusOK, rw.Code)
+	tag := rw.Header().Get("ETag")
+	assert.Regexp(t, `^W/"9-[0-9a-f]+"$`, tag)
+	assert.Equal(t, mtime.Format(http.TimeFormat), rw.Header().Get("Last-Modified"))
+
+	// The ETag is the same for the page, and the directory it's the index of.
+	rw = httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/books/1/", nil)
+	req.Header.Set("If-None-Match", tag)
+	h.ServeHTTP(rw, req)
+	assert.Equal(t, http.StatusNotModified, rw.Code)
+
+	rw = httptest.NewRecorder()
+	req = httptest.NewRequest("GET", "/books/1/", nil)
+	req.Header.Set("If-None-Match", `W/"other"`)
+	h.ServeHTTP(rw, req)
+	assert.Equal(t, http.StatusOK, rw.Code)
+}
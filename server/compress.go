@@ -0,0 +1,165 @@
+package server
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/andybalholm/brotli"
+)
+
+// Responses smaller than this aren't worth compressing.
+const compressMinSize = 512
+
+// Content types worth compressing; books and images are already compressed.
+var compressibleTypes = map[string]bool{
+	"text/html":              true,
+	"text/css":               true,
+	"text/plain":             true,
+	"text/xml":               true,
+	"text/javascript":        true,
+	"application/javascript": true,
+	"application/json":       true,
+	"application/xml":        true,
+	"application/atom+xml":   true,
+	"application/rss+xml":    true,
+	"image/svg+xml":          true,
+}
+
+func compressible(contentType string) bool {
+	typ, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	return compressibleTypes[typ] || strings.HasSuffix(typ, "+json") || strings.HasSuffix(typ, "+xml")
+}
+
+var (
+	gzipWriters   = sync.Pool{New: func() interface{} { return gzip.NewWriter(nil) }}
+	brotliWriters = sync.Pool{New: func() interface{} { return brotli.NewWriterLevel(nil, 5) }}
+)
+
+// Picks the best encoding the client accepts: "br", "gzip", or "" for none.
+func negotiateEncoding(acceptEncoding string) string {
+	var gz bool
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		name, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		if q, ok := params["q"]; ok {
+			if f, err := strconv.ParseFloat(q, 64); err != nil || f <= 0 {
+				continue
+			}
+		}
+		switch name {
+		case "br":
+			return "br"
+		case "gzip":
+			gz = true
+		}
+	}
+	if gz {
+		return "gzip"
+	}
+	return ""
+}
+
+// Compresses text responses with brotli or gzip, if the client accepts either. Anything that
+// isn't a plain 200 response (eg. ranges, errors) is left alone.
+func compress(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		cw := &compressResponseWriter{ResponseWriter: rw, encoding: negotiateEncoding(req.Header.Get("Accept-Encoding"))}
+		defer cw.Close()
+		next.ServeHTTP(cw, req)
+	})
+}
+
+type compressResponseWriter struct {
+	http.ResponseWriter
+	encoding string // What the client accepts.
+
+	wroteHeader bool
+	w           io.WriteCloser // Compressor, if compressing.
+	release     func()         // Returns w to its pool.
+}
+
+func (w *compressResponseWriter) WriteHeader(status int) {
+	if w.wroteHeader {
+		w.ResponseWriter.WriteHeader(status)
+		return
+	}
+	w.wroteHeader = true
+
+	h := w.Header()
+	if status == http.StatusOK && h.Get("Content-Encoding") == "" && compressible(h.Get("Content-Type")) {
+		h.Add("Vary", "Accept-Encoding")
+		size, err := strconv.ParseInt(h.Get("Content-Length"), 10, 64)
+		if w.encoding != "" && (err != nil || size >= compressMinSize) {
+			h.Set("Content-Encoding", w.encoding)
+			h.Del("Content-Length")
+			w.start()
+		}
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *compressResponseWriter) start() {
+	switch w.encoding {
+	case "br":
+		bw := brotliWriters.Get().(*brotli.Writer)
+		bw.Reset(w.ResponseWriter)
+		w.w, w.release = bw, func() { brotliWriters.Put(bw) }
+	case "gzip":
+		gw := gzipWriters.Get().(*gzip.Writer)
+		gw.Reset(w.ResponseWriter)
+		w.w, w.release = gw, func() { gzipWriters.Put(gw) }
+	}
+}
+
+func (w *compressResponseWriter) Write(data []byte) (int, error) {
+	if !w.wroteHeader {
+		if w.Header().Get("Content-Type") == "" {
+			w.Header().Set("Content-Type", http.DetectContentType(data))
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.w != nil {
+		return w.w.Write(data)
+	}
+	return w.ResponseWriter.Write(data)
+}
+
+// Finishes the compressed stream, if there is one.
+func (w *compressResponseWriter) Close() error {
+	if w.w == nil {
+		return nil
+	}
+	err := w.w.Close()
+	w.release()
+	w.w = nil
+	return err
+}
+
+func (w *compressResponseWriter) Flush() {
+	if f, ok := w.w.(interface{ Flush() error }); ok {
+		_ = f.Flush()
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *compressResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if h, ok := w.ResponseWriter.(http.Hijacker); ok {
+		return h.Hijack()
+	}
+	return nil, nil, fmt.Errorf("http: response can't be hijacked")
+}
@@ -0,0 +1,112 @@
+package server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNegotiateEncoding(t *testing.T) {
+	testdata := map[string]string{
+		"":                     "",
+		"identity":             "",
+		"gzip":                 "gzip",
+		"gzip, deflate, br":    "br",
+		"br;q=0, gzip":         "gzip",
+		"gzip;q=0":             "",
+		"deflate, gzip;q=0.5":  "gzip",
+		"br;q=0.1, gzip;q=1.0": "br",
+	}
+	for accept, encoding := range testdata {
+		t.Run(accept, func(t *testing.T) {
+			assert.Equal(t, encoding, negotiateEncoding(accept))
+		})
+	}
+}
+
+func TestCompress(t *testing.T) {
+	page := strings.Repeat("<p>Hello, world!</p>\n", 100)
+	testdata := map[string]struct {
+		accept      string
+		contentType string
+		body        string
+		status      int
+		encoding    string // Expected Content-Encoding.
+	}{
+		"HTML/None":   {"", "text/html; charset=utf-8", page, http.StatusOK, ""},
+		"HTML/Gzip":   {"gzip", "text/html; charset=utf-8", page, http.StatusOK, "gzip"},
+		"HTML/Brotli": {"gzip, br", "text/html; charset=utf-8", page, http.StatusOK, "br"},
+		"JSON":        {"gzip", "application/json", page, http.StatusOK, "gzip"},
+		"Atom":        {"gzip", "application/atom+xml", page, http.StatusOK, "gzip"},
+		"EPUB":        {"gzip", "application/epub+zip", page, http.StatusOK, ""},
+		"Small":       {"gzip", "text/html; charset=utf-8", "<p>Hi</p>", http.StatusOK, ""},
+		"Partial":     {"gzip", "text/html; charset=utf-8", page, http.StatusPartialContent, ""},
+		"Sniffed":     {"gzip", "", "<!DOCTYPE html>" + page, http.StatusOK, "gzip"},
+	}
+	for name, tdata := range testdata {
+		t.Run(name, func(t *testing.T) {
+			h := compress(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				if tdata.contentType != "" {
+					rw.Header().Set("Content-Type", tdata.contentType)
+					rw.Header().Set("Content-Length", strconv.Itoa(len(tdata.body)))
+					rw.WriteHeader(tdata.status)
+				}
+				_, _ = rw.Write([]byte(tdata.body))
+			}))
+			req := httptest.NewRequest("GET", "/", nil)
+			req.Header.Set("Accept-Encoding", tdata.accept)
+			rw := httptest.NewRecorder()
+			h.ServeHTTP(rw, req)
+
+			assert.Equal(t, tdata.status, rw.Code)
+			assert.Equal(t, tdata.encoding, rw.Header().Get("Content-Encoding"))
+			var body []byte
+			var err error
+			switch tdata.encoding {
+			case "gzip":
+				assert.Empty(t, rw.Header().Get("Content-Length"))
+				zr, zerr := gzip.NewReader(rw.Body)
+				require.NoError(t, zerr)
+				body, err = ioutil.ReadAll(zr)
+			case "br":
+				body, err = ioutil.ReadAll(brotli.NewReader(rw.Body))
+			default:
+				body, err = ioutil.ReadAll(rw.Body)
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tdata.body, string(body))
+			if tdata.encoding != "" {
+				assert.Less(t, rw.Body.Len(), len(tdata.body))
+			}
+		})
+	}
+
+	t.Run("Pooled", func(t *testing.T) {
+		// Writers are reused; make sure nothing leaks from one response into the next.
+		for i := 0; i < 3; i++ {
+			body := strings.Repeat(string(rune('a'+i)), 1000)
+			h := compress(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				rw.Header().Set("Content-Type", "text/plain")
+				_, _ = rw.Write([]byte(body))
+			}))
+			req := httptest.NewRequest("GET", "/", nil)
+			req.Header.Set("Accept-Encoding", "gzip")
+			rw := httptest.NewRecorder()
+			h.ServeHTTP(rw, req)
+			zr, err := gzip.NewReader(bytes.NewReader(rw.Body.Bytes()))
+			require.NoError(t, err)
+			data, err := ioutil.ReadAll(zr)
+			require.NoError(t, err)
+			assert.Equal(t, body, string(data))
+		}
+	})
+}
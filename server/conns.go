@@ -0,0 +1,102 @@
+package server
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Keeps track of open connections, for servers that don't have an http.Server to do it for
+// them, so responses in progress can finish when shutting down. The zero value is ready to use.
+type connTracker struct {
+	mu      sync.Mutex
+	conns   map[net.Conn]struct{}
+	closing bool
+	wg      sync.WaitGroup
+}
+
+// Accepts connections and handles each in its own goroutine, until the listener is closed.
+// Errors caused by the context being cancelled (which should close the listener) are ignored.
+func (t *connTracker) serve(ctx context.Context, l net.Listener, handle func(net.Conn)) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			select {
+			case <-ctx.Done():
+				return nil
+			default:
+				return err
+			}
+		}
+		if !t.track(conn) {
+			conn.Close()
+			continue
+		}
+		go func() {
+			defer t.untrack(conn)
+			defer conn.Close()
+			handle(conn)
+		}()
+	}
+}
+
+func (t *connTracker) track(conn net.Conn) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closing {
+		return false
+	}
+	if t.conns == nil {
+		t.conns = map[net.Conn]struct{}{}
+	}
+	t.conns[conn] = struct{}{}
+	t.wg.Add(1)
+	return true
+}
+
+func (t *connTracker) untrack(conn net.Conn) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.conns, conn)
+	t.wg.Done()
+}
+
+// Interrupts any reads in progress, eg. so sessions waiting for their next command notice that
+// we're shutting down, without cutting off responses being written.
+func (t *connTracker) interrupt() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for conn := range t.conns {
+		_ = conn.SetReadDeadline(time.Now())
+	}
+}
+
+// Waits up to the grace period for responses in progress to finish, then cuts them off.
+func (t *connTracker) shutdown(L *zap.Logger, grace time.Duration) {
+	t.mu.Lock()
+	t.closing = true
+	num := len(t.conns)
+	t.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		t.wg.Wait()
+		close(done)
+	}()
+	L.Info("Gracefully shutting down...", zap.Duration("timeout", grace), zap.Int("conns", num))
+	select {
+	case <-done:
+		return
+	case <-time.After(grace):
+	}
+	t.mu.Lock()
+	L.Warn("Grace period expired, closing connections", zap.Int("conns", len(t.conns)))
+	for conn := range t.conns {
+		conn.Close()
+	}
+	t.mu.Unlock()
+	<-done
+}
@@ -0,0 +1,83 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/afero"
+
+	"github.com/liclac/sharlayan/builder/tree"
+	"github.com/liclac/sharlayan/calibre"
+)
+
+// Sets the Content-Type for book files, which http.FileServer would otherwise guess from Go's
+// MIME table, and a Content-Disposition that names them like Calibre does (eg. "The Fifth
+// Elephant - Terry Pratchett.epub") rather than after their ID. Range requests, If-Range and
+// so on are left to http.FileServer.
+func withDownloadHeaders(fs afero.Fs, meta *calibre.Metadata, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		p := path.Clean("/" + req.URL.Path)
+		if typ := calibre.FormatMIMEType(path.Ext(p)); typ != "" {
+			if info, err := fs.Stat(p); err == nil && !info.IsDir() {
+				rw.Header().Set("Content-Type", typ)
+				if name := dataFilename(meta, p); name != "" {
+					rw.Header().Set("Content-Disposition", contentDisposition("attachment", name))
+				}
+			}
+		}
+		next.ServeHTTP(rw, req)
+	})
+}
+
+// Returns the name a book file has in the ByName scheme, given its path in the ByID scheme,
+// eg. "/books/4/4.epub" -> "The Fifth Elephant - Terry Pratchett.epub", or "" if the path
+// isn't a book file, or metadata isn't available.
+func dataFilename(meta *calibre.Metadata, p string) string {
+	if meta == nil {
+		return ""
+	}
+	parts := strings.Split(strings.TrimPrefix(p, "/"), "/")
+	if len(parts) != 3 || parts[0] != tree.BookDirInfo.ID {
+		return ""
+	}
+	id, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return ""
+	}
+	book := meta.GetBook(id)
+	if book == nil {
+		return ""
+	}
+	for _, data := range book.Data {
+		if info := tree.DataInfo(book, data); info.ID == parts[2] {
+			return info.Name
+		}
+	}
+	return ""
+}
+
+// Formats a Content-Disposition header, with an ASCII-only filename for old clients, and the
+// real one (RFC 6266) for everyone else.
+func contentDisposition(disposition, filename string) string {
+	fallback := strings.Map(func(r rune) rune {
+		if r < ' ' || r > '~' || r == '"' || r == '\\' || r == '%' {
+			return '_'
+		}
+		return r
+	}, filename)
+	if fallback == filename {
+		return fmt.Sprintf(`%s; filename="%s"`, disposition, filename)
+	}
+	var ext strings.Builder // RFC 5987 ext-value, escaping anything that isn't an attr-char.
+	for _, c := range []byte(filename) {
+		if c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.IndexByte("!#$&+-.^_`|~", c) >= 0 {
+			ext.WriteByte(c)
+		} else {
+			fmt.Fprintf(&ext, "%%%02X", c)
+		}
+	}
+	return fmt.Sprintf(`%s; filename="%s"; filename*=UTF-8''%s`, disposition, fallback, ext.String())
+}
@@ -0,0 +1,163 @@
+package server
+
+import (
+	"io/ioutil"
+	"math/rand"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/liclac/sharlayan/calibre"
+	"github.com/liclac/sharlayan/config"
+)
+
+// A filesystem with metadata, like acl.Views, but the same for everyone.
+type testMetaFs struct {
+	afero.Fs
+	meta *calibre.Metadata
+}
+
+func (fs testMetaFs) ForUser(string) (afero.Fs, error)                  { return fs.Fs, nil }
+func (fs testMetaFs) MetadataForUser(string) (*calibre.Metadata, error) { return fs.meta, nil }
+
+func TestContentDisposition(t *testing.T) {
+	testdata := map[string]string{
+		"book.epub": `attachment; filename="book.epub"`,
+		"The Fifth Elephant - Terry Pratchett.epub": `attachment; filename="The Fifth Elephant - Terry Pratchett.epub"`,
+		"Les Misérables - Victor Hugo.epub":         `attachment; filename="Les Mis_rables - Victor Hugo.epub"; filename*=UTF-8''Les%20Mis%C3%A9rables%20-%20Victor%20Hugo.epub`,
+		`Say "Hi"; 100%.pdf`:                        `attachment; filename="Say _Hi_; 100_.pdf"; filename*=UTF-8''Say%20%22Hi%22%3B%20100%25.pdf`,
+	}
+	for filename, header := range testdata {
+		t.Run(filename, func(t *testing.T) {
+			assert.Equal(t, header, contentDisposition("attachment", filename))
+			_, params, err := mime.ParseMediaType(header)
+			require.NoError(t, err)
+			assert.Equal(t, filename, params["filename"])
+		})
+	}
+}
+
+func TestDownloads(t *testing.T) {
+	// Big enough that http.FileServer can't just buffer it.
+	data := make([]byte, 4<<20)
+	rand.New(rand.NewSource(1)).Read(data)
+	fs := afero.NewMemMapFs()
+	require.NoError(t, afero.WriteFile(fs, "/books/1/1.epub", data, 0644))
+	require.NoError(t, afero.WriteFile(fs, "/books/1/1.azw3", data[:1000], 0644))
+	require.NoError(t, afero.WriteFile(fs, "/books/1/notes.txt", []byte("Hello"), 0644))
+	meta := &calibre.Metadata{Books: []*calibre.Book{{ID: 1, Title: "Les Misérables", Data: []*calibre.Data{
+		{Format: "EPUB", Name: "Les Misérables - Victor Hugo"},
+		{Format: "AZW3", Name: "Les Misérables - Victor Hugo"},
+	}}}}
+
+	cfg := &config.Config{}
+	h := compress(httpServer{zap.NewNop(), cfg}.handler(testMetaFs{fs, meta}))
+	get := func(path string, headers map[string]string) *http.Response {
+		req := httptest.NewRequest("GET", path, nil)
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		rw := httptest.NewRecorder()
+		h.ServeHTTP(rw, req)
+		return rw.Result()
+	}
+	body := func(resp *http.Response) []byte {
+		b, err := ioutil.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return b
+	}
+
+	t.Run("Full", func(t *testing.T) {
+		resp := get("/books/1/1.epub", map[string]string{"Accept-Encoding": "gzip, br"})
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "application/epub+zip", resp.Header.Get("Content-Type"))
+		assert.Equal(t, "bytes", resp.Header.Get("Accept-Ranges"))
+		assert.Equal(t, "", resp.Header.Get("Content-Encoding"), "books are already compressed")
+		_, params, err := mime.ParseMediaType(resp.Header.Get("Content-Disposition"))
+		require.NoError(t, err)
+		assert.Equal(t, "Les Misérables - Victor Hugo.epub", params["filename"])
+		assert.Equal(t, data, body(resp))
+	})
+	t.Run("AZW3", func(t *testing.T) {
+		resp := get("/books/1/1.azw3", nil)
+		assert.Equal(t, "application/vnd.amazon.mobi8-ebook", resp.Header.Get("Content-Type"))
+		_, params, err := mime.ParseMediaType(resp.Header.Get("Content-Disposition"))
+		require.NoError(t, err)
+		assert.Equal(t, "Les Misérables - Victor Hugo.azw3", params["filename"])
+	})
+	t.Run("NotABook", func(t *testing.T) {
+		resp := get("/books/1/notes.txt", nil)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "", resp.Header.Get("Content-Disposition"))
+	})
+	t.Run("Missing", func(t *testing.T) {
+		resp := get("/books/1/2.epub", nil)
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+		assert.Equal(t, "", resp.Header.Get("Content-Disposition"))
+	})
+
+	testdata := map[string]struct {
+		rng          string
+		contentRange string
+		start, end   int
+	}{
+		"Start":  {"bytes=0-99", "bytes 0-99/4194304", 0, 100},
+		"Middle": {"bytes=2097152-2098175", "bytes 2097152-2098175/4194304", 2097152, 2098176},
+		"Open":   {"bytes=4194000-", "bytes 4194000-4194303/4194304", 4194000, 4194304},
+		"Suffix": {"bytes=-100", "bytes 4194204-4194303/4194304", 4194204, 4194304},
+		"Past":   {"bytes=4194300-5000000", "bytes 4194300-4194303/4194304", 4194300, 4194304},
+	}
+	for name, tdata := range testdata {
+		t.Run("Range/"+name, func(t *testing.T) {
+			resp := get("/books/1/1.epub", map[string]string{"Range": tdata.rng, "Accept-Encoding": "gzip"})
+			assert.Equal(t, http.StatusPartialContent, resp.StatusCode)
+			assert.Equal(t, tdata.contentRange, resp.Header.Get("Content-Range"))
+			assert.Equal(t, "application/epub+zip", resp.Header.Get("Content-Type"))
+			assert.Equal(t, data[tdata.start:tdata.end], body(resp))
+		})
+	}
+
+	t.Run("Range/Multiple", func(t *testing.T) {
+		resp := get("/books/1/1.epub", map[string]string{"Range": "bytes=0-9,100-109"})
+		assert.Equal(t, http.StatusPartialContent, resp.StatusCode)
+		typ, params, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+		require.NoError(t, err)
+		assert.Equal(t, "multipart/byteranges", typ)
+		mr := multipart.NewReader(resp.Body, params["boundary"])
+		for _, start := range []int{0, 100} {
+			part, err := mr.NextPart()
+			require.NoError(t, err)
+			assert.Equal(t, "application/epub+zip", part.Header.Get("Content-Type"))
+			b, err := ioutil.ReadAll(part)
+			require.NoError(t, err)
+			assert.Equal(t, data[start:start+10], b)
+		}
+	})
+	t.Run("Range/Unsatisfiable", func(t *testing.T) {
+		resp := get("/books/1/1.epub", map[string]string{"Range": "bytes=5000000-"})
+		assert.Equal(t, http.StatusRequestedRangeNotSatisfiable, resp.StatusCode)
+		assert.Equal(t, "bytes */4194304", resp.Header.Get("Content-Range"))
+	})
+
+	// Resuming a download only works if the file hasn't changed in the meantime.
+	t.Run("Resume", func(t *testing.T) {
+		etag := get("/books/1/1.epub", nil).Header.Get("ETag")
+		require.NotEmpty(t, etag)
+		assert.NotContains(t, etag, "W/", "If-Range needs a strong ETag")
+
+		resp := get("/books/1/1.epub", map[string]string{"Range": "bytes=1000-", "If-Range": etag})
+		assert.Equal(t, http.StatusPartialContent, resp.StatusCode)
+		assert.Equal(t, data[1000:], body(resp))
+
+		resp = get("/books/1/1.epub", map[string]string{"Range": "bytes=1000-", "If-Range": `"changed"`})
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, data, body(resp))
+	})
+}
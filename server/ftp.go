@@ -0,0 +1,140 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/afero"
+	"go.uber.org/zap"
+
+	"github.com/liclac/sharlayan/config"
+	"github.com/liclac/sharlayan/metrics"
+)
+
+// Delay after a failed login, to slow down guessing; there's a limit per connection, too.
+const (
+	ftpAuthDelay    = 1 * time.Second
+	ftpMaxAuthTries = 3
+)
+
+// Time allowed for a client to connect to a passive port it asked for.
+const ftpDataTimeout = 30 * time.Second
+
+type ftpServer struct {
+	L     *zap.Logger
+	cfg   *config.Config
+	conns connTracker
+
+	tls              *tls.Config // nil unless ftp.tls.enable is set.
+	portMin, portMax int         // Range for passive connections; 0 for any port.
+	authDelay        time.Duration
+}
+
+// A read-only FTP server, for e-readers and tools that don't speak anything else. Only passive
+// mode is supported, as active mode doesn't get along with NAT, and lets clients make us connect
+// to arbitrary addresses. Users log in with users.*.password, or anonymously if allowed; with
+// ftp.tls.enable, they can upgrade to TLS with AUTH TLS ("explicit FTPS").
+func FTP(cfg *config.Config) Server {
+	L := zap.L().Named("ftp")
+	if !cfg.FTP.Enable {
+		L.Debug("Not enabled, skipping...")
+		return nil
+	}
+	metrics.NotReady("ftp")
+	return &ftpServer{L: L, cfg: cfg, authDelay: ftpAuthDelay}
+}
+
+func (s *ftpServer) Run(ctx context.Context, fs afero.Fs) error {
+	var err error
+	if s.portMin, s.portMax, err = parsePortRange(s.cfg.FTP.PassivePorts); err != nil {
+		return fmt.Errorf("ftp: passive ports: %w", err)
+	}
+	if ip := s.cfg.FTP.PublicIP; ip != "" && net.ParseIP(ip).To4() == nil {
+		return fmt.Errorf("ftp: public IP: not an IPv4 address: %s", ip)
+	}
+	if s.cfg.FTP.TLS.Enable {
+		if s.tls, err = httpTLSConfig(ctx, s.L.Named("tls"), s.cfg); err != nil {
+			return fmt.Errorf("ftp: %w", err)
+		}
+	} else if s.cfg.FTP.TLS.Require {
+		return fmt.Errorf("ftp: ftp.tls.require is set, but not ftp.tls.enable")
+	}
+
+	l, err := Listen(ctx, s.cfg, s.cfg.FTP.Addrs...)
+	if err != nil {
+		return fmt.Errorf("ftp: couldn't listen: %w", err)
+	}
+	if err := requireTCP(l.Addr()); err != nil {
+		l.Close()
+		return fmt.Errorf("ftp: %w", err)
+	}
+	go func() {
+		<-ctx.Done()
+		if err := l.Close(); err != nil {
+			s.L.Error("Error closing listener", zap.Error(err))
+		}
+	}()
+	s.L.Info("Listening", zap.Stringer("addr", l.Addr()), zap.Bool("tls", s.tls != nil),
+		zap.String("passive-ports", s.cfg.FTP.PassivePorts))
+	metrics.Ready("ftp")
+	defer s.shutdown()
+
+	if err := s.conns.serve(ctx, l, func(conn net.Conn) { s.newSession(ctx, fs, conn).serve() }); err != nil {
+		return fmt.Errorf("ftp: accept: %w", err)
+	}
+	return nil
+}
+
+// Sessions last until the client logs out, so rather than waiting for them, idle ones are told
+// to go away; transfers in progress get the grace period to finish.
+func (s *ftpServer) shutdown() {
+	metrics.NotReady("ftp")
+	s.conns.interrupt()
+	s.conns.shutdown(s.L, s.cfg.FTP.Grace)
+}
+
+// Listens for a passive data connection on the given IP, on a port in the configured range.
+func (s *ftpServer) listenPassive(ip net.IP) (net.Listener, error) {
+	if s.portMin == 0 {
+		return net.Listen("tcp", net.JoinHostPort(ip.String(), "0"))
+	}
+	// Start somewhere random, so concurrent sessions don't all fight over the first port.
+	num := s.portMax - s.portMin + 1
+	start := rand.Intn(num)
+	var err error
+	for i := 0; i < num; i++ {
+		port := s.portMin + (start+i)%num
+		var l net.Listener
+		if l, err = net.Listen("tcp", net.JoinHostPort(ip.String(), strconv.Itoa(port))); err == nil {
+			return l, nil
+		}
+	}
+	return nil, fmt.Errorf("no free passive ports: %w", err)
+}
+
+// Parses a port range, eg. "50000-50100", or a single port; "" means any port, returned as 0s.
+func parsePortRange(s string) (min, max int, err error) {
+	if s == "" {
+		return 0, 0, nil
+	}
+	parts := strings.SplitN(s, "-", 2)
+	if min, err = strconv.Atoi(strings.TrimSpace(parts[0])); err != nil {
+		return 0, 0, fmt.Errorf("%s: invalid port: %w", s, err)
+	}
+	max = min
+	if len(parts) == 2 {
+		if max, err = strconv.Atoi(strings.TrimSpace(parts[1])); err != nil {
+			return 0, 0, fmt.Errorf("%s: invalid port: %w", s, err)
+		}
+	}
+	if min < 1 || max > 65535 || min > max {
+		return 0, 0, fmt.Errorf("%s: expected a range like 50000-50100", s)
+	}
+	return min, max, nil
+}
@@ -0,0 +1,63 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// Timestamps in MDTM and MLST replies; always UTC. See RFC 3659, section 2.3.
+const ftpTimeFormat = "20060102150405"
+
+// Formats a LIST line like `ls -l`, which is what clients expect, even though it was never
+// standardised. Everything is read-only, and owned by "ftp".
+func listLine(info os.FileInfo, now time.Time) string {
+	mode := "-r--r--r--"
+	if info.IsDir() {
+		mode = "dr-xr-xr-x"
+	}
+	// Like ls, recent files get a time, older (or future) ones get a year instead.
+	mtime := info.ModTime()
+	date := mtime.Format("Jan _2  2006")
+	if age := now.Sub(mtime); age >= 0 && age < 180*24*time.Hour {
+		date = mtime.Format("Jan _2 15:04")
+	}
+	return fmt.Sprintf("%s 1 ftp ftp %12d %s %s", mode, info.Size(), date, info.Name())
+}
+
+// Formats a file's facts for MLST and MLSD, which unlike LIST are machine-readable; see
+// RFC 3659, section 7.
+func mlstFacts(info os.FileInfo, name string) string {
+	modify := info.ModTime().UTC().Format(ftpTimeFormat)
+	if info.IsDir() {
+		return fmt.Sprintf("type=dir;modify=%s;perm=el; %s", modify, name)
+	}
+	return fmt.Sprintf("type=file;size=%d;modify=%s;perm=r; %s", info.Size(), modify, name)
+}
+
+// Removes ls-style flags from a LIST argument, eg. "-la /books"; lots of clients send them,
+// and we don't support any.
+func stripListFlags(arg string) string {
+	for strings.HasPrefix(arg, "-") {
+		i := strings.IndexByte(arg, ' ')
+		if i == -1 {
+			return ""
+		}
+		arg = strings.TrimLeft(arg[i:], " ")
+	}
+	return arg
+}
+
+// Counts bytes written through it.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (w *countingWriter) Write(data []byte) (int, error) {
+	n, err := w.w.Write(data)
+	w.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,610 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/afero"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Commands are short; anything longer than this is nonsense, or an attack.
+const ftpMaxLine = 4096
+
+// Commands that would change something, which we refuse politely, rather than as unknown.
+var ftpWriteCommands = map[string]bool{
+	"STOR": true, "STOU": true, "APPE": true, "DELE": true, "RNFR": true, "RNTO": true,
+	"MKD": true, "XMKD": true, "RMD": true, "XRMD": true, "SITE": true,
+}
+
+// Commands that may be used before logging in.
+var ftpPreLoginCommands = map[string]bool{
+	"USER": true, "PASS": true, "AUTH": true, "PBSZ": true, "PROT": true, "FEAT": true,
+	"SYST": true, "OPTS": true, "NOOP": true, "HELP": true, "QUIT": true,
+}
+
+// A client's connection to the FTP server.
+type ftpSession struct {
+	s    *ftpServer
+	L    *zap.Logger
+	ctx  context.Context
+	fs   afero.Fs // Everything; see view.
+	conn net.Conn // Replaced by a *tls.Conn after AUTH TLS.
+	r    *bufio.Reader
+
+	secure   bool     // The control connection is encrypted.
+	prot     bool     // Data connections are encrypted (PROT P).
+	pending  string   // Username from USER, awaiting PASS.
+	failures int      // Failed logins.
+	user     string   // Logged-in user; "" is anonymous.
+	view     afero.Fs // What the user may see, once logged in.
+	cwd      string
+	rest     int64        // Offset for the next transfer, from REST.
+	pasv     net.Listener // Waiting for a data connection, from PASV or EPSV.
+}
+
+func (s *ftpServer) newSession(ctx context.Context, fs afero.Fs, conn net.Conn) *ftpSession {
+	return &ftpSession{
+		s:    s,
+		L:    s.L.With(zap.Stringer("addr", conn.RemoteAddr())),
+		ctx:  ctx,
+		fs:   fs,
+		conn: conn,
+		r:    bufio.NewReaderSize(conn, ftpMaxLine),
+		cwd:  "/",
+	}
+}
+
+func (c *ftpSession) serve() {
+	defer c.closePassive()
+	c.L.Debug("Connected")
+	c.reply(220, "Sharlayan FTP server ready; everything here is read-only.")
+	for {
+		select {
+		case <-c.ctx.Done():
+			c.reply(421, "Server shutting down.")
+			return
+		default:
+		}
+		if timeout := c.s.cfg.FTP.IdleTimeout; timeout > 0 {
+			_ = c.conn.SetReadDeadline(time.Now().Add(timeout))
+		}
+		line, isPrefix, err := c.r.ReadLine()
+		if err != nil {
+			switch {
+			case c.ctx.Err() != nil:
+				c.reply(421, "Server shutting down.")
+			case isTimeout(err):
+				c.reply(421, "Idle for too long, goodbye.")
+			case err != io.EOF:
+				c.L.Debug("Couldn't read command", zap.Error(err))
+			}
+			return
+		}
+		if isPrefix {
+			c.reply(500, "Command too long.")
+			return
+		}
+		cmd, arg := splitFTPCommand(string(line))
+		if !c.handle(cmd, arg) {
+			return
+		}
+	}
+}
+
+// Splits a command line into an upper-cased command, and its argument.
+func splitFTPCommand(line string) (cmd, arg string) {
+	line = strings.TrimRight(line, "\r\n")
+	parts := strings.SplitN(line, " ", 2)
+	cmd = strings.ToUpper(parts[0])
+	if len(parts) > 1 {
+		arg = parts[1]
+	}
+	return cmd, arg
+}
+
+// Handles a single command; returns false if the connection should be closed.
+func (c *ftpSession) handle(cmd, arg string) bool {
+	if cmd == "PASS" {
+		c.L.Debug("Command", zap.String("cmd", cmd)) // Don't log passwords.
+	} else {
+		c.L.Debug("Command", zap.String("cmd", cmd), zap.String("arg", arg))
+	}
+	if c.view == nil && !ftpPreLoginCommands[cmd] {
+		c.reply(530, "Please log in with USER and PASS.")
+		return true
+	}
+	if ftpWriteCommands[cmd] {
+		c.reply(550, "Permission denied, this server is read-only.")
+		return true
+	}
+	switch cmd {
+	case "USER":
+		return c.cmdUSER(arg)
+	case "PASS":
+		return c.cmdPASS(arg)
+	case "AUTH":
+		return c.cmdAUTH(arg)
+	case "PBSZ":
+		if !c.secure {
+			c.reply(503, "Use AUTH TLS first.")
+		} else {
+			c.reply(200, "PBSZ=0")
+		}
+	case "PROT":
+		c.cmdPROT(arg)
+	case "FEAT":
+		c.cmdFEAT()
+	case "SYST":
+		c.reply(215, "UNIX Type: L8")
+	case "OPTS":
+		if strings.EqualFold(strings.TrimSpace(arg), "UTF8 ON") {
+			c.reply(200, "Always in UTF-8 mode.")
+		} else {
+			c.reply(501, "Unknown option.")
+		}
+	case "NOOP":
+		c.reply(200, "OK.")
+	case "HELP":
+		c.reply(214, "See RFC 959; only reading and listing is supported.")
+	case "QUIT":
+		c.reply(221, "Goodbye.")
+		return false
+
+	case "PWD", "XPWD":
+		c.reply(257, `"`+strings.Replace(c.cwd, `"`, `""`, -1)+`" is the current directory.`)
+	case "CWD", "XCWD":
+		c.cmdCWD(arg)
+	case "CDUP", "XCUP":
+		c.cmdCWD("..")
+	case "TYPE":
+		switch strings.ToUpper(strings.TrimSpace(arg)) {
+		case "A", "A N", "I", "L 8":
+			// ASCII mode is accepted, but files are sent as-is, like most servers do.
+			c.reply(200, "Type set to "+arg+".")
+		default:
+			c.reply(504, "Unsupported type.")
+		}
+	case "MODE":
+		c.replyIf(strings.EqualFold(arg, "S"), 200, "Mode set to S.", 504, "Only stream mode is supported.")
+	case "STRU":
+		c.replyIf(strings.EqualFold(arg, "F"), 200, "Structure set to F.", 504, "Only file structure is supported.")
+	case "PASV":
+		c.cmdPASV()
+	case "EPSV":
+		c.cmdEPSV(arg)
+	case "PORT", "EPRT":
+		c.reply(502, "Active mode isn't supported, use PASV or EPSV.")
+	case "ALLO":
+		c.reply(202, "No storage allocation necessary.")
+	case "ABOR":
+		c.closePassive() // Transfers are done by the time we read the next command.
+		c.reply(226, "Nothing to abort.")
+
+	case "SIZE":
+		c.cmdSIZE(arg)
+	case "MDTM":
+		c.cmdMDTM(arg)
+	case "MLST":
+		c.cmdMLST(arg)
+	case "REST":
+		c.cmdREST(arg)
+	case "RETR":
+		c.cmdRETR(arg)
+	case "LIST", "NLST", "MLSD":
+		c.cmdLIST(cmd, arg)
+	default:
+		c.reply(502, "Command not implemented.")
+	}
+	return true
+}
+
+func (c *ftpSession) cmdUSER(name string) bool {
+	if c.s.cfg.FTP.TLS.Require && !c.secure {
+		c.reply(530, "Please use AUTH TLS first.")
+		return true
+	}
+	if c.view != nil {
+		c.reply(530, "Already logged in.")
+		return true
+	}
+	c.pending = name
+	if isAnonymousFTPUser(name) && c.s.cfg.FTP.Anonymous {
+		c.reply(331, "Anonymous login OK, send anything as a password.")
+	} else {
+		c.reply(331, "Password required for "+name+".")
+	}
+	return true
+}
+
+func (c *ftpSession) cmdPASS(password string) bool {
+	if c.pending == "" || c.view != nil {
+		c.reply(503, "Log in with USER first.")
+		return true
+	}
+	name := c.pending
+	c.pending = ""
+	if isAnonymousFTPUser(name) && c.s.cfg.FTP.Anonymous {
+		return c.login(name, "")
+	}
+	if err := c.checkPassword(name, password); err != nil {
+		c.failures++
+		c.L.Info("Login failed", zap.String("user", name), zap.Error(err))
+		ftpLogins.Inc("failed")
+		time.Sleep(c.s.authDelay)
+		if c.failures >= ftpMaxAuthTries {
+			c.reply(421, "Too many failed logins.")
+			return false
+		}
+		c.reply(530, "Login incorrect.")
+		return true
+	}
+	return c.login(name, name)
+}
+
+func (c *ftpSession) checkPassword(name, password string) error {
+	u, ok := c.s.cfg.Users[name]
+	if !ok || u.Password == "" {
+		_ = bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+		return fmt.Errorf("no password set for %s", name)
+	}
+	return bcrypt.CompareHashAndPassword([]byte(u.Password), []byte(password))
+}
+
+func (c *ftpSession) login(name, user string) bool {
+	view, err := ForUser(c.fs, user)
+	if err != nil {
+		c.L.Error("Couldn't get filesystem for user", zap.String("user", user), zap.Error(err))
+		c.reply(421, "Internal error.")
+		return false
+	}
+	c.user, c.view = user, view
+	c.L = c.L.With(zap.String("user", name))
+	c.L.Info("Logged in", zap.Bool("tls", c.secure))
+	if user == "" {
+		ftpLogins.Inc("anonymous")
+	} else {
+		ftpLogins.Inc("user")
+	}
+	c.reply(230, "Logged in.")
+	return true
+}
+
+func isAnonymousFTPUser(name string) bool {
+	return strings.EqualFold(name, "anonymous") || strings.EqualFold(name, "ftp")
+}
+
+func (c *ftpSession) cmdAUTH(arg string) bool {
+	switch {
+	case c.s.tls == nil:
+		c.reply(502, "TLS isn't enabled on this server.")
+		return true
+	case c.secure:
+		c.reply(503, "Already using TLS.")
+		return true
+	case !strings.EqualFold(arg, "TLS") && !strings.EqualFold(arg, "TLS-C") && !strings.EqualFold(arg, "SSL"):
+		c.reply(504, "Only AUTH TLS is supported.")
+		return true
+	}
+	c.reply(234, "Starting TLS.")
+	tconn := tls.Server(c.conn, c.s.tls)
+	_ = tconn.SetDeadline(time.Now().Add(ftpDataTimeout))
+	if err := tconn.Handshake(); err != nil {
+		c.L.Debug("TLS handshake failed", zap.Error(err))
+		return false
+	}
+	_ = tconn.SetDeadline(time.Time{})
+	c.conn, c.r, c.secure = tconn, bufio.NewReaderSize(tconn, ftpMaxLine), true
+	return true
+}
+
+func (c *ftpSession) cmdPROT(arg string) {
+	switch {
+	case !c.secure:
+		c.reply(503, "Use AUTH TLS first.")
+	case strings.EqualFold(arg, "P"):
+		c.prot = true
+		c.reply(200, "Data connections will be encrypted.")
+	case strings.EqualFold(arg, "C"):
+		c.prot = false
+		c.reply(200, "Data connections will not be encrypted.")
+	default:
+		c.reply(504, "Only PROT P and PROT C are supported.")
+	}
+}
+
+func (c *ftpSession) cmdFEAT() {
+	feats := []string{"EPSV", "PASV", "SIZE", "MDTM", "REST STREAM", "MLST type*;size*;modify*;perm*;", "UTF8", "TVFS"}
+	if c.s.tls != nil {
+		feats = append([]string{"AUTH TLS", "PBSZ", "PROT"}, feats...)
+	}
+	c.replyLines(211, "Features:", feats, "End")
+}
+
+func (c *ftpSession) cmdCWD(arg string) {
+	p := c.resolve(arg)
+	if info, err := c.view.Stat(p); err != nil || !info.IsDir() {
+		c.reply(550, "No such directory.")
+		return
+	}
+	c.cwd = p
+	c.reply(250, "Directory changed to "+p+".")
+}
+
+// Opens a passive listener, and returns its address, or replies with an error.
+func (c *ftpSession) passive() (*net.TCPAddr, bool) {
+	c.closePassive()
+	local, _ := c.conn.LocalAddr().(*net.TCPAddr)
+	if local == nil {
+		c.reply(425, "Can't open a data connection.")
+		return nil, false
+	}
+	l, err := c.s.listenPassive(local.IP)
+	if err != nil {
+		c.L.Warn("Couldn't open passive port", zap.Error(err))
+		c.reply(425, "Can't open a data connection.")
+		return nil, false
+	}
+	c.pasv = l
+	return l.Addr().(*net.TCPAddr), true
+}
+
+func (c *ftpSession) cmdPASV() {
+	local, _ := c.conn.LocalAddr().(*net.TCPAddr)
+	if local == nil {
+		c.reply(425, "Can't open a data connection.")
+		return
+	}
+	ip := local.IP.To4()
+	if public := c.s.cfg.FTP.PublicIP; public != "" {
+		ip = net.ParseIP(public).To4()
+	}
+	if ip == nil {
+		c.reply(425, "PASV only works with IPv4, use EPSV.")
+		return
+	}
+	addr, ok := c.passive()
+	if !ok {
+		return
+	}
+	c.reply(227, fmt.Sprintf("Entering Passive Mode (%d,%d,%d,%d,%d,%d).",
+		ip[0], ip[1], ip[2], ip[3], addr.Port>>8, addr.Port&0xff))
+}
+
+func (c *ftpSession) cmdEPSV(arg string) {
+	if strings.EqualFold(arg, "ALL") {
+		c.reply(200, "EPSV ALL OK.") // We never use anything else anyway.
+		return
+	}
+	if addr, ok := c.passive(); ok {
+		c.reply(229, fmt.Sprintf("Entering Extended Passive Mode (|||%d|).", addr.Port))
+	}
+}
+
+func (c *ftpSession) closePassive() {
+	if c.pasv != nil {
+		c.pasv.Close()
+		c.pasv = nil
+	}
+}
+
+// Accepts the data connection for a transfer, encrypting it if PROT P is in effect. Only the
+// client on the other end of the control connection may connect, or anyone who could guess the
+// port could steal the transfer.
+func (c *ftpSession) openData() (net.Conn, error) {
+	if c.pasv == nil {
+		return nil, fmt.Errorf("use PASV or EPSV first")
+	}
+	l := c.pasv
+	c.pasv = nil
+	defer l.Close()
+	if tl, ok := l.(*net.TCPListener); ok {
+		_ = tl.SetDeadline(time.Now().Add(ftpDataTimeout))
+	}
+	conn, err := l.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if !sameHost(conn.RemoteAddr(), c.conn.RemoteAddr()) {
+		conn.Close()
+		return nil, fmt.Errorf("data connection from the wrong address: %s", conn.RemoteAddr())
+	}
+	if c.prot {
+		tconn := tls.Server(conn, c.s.tls)
+		_ = tconn.SetDeadline(time.Now().Add(ftpDataTimeout))
+		if err := tconn.Handshake(); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("TLS handshake: %w", err)
+		}
+		_ = tconn.SetDeadline(time.Time{})
+		conn = tconn
+	}
+	return conn, nil
+}
+
+func sameHost(a, b net.Addr) bool {
+	ta, ok1 := a.(*net.TCPAddr)
+	tb, ok2 := b.(*net.TCPAddr)
+	return ok1 && ok2 && ta.IP.Equal(tb.IP)
+}
+
+// Sends something over a data connection.
+func (c *ftpSession) transfer(cmd string, send func(w io.Writer) error) {
+	defer func() { c.rest = 0 }() // REST applies to the next transfer, whatever happens to it.
+	if c.s.cfg.FTP.TLS.Require && !c.prot {
+		c.reply(521, "Data connections must be encrypted, use PROT P.")
+		return
+	}
+	c.reply(150, "Opening data connection.")
+	conn, err := c.openData()
+	if err != nil {
+		c.L.Debug("Couldn't open data connection", zap.Error(err))
+		c.reply(425, "Can't open data connection.")
+		return
+	}
+	w := &countingWriter{w: conn}
+	err = send(w)
+	if cerr := conn.Close(); err == nil {
+		err = cerr
+	}
+	ftpTransferBytes.Add(float64(w.n), cmd)
+	if err != nil {
+		c.L.Debug("Transfer failed", zap.String("cmd", cmd), zap.Error(err))
+		c.reply(426, "Transfer aborted.")
+		return
+	}
+	c.reply(226, "Transfer complete.")
+}
+
+func (c *ftpSession) cmdRETR(arg string) {
+	p := c.resolve(arg)
+	f, err := c.view.Open(p)
+	if err != nil {
+		c.reply(550, "No such file.")
+		return
+	}
+	defer f.Close()
+	if info, err := f.Stat(); err != nil || info.IsDir() {
+		c.reply(550, "Not a file.")
+		return
+	}
+	offset := c.rest
+	if offset > 0 {
+		if _, err := f.Seek(offset, io.SeekStart); err != nil {
+			c.rest = 0
+			c.reply(554, "Invalid restart position.")
+			return
+		}
+	}
+	start := time.Now()
+	c.transfer("RETR", func(w io.Writer) error {
+		_, err := io.Copy(w, f)
+		return err
+	})
+	c.L.Info("Download", zap.String("path", p), zap.Int64("offset", offset), zap.Duration("t", time.Since(start)))
+}
+
+func (c *ftpSession) cmdREST(arg string) {
+	offset, err := strconv.ParseInt(strings.TrimSpace(arg), 10, 64)
+	if err != nil || offset < 0 {
+		c.reply(501, "Invalid restart position.")
+		return
+	}
+	c.rest = offset
+	c.reply(350, fmt.Sprintf("Restarting at %d.", offset))
+}
+
+func (c *ftpSession) cmdSIZE(arg string) {
+	info, err := c.view.Stat(c.resolve(arg))
+	if err != nil || info.IsDir() {
+		c.reply(550, "No such file.")
+		return
+	}
+	c.reply(213, strconv.FormatInt(info.Size(), 10))
+}
+
+func (c *ftpSession) cmdMDTM(arg string) {
+	info, err := c.view.Stat(c.resolve(arg))
+	if err != nil || info.IsDir() {
+		c.reply(550, "No such file.")
+		return
+	}
+	c.reply(213, info.ModTime().UTC().Format(ftpTimeFormat))
+}
+
+func (c *ftpSession) cmdMLST(arg string) {
+	p := c.resolve(arg)
+	info, err := c.view.Stat(p)
+	if err != nil {
+		c.reply(550, "No such file or directory.")
+		return
+	}
+	c.replyLines(250, "Listing "+p, []string{mlstFacts(info, p)}, "End")
+}
+
+func (c *ftpSession) cmdLIST(cmd, arg string) {
+	p := c.resolve(stripListFlags(arg))
+	info, err := c.view.Stat(p)
+	if err != nil {
+		c.reply(550, "No such file or directory.")
+		return
+	}
+	infos := []os.FileInfo{info}
+	if info.IsDir() {
+		if infos, err = afero.ReadDir(c.view, p); err != nil {
+			c.L.Error("Couldn't list directory", zap.String("path", p), zap.Error(err))
+			c.reply(550, "Couldn't list directory.")
+			return
+		}
+	} else if cmd == "MLSD" {
+		c.reply(501, "Not a directory.")
+		return
+	}
+	now := time.Now()
+	c.transfer(cmd, func(w io.Writer) error {
+		for _, info := range infos {
+			var line string
+			switch cmd {
+			case "LIST":
+				line = listLine(info, now)
+			case "NLST":
+				line = info.Name()
+			case "MLSD":
+				line = mlstFacts(info, info.Name())
+			}
+			if _, err := io.WriteString(w, line+"\r\n"); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Resolves a path relative to the current directory. Clients can't escape the root, as
+// Clean() removes any ".." there.
+func (c *ftpSession) resolve(arg string) string {
+	if arg == "" {
+		return c.cwd
+	}
+	if !strings.HasPrefix(arg, "/") {
+		arg = path.Join(c.cwd, arg)
+	}
+	return path.Clean("/" + arg)
+}
+
+func (c *ftpSession) reply(code int, msg string) {
+	if _, err := fmt.Fprintf(c.conn, "%d %s\r\n", code, msg); err != nil {
+		c.L.Debug("Couldn't send reply", zap.Error(err))
+	}
+}
+
+func (c *ftpSession) replyIf(ok bool, okCode int, okMsg string, errCode int, errMsg string) {
+	if ok {
+		c.reply(okCode, okMsg)
+	} else {
+		c.reply(errCode, errMsg)
+	}
+}
+
+// Sends a multi-line reply, eg. "211-Features:", " EPSV", ..., "211 End".
+func (c *ftpSession) replyLines(code int, first string, lines []string, last string) {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%d-%s\r\n", code, first)
+	for _, line := range lines {
+		fmt.Fprintf(&b, " %s\r\n", line)
+	}
+	fmt.Fprintf(&b, "%d %s\r\n", code, last)
+	if _, err := io.WriteString(c.conn, b.String()); err != nil {
+		c.L.Debug("Couldn't send reply", zap.Error(err))
+	}
+}
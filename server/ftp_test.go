@@ -0,0 +1,324 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/textproto"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/liclac/sharlayan/config"
+)
+
+var testFTPTime = time.Date(2020, 5, 1, 12, 0, 0, 0, time.UTC)
+
+func testFTPFs(t *testing.T) afero.Fs {
+	fs := afero.NewMemMapFs()
+	require.NoError(t, afero.WriteFile(fs, "/books/4/4.epub", []byte("PK epub"), 0644))
+	require.NoError(t, afero.WriteFile(fs, "/books/4/cover.jpg", []byte("JPEG"), 0644))
+	for _, p := range []string{"/books/4/4.epub", "/books/4/cover.jpg", "/books/4", "/books"} {
+		require.NoError(t, fs.Chtimes(p, testFTPTime, testFTPTime))
+	}
+	return fs
+}
+
+// Starts an FTP server on a random port, returning its address.
+func startFTP(t *testing.T, srv *ftpServer, fs afero.Fs) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() { _ = srv.conns.serve(ctx, l, func(conn net.Conn) { srv.newSession(ctx, fs, conn).serve() }) }()
+	t.Cleanup(func() {
+		cancel()
+		l.Close()
+	})
+	return l.Addr().String()
+}
+
+type ftpClient struct {
+	t *testing.T
+	*textproto.Conn
+	conn net.Conn
+	tls  *tls.Config // For data connections, after PROT P.
+}
+
+func dialFTP(t *testing.T, addr string) *ftpClient {
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	c := &ftpClient{t: t, Conn: textproto.NewConn(conn), conn: conn}
+	c.expect(220)
+	return c
+}
+
+// Sends a command, and checks the reply's code.
+func (c *ftpClient) cmd(code int, format string, args ...interface{}) string {
+	c.t.Helper()
+	_, err := c.Cmd(format, args...)
+	require.NoError(c.t, err)
+	return c.expect(code)
+}
+
+func (c *ftpClient) expect(code int) string {
+	c.t.Helper()
+	got, msg, err := c.ReadResponse(0)
+	require.NoError(c.t, err)
+	require.Equal(c.t, code, got, msg)
+	return msg
+}
+
+func (c *ftpClient) login(user, password string) {
+	c.t.Helper()
+	c.cmd(331, "USER %s", user)
+	c.cmd(230, "PASS %s", password)
+}
+
+var epsvRe = regexp.MustCompile(`\(\|\|\|(\d+)\|\)`)
+
+// Runs a command with a data connection, eg. "RETR x", and returns what was sent over it.
+func (c *ftpClient) data(format string, args ...interface{}) string {
+	c.t.Helper()
+	m := epsvRe.FindStringSubmatch(c.cmd(229, "EPSV"))
+	require.NotNil(c.t, m)
+	host, _, _ := net.SplitHostPort(c.conn.RemoteAddr().String())
+	dconn, err := net.Dial("tcp", net.JoinHostPort(host, m[1]))
+	require.NoError(c.t, err)
+	if c.tls != nil {
+		dconn = tls.Client(dconn, c.tls)
+	}
+	defer dconn.Close()
+
+	c.cmd(150, format, args...)
+	data, err := ioutil.ReadAll(dconn)
+	require.NoError(c.t, err)
+	c.expect(226)
+	return string(data)
+}
+
+func TestFTP(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("hunter2"), bcrypt.MinCost)
+	require.NoError(t, err)
+	cfg := &config.Config{Users: map[string]config.User{"alice": {Password: string(hash)}}}
+	assert.Nil(t, FTP(cfg), "not enabled")
+	addr := startFTP(t, &ftpServer{L: zap.NewNop(), cfg: cfg}, testFTPFs(t))
+
+	t.Run("LoggedOut", func(t *testing.T) {
+		c := dialFTP(t, addr)
+		c.cmd(215, "SYST")
+		c.cmd(530, "LIST")
+		c.cmd(530, "RETR /books/4/4.epub")
+		c.cmd(502, "AUTH TLS")
+		c.cmd(331, "USER anonymous")
+		c.cmd(530, "PASS me@example.com")
+	})
+	t.Run("WrongPassword", func(t *testing.T) {
+		c := dialFTP(t, addr)
+		c.cmd(331, "USER alice")
+		c.cmd(530, "PASS hunter3")
+		c.cmd(331, "USER bob")
+		c.cmd(530, "PASS hunter2")
+		c.cmd(331, "USER alice")
+		c.cmd(421, "PASS nope")
+	})
+	t.Run("Browse", func(t *testing.T) {
+		c := dialFTP(t, addr)
+		c.login("alice", "hunter2")
+		assert.Equal(t, `"/" is the current directory.`, c.cmd(257, "PWD"))
+		c.cmd(250, "CWD books/4")
+		assert.Equal(t, `"/books/4" is the current directory.`, c.cmd(257, "PWD"))
+		c.cmd(550, "CWD 4.epub")
+		c.cmd(550, "CWD /nope")
+		c.cmd(250, "CDUP")
+		assert.Equal(t, `"/books" is the current directory.`, c.cmd(257, "PWD"))
+		c.cmd(250, "CWD ../../../books/4")
+
+		c.cmd(200, "TYPE I")
+		assert.Equal(t, "7", c.cmd(213, "SIZE 4.epub"))
+		assert.Equal(t, "20200501120000", c.cmd(213, "MDTM /books/4/4.epub"))
+		c.cmd(550, "SIZE nope.epub")
+		assert.Equal(t, "Listing /books/4/4.epub\n type=file;size=7;modify=20200501120000;perm=r; /books/4/4.epub\nEnd",
+			c.cmd(250, "MLST 4.epub"))
+
+		assert.Equal(t, ""+
+			"-r--r--r-- 1 ftp ftp            7 May  1  2020 4.epub\r\n"+
+			"-r--r--r-- 1 ftp ftp            4 May  1  2020 cover.jpg\r\n",
+			c.data("LIST -la"))
+		assert.Equal(t, "4.epub\r\ncover.jpg\r\n", c.data("NLST"))
+		assert.Equal(t, "type=dir;modify=20200501120000;perm=el; 4\r\n", c.data("MLSD /books"))
+
+		assert.Equal(t, "PK epub", c.data("RETR 4.epub"))
+		c.cmd(350, "REST 3")
+		assert.Equal(t, "epub", c.data("RETR 4.epub"))
+		assert.Equal(t, "PK epub", c.data("RETR 4.epub"), "REST only applies once")
+		c.cmd(550, "RETR /books/4")
+
+		c.cmd(550, "STOR x.epub")
+		c.cmd(550, "DELE 4.epub")
+		c.cmd(502, "PORT 127,0,0,1,4,1")
+		c.cmd(502, "XYZZY")
+		c.cmd(221, "QUIT")
+	})
+	t.Run("PASV", func(t *testing.T) {
+		c := dialFTP(t, addr)
+		c.login("alice", "hunter2")
+		assert.Regexp(t, `^Entering Passive Mode \(127,0,0,1,\d+,\d+\)\.$`, c.cmd(227, "PASV"))
+	})
+}
+
+func TestFTPAnonymous(t *testing.T) {
+	cfg := &config.Config{}
+	cfg.FTP.Anonymous = true
+	addr := startFTP(t, &ftpServer{L: zap.NewNop(), cfg: cfg}, testFTPFs(t))
+
+	c := dialFTP(t, addr)
+	c.login("anonymous", "me@example.com")
+	assert.Equal(t, "PK epub", c.data("RETR /books/4/4.epub"))
+}
+
+func TestFTPTLS(t *testing.T) {
+	dir := t.TempDir()
+	certPath, keyPath := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	require.NoError(t, GenerateCertificate(certPath, keyPath, []string{"localhost"}, certValidity))
+	cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+	require.NoError(t, err)
+
+	cfg := &config.Config{}
+	cfg.FTP.Anonymous = true
+	cfg.FTP.TLS.Enable = true
+	cfg.FTP.TLS.Require = true
+	srv := &ftpServer{L: zap.NewNop(), cfg: cfg, tls: &tls.Config{Certificates: []tls.Certificate{cert}}}
+	addr := startFTP(t, srv, testFTPFs(t))
+
+	c := dialFTP(t, addr)
+	c.cmd(530, "USER anonymous")
+	c.cmd(503, "PROT P")
+	c.cmd(234, "AUTH TLS")
+	tconn := tls.Client(c.conn, &tls.Config{InsecureSkipVerify: true})
+	c.Conn = textproto.NewConn(tconn)
+	c.login("anonymous", "me@example.com")
+
+	c.cmd(200, "PBSZ 0")
+	c.cmd(229, "EPSV")
+	c.cmd(521, "RETR /books/4/4.epub")
+	c.cmd(200, "PROT P")
+	c.tls = &tls.Config{InsecureSkipVerify: true}
+	assert.Equal(t, "PK epub", c.data("RETR /books/4/4.epub"))
+}
+
+func TestFTPUnix(t *testing.T) {
+	dir := t.TempDir()
+	cfg := &config.Config{}
+	cfg.FTP.Anonymous = true
+
+	t.Run("Run", func(t *testing.T) {
+		cfg.FTP.Addrs = []string{"127.0.0.1:0", "unix:" + filepath.Join(dir, "ftp.sock")}
+		err := (&ftpServer{L: zap.NewNop(), cfg: cfg}).Run(context.Background(), testFTPFs(t))
+		assert.EqualError(t, err, "ftp: unix:"+filepath.Join(dir, "ftp.sock")+": only TCP addresses are supported")
+	})
+
+	// Sessions shouldn't fall over if they end up on one anyway.
+	t.Run("PASV", func(t *testing.T) {
+		path := filepath.Join(dir, "session.sock")
+		l, err := net.Listen("unix", path)
+		require.NoError(t, err)
+		defer l.Close()
+		srv := &ftpServer{L: zap.NewNop(), cfg: cfg}
+		go func() {
+			_ = srv.conns.serve(context.Background(), l, func(conn net.Conn) {
+				srv.newSession(context.Background(), testFTPFs(t), conn).serve()
+			})
+		}()
+
+		conn, err := net.Dial("unix", path)
+		require.NoError(t, err)
+		defer conn.Close()
+		c := &ftpClient{t: t, Conn: textproto.NewConn(conn), conn: conn}
+		c.expect(220)
+		c.login("anonymous", "me@example.com")
+		c.cmd(425, "PASV")
+		c.cmd(425, "EPSV")
+	})
+}
+
+func TestListLine(t *testing.T) {
+	now := time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC)
+	fs := afero.NewMemMapFs()
+	require.NoError(t, afero.WriteFile(fs, "/recent.epub", []byte("PK"), 0644))
+	require.NoError(t, fs.Chtimes("/recent.epub", testFTPTime, testFTPTime))
+	require.NoError(t, afero.WriteFile(fs, "/old.epub", []byte("PK"), 0644))
+	old := time.Date(2019, 1, 2, 3, 4, 5, 0, time.UTC)
+	require.NoError(t, fs.Chtimes("/old.epub", old, old))
+	require.NoError(t, fs.MkdirAll("/dir", 0755))
+	require.NoError(t, fs.Chtimes("/dir", testFTPTime, testFTPTime))
+
+	testdata := map[string]string{
+		"/recent.epub": "-r--r--r-- 1 ftp ftp            2 May  1 12:00 recent.epub",
+		"/old.epub":    "-r--r--r-- 1 ftp ftp            2 Jan  2  2019 old.epub",
+	}
+	for p, line := range testdata {
+		t.Run(p, func(t *testing.T) {
+			info, err := fs.Stat(p)
+			require.NoError(t, err)
+			assert.Equal(t, line, listLine(info, now))
+		})
+	}
+	t.Run("/dir", func(t *testing.T) {
+		info, err := fs.Stat("/dir")
+		require.NoError(t, err)
+		assert.Regexp(t, `^dr-xr-xr-x 1 ftp ftp +\d+ May  1 12:00 dir$`, listLine(info, now))
+	})
+}
+
+func TestParsePortRange(t *testing.T) {
+	testdata := map[string]struct {
+		min, max int
+		err      bool
+	}{
+		"":              {0, 0, false},
+		"50000-50100":   {50000, 50100, false},
+		"50000":         {50000, 50000, false},
+		"50000 - 50001": {50000, 50001, false},
+		"50100-50000":   {0, 0, true},
+		"0-10":          {0, 0, true},
+		"1-70000":       {0, 0, true},
+		"a-b":           {0, 0, true},
+	}
+	for s, tdata := range testdata {
+		t.Run(strconv.Quote(s), func(t *testing.T) {
+			min, max, err := parsePortRange(s)
+			if tdata.err {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tdata.min, min)
+			assert.Equal(t, tdata.max, max)
+		})
+	}
+}
+
+func TestStripListFlags(t *testing.T) {
+	for in, out := range map[string]string{
+		"":            "",
+		"-la":         "",
+		"-la /books":  "/books",
+		"-l -a books": "books",
+		"books":       "books",
+	} {
+		assert.Equal(t, out, stripListFlags(in), in)
+	}
+}
+
+var _ io.Writer = &countingWriter{}
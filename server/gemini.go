@@ -0,0 +1,265 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/url"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/afero"
+	"go.uber.org/zap"
+
+	"github.com/liclac/sharlayan/builder/gemini"
+	"github.com/liclac/sharlayan/calibre"
+	"github.com/liclac/sharlayan/config"
+	"github.com/liclac/sharlayan/metrics"
+)
+
+// Gemini clients pin a server's certificate the first time they see it ("trust on first use"),
+// and complain loudly when it changes, so generated ones should last practically forever.
+const geminiCertValidity = 100 * 365 * 24 * time.Hour
+
+// Time allowed to send a request. Responses aren't limited, so books can take a while.
+const geminiRequestTimeout = 30 * time.Second
+
+// Requests are a URL of at most this many bytes, followed by CRLF.
+const geminiMaxRequest = 1024
+
+// Gemini status codes; see the specification, section 3.2.
+const (
+	geminiSuccess          = 20
+	geminiRedirect         = 31 // Permanent.
+	geminiTemporaryFailure = 40
+	geminiNotFound         = 51
+	geminiProxyRefused     = 53
+	geminiBadRequest       = 59
+)
+
+type geminiServer struct {
+	L     *zap.Logger
+	cfg   *config.Config
+	conns connTracker
+}
+
+// A Gemini server, for the library rendered as gemtext; see builder/gemini. Everyone is
+// anonymous, as Gemini has no passwords; client certificates aren't supported (yet).
+func Gemini(cfg *config.Config) Server {
+	L := zap.L().Named("gemini")
+	if !cfg.Gemini.Enable {
+		L.Debug("Not enabled, skipping...")
+		return nil
+	}
+	metrics.NotReady("gemini")
+	return &geminiServer{L: L, cfg: cfg}
+}
+
+// Returns the paths to the Gemini server's certificate and key, generating a self-signed pair
+// if neither exists. Unless configured, they're ${config.dir}/gemini.crt and gemini.key.
+func LoadOrGenerateGeminiCertificate(cfg *config.Config) (certPath, keyPath string, err error) {
+	hosts := certHosts(cfg.Gemini.Addrs)
+	if cfg.Gemini.Hostname != "" {
+		hosts = append([]string{cfg.Gemini.Hostname}, hosts...) // It's the CommonName.
+	}
+	return loadOrGenerateCertificate(cfg.Gemini.Cert, cfg.Gemini.Key,
+		filepath.Join(cfg.Config.Dir, "gemini"), hosts, geminiCertValidity)
+}
+
+func (s *geminiServer) Run(ctx context.Context, fs afero.Fs) error {
+	certPath, keyPath, err := LoadOrGenerateGeminiCertificate(s.cfg)
+	if err != nil {
+		return fmt.Errorf("gemini: %w", err)
+	}
+	certs, err := newCertReloader(s.L.Named("tls"), certPath, keyPath)
+	if err != nil {
+		return fmt.Errorf("gemini: %w", err)
+	}
+	certs.logCert("Certificate")
+	if cert, _ := certs.GetCertificate(nil); cert != nil {
+		// What TOFU clients show, so users can check it's really us.
+		sum := sha256.Sum256(cert.Leaf.Raw)
+		s.L.Info("Certificate fingerprint", zap.String("sha256", hex.EncodeToString(sum[:])))
+	}
+	go certs.watch(ctx, certReloadInterval)
+
+	rawL, err := Listen(ctx, s.cfg, s.cfg.Gemini.Addrs...)
+	if err != nil {
+		return fmt.Errorf("gemini: couldn't listen: %w", err)
+	}
+	l := tls.NewListener(rawL, &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: certs.GetCertificate,
+		ClientAuth:     tls.RequestClientCert, // Some clients insist on sending one.
+	})
+	go func() {
+		<-ctx.Done()
+		if err := l.Close(); err != nil {
+			s.L.Error("Error closing listener", zap.Error(err))
+		}
+	}()
+	s.L.Info("Listening", zap.Stringer("addr", l.Addr()))
+	metrics.Ready("gemini")
+	defer s.shutdown()
+
+	if err := s.conns.serve(ctx, l, func(conn net.Conn) { s.serve(fs, conn) }); err != nil {
+		return fmt.Errorf("gemini: accept: %w", err)
+	}
+	return nil
+}
+
+func (s *geminiServer) shutdown() {
+	metrics.NotReady("gemini")
+	s.conns.shutdown(s.L, s.cfg.Gemini.Grace)
+}
+
+// Serves a single request; Gemini closes the connection after every response.
+func (s *geminiServer) serve(fs afero.Fs, conn net.Conn) {
+	start := time.Now()
+	L := s.L.With(zap.Stringer("addr", conn.RemoteAddr()))
+	if err := conn.SetDeadline(start.Add(geminiRequestTimeout)); err != nil {
+		L.Error("Couldn't set request deadline", zap.Error(err))
+		return
+	}
+	line, err := readGeminiRequest(conn)
+	if err != nil {
+		L.Debug("Couldn't read request", zap.Error(err))
+		if err != io.EOF && !isTimeout(err) {
+			rw := &geminiResponse{w: conn}
+			rw.header(geminiBadRequest, "Bad request")
+		}
+		return
+	}
+	_ = conn.SetDeadline(time.Time{})
+
+	rw := &geminiResponse{w: conn}
+	s.handle(L, fs, rw, line)
+	L.Info("Request", zap.String("url", line), zap.Int("status", rw.status),
+		zap.Int64("size", rw.size), zap.Duration("t", time.Since(start)))
+	geminiRequests.Inc(strconv.Itoa(rw.status))
+}
+
+// Reads a request line, without the CRLF.
+func readGeminiRequest(r io.Reader) (string, error) {
+	br := bufio.NewReaderSize(io.LimitReader(r, geminiMaxRequest+2), geminiMaxRequest+2)
+	line, err := br.ReadString('\n')
+	if err != nil {
+		if err == io.EOF && line != "" {
+			return "", fmt.Errorf("request too long, or not terminated")
+		}
+		return "", err
+	}
+	if !strings.HasSuffix(line, "\r\n") {
+		return "", fmt.Errorf("request not terminated with CRLF")
+	}
+	return strings.TrimSuffix(line, "\r\n"), nil
+}
+
+// Answers a request line, with a file or gemtext page from the tree.
+func (s *geminiServer) handle(L *zap.Logger, fs afero.Fs, rw *geminiResponse, line string) {
+	u, err := url.Parse(line)
+	switch {
+	case err != nil || !u.IsAbs() || u.Host == "" || u.User != nil:
+		rw.header(geminiBadRequest, "Bad request")
+		return
+	case u.Scheme != "gemini":
+		rw.header(geminiProxyRefused, "Only gemini:// URLs are served here")
+		return
+	case s.cfg.Gemini.Hostname != "" && !strings.EqualFold(u.Hostname(), s.cfg.Gemini.Hostname):
+		rw.header(geminiProxyRefused, "Not this host")
+		return
+	}
+
+	userFs, err := ForUser(fs, "")
+	if err != nil {
+		L.Error("Couldn't get filesystem", zap.Error(err))
+		rw.header(geminiTemporaryFailure, "Internal error")
+		return
+	}
+	p := path.Clean("/" + u.Path)
+	info, err := userFs.Stat(p)
+	if err != nil {
+		rw.header(geminiNotFound, "Not found")
+		return
+	}
+	if info.IsDir() {
+		if !strings.HasSuffix(u.Path, "/") {
+			// Otherwise, relative links on the page would be resolved against the parent.
+			target := *u
+			target.Path = strings.TrimSuffix(p, "/") + "/"
+			rw.header(geminiRedirect, target.String())
+			return
+		}
+		p = path.Join(p, gemini.IndexFile)
+	}
+
+	f, err := userFs.Open(p)
+	if err != nil {
+		rw.header(geminiNotFound, "Not found")
+		return
+	}
+	defer f.Close()
+	if info, err := f.Stat(); err != nil || info.IsDir() {
+		rw.header(geminiNotFound, "Not found")
+		return
+	}
+	if !rw.header(geminiSuccess, geminiMIMEType(p)) {
+		return
+	}
+	if _, err := io.Copy(rw, f); err != nil {
+		L.Debug("Response interrupted", zap.String("path", p), zap.Error(err))
+	}
+}
+
+// Returns the MIME type for a file; gemtext, book formats, then Go's table.
+func geminiMIMEType(p string) string {
+	ext := path.Ext(p)
+	if ext == ".gmi" {
+		return "text/gemini; charset=utf-8"
+	}
+	if typ := calibre.FormatMIMEType(ext); typ != "" {
+		return typ
+	}
+	if typ := mime.TypeByExtension(ext); typ != "" {
+		return typ
+	}
+	return "application/octet-stream"
+}
+
+// A response being written, which remembers its status and size for logging.
+type geminiResponse struct {
+	w      io.Writer
+	status int
+	size   int64
+	err    error
+}
+
+// Writes the response header; returns false if that failed.
+func (rw *geminiResponse) header(status int, meta string) bool {
+	rw.status = status
+	_, rw.err = fmt.Fprintf(rw.w, "%d %s\r\n", status, meta)
+	return rw.err == nil
+}
+
+func (rw *geminiResponse) Write(data []byte) (int, error) {
+	n, err := rw.w.Write(data)
+	rw.size += int64(n)
+	if err != nil {
+		rw.err = err
+	}
+	return n, err
+}
+
+func isTimeout(err error) bool {
+	ne, ok := err.(net.Error)
+	return ok && ne.Timeout()
+}
@@ -0,0 +1,115 @@
+package server
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/liclac/sharlayan/config"
+)
+
+func TestReadGeminiRequest(t *testing.T) {
+	testdata := map[string]struct {
+		in, line string
+		err      bool
+	}{
+		"OK":        {"gemini://localhost/books/\r\n", "gemini://localhost/books/", false},
+		"Trailing":  {"gemini://localhost/\r\nmore", "gemini://localhost/", false},
+		"LF":        {"gemini://localhost/\n", "", true},
+		"Short":     {"gemini://localhost/", "", true},
+		"Empty":     {"", "", true},
+		"Max":       {"gemini://x/" + strings.Repeat("a", 1024-11) + "\r\n", "gemini://x/" + strings.Repeat("a", 1024-11), false},
+		"TooLong":   {"gemini://x/" + strings.Repeat("a", 1024-10) + "\r\n", "", true},
+		"Unlimited": {strings.Repeat("a", 1<<20), "", true},
+	}
+	for name, tdata := range testdata {
+		t.Run(name, func(t *testing.T) {
+			line, err := readGeminiRequest(strings.NewReader(tdata.in))
+			if tdata.err {
+				assert.Error(t, err)
+			} else {
+				require.NoError(t, err)
+				assert.Equal(t, tdata.line, line)
+			}
+		})
+	}
+}
+
+func TestGeminiHandle(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	require.NoError(t, afero.WriteFile(fs, "/index.gmi", []byte("# Library\n"), 0644))
+	require.NoError(t, afero.WriteFile(fs, "/index.html", []byte("<h1>Library</h1>"), 0644))
+	require.NoError(t, afero.WriteFile(fs, "/books/4/index.gmi", []byte("# Book\n"), 0644))
+	require.NoError(t, afero.WriteFile(fs, "/books/4/4.epub", []byte("PK"), 0644))
+	require.NoError(t, afero.WriteFile(fs, "/books/4/cover.jpg", []byte("JPEG"), 0644))
+	require.NoError(t, fs.MkdirAll("/empty", 0755))
+
+	cfg := &config.Config{}
+	cfg.Gemini.Hostname = "books.example.com"
+	assert.Nil(t, Gemini(cfg), "not enabled")
+	srv := &geminiServer{L: zap.NewNop(), cfg: cfg}
+
+	testdata := map[string]struct {
+		url, resp string
+	}{
+		"Root":        {"gemini://books.example.com/", "20 text/gemini; charset=utf-8\r\n# Library\n"},
+		"RootNoSlash": {"gemini://books.example.com", "31 gemini://books.example.com/\r\n"},
+		"Port":        {"gemini://books.example.com:1965/", "20 text/gemini; charset=utf-8\r\n# Library\n"},
+		"Case":        {"gemini://BOOKS.example.com/", "20 text/gemini; charset=utf-8\r\n# Library\n"},
+		"Dir":         {"gemini://books.example.com/books/4/", "20 text/gemini; charset=utf-8\r\n# Book\n"},
+		"DirNoSlash":  {"gemini://books.example.com/books/4?q", "31 gemini://books.example.com/books/4/?q\r\n"},
+		"Page":        {"gemini://books.example.com/books/4/index.gmi", "20 text/gemini; charset=utf-8\r\n# Book\n"},
+		"Book":        {"gemini://books.example.com/books/4/4.epub", "20 application/epub+zip\r\nPK"},
+		"Cover":       {"gemini://books.example.com/books/4/cover.jpg", "20 image/jpeg\r\nJPEG"},
+		"HTML":        {"gemini://books.example.com/index.html", "20 text/html; charset=utf-8\r\n<h1>Library</h1>"},
+		"Escaped":     {"gemini://books.example.com/books/%34/", "20 text/gemini; charset=utf-8\r\n# Book\n"},
+		"Traversal":   {"gemini://books.example.com/../../index.gmi", "20 text/gemini; charset=utf-8\r\n# Library\n"},
+		"Missing":     {"gemini://books.example.com/books/5/", "51 Not found\r\n"},
+		"NoIndex":     {"gemini://books.example.com/empty/", "51 Not found\r\n"},
+		"OtherHost":   {"gemini://example.com/", "53 Not this host\r\n"},
+		"HTTP":        {"https://books.example.com/", "53 Only gemini:// URLs are served here\r\n"},
+		"Relative":    {"/books/4/", "59 Bad request\r\n"},
+		"Userinfo":    {"gemini://me@books.example.com/", "59 Bad request\r\n"},
+		"Garbage":     {"gemini://%zz", "59 Bad request\r\n"},
+	}
+	for name, tdata := range testdata {
+		t.Run(name, func(t *testing.T) {
+			var buf bytes.Buffer
+			rw := &geminiResponse{w: &buf}
+			srv.handle(zap.NewNop(), fs, rw, tdata.url)
+			assert.Equal(t, tdata.resp, buf.String())
+			assert.Equal(t, int64(strings.Index(tdata.resp, "\r\n")+2), int64(buf.Len())-rw.size)
+		})
+	}
+}
+
+func TestLoadOrGenerateGeminiCertificate(t *testing.T) {
+	cfg := &config.Config{}
+	cfg.Config.Dir = t.TempDir()
+	cfg.Gemini.Addrs = []string{"0.0.0.0:1965"}
+	cfg.Gemini.Hostname = "books.example.com"
+
+	certPath, keyPath, err := LoadOrGenerateGeminiCertificate(cfg)
+	require.NoError(t, err)
+	assert.Equal(t, filepath.Join(cfg.Config.Dir, "gemini.crt"), certPath)
+	assert.Equal(t, filepath.Join(cfg.Config.Dir, "gemini.key"), keyPath)
+
+	data, err := ioutil.ReadFile(certPath)
+	require.NoError(t, err)
+	block, _ := pem.Decode(data)
+	require.NotNil(t, block)
+	cert, err := x509.ParseCertificate(block.Bytes)
+	require.NoError(t, err)
+	assert.Equal(t, "books.example.com", cert.Subject.CommonName, "TOFU clients check the CN")
+	assert.Equal(t, []string{"books.example.com", "localhost"}, cert.DNSNames)
+	assert.True(t, cert.NotAfter.Sub(cert.NotBefore) > 50*certValidity, "should practically never expire")
+}
@@ -0,0 +1,256 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"html"
+	"io"
+	"net"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/afero"
+	"go.uber.org/zap"
+
+	"github.com/liclac/sharlayan/builder/gopher"
+	"github.com/liclac/sharlayan/config"
+	"github.com/liclac/sharlayan/metrics"
+)
+
+// Time allowed to send a selector. Responses aren't limited, so books can take a while.
+const gopherRequestTimeout = 30 * time.Second
+
+// Requests are a selector, optionally followed by a tab and search terms, then CRLF. RFC 1436
+// limits selectors to 255 characters, but nobody minds a few more.
+const gopherMaxRequest = 1024
+
+type gopherServer struct {
+	L     *zap.Logger
+	cfg   *config.Config
+	conns connTracker
+
+	host, port string // Where menus point clients, see gopher.hostname and gopher.port.
+}
+
+// A Gopher server, for the library rendered as gophermaps; see builder/gopher. Gopher has no
+// concept of logging in, so everyone is anonymous, and there's no encryption either.
+func Gopher(cfg *config.Config) Server {
+	L := zap.L().Named("gopher")
+	if !cfg.Gopher.Enable {
+		L.Debug("Not enabled, skipping...")
+		return nil
+	}
+	metrics.NotReady("gopher")
+	return &gopherServer{L: L, cfg: cfg}
+}
+
+func (s *gopherServer) Run(ctx context.Context, fs afero.Fs) error {
+	l, err := Listen(ctx, s.cfg, s.cfg.Gopher.Addrs...)
+	if err != nil {
+		return fmt.Errorf("gopher: couldn't listen: %w", err)
+	}
+	go func() {
+		<-ctx.Done()
+		if err := l.Close(); err != nil {
+			s.L.Error("Error closing listener", zap.Error(err))
+		}
+	}()
+	s.host, s.port = gopherMenuAddr(s.cfg, l.Addr())
+	if s.cfg.Gopher.Hostname == "" && s.host == "localhost" {
+		s.L.Warn("gopher.hostname isn't set; menus will only work on this machine")
+	}
+	s.L.Info("Listening", zap.Stringer("addr", l.Addr()), zap.String("host", s.host), zap.String("port", s.port))
+	metrics.Ready("gopher")
+	defer s.shutdown()
+
+	if err := s.conns.serve(ctx, l, func(conn net.Conn) { s.serve(fs, conn) }); err != nil {
+		return fmt.Errorf("gopher: accept: %w", err)
+	}
+	return nil
+}
+
+func (s *gopherServer) shutdown() {
+	metrics.NotReady("gopher")
+	s.conns.shutdown(s.L, s.cfg.Gopher.Grace)
+}
+
+// Returns the host and port menus should point clients to: gopher.hostname and gopher.port if
+// set, otherwise the (first TCP) address we're listening on, or localhost if that's every
+// address, or we're only listening on Unix sockets.
+func gopherMenuAddr(cfg *config.Config, addr net.Addr) (host, port string) {
+	host, port = "localhost", "70"
+	if tcp := tcpAddr(addr); tcp != nil {
+		port = strconv.Itoa(tcp.Port)
+		if tcp.IP != nil && !tcp.IP.IsUnspecified() {
+			host = tcp.IP.String()
+		}
+	}
+	if cfg.Gopher.Hostname != "" {
+		host = cfg.Gopher.Hostname
+	}
+	if cfg.Gopher.Port != 0 {
+		port = strconv.Itoa(cfg.Gopher.Port)
+	}
+	return host, port
+}
+
+// Serves a single request; Gopher closes the connection after every response.
+func (s *gopherServer) serve(fs afero.Fs, conn net.Conn) {
+	start := time.Now()
+	L := s.L.With(zap.Stringer("addr", conn.RemoteAddr()))
+	if err := conn.SetDeadline(start.Add(gopherRequestTimeout)); err != nil {
+		L.Error("Couldn't set request deadline", zap.Error(err))
+		return
+	}
+	selector, err := readGopherRequest(conn)
+	if err != nil {
+		L.Debug("Couldn't read request", zap.Error(err))
+		if err != io.EOF && !isTimeout(err) {
+			s.gopherError(&gopherResponse{w: conn}, "Bad request")
+		}
+		return
+	}
+	_ = conn.SetDeadline(time.Time{})
+
+	rw := &gopherResponse{w: conn}
+	s.handle(L, fs, rw, selector)
+	L.Info("Request", zap.String("selector", selector), zap.String("type", rw.kind),
+		zap.Int64("size", rw.size), zap.Duration("t", time.Since(start)))
+	gopherRequests.Inc(rw.kind)
+}
+
+// Reads a request's selector, without search terms (which we don't support) or the line ending.
+// RFC 1436 says lines end with CRLF, but some clients only send LF.
+func readGopherRequest(r io.Reader) (string, error) {
+	br := bufio.NewReaderSize(io.LimitReader(r, gopherMaxRequest+2), gopherMaxRequest+2)
+	line, err := br.ReadString('\n')
+	if err != nil {
+		if err == io.EOF && line != "" {
+			return "", fmt.Errorf("request too long, or not terminated")
+		}
+		return "", err
+	}
+	line = strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r")
+	if i := strings.IndexByte(line, '\t'); i != -1 {
+		line = line[:i]
+	}
+	return line, nil
+}
+
+// Answers a selector, with a menu or file from the tree.
+func (s *gopherServer) handle(L *zap.Logger, fs afero.Fs, rw *gopherResponse, selector string) {
+	if strings.HasPrefix(selector, "URL:") {
+		s.gopherURL(rw, strings.TrimPrefix(selector, "URL:"))
+		return
+	}
+
+	userFs, err := ForUser(fs, "")
+	if err != nil {
+		L.Error("Couldn't get filesystem", zap.Error(err))
+		s.gopherError(rw, "Internal error")
+		return
+	}
+	p := path.Clean("/" + selector)
+	info, err := userFs.Stat(p)
+	if err != nil {
+		s.gopherError(rw, "Not found")
+		return
+	}
+	dir := p
+	if info.IsDir() {
+		p = path.Join(p, gopher.MapFile)
+	} else {
+		dir = path.Dir(p)
+	}
+
+	f, err := userFs.Open(p)
+	if err != nil {
+		s.gopherError(rw, "Not found")
+		return
+	}
+	defer f.Close()
+	if info, err := f.Stat(); err != nil || info.IsDir() {
+		s.gopherError(rw, "Not found")
+		return
+	}
+	if path.Base(p) == gopher.MapFile {
+		rw.kind = "menu"
+		err = s.writeMenu(rw, f, dir)
+	} else {
+		rw.kind = "file"
+		_, err = io.Copy(rw, f)
+	}
+	if err != nil {
+		L.Debug("Response interrupted", zap.String("path", p), zap.Error(err))
+	}
+}
+
+// Turns a gophermap from builder/gopher (or one written for Gophernicus, mostly) into a menu,
+// filling in our host and port, and resolving relative selectors against its directory.
+func (s *gopherServer) writeMenu(w io.Writer, r io.Reader, dir string) error {
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		line := strings.TrimSuffix(sc.Text(), "\r")
+		if !strings.Contains(line, "\t") {
+			line = "i" + line + "\t" // Anything else is just text.
+		}
+		fields := strings.SplitN(line, "\t", 4)
+		name, selector := fields[0], fields[1]
+		host, port := s.host, s.port
+		if len(fields) > 2 && fields[2] != "" {
+			host = fields[2]
+		}
+		if len(fields) > 3 && fields[3] != "" {
+			port = fields[3]
+		}
+		if selector != "" && !strings.HasPrefix(selector, "/") && !strings.HasPrefix(selector, "URL:") {
+			trailing := strings.HasSuffix(selector, "/")
+			selector = path.Join(dir, selector)
+			if trailing {
+				selector += "/"
+			}
+		}
+		if _, err := fmt.Fprintf(w, "%s\t%s\t%s\t%s\r\n", name, selector, host, port); err != nil {
+			return err
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, ".\r\n")
+	return err
+}
+
+// Writes an error menu; an item of type 3, see RFC 1436, section 3.8.
+func (s *gopherServer) gopherError(rw *gopherResponse, msg string) {
+	rw.kind = "error"
+	fmt.Fprintf(rw, "3%s\t\t%s\t%s\r\n.\r\n", msg, s.host, s.port)
+}
+
+// Answers a "URL:" selector, which clients that don't understand "h" items (links to the web)
+// request from us, with a page that redirects to it; a convention from gopher.floodgap.com.
+func (s *gopherServer) gopherURL(rw *gopherResponse, target string) {
+	rw.kind = "url"
+	target = html.EscapeString(target)
+	fmt.Fprintf(rw, `<html>
+<head><meta http-equiv="refresh" content="0;url=%s"></head>
+<body>You're following a link from Gopher to the web: <a href="%s">%s</a></body>
+</html>
+`, target, target, target)
+}
+
+// A response being written, which remembers its type and size for logging.
+type gopherResponse struct {
+	w    io.Writer
+	kind string // "menu", "file", "url" or "error".
+	size int64
+}
+
+func (rw *gopherResponse) Write(data []byte) (int, error) {
+	n, err := rw.w.Write(data)
+	rw.size += int64(n)
+	return n, err
+}
@@ -0,0 +1,127 @@
+package server
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/liclac/sharlayan/config"
+)
+
+func TestReadGopherRequest(t *testing.T) {
+	testdata := map[string]struct {
+		in, selector string
+		err          bool
+	}{
+		"OK":         {"/books/\r\n", "/books/", false},
+		"Root":       {"\r\n", "", false},
+		"LF":         {"/books/\n", "/books/", false},
+		"Search":     {"/search\tpratchett\r\n", "/search", false},
+		"GopherPlus": {"/books/\t$\r\n", "/books/", false},
+		"Short":      {"/books/", "", true},
+		"Empty":      {"", "", true},
+		"Unlimited":  {strings.Repeat("a", 1<<20), "", true},
+	}
+	for name, tdata := range testdata {
+		t.Run(name, func(t *testing.T) {
+			selector, err := readGopherRequest(strings.NewReader(tdata.in))
+			if tdata.err {
+				assert.Error(t, err)
+			} else {
+				require.NoError(t, err)
+				assert.Equal(t, tdata.selector, selector)
+			}
+		})
+	}
+}
+
+func TestGopherHandle(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	require.NoError(t, afero.WriteFile(fs, "/gophermap", []byte("iLibrary\t\n1Books\t/books/\n"), 0644))
+	require.NoError(t, afero.WriteFile(fs, "/books/4/gophermap", []byte(""+
+		"iThe Fifth Elephant\t\n"+
+		"Plain text\n"+
+		"0About this book\tabout.txt\n"+
+		"1Up\t../\n"+
+		"1Elsewhere\t/\texample.com\t70\n"+
+		"hISBN\tURL:https://example.com/?a=1&b=2\n"), 0644))
+	require.NoError(t, afero.WriteFile(fs, "/books/4/about.txt", []byte("The Fifth Elephant\n"), 0644))
+	require.NoError(t, afero.WriteFile(fs, "/books/4/4.epub", []byte("PK"), 0644))
+	require.NoError(t, fs.MkdirAll("/empty", 0755))
+
+	cfg := &config.Config{}
+	assert.Nil(t, Gopher(cfg), "not enabled")
+	srv := &gopherServer{L: zap.NewNop(), cfg: cfg, host: "books.example.com", port: "70"}
+
+	testdata := map[string]struct {
+		selector, kind, resp string
+	}{
+		"Root":      {"", "menu", "iLibrary\t\tbooks.example.com\t70\r\n1Books\t/books/\tbooks.example.com\t70\r\n.\r\n"},
+		"RootSlash": {"/", "menu", "iLibrary\t\tbooks.example.com\t70\r\n1Books\t/books/\tbooks.example.com\t70\r\n.\r\n"},
+		"Book": {"/books/4", "menu", "" +
+			"iThe Fifth Elephant\t\tbooks.example.com\t70\r\n" +
+			"iPlain text\t\tbooks.example.com\t70\r\n" +
+			"0About this book\t/books/4/about.txt\tbooks.example.com\t70\r\n" +
+			"1Up\t/books/\tbooks.example.com\t70\r\n" +
+			"1Elsewhere\t/\texample.com\t70\r\n" +
+			"hISBN\tURL:https://example.com/?a=1&b=2\tbooks.example.com\t70\r\n" +
+			".\r\n"},
+		"About":     {"/books/4/about.txt", "file", "The Fifth Elephant\n"},
+		"File":      {"books/4/4.epub", "file", "PK"},
+		"Traversal": {"/../../books/4/4.epub", "file", "PK"},
+		"Missing":   {"/books/5/", "error", "3Not found\t\tbooks.example.com\t70\r\n.\r\n"},
+		"NoMap":     {"/empty/", "error", "3Not found\t\tbooks.example.com\t70\r\n.\r\n"},
+		"URL": {"URL:https://example.com/?a=1&b=2", "url", `<html>
+<head><meta http-equiv="refresh" content="0;url=https://example.com/?a=1&amp;b=2"></head>
+<body>You're following a link from Gopher to the web: <a href="https://example.com/?a=1&amp;b=2">https://example.com/?a=1&amp;b=2</a></body>
+</html>
+`},
+	}
+	for name, tdata := range testdata {
+		t.Run(name, func(t *testing.T) {
+			var buf bytes.Buffer
+			rw := &gopherResponse{w: &buf}
+			srv.handle(zap.NewNop(), fs, rw, tdata.selector)
+			assert.Equal(t, tdata.resp, buf.String())
+			assert.Equal(t, tdata.kind, rw.kind)
+			assert.Equal(t, int64(buf.Len()), rw.size)
+		})
+	}
+}
+
+func TestGopherMenuAddr(t *testing.T) {
+	testdata := map[string]struct {
+		addr       string
+		hostname   string
+		port       int
+		host, want string
+	}{
+		"Listening":   {"127.0.0.1:7070", "", 0, "127.0.0.1", "7070"},
+		"Unspecified": {"0.0.0.0:7070", "", 0, "localhost", "7070"},
+		"IPv6":        {"[::]:7070", "", 0, "localhost", "7070"},
+		"Configured":  {"0.0.0.0:7070", "books.example.com", 70, "books.example.com", "70"},
+		"Unix":        {"unix:/run/sharlayan.sock", "", 0, "localhost", "70"},
+	}
+	for name, tdata := range testdata {
+		t.Run(name, func(t *testing.T) {
+			cfg := &config.Config{}
+			cfg.Gopher.Hostname = tdata.hostname
+			cfg.Gopher.Port = tdata.port
+			var addr net.Addr = &net.UnixAddr{Name: strings.TrimPrefix(tdata.addr, "unix:"), Net: "unix"}
+			if !strings.HasPrefix(tdata.addr, "unix:") {
+				tcp, err := net.ResolveTCPAddr("tcp", tdata.addr)
+				require.NoError(t, err)
+				addr = tcp
+			}
+			host, port := gopherMenuAddr(cfg, addr)
+			assert.Equal(t, tdata.host, host)
+			assert.Equal(t, tdata.want, port)
+		})
+	}
+}
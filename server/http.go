@@ -3,14 +3,18 @@ package server
 import (
 	"context"
 	"fmt"
+	"io"
 	"net"
 	"net/http"
+	"os"
+	"strconv"
 	"time"
 
 	"github.com/spf13/afero"
 	"go.uber.org/zap"
 
 	"github.com/liclac/sharlayan/config"
+	"github.com/liclac/sharlayan/metrics"
 )
 
 type httpServer struct {
@@ -24,37 +28,136 @@ func HTTP(cfg *config.Config) Server {
 		L.Debug("Not enabled")
 		return nil
 	}
+	metrics.NotReady("http")
 	return httpServer{L, cfg}
 }
 
 func (s httpServer) Run(ctx context.Context, fs afero.Fs) error {
-	// HTTP server which gracefully shuts down with the context.
-	srv := (&http.Server{
-		Handler:     http.FileServer(afero.NewHttpFs(fs)),
+	auth, err := newHTTPAuth(s.L.Named("auth"), s.cfg)
+	if err != nil {
+		return fmt.Errorf("http: %w", err)
+	}
+	h := s.handler(fs)
+	if s.cfg.HTTP.Compress {
+		h = compress(h)
+	}
+	h = auth.Wrap(noteUser(withCacheControl(s.cfg.HTTP.Cache, h)))
+	switch s.cfg.HTTP.AccessLog {
+	case "off":
+	case "on", "":
+		h = logRequests(s.L.Named("access"), nil, h)
+	case "combined":
+		w := io.Writer(os.Stdout)
+		if path := s.cfg.HTTP.AccessLogFile; path != "" {
+			f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+			if err != nil {
+				return fmt.Errorf("http: couldn't open access log: %w", err)
+			}
+			defer f.Close()
+			w = f
+		}
+		h = logRequests(s.L.Named("access"), w, h)
+	default:
+		return fmt.Errorf("http: unknown access log format: %s", s.cfg.HTTP.AccessLog)
+	}
+	srv := &http.Server{
+		Handler:     withRequestID(countRequests(h)),
 		BaseContext: func(net.Listener) context.Context { return ctx },
-	})
-	go func() {
-		<-ctx.Done()
-
-		timeout := 60 * time.Second
-		sctx, cancel := context.WithTimeout(context.Background(), timeout)
-		defer cancel()
-		s.L.Info("Gracefully shutting down...", zap.Duration("timeout", timeout))
-		if err := srv.Shutdown(sctx); err != nil {
-			s.L.Warn("Graceful shutdown failed", zap.Error(err))
+	}
+	if s.cfg.HTTP.TLS.Enable {
+		if srv.TLSConfig, err = httpTLSConfig(ctx, s.L.Named("tls"), s.cfg); err != nil {
+			return fmt.Errorf("http: %w", err)
 		}
-	}()
+	}
 
 	// Not using ListenAndServe only so that we can print the real address.
-	l, err := (&net.ListenConfig{}).Listen(ctx, "tcp", s.cfg.HTTP.Addr)
+	l, err := Listen(ctx, s.cfg, s.cfg.HTTP.Addrs...)
 	if err != nil {
 		return fmt.Errorf("http: couldn't listen: %w", err)
 	}
-	s.L.Info("Listening", zap.Stringer("addr", l.Addr()))
+	s.L.Info("Listening", zap.Stringer("addr", l.Addr()), zap.Bool("tls", srv.TLSConfig != nil))
+
+	// Optionally redirect plain HTTP to HTTPS, from another address. If that fails, so do we.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	errC := make(chan error, 1)
+	if srv.TLSConfig != nil && s.cfg.HTTP.TLS.Redirect != "" {
+		addr := tcpAddr(l.Addr())
+		if addr == nil {
+			l.Close()
+			return fmt.Errorf("http: http.tls.redirect needs a TCP address in http.addr to redirect to")
+		}
+		port := strconv.Itoa(addr.Port)
+		rl, err := Listen(ctx, s.cfg, s.cfg.HTTP.TLS.Redirect)
+		if err != nil {
+			l.Close()
+			return fmt.Errorf("http: couldn't listen for redirects: %w", err)
+		}
+		s.L.Info("Redirecting to HTTPS", zap.Stringer("addr", rl.Addr()))
+		rsrv := &http.Server{
+			Handler:     redirectHandler(port),
+			BaseContext: func(net.Listener) context.Context { return ctx },
+		}
+		go shutdownWith(ctx, s.L.Named("redirect"), rsrv, s.cfg.HTTP.Grace)
+		go func() {
+			if err := rsrv.Serve(rl); err != nil && err != http.ErrServerClosed {
+				errC <- fmt.Errorf("http: redirect server error: %w", err)
+				cancel()
+			}
+			close(errC)
+		}()
+	} else {
+		close(errC)
+	}
 
-	// Serve until the goroutine above calls srv.Shutdown().
-	if err := srv.Serve(l); err != nil && err != http.ErrServerClosed {
+	// Serve until shutdownWith() calls srv.Shutdown().
+	metrics.Ready("http")
+	defer metrics.NotReady("http")
+	go func() {
+		<-ctx.Done()
+		metrics.NotReady("http") // Stop sending us traffic while we finish up.
+		shutdownWith(ctx, s.L, srv, s.cfg.HTTP.Grace)
+	}()
+	if srv.TLSConfig != nil {
+		err = srv.ServeTLS(l, "", "")
+	} else {
+		err = srv.Serve(l)
+	}
+	if err != nil && err != http.ErrServerClosed {
 		return fmt.Errorf("http: server error: %w", err)
 	}
-	return nil
+	return <-errC
+}
+
+// Gracefully shuts down a server when the context expires.
+func shutdownWith(ctx context.Context, L *zap.Logger, srv *http.Server, timeout time.Duration) {
+	<-ctx.Done()
+
+	sctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	L.Info("Gracefully shutting down...", zap.Duration("timeout", timeout))
+	if err := srv.Shutdown(sctx); err != nil {
+		L.Warn("Graceful shutdown failed", zap.Error(err))
+	}
+}
+
+// Serves files from the part of the filesystem the request's user may see.
+func (s httpServer) handler(fs afero.Fs) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		user := UserFromContext(req.Context())
+		userFs, err := ForUser(fs, user)
+		if err != nil {
+			s.L.Error("Couldn't get filesystem for user", zap.Error(err))
+			http.Error(rw, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		meta, err := MetadataForUser(fs, user)
+		if err != nil {
+			s.L.Error("Couldn't get metadata for user", zap.Error(err))
+			http.Error(rw, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		files := http.FileServer(afero.NewHttpFs(userFs))
+		withDownloadHeaders(userFs, meta, withETag(userFs, files)).ServeHTTP(rw, req)
+	})
 }
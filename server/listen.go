@@ -0,0 +1,318 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/liclac/sharlayan/config"
+)
+
+// Prefixes for addresses that aren't TCP; see Listen.
+const (
+	unixPrefix    = "unix:"
+	systemdPrefix = "systemd:"
+)
+
+// The first file descriptor systemd passes; see sd_listen_fds(3).
+const listenFdsStart = 3
+
+var errListenerClosed = errors.New("use of closed network connection")
+
+// Listens on one or more addresses, which may be:
+//
+//   - "host:port", for TCP, eg. "127.0.0.1:3300", or ":3300" for every interface.
+//   - "unix:/path/to.sock", for a Unix socket, eg. for a reverse proxy on the same machine;
+//     its permissions are set from sockets.mode and sockets.group.
+//   - "systemd:name", for sockets passed in by systemd (socket activation), where name is the
+//     socket's FileDescriptorName=, which defaults to the unit's name, eg. "sharlayan.socket".
+//
+// Listening on several addresses returns a listener that accepts connections from all of them.
+//
+// Every server can listen on any of these, except:
+//
+//   - FTP needs TCP, to tell clients where to open data connections; see requireTCP.
+//   - HTTP's http.tls.redirect needs a TCP address in http.addr, to redirect to.
+//   - Gopher menus point to localhost:70 without one, unless gopher.hostname and .port are set.
+//   - SSH's per-IP limits see every client on a Unix socket as the same one.
+//   - HTTP only trusts http.auth.proxy-header over a Unix socket if http.auth.trusted-proxies
+//     includes "unix", and access logs show such clients as "@"; the proxy's logs have their IPs.
+func Listen(ctx context.Context, cfg *config.Config, addrs ...string) (net.Listener, error) {
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("no addresses to listen on")
+	}
+	var ls []net.Listener
+	for _, addr := range addrs {
+		l, err := listen(ctx, cfg, addr)
+		if err != nil {
+			for _, l := range ls {
+				l.Close()
+			}
+			return nil, err
+		}
+		ls = append(ls, l...)
+	}
+	if len(ls) == 1 {
+		return ls[0], nil
+	}
+	return newMultiListener(ls), nil
+}
+
+func listen(ctx context.Context, cfg *config.Config, addr string) ([]net.Listener, error) {
+	switch {
+	case strings.HasPrefix(addr, unixPrefix):
+		l, err := listenUnix(ctx, cfg, strings.TrimPrefix(addr, unixPrefix))
+		if err != nil {
+			return nil, err
+		}
+		return []net.Listener{l}, nil
+	case strings.HasPrefix(addr, systemdPrefix):
+		return systemdListeners(strings.TrimPrefix(addr, systemdPrefix))
+	default:
+		l, err := (&net.ListenConfig{}).Listen(ctx, "tcp", addr)
+		if err != nil {
+			return nil, err
+		}
+		return []net.Listener{l}, nil
+	}
+}
+
+// Listens on a Unix socket, replacing a stale one left behind by a crash; the socket is removed
+// again when the listener is closed.
+func listenUnix(ctx context.Context, cfg *config.Config, path string) (net.Listener, error) {
+	if info, err := os.Lstat(path); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s: exists, and isn't a socket", path)
+		}
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("%s: already in use", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, fmt.Errorf("%s: removing stale socket: %w", path, err)
+		}
+	}
+	l, err := (&net.ListenConfig{}).Listen(ctx, "unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := setSocketPerms(cfg, path); err != nil {
+		l.Close()
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return l, nil
+}
+
+func setSocketPerms(cfg *config.Config, path string) error {
+	if cfg.Sockets.Mode != "" {
+		mode, err := strconv.ParseUint(cfg.Sockets.Mode, 8, 32)
+		if err != nil {
+			return fmt.Errorf("invalid sockets.mode: %s", cfg.Sockets.Mode)
+		}
+		if err := os.Chmod(path, os.FileMode(mode)); err != nil {
+			return err
+		}
+	}
+	if cfg.Sockets.Group != "" {
+		g, err := user.LookupGroup(cfg.Sockets.Group)
+		if err != nil {
+			return fmt.Errorf("invalid sockets.group: %w", err)
+		}
+		gid, err := strconv.Atoi(g.Gid)
+		if err != nil {
+			return fmt.Errorf("invalid sockets.group: %w", err)
+		}
+		if err := os.Lchown(path, -1, gid); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+var (
+	systemdOnce  sync.Once
+	systemdMu    sync.Mutex
+	systemdFiles map[string][]*os.File // Passed-in sockets not yet listened on, by name.
+)
+
+// Returns listeners for the sockets systemd passed in with the given name. Each socket can
+// only be used once, by one server.
+func systemdListeners(name string) ([]net.Listener, error) {
+	systemdOnce.Do(func() { systemdFiles = systemdSockets() })
+	systemdMu.Lock()
+	defer systemdMu.Unlock()
+
+	files, ok := systemdFiles[name]
+	if !ok {
+		return nil, fmt.Errorf("%s%s: no such socket passed in by systemd (is the service socket activated?)", systemdPrefix, name)
+	}
+	delete(systemdFiles, name)
+	var ls []net.Listener
+	for _, f := range files {
+		l, err := net.FileListener(f) // Duplicates the file descriptor.
+		f.Close()
+		if err != nil {
+			for _, l := range ls {
+				l.Close()
+			}
+			return nil, fmt.Errorf("%s%s: %w", systemdPrefix, name, err)
+		}
+		ls = append(ls, l)
+	}
+	return ls, nil
+}
+
+// Reads the sockets systemd passed in, by name, from $LISTEN_FDS and $LISTEN_FDNAMES; see
+// sd_listen_fds(3). The variables are unset, so that child processes don't think they're for them.
+func systemdSockets() map[string][]*os.File {
+	defer func() {
+		os.Unsetenv("LISTEN_PID")
+		os.Unsetenv("LISTEN_FDS")
+		os.Unsetenv("LISTEN_FDNAMES")
+	}()
+	files := map[string][]*os.File{}
+	if pid, err := strconv.Atoi(os.Getenv("LISTEN_PID")); err != nil || pid != os.Getpid() {
+		return files
+	}
+	num, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || num <= 0 {
+		return files
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+	for i := 0; i < num; i++ {
+		fd := listenFdsStart + i
+		name := "unknown" // What systemd calls sockets without names.
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+		files[name] = append(files[name], os.NewFile(uintptr(fd), name))
+	}
+	return files
+}
+
+// Accepts connections from several listeners at once.
+type multiListener struct {
+	ls    []net.Listener
+	conns chan net.Conn
+	errs  chan error
+	done  chan struct{}
+	once  sync.Once
+}
+
+func newMultiListener(ls []net.Listener) *multiListener {
+	m := &multiListener{
+		ls:    ls,
+		conns: make(chan net.Conn),
+		errs:  make(chan error),
+		done:  make(chan struct{}),
+	}
+	for _, l := range ls {
+		go m.accept(l)
+	}
+	return m
+}
+
+func (m *multiListener) accept(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			select {
+			case m.errs <- err:
+			case <-m.done:
+				return
+			}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				continue
+			}
+			return
+		}
+		select {
+		case m.conns <- conn:
+		case <-m.done:
+			conn.Close()
+			return
+		}
+	}
+}
+
+func (m *multiListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-m.conns:
+		return conn, nil
+	case err := <-m.errs:
+		return nil, err
+	case <-m.done:
+		return nil, errListenerClosed
+	}
+}
+
+func (m *multiListener) Close() error {
+	var err error
+	m.once.Do(func() {
+		close(m.done)
+		for _, l := range m.ls {
+			if cerr := l.Close(); cerr != nil && err == nil {
+				err = cerr
+			}
+		}
+	})
+	return err
+}
+
+func (m *multiListener) Addr() net.Addr {
+	addrs := make(multiAddr, len(m.ls))
+	for i, l := range m.ls {
+		addrs[i] = l.Addr()
+	}
+	return addrs
+}
+
+// The addresses of a multiListener; mostly for logging.
+type multiAddr []net.Addr
+
+func (a multiAddr) Network() string { return "multi" }
+
+func (a multiAddr) String() string {
+	strs := make([]string, len(a))
+	for i, addr := range a {
+		strs[i] = addr.String()
+	}
+	return strings.Join(strs, ", ")
+}
+
+// Returns an error unless every address a listener is listening on is TCP; for protocols that
+// can't work without IP addresses, ie. FTP, which tells clients where to open data connections.
+func requireTCP(addr net.Addr) error {
+	addrs, ok := addr.(multiAddr)
+	if !ok {
+		addrs = multiAddr{addr}
+	}
+	for _, a := range addrs {
+		if _, ok := a.(*net.TCPAddr); !ok {
+			return fmt.Errorf("%s:%s: only TCP addresses are supported", a.Network(), a)
+		}
+	}
+	return nil
+}
+
+// Returns the first TCP address a listener is listening on, or nil if there isn't one, eg. if
+// it's only listening on a Unix socket.
+func tcpAddr(addr net.Addr) *net.TCPAddr {
+	switch addr := addr.(type) {
+	case *net.TCPAddr:
+		return addr
+	case multiAddr:
+		for _, a := range addr {
+			if tcp := tcpAddr(a); tcp != nil {
+				return tcp
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,161 @@
+package server
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/liclac/sharlayan/config"
+)
+
+// Dials a listener and checks that the connection is accepted.
+func testAccept(t *testing.T, l net.Listener, network, addr string) {
+	t.Helper()
+	conn, err := net.Dial(network, addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	sconn, err := l.Accept()
+	require.NoError(t, err)
+	sconn.Close()
+}
+
+func TestListen(t *testing.T) {
+	ctx := context.Background()
+	cfg := &config.Config{}
+	cfg.Sockets.Mode = "0600"
+
+	t.Run("None", func(t *testing.T) {
+		_, err := Listen(ctx, cfg)
+		assert.Error(t, err)
+	})
+	t.Run("TCP", func(t *testing.T) {
+		l, err := Listen(ctx, cfg, "127.0.0.1:0")
+		require.NoError(t, err)
+		defer l.Close()
+		testAccept(t, l, "tcp", l.Addr().String())
+		assert.NotNil(t, tcpAddr(l.Addr()))
+	})
+	t.Run("Unix", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "sharlayan.sock")
+		l, err := Listen(ctx, cfg, "unix:"+path)
+		require.NoError(t, err)
+		defer l.Close()
+		testAccept(t, l, "unix", path)
+		assert.Nil(t, tcpAddr(l.Addr()))
+
+		info, err := os.Stat(path)
+		require.NoError(t, err)
+		assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+		_, err = Listen(ctx, cfg, "unix:"+path)
+		assert.EqualError(t, err, path+": already in use")
+	})
+	t.Run("UnixStale", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "sharlayan.sock")
+		stale, err := net.Listen("unix", path)
+		require.NoError(t, err)
+		stale.(*net.UnixListener).SetUnlinkOnClose(false) // As if we'd crashed.
+		stale.Close()
+
+		l, err := Listen(ctx, cfg, "unix:"+path)
+		require.NoError(t, err)
+		defer l.Close()
+		testAccept(t, l, "unix", path)
+	})
+	t.Run("UnixNotSocket", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "sharlayan.sock")
+		require.NoError(t, ioutil.WriteFile(path, []byte("important"), 0644))
+		_, err := Listen(ctx, cfg, "unix:"+path)
+		assert.EqualError(t, err, path+": exists, and isn't a socket")
+	})
+	t.Run("Multiple", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "sharlayan.sock")
+		l, err := Listen(ctx, cfg, "127.0.0.1:0", "unix:"+path)
+		require.NoError(t, err)
+		tcp := tcpAddr(l.Addr())
+		require.NotNil(t, tcp)
+		assert.Equal(t, tcp.String()+", "+path, l.Addr().String())
+
+		testAccept(t, l, "tcp", tcp.String())
+		testAccept(t, l, "unix", path)
+		require.NoError(t, l.Close())
+		_, err = l.Accept()
+		assert.Error(t, err)
+		_, err = os.Stat(path)
+		assert.True(t, os.IsNotExist(err), "socket should be removed")
+	})
+	t.Run("MultipleFails", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "sharlayan.sock")
+		_, err := Listen(ctx, cfg, "unix:"+path, "256.0.0.1:0")
+		assert.Error(t, err)
+		_, err = os.Stat(path)
+		assert.True(t, os.IsNotExist(err), "socket should be cleaned up")
+	})
+}
+
+func TestSystemdSockets(t *testing.T) {
+	// Sockets for another process, eg. our parent, who forgot to unset them.
+	os.Setenv("LISTEN_PID", strconv.Itoa(os.Getppid()))
+	os.Setenv("LISTEN_FDS", "1")
+	os.Setenv("LISTEN_FDNAMES", "sharlayan.socket")
+	assert.Empty(t, systemdSockets())
+	for _, key := range []string{"LISTEN_PID", "LISTEN_FDS", "LISTEN_FDNAMES"} {
+		_, ok := os.LookupEnv(key)
+		assert.False(t, ok, key)
+	}
+}
+
+// Every server but FTP works on Unix sockets; see Listen.
+func TestListenServers(t *testing.T) {
+	testdata := map[string]struct {
+		configure func(cfg *config.Config, addr string)
+		server    func(cfg *config.Config) Server
+		err       bool
+	}{
+		"HTTP":    {func(cfg *config.Config, addr string) { cfg.HTTP.Enable, cfg.HTTP.Addrs = true, []string{addr} }, HTTP, false},
+		"WebDAV":  {func(cfg *config.Config, addr string) { cfg.WebDAV.Enable, cfg.WebDAV.Addrs = true, []string{addr} }, WebDAV, false},
+		"Gemini":  {func(cfg *config.Config, addr string) { cfg.Gemini.Enable, cfg.Gemini.Addrs = true, []string{addr} }, Gemini, false},
+		"Gopher":  {func(cfg *config.Config, addr string) { cfg.Gopher.Enable, cfg.Gopher.Addrs = true, []string{addr} }, Gopher, false},
+		"Metrics": {func(cfg *config.Config, addr string) { cfg.Metrics.Enable, cfg.Metrics.Addrs = true, []string{addr} }, Metrics, false},
+		"FTP":     {func(cfg *config.Config, addr string) { cfg.FTP.Enable, cfg.FTP.Addrs = true, []string{addr} }, FTP, true},
+	}
+	for name, tdata := range testdata {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			path := filepath.Join(dir, "sharlayan.sock")
+			cfg := &config.Config{}
+			cfg.Config.Dir = dir
+			tdata.configure(cfg, "unix:"+path)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			errC := make(chan error, 1)
+			go func() { errC <- tdata.server(cfg).Run(ctx, afero.NewMemMapFs()) }()
+			if tdata.err {
+				assert.Error(t, <-errC)
+				cancel()
+				return
+			}
+			var conn net.Conn
+			var err error
+			for i := 0; i < 50; i++ { // Wait for it to start listening.
+				if conn, err = net.Dial("unix", path); err == nil {
+					break
+				}
+				time.Sleep(20 * time.Millisecond)
+			}
+			require.NoError(t, err)
+			conn.Close()
+			cancel()
+			assert.NoError(t, <-errC)
+		})
+	}
+}
@@ -0,0 +1,149 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/afero"
+	"go.uber.org/zap"
+
+	"github.com/liclac/sharlayan/builder/tree"
+	"github.com/liclac/sharlayan/calibre"
+	"github.com/liclac/sharlayan/config"
+	"github.com/liclac/sharlayan/metrics"
+)
+
+var (
+	httpRequests = metrics.NewCounter("sharlayan_http_requests_total",
+		"HTTP requests served, by status class (eg. 2xx) and type of path.", "code", "class")
+	httpResponseBytes = metrics.NewCounter("sharlayan_http_response_bytes_total",
+		"Bytes sent in HTTP response bodies, by type of path.", "class")
+	geminiRequests = metrics.NewCounter("sharlayan_gemini_requests_total",
+		"Gemini requests served, by status, eg. 20.", "status")
+	gopherRequests = metrics.NewCounter("sharlayan_gopher_requests_total",
+		"Gopher requests served, by type of response: menu, file, url or error.", "type")
+	ftpLogins = metrics.NewCounter("sharlayan_ftp_logins_total",
+		"FTP logins, by result: user, anonymous or failed.", "result")
+	ftpTransferBytes = metrics.NewCounter("sharlayan_ftp_transfer_bytes_total",
+		"Bytes sent over FTP data connections, by command: RETR, LIST, NLST or MLSD.", "command")
+
+	libraryItems = metrics.NewGauge("sharlayan_library_items",
+		"Things in the library, by kind: books, authors, series, tags or files.", "kind")
+	libraryReadSeconds = metrics.NewGauge("sharlayan_library_read_seconds",
+		"Time taken to read the library's metadata, by stage, and in total.", "stage")
+)
+
+// Records the size of the library, and how long it took to read.
+func ObserveLibrary(meta *calibre.Metadata) {
+	var files int
+	for _, book := range meta.Books {
+		files += len(book.Data)
+	}
+	libraryItems.Set(float64(len(meta.Books)), "books")
+	libraryItems.Set(float64(len(meta.Authors)), "authors")
+	libraryItems.Set(float64(len(meta.Series)), "series")
+	libraryItems.Set(float64(len(meta.Tags)), "tags")
+	libraryItems.Set(float64(files), "files")
+	for stage, t := range meta.Timings {
+		libraryReadSeconds.Set(t.Seconds(), stage)
+	}
+}
+
+type metricsServer struct {
+	L   *zap.Logger
+	cfg *config.Config
+}
+
+// A server for Prometheus metrics, and health checks for load balancers and orchestrators.
+// It doesn't serve anything from the library, and runs on its own address, so it can be kept
+// private, and answer health checks while the library is still being rendered.
+func Metrics(cfg *config.Config) Server {
+	L := zap.L().Named("metrics")
+	if !cfg.Metrics.Enable {
+		L.Debug("Not enabled, skipping...")
+		return nil
+	}
+	return metricsServer{L, cfg}
+}
+
+func (s metricsServer) Run(ctx context.Context, fs afero.Fs) error {
+	srv := &http.Server{
+		Handler:     metricsHandler(metrics.Default, metrics.Pending),
+		BaseContext: func(net.Listener) context.Context { return ctx },
+	}
+	l, err := Listen(ctx, s.cfg, s.cfg.Metrics.Addrs...)
+	if err != nil {
+		return fmt.Errorf("metrics: couldn't listen: %w", err)
+	}
+	s.L.Info("Listening", zap.Stringer("addr", l.Addr()))
+
+	go func() {
+		<-ctx.Done()
+		// Nothing here takes long; don't hold up shutting down the rest.
+		sctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := srv.Shutdown(sctx); err != nil {
+			s.L.Warn("Graceful shutdown failed", zap.Error(err))
+		}
+	}()
+	if err := srv.Serve(l); err != nil && err != http.ErrServerClosed {
+		return fmt.Errorf("metrics: server error: %w", err)
+	}
+	return nil
+}
+
+// Serves /metrics, /healthz, which succeeds as long as we're running, and /readyz, which
+// fails while anything is pending, eg. while rendering the library, or shutting down.
+func metricsHandler(reg *metrics.Registry, pending func() []string) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		_, _ = reg.WriteTo(rw)
+	})
+	mux.HandleFunc("/healthz", func(rw http.ResponseWriter, req *http.Request) {
+		fmt.Fprintln(rw, "ok")
+	})
+	mux.HandleFunc("/readyz", func(rw http.ResponseWriter, req *http.Request) {
+		if p := pending(); len(p) > 0 {
+			http.Error(rw, "not ready: "+strings.Join(p, ", "), http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(rw, "ok")
+	})
+	return mux
+}
+
+// Counts requests and response sizes, by status class and type of path.
+func countRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		e := &accessEntry{}
+		next.ServeHTTP(&statusResponseWriter{ResponseWriter: rw, entry: e}, req)
+		if e.Status == 0 {
+			e.Status = http.StatusOK // Nothing was written.
+		}
+		class := pathClass(req.URL.Path)
+		httpRequests.Inc(strconv.Itoa(e.Status/100)+"xx", class)
+		httpResponseBytes.Add(float64(e.Size), class)
+	})
+}
+
+// Sorts paths into a few types, so there's a manageable number of them in metrics: pages,
+// books, covers and anything else (eg. stylesheets, or nonsense).
+func pathClass(p string) string {
+	switch p = path.Clean("/" + p); {
+	case strings.HasSuffix(p, ".html") || path.Ext(p) == "":
+		return "page"
+	case calibre.FormatMIMEType(path.Ext(p)) != "":
+		return "book"
+	case path.Base(p) == tree.CoverInfo.ID:
+		return "cover"
+	default:
+		return "other"
+	}
+}
@@ -0,0 +1,90 @@
+package server
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/liclac/sharlayan/metrics"
+)
+
+func TestPathClass(t *testing.T) {
+	testdata := map[string]string{
+		"":                     "page",
+		"/":                    "page",
+		"/books/":              "page",
+		"/books/1":             "page",
+		"/books/1/index.html":  "page",
+		"/books/1/1.epub":      "book",
+		"/books/1/1.AZW3":      "book",
+		"/books/1/cover.jpg":   "cover",
+		"/static/style.css":    "other",
+		"/../../etc/passwd.gz": "other",
+	}
+	for p, class := range testdata {
+		t.Run(p, func(t *testing.T) {
+			assert.Equal(t, class, pathClass(p))
+		})
+	}
+}
+
+func TestCountRequests(t *testing.T) {
+	h := countRequests(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/books/1/1.epub":
+			_, _ = rw.Write([]byte("12345"))
+		case "/books/1/":
+		default:
+			http.NotFound(rw, req)
+		}
+	}))
+	reqs := func(code, class string) float64 { return httpRequests.Value(code, class) }
+	book, page, missing := reqs("2xx", "book"), reqs("2xx", "page"), reqs("4xx", "other")
+	bytes := httpResponseBytes.Value("book")
+	for _, p := range []string{"/books/1/1.epub", "/books/1/1.epub", "/books/1/", "/nope.css"} {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", p, nil))
+	}
+	assert.Equal(t, book+2, reqs("2xx", "book"))
+	assert.Equal(t, page+1, reqs("2xx", "page"))
+	assert.Equal(t, missing+1, reqs("4xx", "other"))
+	assert.Equal(t, bytes+10, httpResponseBytes.Value("book"))
+}
+
+func TestMetricsHandler(t *testing.T) {
+	reg := &metrics.Registry{}
+	reg.Counter("test_total", "A test.").Inc()
+	var pending []string
+	h := metricsHandler(reg, func() []string { return pending })
+	get := func(path string) (int, string) {
+		rw := httptest.NewRecorder()
+		h.ServeHTTP(rw, httptest.NewRequest("GET", path, nil))
+		body, err := ioutil.ReadAll(rw.Result().Body)
+		require.NoError(t, err)
+		return rw.Code, string(body)
+	}
+
+	code, body := get("/metrics")
+	assert.Equal(t, http.StatusOK, code)
+	assert.True(t, strings.HasSuffix(body, "\ntest_total 1\n"), body)
+
+	pending = []string{"http", "library"}
+	code, body = get("/healthz")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "ok\n", body)
+	code, body = get("/readyz")
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, "not ready: http, library\n", body)
+
+	pending = nil
+	code, body = get("/readyz")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "ok\n", body)
+
+	code, _ = get("/books/")
+	assert.Equal(t, http.StatusNotFound, code, "the library isn't served here")
+}
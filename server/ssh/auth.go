@@ -0,0 +1,223 @@
+package ssh
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/ssh"
+
+	"github.com/liclac/sharlayan/config"
+)
+
+// Permissions extension holding the authenticated user's name; blank for anonymous users.
+const userExtension = "sharlayan-user"
+
+// Compared against when a user doesn't exist, so failed logins take the same amount of time
+// whether the user exists or not. This is the bcrypt hash of an empty string.
+var dummyHash = []byte("$2a$10$Wtvu5rcksmw/EIwklONbou3NguOHPxvdkw4dsNx03nJOaifD3h64.")
+
+// A public key, optionally restricted to a set of usernames.
+type authorizedKey struct {
+	Key        ssh.PublicKey
+	Principals []string // If non-empty, usernames this key may log in as.
+}
+
+func (k authorizedKey) allows(user string) bool {
+	if len(k.Principals) == 0 {
+		return true
+	}
+	for _, p := range k.Principals {
+		if p == user {
+			return true
+		}
+	}
+	return false
+}
+
+type authenticator struct {
+	L   *zap.Logger
+	cfg *config.Config
+
+	keys     []authorizedKey            // Global keys, from ssh.authorized-keys.
+	userKeys map[string][]authorizedKey // Per-user keys, from users.*.authorized-keys.
+	backoff  *authBackoff               // Delays failed passwords, by IP.
+}
+
+func newAuthenticator(L *zap.Logger, cfg *config.Config) (*authenticator, error) {
+	a := &authenticator{
+		L: L, cfg: cfg,
+		userKeys: make(map[string][]authorizedKey),
+		backoff:  newAuthBackoff(cfg.SSH.AuthBackoff),
+	}
+
+	// A missing authorized_keys file is fine, unless one was explicitly given.
+	path := cfg.SSH.AuthorizedKeys
+	if path == "" {
+		path = filepath.Join(cfg.Config.Dir, "authorized_keys")
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil && !(os.IsNotExist(err) && cfg.SSH.AuthorizedKeys == "") {
+		return nil, fmt.Errorf("couldn't read authorized keys: %w", err)
+	}
+	if a.keys, err = parseAuthorizedKeys(data); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	L.Debug("Loaded authorized keys", zap.String("path", path), zap.Int("num", len(a.keys)))
+
+	for name, user := range cfg.Users {
+		keys, err := parseAuthorizedKeys([]byte(strings.Join(user.AuthorizedKeys, "\n")))
+		if err != nil {
+			return nil, fmt.Errorf("users.%s.authorized-keys: %w", name, err)
+		}
+		a.userKeys[name] = keys
+	}
+	return a, nil
+}
+
+// Parses keys in OpenSSH's authorized_keys format. The only option we understand is
+// principals="alice,bob", which restricts which usernames a key may log in as. Without it, a
+// key in users.*.authorized-keys logs in as that user, and one in ssh.authorized-keys may log
+// in with any username, but is treated as anonymous.
+func parseAuthorizedKeys(data []byte) ([]authorizedKey, error) {
+	var keys []authorizedKey
+	for len(bytes.TrimSpace(data)) > 0 {
+		key, _, options, rest, err := ssh.ParseAuthorizedKey(data)
+		if err != nil {
+			return nil, err
+		}
+		ak := authorizedKey{Key: key}
+		for _, opt := range options {
+			if strings.HasPrefix(opt, "principals=") {
+				ak.Principals = strings.Split(strings.Trim(strings.TrimPrefix(opt, "principals="), `"`), ",")
+			}
+		}
+		keys = append(keys, ak)
+		data = rest
+	}
+	return keys, nil
+}
+
+// Configures authentication callbacks on a server config.
+func (a *authenticator) configure(sshConfig *ssh.ServerConfig) {
+	sshConfig.PublicKeyCallback = a.publicKey
+	sshConfig.PasswordCallback = a.password
+	if a.cfg.SSH.KeyboardInteractive || a.cfg.SSH.Anonymous {
+		sshConfig.KeyboardInteractiveCallback = a.keyboardInteractive
+	}
+	sshConfig.AuthLogCallback = a.log
+}
+
+func (a *authenticator) publicKey(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+	user := conn.User()
+	keyData := key.Marshal()
+	for _, ak := range a.userKeys[user] {
+		if ak.allows(user) && bytes.Equal(ak.Key.Marshal(), keyData) {
+			return permissions(user), nil
+		}
+	}
+	for _, ak := range a.keys {
+		if ak.allows(user) && bytes.Equal(ak.Key.Marshal(), keyData) {
+			if len(ak.Principals) == 0 {
+				return permissions(""), nil // Could be anyone, so it gets nobody's view.
+			}
+			return permissions(user), nil
+		}
+	}
+	return nil, fmt.Errorf("unknown public key for %s", user)
+}
+
+func (a *authenticator) password(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+	user := conn.User()
+	if _, ok := a.cfg.Users[user]; !ok && a.cfg.SSH.Anonymous {
+		return permissions(""), nil // Anonymous users can type anything.
+	}
+	return a.checkPassword(conn, password)
+}
+
+// Keyboard-interactive auth is used for passwords if enabled, or for anonymous logins; an
+// anonymous user gets no questions at all, so most clients will log them in without a prompt.
+func (a *authenticator) keyboardInteractive(conn ssh.ConnMetadata, client ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
+	user := conn.User()
+	if _, ok := a.cfg.Users[user]; !ok && a.cfg.SSH.Anonymous {
+		if _, err := client("", "", nil, nil); err != nil {
+			return nil, err
+		}
+		return permissions(""), nil
+	}
+	if !a.cfg.SSH.KeyboardInteractive {
+		return nil, fmt.Errorf("keyboard-interactive auth is disabled")
+	}
+	answers, err := client(user, "", []string{"Password: "}, []bool{false})
+	if err != nil {
+		return nil, err
+	}
+	if len(answers) != 1 {
+		return nil, fmt.Errorf("expected 1 answer, got %d", len(answers))
+	}
+	return a.checkPassword(conn, []byte(answers[0]))
+}
+
+func (a *authenticator) checkPassword(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+	user := conn.User()
+	u, ok := a.cfg.Users[user]
+	if !ok || u.Password == "" {
+		_ = bcrypt.CompareHashAndPassword(dummyHash, password)
+		return nil, a.fail(conn, fmt.Errorf("no password set for %s", user))
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(u.Password), password); err != nil {
+		return nil, a.fail(conn, err)
+	}
+	return permissions(user), nil
+}
+
+// Waits out the backoff for a failed password, then returns the error.
+func (a *authenticator) fail(conn ssh.ConnMetadata, err error) error {
+	delay, n := a.backoff.fail(addrIP(conn.RemoteAddr()))
+	if delay > 0 {
+		a.L.Debug("Delaying failed login", zap.Stringer("addr", conn.RemoteAddr()),
+			zap.Int("failures", n), zap.Duration("delay", delay))
+		time.Sleep(delay)
+	}
+	return err
+}
+
+func (a *authenticator) log(conn ssh.ConnMetadata, method string, err error) {
+	L := a.L.With(zap.String("user", conn.User()), zap.String("method", method),
+		zap.Stringer("addr", conn.RemoteAddr()))
+	switch {
+	case err == nil:
+		L.Info("Auth Success")
+	case method == "none":
+		L.Debug("Auth Failure", zap.Error(err)) // Clients always try this first.
+	default:
+		sshAuthFailures.Inc(method)
+		L.Info("Auth Failure", zap.Error(err))
+	}
+}
+
+// Called after a successful handshake. Failed logins are only forgiven when a real user logs
+// in; otherwise, with ssh.anonymous, anyone could reset their backoff between guesses.
+func (a *authenticator) authenticated(conn *ssh.ServerConn) {
+	if authenticatedUser(conn) != "" {
+		a.backoff.succeed(addrIP(conn.RemoteAddr()))
+	}
+}
+
+func permissions(user string) *ssh.Permissions {
+	return &ssh.Permissions{Extensions: map[string]string{userExtension: user}}
+}
+
+// Returns the authenticated user for a connection, or "" for anonymous users.
+func authenticatedUser(conn *ssh.ServerConn) string {
+	if conn.Permissions == nil {
+		return ""
+	}
+	return conn.Permissions.Extensions[userExtension]
+}
@@ -0,0 +1,167 @@
+package ssh
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/ssh"
+
+	"github.com/liclac/sharlayan/config"
+)
+
+func testSigner(t *testing.T) ssh.Signer {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	signer, err := ssh.NewSignerFromKey(key)
+	require.NoError(t, err)
+	return signer
+}
+
+// Performs a handshake between a client and a server with the given config, returning the
+// authenticated user on the server side.
+func testHandshake(t *testing.T, cfg *config.Config, user string, auth ...ssh.AuthMethod) (string, error) {
+	a, err := newAuthenticator(zap.NewNop(), cfg)
+	require.NoError(t, err)
+	sconn, err := testHandshakeWith(t, a, user, auth...)
+	if err != nil {
+		return "", err
+	}
+	return authenticatedUser(sconn), nil
+}
+
+func testHandshakeWith(t *testing.T, a *authenticator, user string, auth ...ssh.AuthMethod) (*ssh.ServerConn, error) {
+	serverConfig := &ssh.ServerConfig{}
+	a.configure(serverConfig)
+	serverConfig.AddHostKey(testSigner(t))
+
+	// net.Pipe() is unbuffered, and both sides send their version string at once.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+
+	go func() {
+		clientConfig := &ssh.ClientConfig{User: user, Auth: auth, HostKeyCallback: ssh.InsecureIgnoreHostKey()}
+		if conn, err := ssh.Dial("tcp", l.Addr().String(), clientConfig); err == nil {
+			conn.Close()
+		}
+	}()
+	c, err := l.Accept()
+	require.NoError(t, err)
+	defer c.Close()
+	sconn, _, _, err := ssh.NewServerConn(c, serverConfig)
+	return sconn, err
+}
+
+func TestAuth(t *testing.T) {
+	alice, bob, carol, eve := testSigner(t), testSigner(t), testSigner(t), testSigner(t)
+	hash, err := bcrypt.GenerateFromPassword([]byte("hunter2"), bcrypt.MinCost)
+	require.NoError(t, err)
+
+	// Keyboard-interactive callback that answers every question with a password.
+	answer := func(password string) ssh.AuthMethod {
+		return ssh.KeyboardInteractive(func(user, instruction string, questions []string, echos []bool) ([]string, error) {
+			answers := make([]string, len(questions))
+			for i := range answers {
+				answers[i] = password
+			}
+			return answers, nil
+		})
+	}
+
+	newConfig := func(anonymous, kbdInteractive bool) *config.Config {
+		cfg := &config.Config{}
+		cfg.Config.Dir = t.TempDir()
+		cfg.SSH.Anonymous = anonymous
+		cfg.SSH.KeyboardInteractive = kbdInteractive
+		cfg.Users = map[string]config.User{
+			"alice": {Password: string(hash), AuthorizedKeys: []string{string(ssh.MarshalAuthorizedKey(alice.PublicKey()))}},
+		}
+		return cfg
+	}
+
+	testdata := map[string]struct {
+		anonymous, kbdInteractive bool
+		user                      string
+		auth                      []ssh.AuthMethod
+		identity                  string
+		ok                        bool
+	}{
+		"None":                         {false, false, "alice", nil, "", false},
+		"Password":                     {false, false, "alice", []ssh.AuthMethod{ssh.Password("hunter2")}, "alice", true},
+		"Password/Wrong":               {false, false, "alice", []ssh.AuthMethod{ssh.Password("hunter3")}, "", false},
+		"Password/UnknownUser":         {false, false, "mallory", []ssh.AuthMethod{ssh.Password("hunter2")}, "", false},
+		"Key":                          {false, false, "alice", []ssh.AuthMethod{ssh.PublicKeys(alice)}, "alice", true},
+		"Key/WrongUser":                {false, false, "bob", []ssh.AuthMethod{ssh.PublicKeys(alice)}, "", false},
+		"Key/Unknown":                  {false, false, "alice", []ssh.AuthMethod{ssh.PublicKeys(eve)}, "", false},
+		"Key/AuthorizedKeysFile":       {false, false, "bob", []ssh.AuthMethod{ssh.PublicKeys(bob)}, "bob", true},
+		"Key/AuthorizedKeysPrincipals": {false, false, "carol", []ssh.AuthMethod{ssh.PublicKeys(bob)}, "", false},
+		"Key/AuthorizedKeysAnyone":     {false, false, "alice", []ssh.AuthMethod{ssh.PublicKeys(carol)}, "", true},
+		"KbdInteractive/Disabled":      {false, false, "alice", []ssh.AuthMethod{answer("hunter2")}, "", false},
+		"KbdInteractive":               {false, true, "alice", []ssh.AuthMethod{answer("hunter2")}, "alice", true},
+		"KbdInteractive/Wrong":         {false, true, "alice", []ssh.AuthMethod{answer("hunter3")}, "", false},
+		"Anonymous/Disabled":           {false, true, "mallory", []ssh.AuthMethod{answer("")}, "", false},
+		"Anonymous":                    {true, false, "mallory", []ssh.AuthMethod{answer("")}, "", true},
+		"Anonymous/Password":           {true, false, "mallory", []ssh.AuthMethod{ssh.Password("anything")}, "", true},
+		"Anonymous/KnownUser":          {true, false, "alice", []ssh.AuthMethod{ssh.Password("hunter3")}, "", false},
+	}
+	for name, tdata := range testdata {
+		t.Run(name, func(t *testing.T) {
+			cfg := newConfig(tdata.anonymous, tdata.kbdInteractive)
+			cfg.SSH.AuthorizedKeys = filepath.Join(cfg.Config.Dir, "keys")
+			require.NoError(t, ioutil.WriteFile(cfg.SSH.AuthorizedKeys,
+				append(append([]byte(`principals="bob,dave" `), ssh.MarshalAuthorizedKey(bob.PublicKey())...),
+					ssh.MarshalAuthorizedKey(carol.PublicKey())...), 0600))
+
+			identity, err := testHandshake(t, cfg, tdata.user, tdata.auth...)
+			if tdata.ok {
+				require.NoError(t, err)
+			} else {
+				require.Error(t, err)
+			}
+			assert.Equal(t, tdata.identity, identity)
+		})
+	}
+}
+
+func TestAuthMissingAuthorizedKeys(t *testing.T) {
+	cfg := &config.Config{}
+	cfg.Config.Dir = t.TempDir()
+	_, err := newAuthenticator(zap.NewNop(), cfg)
+	assert.NoError(t, err, "the default path may be missing")
+
+	cfg.SSH.AuthorizedKeys = filepath.Join(cfg.Config.Dir, "keys")
+	_, err = newAuthenticator(zap.NewNop(), cfg)
+	assert.Error(t, err, "an explicitly configured path may not")
+}
+
+func TestAuthBackoffReset(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("hunter2"), bcrypt.MinCost)
+	require.NoError(t, err)
+	cfg := &config.Config{Users: map[string]config.User{"alice": {Password: string(hash)}}}
+	cfg.Config.Dir = t.TempDir()
+	cfg.SSH.Anonymous = true
+	cfg.SSH.AuthBackoff = time.Millisecond
+	a, err := newAuthenticator(zap.NewNop(), cfg)
+	require.NoError(t, err)
+	a.backoff.fail("127.0.0.1")
+
+	sconn, err := testHandshakeWith(t, a, "mallory", ssh.Password("anything"))
+	require.NoError(t, err)
+	a.authenticated(sconn)
+	assert.Contains(t, a.backoff.fails, "127.0.0.1", "anonymous logins don't count")
+
+	sconn, err = testHandshakeWith(t, a, "alice", ssh.Password("hunter2"))
+	require.NoError(t, err)
+	a.authenticated(sconn)
+	assert.NotContains(t, a.backoff.fails, "127.0.0.1")
+}
@@ -0,0 +1,202 @@
+package ssh
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"path"
+	"strconv"
+	"strings"
+
+	"go.uber.org/zap"
+	"golang.org/x/crypto/ssh"
+
+	"github.com/liclac/sharlayan/builder/tree"
+	"github.com/liclac/sharlayan/calibre"
+	"github.com/liclac/sharlayan/config"
+)
+
+// Exit statuses for commands, following BSD's sysexits.h.
+const (
+	exitOK          = 0
+	exitError       = 1
+	exitUsage       = 64 // EX_USAGE
+	exitNotFound    = 66 // EX_NOINPUT
+	exitUnavailable = 69 // EX_UNAVAILABLE
+)
+
+// A Command implemented by a function; see Commands().
+type funcCommand struct {
+	id    string
+	usage string
+	fn    func(c *SSHConn, stdout, stderr io.Writer, args []string) uint32
+}
+
+func (cmd funcCommand) ID() string { return cmd.id }
+
+func (cmd funcCommand) Exec(c *SSHConn, ch ssh.Channel, args []string) uint32 {
+	if c.Meta == nil {
+		fmt.Fprintf(ch.Stderr(), "%s: no library metadata available\n", cmd.id)
+		return exitUnavailable
+	}
+	status := cmd.fn(c, ch, ch.Stderr(), args[1:])
+	if status == exitUsage {
+		fmt.Fprintf(ch.Stderr(), "usage: %s\n", cmd.usage)
+	}
+	return status
+}
+
+// Commands for automation, eg. `ssh library search pratchett`. Output is JSON (or a raw file
+// for `get`), errors go to stderr, and the exit status says whether it worked.
+func Commands(cfg *config.Config) []Handler {
+	if !cfg.SSH.Exec.Enable {
+		zap.L().Named("ssh.exec").Debug("Not enabled, skipping...")
+		return nil
+	}
+	return []Handler{
+		funcCommand{"search", "search query...", searchCommand},
+		funcCommand{"meta", "meta id", metaCommand},
+		funcCommand{"get", "get id [format]", getCommand},
+	}
+}
+
+// Brief information about a book, as returned by search.
+type bookSummary struct {
+	ID      int      `json:"id"`
+	Title   string   `json:"title"`
+	Authors []string `json:"authors"`
+	Series  []string `json:"series"`
+	Tags    []string `json:"tags"`
+	Formats []string `json:"formats"`
+	Path    string   `json:"path"` // In the served tree, eg. "/books/4".
+}
+
+func summarize(book *calibre.Book) bookSummary {
+	s := bookSummary{
+		ID:      book.ID,
+		Title:   book.Title,
+		Authors: []string{},
+		Series:  []string{},
+		Tags:    []string{},
+		Formats: []string{},
+		Path:    "/" + tree.Path(tree.ByID, tree.BookDirInfo, tree.BookInfo(book)),
+	}
+	for _, a := range book.Authors {
+		s.Authors = append(s.Authors, a.Name)
+	}
+	for _, ser := range book.Series {
+		s.Series = append(s.Series, ser.Name)
+	}
+	for _, t := range book.Tags {
+		s.Tags = append(s.Tags, t.Name)
+	}
+	for _, d := range book.Data {
+		s.Formats = append(s.Formats, strings.ToLower(d.Format))
+	}
+	return s
+}
+
+// Everything about a book, as returned by meta. Names shadow the Book's lists of IDs, which
+// aren't very useful on their own.
+type bookMeta struct {
+	*calibre.Book
+	Authors []string `json:"authors"`
+	Series  []string `json:"series"`
+	Tags    []string `json:"tags"`
+	Formats []string `json:"formats"`
+	Path    string   `json:"path"`
+}
+
+func writeJSON(w io.Writer, v interface{}) uint32 {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		return exitError
+	}
+	return exitOK
+}
+
+// Finds a book by ID, writing an error if it doesn't exist (or isn't visible to the user).
+func findBookByID(c *SSHConn, stderr io.Writer, arg string) (*calibre.Book, uint32) {
+	id, err := strconv.Atoi(arg)
+	if err != nil {
+		fmt.Fprintf(stderr, "%s: not a book ID\n", arg)
+		return nil, exitUsage
+	}
+	book := c.Meta.GetBook(id)
+	if book == nil {
+		fmt.Fprintf(stderr, "%d: no such book\n", id)
+		return nil, exitNotFound
+	}
+	return book, exitOK
+}
+
+func searchCommand(c *SSHConn, stdout, stderr io.Writer, args []string) uint32 {
+	if len(args) == 0 {
+		return exitUsage
+	}
+	results := []bookSummary{}
+	for _, book := range c.Meta.Search(strings.Join(args, " ")) {
+		results = append(results, summarize(book))
+	}
+	return writeJSON(stdout, results)
+}
+
+func metaCommand(c *SSHConn, stdout, stderr io.Writer, args []string) uint32 {
+	if len(args) != 1 {
+		return exitUsage
+	}
+	book, status := findBookByID(c, stderr, args[0])
+	if book == nil {
+		return status
+	}
+	s := summarize(book)
+	return writeJSON(stdout, bookMeta{book, s.Authors, s.Series, s.Tags, s.Formats, s.Path})
+}
+
+func getCommand(c *SSHConn, stdout, stderr io.Writer, args []string) uint32 {
+	if len(args) < 1 || len(args) > 2 {
+		return exitUsage
+	}
+	book, status := findBookByID(c, stderr, args[0])
+	if book == nil {
+		return status
+	}
+
+	// Without a format, there has to be only one to pick from.
+	var formats []string
+	var data *calibre.Data
+	for _, d := range book.Data {
+		formats = append(formats, strings.ToLower(d.Format))
+		if len(args) == 2 && strings.EqualFold(d.Format, args[1]) {
+			data = d
+		}
+	}
+	if len(args) == 1 && len(book.Data) == 1 {
+		data = book.Data[0]
+	}
+	if data == nil {
+		switch {
+		case len(formats) == 0:
+			fmt.Fprintf(stderr, "%d: book has no files\n", book.ID)
+		case len(args) == 1:
+			fmt.Fprintf(stderr, "%d: pick a format: %s\n", book.ID, strings.Join(formats, ", "))
+		default:
+			fmt.Fprintf(stderr, "%d: no %s file; formats: %s\n", book.ID, args[1], strings.Join(formats, ", "))
+		}
+		return exitNotFound
+	}
+
+	p := "/" + tree.Path(tree.ByID, tree.BookDirInfo, tree.BookInfo(book), tree.DataInfo(book, data))
+	f, err := c.Fs.Open(p)
+	if err != nil {
+		fmt.Fprintf(stderr, "%s: %s\n", path.Base(p), err)
+		return exitNotFound
+	}
+	defer f.Close()
+	if _, err := io.Copy(stdout, f); err != nil {
+		c.L.Debug("Couldn't send file", zap.String("path", p), zap.Error(err))
+		return exitError
+	}
+	return exitOK
+}
@@ -0,0 +1,57 @@
+package ssh
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func TestCommands(t *testing.T) {
+	testdata := map[string]struct {
+		fn     func(c *SSHConn, stdout, stderr io.Writer, args []string) uint32
+		args   []string
+		status uint32
+		out    string
+		errout string
+	}{
+		"search":            {searchCommand, []string{"gaiman"}, exitOK, `[{"id":2,"title":"Good Omens","authors":["Terry Pratchett","Neil Gaiman"],"series":[],"tags":[],"formats":["epub"],"path":"/books/2"}]`, ""},
+		"search/NoResults":  {searchCommand, []string{"vimes"}, exitOK, `[]`, ""},
+		"search/Usage":      {searchCommand, nil, exitUsage, "", ""},
+		"meta/Missing":      {metaCommand, []string{"3"}, exitNotFound, "", "3: no such book\n"},
+		"meta/NotAnID":      {metaCommand, []string{"omens"}, exitUsage, "", "omens: not a book ID\n"},
+		"get":               {getCommand, []string{"2"}, exitOK, "EPUB", ""},
+		"get/Format":        {getCommand, []string{"2", "epub"}, exitOK, "EPUB", ""},
+		"get/MissingFormat": {getCommand, []string{"2", "pdf"}, exitNotFound, "", "2: no pdf file; formats: epub\n"},
+		"get/NoFiles":       {getCommand, []string{"1"}, exitNotFound, "", "1: book has no files\n"},
+	}
+	for name, tdata := range testdata {
+		t.Run(name, func(t *testing.T) {
+			sh, _ := testShell(t)
+			c := &SSHConn{Fs: sh.Fs, Meta: sh.Meta, L: zap.NewNop()}
+			var out, errout bytes.Buffer
+			assert.Equal(t, tdata.status, tdata.fn(c, &out, &errout, tdata.args))
+			if tdata.out != "" && tdata.out[0] == '[' {
+				assert.JSONEq(t, tdata.out, out.String())
+			} else {
+				assert.Equal(t, tdata.out, out.String())
+			}
+			assert.Equal(t, tdata.errout, errout.String())
+		})
+	}
+}
+
+func TestCommandsMeta(t *testing.T) {
+	sh, _ := testShell(t)
+	c := &SSHConn{Fs: sh.Fs, Meta: sh.Meta, L: zap.NewNop()}
+	var out bytes.Buffer
+	assert.Equal(t, uint32(exitOK), metaCommand(c, &out, &out, []string{"2"}))
+	assert.Contains(t, out.String(), `"title": "Good Omens"`)
+	assert.Contains(t, out.String(), `"authors": [
+    "Terry Pratchett",
+    "Neil Gaiman"
+  ]`)
+	assert.Contains(t, out.String(), `"path": "/books/2"`)
+}
@@ -1,11 +1,17 @@
 package ssh
 
 import (
+	"io"
 	"net"
+	"sync/atomic"
+	"time"
 
 	"github.com/spf13/afero"
 	"go.uber.org/zap"
 	"golang.org/x/crypto/ssh"
+
+	"github.com/liclac/sharlayan/calibre"
+	"github.com/liclac/sharlayan/server"
 )
 
 type SSHConnShared struct {
@@ -13,23 +19,111 @@ type SSHConnShared struct {
 	Fs     afero.Fs
 
 	ServerConfig *ssh.ServerConfig
+	Auth         *authenticator
 }
 
 type SSHConn struct {
 	*SSHConnShared
 	Conn *ssh.ServerConn
+	User string            // Authenticated user, or "" if anonymous.
+	Fs   afero.Fs          // What the user may see; shadows SSHConnShared.Fs.
+	Meta *calibre.Metadata // What the user may see, or nil if unknown.
 	L    *zap.Logger
+
+	sessions int32 // Open sessions, accessed atomically.
+}
+
+// Serves a connection until it closes, within the configured limits.
+func serve(shared *SSHConnShared, limits *connLimiter, rawConn net.Conn) {
+	cfg := shared.Server.cfg
+	ip := addrIP(rawConn.RemoteAddr())
+	L := shared.Server.L.With(zap.Stringer("addr", rawConn.RemoteAddr()))
+	defer rawConn.Close()
+	if !shared.Server.track(rawConn) {
+		L.Debug("Connection refused, shutting down")
+		return
+	}
+	defer shared.Server.untrack(rawConn)
+	if reason := limits.acquire(ip); reason != "" {
+		sshConnections.Inc("rejected")
+		_, _, _, rejected := limits.stats(ip)
+		L.Warn("Connection refused", zap.String("reason", reason), zap.Uint64("rejected", rejected))
+		return
+	}
+	defer limits.release(ip)
+
+	// The handshake, including logging in, has to finish before the deadline; after that,
+	// the connection may stay open for as long as it's not idle.
+	if cfg.SSH.HandshakeTimeout > 0 {
+		if err := rawConn.SetDeadline(time.Now().Add(cfg.SSH.HandshakeTimeout)); err != nil {
+			L.Error("Couldn't set handshake deadline", zap.Error(err))
+			return
+		}
+	}
+	conn := &idleConn{Conn: rawConn}
+	c, err := accept(shared, conn)
+	if err != nil {
+		sshConnections.Inc("failed")
+		if shared.Server.isClosing() {
+			L.Debug("Handshake interrupted by shutdown", zap.Error(err))
+		} else {
+			L.Warn("Failed to accept connection", zap.Error(err))
+		}
+		return
+	}
+	sshConnections.Inc("accepted")
+	if !shared.Server.established(rawConn, c) {
+		c.L.Debug("Shutting down, closing connection")
+		return
+	}
+	sshConnectionsOpen.Add(1)
+	defer sshConnectionsOpen.Add(-1)
+	if err := conn.SetIdleTimeout(cfg.SSH.IdleTimeout); err != nil {
+		c.L.Error("Couldn't set idle timeout", zap.Error(err))
+		return
+	}
+
+	active, activeIP, accepted, rejected := limits.stats(ip)
+	c.L.Info("Connected", zap.Int("conns", active), zap.Int("ip_conns", activeIP),
+		zap.Uint64("accepted", accepted), zap.Uint64("rejected", rejected))
+	start := time.Now()
+	if err := c.Conn.Wait(); err != nil && err != io.EOF && !shared.Server.isClosing() {
+		c.L.Info("Disconnected", zap.Duration("duration", time.Since(start)), zap.Error(err))
+	} else {
+		c.L.Info("Disconnected", zap.Duration("duration", time.Since(start)))
+	}
 }
 
-func accept(shared *SSHConnShared, rawConn net.Conn) error {
+// Performs the handshake for a connection, and starts serving it in the background.
+func accept(shared *SSHConnShared, rawConn net.Conn) (*SSHConn, error) {
 	sconn, chans, reqs, err := ssh.NewServerConn(rawConn, shared.ServerConfig)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	shared.Auth.authenticated(sconn)
+	user := authenticatedUser(sconn)
+	fs, err := server.ForUser(shared.Fs, user)
+	if err != nil {
+		sconn.Close()
+		return nil, err
+	}
+	meta, err := server.MetadataForUser(shared.Fs, user)
+	if err != nil {
+		sconn.Close()
+		return nil, err
+	}
+	c := &SSHConn{
+		SSHConnShared: shared,
+		Conn:          sconn,
+		User:          user,
+		Fs:            fs,
+		Meta:          meta,
+		L: shared.Server.L.With(zap.String("user", user),
+			zap.Stringer("addr", sconn.RemoteAddr())),
 	}
-	c := SSHConn{shared, sconn, shared.Server.L.With(zap.String("user", sconn.User()))}
 	go c.serveChans(chans)
 	go ssh.DiscardRequests(reqs)
-	return nil
+	return c, nil
 }
 
 func (c *SSHConn) serveChans(chans <-chan ssh.NewChannel) {
@@ -39,12 +133,36 @@ func (c *SSHConn) serveChans(chans <-chan ssh.NewChannel) {
 		switch chType {
 		case "session":
 			L.Debug("Opening channel")
+			if c.Server.isClosing() {
+				L.Debug("Refusing to open channel, shutting down")
+				if err := newChan.Reject(ssh.ResourceShortage, "server is shutting down"); err != nil {
+					L.Error("Failed to send reply", zap.Error(err))
+				}
+				continue
+			}
+			if max := c.Server.cfg.SSH.MaxSessions; max > 0 && atomic.LoadInt32(&c.sessions) >= int32(max) {
+				L.Warn("Refusing to open channel, too many sessions")
+				if err := newChan.Reject(ssh.ResourceShortage, "too many sessions"); err != nil {
+					L.Error("Failed to send reply", zap.Error(err))
+				}
+				continue
+			}
 			ch, reqs, err := newChan.Accept()
 			if err != nil {
 				L.Error("Failed to accept channel", zap.Error(err))
 				continue
 			}
-			go c.serveSession(ch, reqs)
+			atomic.AddInt32(&c.sessions, 1)
+			sshSessions.Inc()
+			sshSessionsOpen.Add(1)
+			go func() {
+				c.serveSession(ch, reqs)
+				sshSessionsOpen.Add(-1)
+				if atomic.AddInt32(&c.sessions, -1) == 0 && c.Server.isClosing() {
+					c.L.Debug("Last session closed, shutting down")
+					c.Conn.Close()
+				}
+			}()
 		default:
 			L.Warn("Refusing to open channel")
 			if err := newChan.Reject(ssh.UnknownChannelType, "unknown type: "+chType); err != nil {
@@ -57,21 +175,26 @@ func (c *SSHConn) serveChans(chans <-chan ssh.NewChannel) {
 func (c *SSHConn) serveSession(ch ssh.Channel, reqs <-chan *ssh.Request) {
 	L := c.L.Named("session")
 	defer func() {
-		if err := ch.Close(); err != nil {
+		if err := ch.Close(); err != nil && err != io.EOF {
 			L.Error("Failed to close channel", zap.Error(err))
 		}
 	}()
+	var pty *ptyRequest // If the client requested a pty.
+	var sh *shell       // If the client started a shell.
+	var started bool    // Only one subsystem, command or shell may run per session.
 	for req := range reqs {
 		switch req.Type {
 		case "subsystem":
 			// Payload is 4 length bytes, then an ASCII subsystem ID.
 			ok := false
-			if len(req.Payload) > 4 {
+			if started {
+				L.Debug("Session already started", zap.String("type", req.Type))
+			} else if len(req.Payload) > 4 {
 				// If we have a subsystem with this ID, start it and affirm.
 				id := string(req.Payload[4:])
 				if sub := c.Server.sub[id]; sub != nil {
 					L.Debug("Starting subsystem", zap.String("id", id))
-					ok = true
+					ok, started = true, true
 					go sub.Serve(c, ch)
 				} else {
 					L.Warn("Unknown subsystem requested", zap.String("id", id))
@@ -80,6 +203,58 @@ func (c *SSHConn) serveSession(ch ssh.Channel, reqs <-chan *ssh.Request) {
 				L.Debug("Malformed subsystem ID", zap.String("id", string(req.Payload)))
 			}
 			reply(L, req, ok, nil)
+		case "exec":
+			// Payload is 4 length bytes, then a command line.
+			var cmd Command
+			var args []string
+			if started {
+				L.Debug("Session already started", zap.String("type", req.Type))
+			} else if len(req.Payload) > 4 {
+				var err error
+				if args, err = splitArgs(string(req.Payload[4:])); err != nil || len(args) == 0 {
+					L.Debug("Malformed command", zap.String("cmd", string(req.Payload[4:])), zap.Error(err))
+				} else if cmd = c.Server.cmd[args[0]]; cmd == nil {
+					L.Warn("Unknown command requested", zap.String("cmd", args[0]))
+				}
+			}
+			// Reply before starting the command, so its output and exit status come after.
+			reply(L, req, cmd != nil, nil)
+			if cmd != nil {
+				L.Debug("Executing command", zap.Strings("args", args))
+				started = true
+				go c.run(L, ch, func() uint32 { return cmd.Exec(c, ch, args) })
+			}
+		case "pty-req":
+			var p ptyRequest
+			err := ssh.Unmarshal(req.Payload, &p)
+			if err != nil {
+				L.Debug("Malformed pty request", zap.Error(err))
+			} else {
+				pty = &p
+			}
+			reply(L, req, err == nil, nil)
+		case "window-change":
+			var wc windowChange
+			if err := ssh.Unmarshal(req.Payload, &wc); err != nil {
+				L.Debug("Malformed window change", zap.Error(err))
+			} else if sh != nil {
+				sh.Resize(wc.Cols, wc.Rows)
+			} else if pty != nil {
+				pty.Cols, pty.Rows = wc.Cols, wc.Rows
+			}
+			if req.WantReply {
+				reply(L, req, true, nil)
+			}
+		case "shell":
+			ok := !started && c.Server.cfg.SSH.Shell.Enable
+			if ok {
+				L.Debug("Starting shell", zap.Bool("pty", pty != nil))
+				sh, started = newShell(c, ch, pty), true
+			}
+			reply(L, req, ok, nil)
+			if ok {
+				go c.run(L, ch, sh.Run)
+			}
 		default:
 			DeclineUnknownRequest(L, req)
 		}
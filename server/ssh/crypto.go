@@ -1,22 +1,136 @@
 package ssh
 
 import (
+	"crypto"
 	"crypto/ecdsa"
+	"crypto/ed25519"
 	"crypto/elliptic"
 	"crypto/rand"
+	"crypto/rsa"
 	"crypto/x509"
 	"encoding/pem"
+	"errors"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
 
 	"golang.org/x/crypto/ssh"
+
+	"github.com/liclac/sharlayan/config"
 )
 
+// Key types generated for a host key directory, if it doesn't already have one of each.
+var HostKeyTypes = []string{"ed25519", "ecdsa", "rsa"}
+
+// A host private key, and where it came from.
+type HostKey struct {
+	ssh.Signer
+	Path string
+}
+
+// Returns the type of a key, as in HostKeyTypes, or "" for anything else (eg. DSA).
+func (k HostKey) Type() string {
+	switch t := k.PublicKey().Type(); {
+	case t == ssh.KeyAlgoED25519:
+		return "ed25519"
+	case strings.HasPrefix(t, "ecdsa-"):
+		return "ecdsa"
+	case t == ssh.KeyAlgoRSA:
+		return "rsa"
+	default:
+		return ""
+	}
+}
+
+// Returns a key's fingerprint, as shown by OpenSSH clients, eg. "SHA256:...".
+func (k HostKey) Fingerprint() string {
+	return ssh.FingerprintSHA256(k.PublicKey())
+}
+
+// Loads all configured host keys, generating any missing types. Keys come from:
+//
+//   - ssh.host-key, a single key file. This used to be the only option, so if it isn't set,
+//     but the old default ${config.dir}/host_key exists, that's used, so clients that already
+//     know the server's key don't suddenly see a new one.
+//   - ssh.host-keys, a directory of keys named like OpenSSH's, eg. ssh_host_ed25519_key.
+//     Defaults to ${config.dir}/host_keys.
+//
+// To rotate a key, replace its file and restart.
+func LoadOrGenerateHostKeys(cfg *config.Config) ([]HostKey, error) {
+	var keys []HostKey
+	if path := cfg.SSH.HostKey; path != "" {
+		signer, err := LoadOrGenerateHostKey(path)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, HostKey{signer, path})
+	} else if path := filepath.Join(cfg.Config.Dir, "host_key"); fileExists(path) {
+		signer, err := LoadHostKey(path)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, HostKey{signer, path})
+	}
+
+	dir := cfg.SSH.HostKeys
+	if dir == "" {
+		dir = filepath.Join(cfg.Config.Dir, "host_keys")
+	}
+	dirKeys, err := LoadHostKeys(dir)
+	if err != nil {
+		return nil, err
+	}
+	keys = append(keys, dirKeys...)
+
+	for _, typ := range HostKeyTypes {
+		if hasHostKeyType(keys, typ) {
+			continue
+		}
+		path := filepath.Join(dir, "ssh_host_"+typ+"_key")
+		if err := GenerateHostKey(path, typ); err != nil {
+			return nil, err
+		}
+		signer, err := LoadHostKey(path)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, HostKey{signer, path})
+	}
+
+	// A server can only offer one key per algorithm, so don't make us guess which one.
+	seen := make(map[string]string, len(keys))
+	for _, key := range keys {
+		algo := key.PublicKey().Type()
+		if prev, ok := seen[algo]; ok {
+			return nil, fmt.Errorf("ssh: %s and %s are both %s keys", prev, key.Path, algo)
+		}
+		seen[algo] = key.Path
+	}
+	return keys, nil
+}
+
+func hasHostKeyType(keys []HostKey, typ string) bool {
+	for _, key := range keys {
+		if key.Type() == typ {
+			return true
+		}
+	}
+	return false
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// Loads a single host key, generating an ECDSA key if it doesn't exist.
 func LoadOrGenerateHostKey(path string) (ssh.Signer, error) {
 	key, err := LoadHostKey(path)
 	if os.IsNotExist(err) {
-		if err := GenerateHostKey(path); err != nil {
+		if err := GenerateHostKey(path, "ecdsa"); err != nil {
 			return nil, err
 		}
 		return LoadHostKey(path)
@@ -24,28 +138,76 @@ func LoadOrGenerateHostKey(path string) (ssh.Signer, error) {
 	return key, err
 }
 
+// Loads all host keys from a directory, in filename order; a missing directory has none.
+// Keys are files ending in "_key", in any format OpenSSH understands (including its own), but
+// without a passphrase.
+func LoadHostKeys(dir string) ([]HostKey, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*_key"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(paths)
+	keys := make([]HostKey, 0, len(paths))
+	for _, path := range paths {
+		signer, err := LoadHostKey(path)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, HostKey{signer, path})
+	}
+	return keys, nil
+}
+
 func LoadHostKey(path string) (ssh.Signer, error) {
 	data, err := ioutil.ReadFile(path)
 	if err != nil {
 		return nil, err
 	}
-	return ssh.ParsePrivateKey(data)
+	signer, err := ssh.ParsePrivateKey(data)
+	var passErr *ssh.PassphraseMissingError
+	if errors.As(err, &passErr) {
+		return nil, fmt.Errorf("ssh: %s: host keys can't have a passphrase", path)
+	} else if err != nil {
+		return nil, fmt.Errorf("ssh: %s: %w", path, err)
+	}
+	return signer, nil
 }
 
-func GenerateHostKey(path string) error {
-	privKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+// Generates a host key of the given type (see HostKeyTypes), as a PKCS#8 private key and an
+// OpenSSH-style public key alongside it, eg. ssh_host_ed25519_key and ssh_host_ed25519_key.pub.
+func GenerateHostKey(path, typ string) error {
+	var privKey crypto.Signer
+	var err error
+	switch typ {
+	case "ed25519":
+		_, privKey, err = ed25519.GenerateKey(rand.Reader)
+	case "ecdsa":
+		privKey, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case "rsa":
+		privKey, err = rsa.GenerateKey(rand.Reader, 3072)
+	default:
+		return fmt.Errorf("ssh: unknown host key type: %s", typ)
+	}
 	if err != nil {
 		return err
 	}
-	privDER, err := x509.MarshalECPrivateKey(privKey)
+	privDER, err := x509.MarshalPKCS8PrivateKey(privKey)
 	if err != nil {
 		return err
 	}
+	pubKey, err := ssh.NewPublicKey(privKey.Public())
+	if err != nil {
+		return err
+	}
+
 	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
 		return err
 	}
-	return ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{
-		Type:  "EC PRIVATE KEY",
+	if err := ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{
+		Type:  "PRIVATE KEY",
 		Bytes: privDER,
-	}), 0600)
+	}), 0600); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path+".pub", ssh.MarshalAuthorizedKey(pubKey), 0644)
 }
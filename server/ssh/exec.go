@@ -0,0 +1,78 @@
+package ssh
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+
+	"go.uber.org/zap"
+	"golang.org/x/crypto/ssh"
+)
+
+// Runs a command or shell, then reports its exit status and closes the channel.
+func (c *SSHConn) run(L *zap.Logger, ch ssh.Channel, fn func() uint32) {
+	status := fn()
+	L.Debug("Command exited", zap.Uint32("status", status))
+	if err := sendExitStatus(ch, status); err != nil {
+		L.Warn("Failed to send exit status", zap.Error(err))
+	}
+	if err := ch.Close(); err != nil {
+		L.Warn("Failed to close channel", zap.Error(err))
+	}
+}
+
+func sendExitStatus(ch ssh.Channel, status uint32) error {
+	payload := make([]byte, 4)
+	binary.BigEndian.PutUint32(payload, status)
+	_, err := ch.SendRequest("exit-status", false, payload)
+	return err
+}
+
+// Splits a command line into arguments, roughly like a POSIX shell would, minus expansion.
+// Clients like scp quote paths with spaces in them, so we need to at least handle that.
+func splitArgs(line string) ([]string, error) {
+	var args []string
+	var arg strings.Builder
+	var inArg bool
+	var quote rune
+	var escaped bool
+	for _, r := range line {
+		switch {
+		case escaped:
+			arg.WriteRune(r)
+			escaped = false
+		case quote == '\'':
+			if r == '\'' {
+				quote = 0
+			} else {
+				arg.WriteRune(r)
+			}
+		case r == '\\':
+			escaped, inArg = true, true
+		case quote == '"':
+			if r == '"' {
+				quote = 0
+			} else {
+				arg.WriteRune(r)
+			}
+		case r == '\'' || r == '"':
+			quote, inArg = r, true
+		case r == ' ' || r == '\t' || r == '\n':
+			if inArg {
+				args = append(args, arg.String())
+				arg.Reset()
+				inArg = false
+			}
+		default:
+			arg.WriteRune(r)
+			inArg = true
+		}
+	}
+	if quote != 0 || escaped {
+		return nil, fmt.Errorf("unterminated quote or escape")
+	}
+	if inArg {
+		args = append(args, arg.String())
+	}
+	return args, nil
+}
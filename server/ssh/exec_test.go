@@ -0,0 +1,37 @@
+package ssh
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_splitArgs(t *testing.T) {
+	testdata := map[string]struct {
+		line string
+		args []string
+		err  bool
+	}{
+		"Empty":        {"", nil, false},
+		"Simple":       {"scp -f /books/1", []string{"scp", "-f", "/books/1"}, false},
+		"Whitespace":   {"  scp \t -f\n", []string{"scp", "-f"}, false},
+		"SingleQuotes": {`scp -f '/Books/Re: Zero'`, []string{"scp", "-f", "/Books/Re: Zero"}, false},
+		"DoubleQuotes": {`scp -f "/Books/Re: \"Zero\""`, []string{"scp", "-f", `/Books/Re: "Zero"`}, false},
+		"Escapes":      {`scp -f /Books/Re:\ Zero`, []string{"scp", "-f", "/Books/Re: Zero"}, false},
+		"Adjacent":     {`a'b c'"d"`, []string{"ab cd"}, false},
+		"EmptyQuotes":  {`a '' b`, []string{"a", "", "b"}, false},
+		"Unterminated": {`scp -f 'oops`, nil, true},
+		"TrailingEsc":  {`scp \`, nil, true},
+	}
+	for name, tdata := range testdata {
+		t.Run(name, func(t *testing.T) {
+			args, err := splitArgs(tdata.line)
+			if tdata.err {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+				assert.Equal(t, tdata.args, args)
+			}
+		})
+	}
+}
@@ -0,0 +1,232 @@
+package ssh
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Where the inbox appears in the tree.
+const inboxPath = "/inbox"
+
+// Formats that may be uploaded, by extension.
+var inboxFormats = map[string]func(head []byte) bool{
+	".epub": func(head []byte) bool {
+		// A zip file whose first entry is an uncompressed "mimetype" file; see the OCF spec.
+		return bytes.HasPrefix(head, []byte("PK\x03\x04")) &&
+			bytes.HasPrefix(head[30:], []byte("mimetypeapplication/epub+zip"))
+	},
+	".pdf": func(head []byte) bool {
+		return bytes.HasPrefix(head, []byte("%PDF-"))
+	},
+	".mobi": func(head []byte) bool {
+		// A PalmDB file, with the type and creator at offset 60.
+		return bytes.HasPrefix(head[60:], []byte("BOOKMOBI"))
+	},
+}
+
+// How much of a file sniffing needs; enough for all of the above.
+const inboxSniffLen = 128
+
+// The inbox is a write-only directory where logged-in users can upload books over SFTP. An
+// upload is written to a hidden staging directory inside Dir first, then checked, and only
+// moved into Dir (eg. Calibre's auto-add folder) if it's a complete book. Users can't see or
+// touch anything in the inbox, including their own uploads.
+type inbox struct {
+	L       *zap.Logger
+	Dir     string
+	MaxSize int64
+
+	mu      sync.Mutex              // Also serialises picking names for finished uploads.
+	uploads map[string]*inboxUpload // In progress, by user and path.
+}
+
+func newInbox(L *zap.Logger, dir string, maxSize int64) *inbox {
+	return &inbox{L: L, Dir: dir, MaxSize: maxSize, uploads: make(map[string]*inboxUpload)}
+}
+
+// Returns whether a path in the tree is inside the inbox.
+func inInbox(p string) bool {
+	return path.Dir(path.Clean(p)) == inboxPath
+}
+
+func uploadKey(user, p string) string {
+	return user + "\x00" + path.Clean(p)
+}
+
+// Starts an upload to a path in the inbox.
+func (ib *inbox) Create(user, p string) (*inboxUpload, error) {
+	name := path.Base(p)
+	ext := strings.ToLower(path.Ext(name))
+	switch {
+	case !inInbox(p) || strings.HasPrefix(name, ".") || strings.ContainsAny(name, "\\\x00"):
+		return nil, &os.PathError{Op: "create", Path: p, Err: os.ErrPermission}
+	case inboxFormats[ext] == nil:
+		return nil, &os.PathError{Op: "create", Path: p, Err: fmt.Errorf("not an EPUB, PDF or MOBI file")}
+	}
+
+	staging := filepath.Join(ib.Dir, ".staging")
+	if err := os.MkdirAll(staging, 0755); err != nil {
+		return nil, err
+	}
+	f, err := ioutil.TempFile(staging, "upload-*"+ext)
+	if err != nil {
+		return nil, err
+	}
+	if err := f.Chmod(0644); err != nil { // TempFile() makes it 0600.
+		f.Close()
+		os.Remove(f.Name())
+		return nil, err
+	}
+	u := &inboxUpload{inbox: ib, User: user, Path: path.Clean(p), Name: name, f: f, start: time.Now()}
+
+	ib.mu.Lock()
+	defer ib.mu.Unlock()
+	ib.uploads[uploadKey(user, p)] = u
+	return u, nil
+}
+
+// Returns info about an upload in progress, so clients that check on them don't get confused.
+func (ib *inbox) Stat(user, p string) (os.FileInfo, error) {
+	ib.mu.Lock()
+	u := ib.uploads[uploadKey(user, p)]
+	ib.mu.Unlock()
+	if u == nil {
+		return nil, &os.PathError{Op: "stat", Path: p, Err: os.ErrNotExist}
+	}
+	info, err := u.f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return renamedFileInfo{info, u.Name}, nil
+}
+
+// Moves a checked upload into the inbox, under a name that isn't taken.
+func (ib *inbox) finish(u *inboxUpload) (string, error) {
+	ib.mu.Lock()
+	defer ib.mu.Unlock()
+	ext := path.Ext(u.Name)
+	base := strings.TrimSuffix(u.Name, ext)
+	dst := filepath.Join(ib.Dir, u.Name)
+	for i := 2; ; i++ {
+		if _, err := os.Lstat(dst); os.IsNotExist(err) {
+			break
+		} else if err != nil {
+			return "", err
+		}
+		dst = filepath.Join(ib.Dir, fmt.Sprintf("%s (%d)%s", base, i, ext))
+	}
+	return dst, os.Rename(u.f.Name(), dst)
+}
+
+func (ib *inbox) forget(u *inboxUpload) {
+	ib.mu.Lock()
+	defer ib.mu.Unlock()
+	if ib.uploads[uploadKey(u.User, u.Path)] == u {
+		delete(ib.uploads, uploadKey(u.User, u.Path))
+	}
+}
+
+var errUploadTooLarge = errors.New("upload is too large")
+
+// A file being uploaded to the inbox; implements io.WriterAt for sftp.
+type inboxUpload struct {
+	inbox *inbox
+	User  string
+	Path  string // In the tree, eg. "/inbox/book.epub".
+	Name  string // As uploaded, eg. "book.epub".
+
+	f     *os.File // Staged file.
+	start time.Time
+
+	mu     sync.Mutex
+	failed error // Set if the transfer failed, or the file is too large.
+}
+
+func (u *inboxUpload) WriteAt(p []byte, off int64) (int, error) {
+	if max := u.inbox.MaxSize; max > 0 && off+int64(len(p)) > max {
+		u.TransferError(errUploadTooLarge)
+		return 0, errUploadTooLarge
+	}
+	return u.f.WriteAt(p, off)
+}
+
+// Called by sftp if the upload fails, eg. because the client disconnected.
+func (u *inboxUpload) TransferError(err error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.failed == nil {
+		u.failed = err
+	}
+}
+
+// Checks and delivers a finished upload, or throws it away if anything's wrong with it.
+func (u *inboxUpload) Close() error {
+	defer u.inbox.forget(u)
+	L := u.inbox.L.With(zap.String("user", u.User), zap.String("name", u.Name))
+	size, err := u.check()
+	if cerr := u.f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		L.Info("Upload rejected", zap.Error(err))
+		if rerr := os.Remove(u.f.Name()); rerr != nil {
+			L.Warn("Couldn't remove rejected upload", zap.Error(rerr))
+		}
+		return &os.PathError{Op: "upload", Path: u.Path, Err: err}
+	}
+
+	dst, err := u.inbox.finish(u)
+	if err != nil {
+		L.Error("Couldn't move upload into the inbox", zap.Error(err))
+		return &os.PathError{Op: "upload", Path: u.Path, Err: errors.New("couldn't save upload")}
+	}
+	L.Info("Book uploaded", zap.String("path", dst), zap.Int64("size", size),
+		zap.Duration("t", time.Since(u.start)))
+	return nil
+}
+
+// Checks that an upload completed, and is what it says it is. Returns its size.
+func (u *inboxUpload) check() (int64, error) {
+	u.mu.Lock()
+	failed := u.failed
+	u.mu.Unlock()
+	if failed != nil {
+		return 0, failed
+	}
+
+	info, err := u.f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	if info.Size() == 0 {
+		return 0, errors.New("upload is empty")
+	}
+	head := make([]byte, inboxSniffLen) // Zero-padded if the file is shorter.
+	if _, err := u.f.ReadAt(head, 0); err != nil && err != io.EOF {
+		return 0, err
+	}
+	ext := strings.ToLower(path.Ext(u.Name))
+	if !inboxFormats[ext](head) {
+		return 0, fmt.Errorf("not a valid %s file", strings.ToUpper(ext[1:]))
+	}
+	return info.Size(), nil
+}
+
+// Info about a file, under a different name.
+type renamedFileInfo struct {
+	os.FileInfo
+	name string
+}
+
+func (i renamedFileInfo) Name() string { return i.name }
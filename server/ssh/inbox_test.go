@@ -0,0 +1,177 @@
+package ssh
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/pkg/sftp"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/liclac/sharlayan/config"
+)
+
+// Smallest files that look like the real thing to the sniffers.
+var (
+	testEPUB = append(append([]byte("PK\x03\x04"), make([]byte, 26)...), "mimetypeapplication/epub+zip"...)
+	testPDF  = []byte("%PDF-1.4\n%%EOF\n")
+	testMOBI = append(make([]byte, 60), "BOOKMOBI"...)
+)
+
+// Returns the names of the files in a directory, except the staging directory.
+func inboxFiles(t *testing.T, dir string) []string {
+	infos, err := ioutil.ReadDir(dir)
+	require.NoError(t, err)
+	var names []string
+	for _, info := range infos {
+		if info.Name() != ".staging" {
+			names = append(names, info.Name())
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestInbox(t *testing.T) {
+	testdata := map[string]struct {
+		path   string
+		data   []byte
+		create bool // Whether Create() should succeed.
+		ok     bool // Whether Close() should.
+	}{
+		"EPUB":           {"/inbox/book.epub", testEPUB, true, true},
+		"EPUB/Uppercase": {"/inbox/BOOK.EPUB", testEPUB, true, true},
+		"PDF":            {"/inbox/book.pdf", testPDF, true, true},
+		"MOBI":           {"/inbox/book.mobi", testMOBI, true, true},
+		"Mislabelled":    {"/inbox/book.epub", testPDF, true, false},
+		"Truncated":      {"/inbox/book.epub", testEPUB[:20], true, false},
+		"Empty":          {"/inbox/book.pdf", nil, true, false},
+		"TooLarge":       {"/inbox/book.pdf", append(testPDF, make([]byte, 1024)...), true, false},
+		"UnknownType":    {"/inbox/book.exe", testPDF, false, false},
+		"Hidden":         {"/inbox/.book.pdf", testPDF, false, false},
+		"Outside":        {"/book.pdf", testPDF, false, false},
+		"Nested":         {"/inbox/dir/book.pdf", testPDF, false, false},
+	}
+	for name, tdata := range testdata {
+		t.Run(name, func(t *testing.T) {
+			ib := newInbox(zap.NewNop(), t.TempDir(), 1024)
+			u, err := ib.Create("alice", tdata.path)
+			if !tdata.create {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+
+			info, err := ib.Stat("alice", tdata.path)
+			require.NoError(t, err)
+			assert.Equal(t, filepath.Base(tdata.path), info.Name())
+			_, err = ib.Stat("bob", tdata.path)
+			assert.True(t, os.IsNotExist(err), "uploads in progress are private")
+
+			_, _ = u.WriteAt(tdata.data, 0)
+			err = u.Close()
+			if tdata.ok {
+				require.NoError(t, err)
+				assert.Equal(t, []string{filepath.Base(tdata.path)}, inboxFiles(t, ib.Dir))
+				data, err := ioutil.ReadFile(filepath.Join(ib.Dir, filepath.Base(tdata.path)))
+				require.NoError(t, err)
+				assert.Equal(t, tdata.data, data)
+			} else {
+				assert.Error(t, err)
+				assert.Empty(t, inboxFiles(t, ib.Dir))
+			}
+			staged, err := ioutil.ReadDir(filepath.Join(ib.Dir, ".staging"))
+			require.NoError(t, err)
+			assert.Empty(t, staged, "nothing is left behind")
+			assert.Empty(t, ib.uploads)
+		})
+	}
+
+	t.Run("Collision", func(t *testing.T) {
+		ib := newInbox(zap.NewNop(), t.TempDir(), 0)
+		for i := 0; i < 3; i++ {
+			u, err := ib.Create("alice", "/inbox/book.pdf")
+			require.NoError(t, err)
+			_, err = u.WriteAt(testPDF, 0)
+			require.NoError(t, err)
+			require.NoError(t, u.Close())
+		}
+		assert.Equal(t, []string{"book (2).pdf", "book (3).pdf", "book.pdf"}, inboxFiles(t, ib.Dir))
+	})
+}
+
+func TestSFTPInbox(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("hunter2"), bcrypt.MinCost)
+	require.NoError(t, err)
+
+	fs := afero.NewMemMapFs()
+	require.NoError(t, afero.WriteFile(fs, "/book.txt", []byte("hi"), 0644))
+	cfg := &config.Config{Users: map[string]config.User{"alice": {Password: string(hash)}}}
+	cfg.SSH.SFTP.Enable = true
+	cfg.SSH.SFTP.Inbox.Enable = true
+	cfg.SSH.SFTP.Inbox.Dir = t.TempDir()
+	cfg.SSH.SFTP.Inbox.MaxSize = 1 << 20
+	sub := SFTP(cfg)
+
+	t.Run("User", func(t *testing.T) {
+		client, err := sftp.NewClient(testServer(t, cfg, afero.NewReadOnlyFs(fs), "alice", sub))
+		require.NoError(t, err)
+		defer client.Close()
+
+		infos, err := client.ReadDir("/")
+		require.NoError(t, err)
+		var names []string
+		for _, info := range infos {
+			names = append(names, info.Name())
+		}
+		assert.ElementsMatch(t, []string{"book.txt", "inbox"}, names)
+
+		f, err := client.Create("/inbox/book.epub")
+		require.NoError(t, err)
+		_, err = f.ReadFrom(bytes.NewReader(testEPUB))
+		require.NoError(t, err)
+		require.NoError(t, f.Close())
+		assert.Equal(t, []string{"book.epub"}, inboxFiles(t, cfg.SSH.SFTP.Inbox.Dir))
+
+		infos, err = client.ReadDir("/inbox")
+		require.NoError(t, err)
+		assert.Empty(t, infos, "the inbox can't be listed")
+
+		f, err = client.Create("/inbox/book.pdf")
+		require.NoError(t, err)
+		_, err = f.Write([]byte("not a pdf"))
+		require.NoError(t, err)
+		assert.Error(t, f.Close())
+		assert.Equal(t, []string{"book.epub"}, inboxFiles(t, cfg.SSH.SFTP.Inbox.Dir))
+
+		_, err = client.Create("/book.pdf")
+		assert.Error(t, err, "the rest of the tree is still read-only")
+		assert.Error(t, client.Remove("/book.txt"))
+
+		st, err := client.StatVFS("/")
+		require.NoError(t, err)
+		assert.Zero(t, st.Flag&sftpFlagReadOnly)
+		assert.Equal(t, uint64(1<<20/sftpBlockSize), st.Bavail)
+	})
+
+	t.Run("Anonymous", func(t *testing.T) {
+		client, err := sftp.NewClient(testServer(t, cfg, afero.NewReadOnlyFs(fs), "anonymous", sub))
+		require.NoError(t, err)
+		defer client.Close()
+
+		infos, err := client.ReadDir("/")
+		require.NoError(t, err)
+		require.Len(t, infos, 1)
+		assert.Equal(t, "book.txt", infos[0].Name())
+
+		_, err = client.Create("/inbox/book.epub")
+		assert.Error(t, err)
+	})
+}
@@ -0,0 +1,161 @@
+package ssh
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Limits concurrent connections, overall and per IP. Zero means unlimited.
+type connLimiter struct {
+	Max, MaxPerIP int
+
+	mu       sync.Mutex
+	total    int
+	byIP     map[string]int
+	accepted uint64 // Totals, for logging.
+	rejected uint64
+}
+
+func newConnLimiter(max, maxPerIP int) *connLimiter {
+	return &connLimiter{Max: max, MaxPerIP: maxPerIP, byIP: make(map[string]int)}
+}
+
+// Reserves a slot for a connection from an IP. Returns a reason if there isn't one, or "".
+func (l *connLimiter) acquire(ip string) string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	switch {
+	case l.Max > 0 && l.total >= l.Max:
+		l.rejected++
+		return "too many connections"
+	case l.MaxPerIP > 0 && l.byIP[ip] >= l.MaxPerIP:
+		l.rejected++
+		return "too many connections from this address"
+	}
+	l.total++
+	l.byIP[ip]++
+	l.accepted++
+	return ""
+}
+
+func (l *connLimiter) release(ip string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.total--
+	if l.byIP[ip]--; l.byIP[ip] <= 0 {
+		delete(l.byIP, ip)
+	}
+}
+
+// Returns current and total counts, for logging.
+func (l *connLimiter) stats(ip string) (active, activeIP int, accepted, rejected uint64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.total, l.byIP[ip], l.accepted, l.rejected
+}
+
+// How long to remember failed logins from an IP; anything older is forgiven.
+const backoffWindow = 15 * time.Minute
+
+// The longest we'll make anyone wait; the handshake deadline will probably hit first.
+const backoffMax = 30 * time.Second
+
+// Slows down password guessing: each failed login from an IP is delayed twice as long as the
+// last, starting at Base. A real user logging in resets it. Zero Base disables this.
+type authBackoff struct {
+	Base time.Duration
+
+	mu    sync.Mutex
+	fails map[string]backoffEntry
+	now   func() time.Time // For tests.
+}
+
+type backoffEntry struct {
+	N    int
+	Last time.Time
+}
+
+func newAuthBackoff(base time.Duration) *authBackoff {
+	return &authBackoff{Base: base, fails: make(map[string]backoffEntry), now: time.Now}
+}
+
+// Records a failed login, and returns how long to wait before replying, and how many
+// recent failures there have been from the IP.
+func (b *authBackoff) fail(ip string) (time.Duration, int) {
+	if b.Base <= 0 {
+		return 0, 0
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := b.now()
+	for k, e := range b.fails {
+		if now.Sub(e.Last) > backoffWindow {
+			delete(b.fails, k)
+		}
+	}
+	e := b.fails[ip]
+	e.N++
+	e.Last = now
+	b.fails[ip] = e
+
+	delay := b.Base
+	for i := 1; i < e.N && delay < backoffMax; i++ {
+		delay *= 2
+	}
+	if delay > backoffMax {
+		delay = backoffMax
+	}
+	return delay, e.N
+}
+
+// Forgets failed logins from an IP.
+func (b *authBackoff) succeed(ip string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.fails, ip)
+}
+
+// Returns the IP part of an address, for use as a key.
+func addrIP(addr net.Addr) string {
+	if tcp, ok := addr.(*net.TCPAddr); ok {
+		return tcp.IP.String()
+	}
+	if host, _, err := net.SplitHostPort(addr.String()); err == nil {
+		return host
+	}
+	return addr.String()
+}
+
+// A connection that times out after a period of inactivity in either direction. Until
+// SetIdleTimeout() is called, any deadline set on the underlying connection (eg. for the
+// handshake) is left alone.
+type idleConn struct {
+	net.Conn
+	timeout int64 // time.Duration, accessed atomically.
+}
+
+func (c *idleConn) SetIdleTimeout(d time.Duration) error {
+	atomic.StoreInt64(&c.timeout, int64(d))
+	if d <= 0 {
+		return c.Conn.SetDeadline(time.Time{})
+	}
+	return c.Conn.SetDeadline(time.Now().Add(d))
+}
+
+func (c *idleConn) Read(p []byte) (int, error) {
+	c.extend()
+	return c.Conn.Read(p)
+}
+
+func (c *idleConn) Write(p []byte) (int, error) {
+	c.extend()
+	return c.Conn.Write(p)
+}
+
+func (c *idleConn) extend() {
+	if d := time.Duration(atomic.LoadInt64(&c.timeout)); d > 0 {
+		_ = c.Conn.SetDeadline(time.Now().Add(d))
+	}
+}
@@ -0,0 +1,94 @@
+package ssh
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConnLimiter(t *testing.T) {
+	l := newConnLimiter(3, 2)
+	assert.Equal(t, "", l.acquire("10.0.0.1"))
+	assert.Equal(t, "", l.acquire("10.0.0.1"))
+	assert.Equal(t, "too many connections from this address", l.acquire("10.0.0.1"))
+	assert.Equal(t, "", l.acquire("10.0.0.2"))
+	assert.Equal(t, "too many connections", l.acquire("10.0.0.3"))
+
+	l.release("10.0.0.1")
+	assert.Equal(t, "", l.acquire("10.0.0.3"))
+	active, activeIP, accepted, rejected := l.stats("10.0.0.1")
+	assert.Equal(t, 3, active)
+	assert.Equal(t, 1, activeIP)
+	assert.Equal(t, uint64(4), accepted)
+	assert.Equal(t, uint64(2), rejected)
+
+	t.Run("Unlimited", func(t *testing.T) {
+		l := newConnLimiter(0, 0)
+		for i := 0; i < 100; i++ {
+			require.Equal(t, "", l.acquire("10.0.0.1"))
+		}
+	})
+}
+
+func TestAuthBackoff(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	b := newAuthBackoff(time.Second)
+	b.now = func() time.Time { return now }
+
+	var delays []time.Duration
+	for i := 0; i < 7; i++ {
+		d, n := b.fail("10.0.0.1")
+		assert.Equal(t, i+1, n)
+		delays = append(delays, d)
+	}
+	assert.Equal(t, []time.Duration{
+		1 * time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second,
+		16 * time.Second, backoffMax, backoffMax,
+	}, delays)
+
+	d, _ := b.fail("10.0.0.2")
+	assert.Equal(t, time.Second, d, "other addresses are unaffected")
+
+	b.succeed("10.0.0.1")
+	d, _ = b.fail("10.0.0.1")
+	assert.Equal(t, time.Second, d, "success resets the delay")
+
+	now = now.Add(backoffWindow + time.Second)
+	d, _ = b.fail("10.0.0.2")
+	assert.Equal(t, time.Second, d, "old failures are forgotten")
+
+	t.Run("Disabled", func(t *testing.T) {
+		d, n := newAuthBackoff(0).fail("10.0.0.1")
+		assert.Equal(t, time.Duration(0), d)
+		assert.Equal(t, 0, n)
+	})
+}
+
+func TestIdleConn(t *testing.T) {
+	a, b := net.Pipe()
+	defer b.Close()
+	c := &idleConn{Conn: a}
+	require.NoError(t, c.SetIdleTimeout(50*time.Millisecond))
+
+	// Traffic keeps it alive...
+	go func() {
+		for i := 0; i < 5; i++ {
+			time.Sleep(20 * time.Millisecond)
+			b.Write([]byte{byte(i)})
+		}
+	}()
+	buf := make([]byte, 1)
+	for i := 0; i < 5; i++ {
+		_, err := c.Read(buf)
+		require.NoError(t, err)
+	}
+
+	// ...but silence doesn't.
+	_, err := c.Read(buf)
+	nerr, ok := err.(net.Error)
+	require.True(t, ok, "%v", err)
+	assert.True(t, nerr.Timeout())
+}
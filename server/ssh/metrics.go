@@ -0,0 +1,20 @@
+package ssh
+
+import (
+	"github.com/liclac/sharlayan/metrics"
+)
+
+var (
+	sshConnections = metrics.NewCounter("sharlayan_ssh_connections_total",
+		"SSH connections, by result: accepted, rejected (over limits) or failed (handshake).", "result")
+	sshConnectionsOpen = metrics.NewGauge("sharlayan_ssh_connections_open",
+		"SSH connections currently open.")
+	sshSessions = metrics.NewCounter("sharlayan_ssh_sessions_total",
+		"SSH sessions opened, eg. for SFTP, SCP or a shell.")
+	sshSessionsOpen = metrics.NewGauge("sharlayan_ssh_sessions_open",
+		"SSH sessions currently open.")
+	sshAuthFailures = metrics.NewCounter("sharlayan_ssh_auth_failures_total",
+		"Failed SSH login attempts, by method, eg. password.", "method")
+	sftpOperations = metrics.NewCounter("sharlayan_sftp_operations_total",
+		"SFTP requests, by method, eg. Get or List.", "method")
+)
@@ -0,0 +1,244 @@
+package ssh
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/spf13/afero"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/ssh"
+
+	"github.com/liclac/sharlayan/config"
+)
+
+type scpCommand struct{}
+
+// SCP implements the legacy SCP protocol (scp -O), for downloads only.
+func SCP(cfg *config.Config) Command {
+	if !cfg.SSH.SCP.Enable {
+		zap.L().Named("ssh.scp").Debug("Not enabled, skipping...")
+		return nil
+	}
+	return &scpCommand{}
+}
+
+func (scpCommand) ID() string {
+	return "scp"
+}
+
+func (scpCommand) Exec(c *SSHConn, ch ssh.Channel, args []string) uint32 {
+	L := c.L.Named("scp")
+
+	flags := flag.NewFlagSet("scp", flag.ContinueOnError)
+	flags.SetOutput(ioutil.Discard)
+	from := flags.Bool("f", false, "source mode")
+	to := flags.Bool("t", false, "sink mode")
+	recursive := flags.Bool("r", false, "recursive")
+	preserve := flags.Bool("p", false, "preserve times")
+	flags.Bool("d", false, "target should be a directory")
+	flags.Bool("v", false, "verbose")
+	if err := flags.Parse(args[1:]); err != nil {
+		fmt.Fprintf(ch.Stderr(), "scp: %s\n", err)
+		return 1
+	}
+
+	switch {
+	case *to:
+		L.Debug("Upload denied", zap.Strings("paths", flags.Args()))
+		fmt.Fprintf(ch, "\x02scp: read-only filesystem\n")
+		return 1
+	case !*from:
+		fmt.Fprintf(ch.Stderr(), "scp: one of -f or -t is required\n")
+		return 1
+	}
+
+	src := &scpSource{
+		L: L, Fs: c.Fs, R: bufio.NewReader(ch), W: ch,
+		Recursive: *recursive, Preserve: *preserve, Trace: c.Server.cfg.SSH.Trace,
+	}
+	if err := src.Send(flags.Args()); err != nil {
+		L.Debug("Transfer failed", zap.Error(err))
+		return 1
+	}
+	return 0
+}
+
+// Errors reported to the client, which don't abort the transfer.
+var errSCPWarning = errors.New("scp: transfer incomplete")
+
+// The sending end of an SCP transfer. The protocol is a simple sequence of messages, each
+// acknowledged by the receiver with a 0 byte (or 1/2 + an error message):
+//
+//	T<mtime> 0 <atime> 0    If preserving times; precedes C or D.
+//	C<mode> <size> <name>   Followed by <size> bytes of data and a 0 byte.
+//	D<mode> 0 <name>        Enters a directory...
+//	E                       ...and leaves it again.
+//
+// Modes are always 0644 for files and 0755 for directories; the rendered tree's modes say
+// nothing useful (in-memory files are all 0000), and downloads shouldn't be read-only.
+type scpSource struct {
+	L  *zap.Logger
+	Fs afero.Fs
+	R  *bufio.Reader
+	W  io.Writer
+
+	Recursive, Preserve, Trace bool
+}
+
+// Sends a list of paths, which may contain glob patterns. Problems with individual files are
+// reported to the client as they happen, but the transfer continues; if any occurred, an
+// error is returned at the end.
+func (s *scpSource) Send(patterns []string) error {
+	if err := s.ack(); err != nil { // The receiver speaks first.
+		return err
+	}
+	var rerr error
+	for _, pattern := range patterns {
+		paths := []string{pattern}
+		if strings.ContainsAny(pattern, "*?[") {
+			matches, err := afero.Glob(s.Fs, path.Join("/", pattern))
+			if err != nil {
+				return err
+			}
+			if len(matches) == 0 {
+				return s.fatal(fmt.Sprintf("%s: No such file or directory", pattern))
+			}
+			paths = matches
+		}
+		for _, p := range paths {
+			if err := s.send(path.Join("/", p)); err == errSCPWarning {
+				rerr = err
+			} else if err != nil {
+				return err
+			}
+		}
+	}
+	return rerr
+}
+
+func (s *scpSource) send(p string) error {
+	info, err := s.Fs.Stat(p)
+	if err != nil {
+		return s.warn(fmt.Sprintf("%s: No such file or directory", p))
+	}
+	if info.IsDir() {
+		if !s.Recursive {
+			return s.warn(fmt.Sprintf("%s: not a regular file", p))
+		}
+		return s.sendDir(p, info)
+	}
+	return s.sendFile(p, info)
+}
+
+func (s *scpSource) sendFile(p string, info os.FileInfo) error {
+	if s.Trace {
+		s.L.Debug("[Trace] Send", zap.String("path", p), zap.Int64("size", info.Size()))
+	}
+	f, err := s.Fs.Open(p)
+	if err != nil {
+		return s.warn(fmt.Sprintf("%s: %s", p, err))
+	}
+	defer f.Close()
+
+	if err := s.sendTimes(info); err != nil {
+		return err
+	}
+	if err := s.msg(fmt.Sprintf("C0644 %d %s\n", info.Size(), info.Name())); err != nil {
+		return err
+	}
+	// We've promised the receiver a number of bytes, so we can't back out now.
+	if _, err := io.CopyN(s.W, f, info.Size()); err != nil {
+		return err
+	}
+	if _, err := s.W.Write([]byte{0}); err != nil {
+		return err
+	}
+	return s.ack()
+}
+
+func (s *scpSource) sendDir(p string, info os.FileInfo) error {
+	if s.Trace {
+		s.L.Debug("[Trace] Enter", zap.String("path", p))
+	}
+	infos, err := afero.ReadDir(s.Fs, p)
+	if err != nil {
+		return s.warn(fmt.Sprintf("%s: %s", p, err))
+	}
+	if err := s.sendTimes(info); err != nil {
+		return err
+	}
+	name := info.Name()
+	if p == "/" {
+		name = "library" // The root has no name of its own.
+	}
+	if err := s.msg(fmt.Sprintf("D0755 0 %s\n", name)); err != nil {
+		return err
+	}
+	var rerr error
+	for _, child := range infos {
+		if err := s.send(path.Join(p, child.Name())); err == errSCPWarning {
+			rerr = err
+		} else if err != nil {
+			return err
+		}
+	}
+	if err := s.msg("E\n"); err != nil {
+		return err
+	}
+	return rerr
+}
+
+func (s *scpSource) sendTimes(info os.FileInfo) error {
+	if !s.Preserve || info.ModTime().IsZero() {
+		return nil // Some in-memory files have no times; let the receiver pick one.
+	}
+	t := info.ModTime().Unix()
+	return s.msg(fmt.Sprintf("T%d 0 %d 0\n", t, t))
+}
+
+// Sends a message and waits for it to be acknowledged.
+func (s *scpSource) msg(msg string) error {
+	if _, err := io.WriteString(s.W, msg); err != nil {
+		return err
+	}
+	return s.ack()
+}
+
+// Reports a non-fatal problem to the client.
+func (s *scpSource) warn(msg string) error {
+	if _, err := fmt.Fprintf(s.W, "\x01scp: %s\n", msg); err != nil {
+		return err
+	}
+	return errSCPWarning
+}
+
+// Reports a fatal problem to the client, which will then disconnect.
+func (s *scpSource) fatal(msg string) error {
+	if _, err := fmt.Fprintf(s.W, "\x02scp: %s\n", msg); err != nil {
+		return err
+	}
+	return errors.New(msg)
+}
+
+// Reads an acknowledgement from the receiver.
+func (s *scpSource) ack() error {
+	b, err := s.R.ReadByte()
+	if err != nil {
+		return err
+	}
+	if b == 0 {
+		return nil
+	}
+	msg, err := s.R.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	return fmt.Errorf("receiver error: %s", strings.TrimSpace(msg))
+}
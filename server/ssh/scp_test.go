@@ -0,0 +1,62 @@
+package ssh
+
+import (
+	"bufio"
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func Test_scpSource(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	require.NoError(t, afero.WriteFile(fs, "/books/1/index.html", []byte("<h1>Hi</h1>"), 0644))
+	require.NoError(t, afero.WriteFile(fs, "/books/1/1.epub", []byte("EPUB"), 0644))
+	require.NoError(t, afero.WriteFile(fs, "/books/2/2.epub", []byte("EPUB2"), 0644))
+
+	testdata := map[string]struct {
+		paths     []string
+		recursive bool
+		out       string
+		err       bool
+	}{
+		"File":        {[]string{"/books/1/1.epub"}, false, "C0644 4 1.epub\nEPUB\x00", false},
+		"File/NoRoot": {[]string{"books/1/1.epub"}, false, "C0644 4 1.epub\nEPUB\x00", false},
+		"Glob":        {[]string{"/books/*/*.epub"}, false, "C0644 4 1.epub\nEPUB\x00C0644 5 2.epub\nEPUB2\x00", false},
+		"Glob/None":   {[]string{"/books/*.pdf"}, false, "\x02scp: /books/*.pdf: No such file or directory\n", true},
+		"Missing":     {[]string{"/nope", "/books/1/1.epub"}, false, "\x01scp: /nope: No such file or directory\nC0644 4 1.epub\nEPUB\x00", true},
+		"Dir":         {[]string{"/books/1"}, false, "\x01scp: /books/1: not a regular file\n", true},
+		"Dir/Recursive": {[]string{"/books/1"}, true,
+			"D0755 0 1\nC0644 4 1.epub\nEPUB\x00C0644 11 index.html\n<h1>Hi</h1>\x00E\n", false},
+	}
+	for name, tdata := range testdata {
+		t.Run(name, func(t *testing.T) {
+			var out bytes.Buffer
+			src := &scpSource{
+				L: zap.NewNop(), Fs: fs, W: &out, Recursive: tdata.recursive,
+				R: bufio.NewReader(strings.NewReader(strings.Repeat("\x00", 100))),
+			}
+			err := src.Send(tdata.paths)
+			if tdata.err {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.Equal(t, tdata.out, out.String())
+		})
+	}
+}
+
+func Test_scpSource_ReceiverError(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	require.NoError(t, afero.WriteFile(fs, "/1.epub", []byte("EPUB"), 0644))
+	src := &scpSource{
+		L: zap.NewNop(), Fs: fs, W: &bytes.Buffer{},
+		R: bufio.NewReader(strings.NewReader("\x00\x01scp: 1.epub: Permission denied\n")),
+	}
+	assert.EqualError(t, src.Send([]string{"/1.epub"}), "receiver error: scp: 1.epub: Permission denied")
+}
@@ -4,74 +4,108 @@ import (
 	"context"
 	"fmt"
 	"net"
-	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/spf13/afero"
 	"go.uber.org/zap"
 	"golang.org/x/crypto/ssh"
 
 	"github.com/liclac/sharlayan/config"
+	"github.com/liclac/sharlayan/metrics"
 	"github.com/liclac/sharlayan/server"
 )
 
-type Subsystem interface {
+// A Handler is either a Subsystem or a Command.
+type Handler interface {
 	ID() string
+}
+
+// A Subsystem handles "subsystem" requests, eg. "sftp".
+type Subsystem interface {
+	Handler
 	Serve(conn *SSHConn, ch ssh.Channel)
 }
 
+// A Command handles "exec" requests for a program, eg. "scp". There's no shell involved;
+// the command line is split into args (args[0] being the ID), and passed straight to Exec(),
+// which returns an exit status.
+type Command interface {
+	Handler
+	Exec(conn *SSHConn, ch ssh.Channel, args []string) uint32
+}
+
 type SSHServer struct {
 	L   *zap.Logger
 	cfg *config.Config
 
 	sub map[string]Subsystem
+	cmd map[string]Command
+
+	mu      sync.Mutex
+	conns   map[net.Conn]*SSHConn // Open connections; nil while still handshaking.
+	closing bool                  // Set on shutdown; no new connections or sessions.
+	wg      sync.WaitGroup        // Waits for all connections to close.
 }
 
-func Server(cfg *config.Config, subs ...Subsystem) server.Server {
+func Server(cfg *config.Config, handlers ...Handler) server.Server {
 	L := zap.L().Named("ssh")
 	if !cfg.SSH.Enable {
 		L.Debug("Not enabled, skipping...")
 		return nil
 	}
-	subMap := map[string]Subsystem{}
-	for _, sub := range subs {
-		if sub != nil {
-			id := sub.ID()
-			subMap[id] = sub
-			L.Debug("Subsystem registered", zap.String("id", id))
+	metrics.NotReady("ssh")
+	s := &SSHServer{
+		L:     L,
+		cfg:   cfg,
+		sub:   map[string]Subsystem{},
+		cmd:   map[string]Command{},
+		conns: map[net.Conn]*SSHConn{},
+	}
+	for _, h := range handlers {
+		switch h := h.(type) {
+		case nil:
+		case Subsystem:
+			s.sub[h.ID()] = h
+			L.Debug("Subsystem registered", zap.String("id", h.ID()))
+		case Command:
+			s.cmd[h.ID()] = h
+			L.Debug("Command registered", zap.String("id", h.ID()))
+		default:
+			panic(fmt.Sprintf("ssh: %T is neither a Subsystem nor a Command", h))
 		}
 	}
-	return &SSHServer{L, cfg, subMap}
+	return s
 }
 
 func (s *SSHServer) Run(ctx context.Context, fs afero.Fs) error {
 	// Configure an SSH server...
-	sshConfig := &ssh.ServerConfig{
-		NoClientAuth: true,
-		AuthLogCallback: func(conn ssh.ConnMetadata, method string, err error) {
-			L := s.L.With(zap.String("user", conn.User()),
-				zap.Stringer("addr", conn.RemoteAddr()))
-			if err != nil {
-				L.Debug("Auth Failure", zap.Error(err))
-			} else {
-				L.Debug("Auth Success")
-			}
-		},
+	auth, err := newAuthenticator(s.L.Named("auth"), s.cfg)
+	if err != nil {
+		return fmt.Errorf("ssh: %w", err)
 	}
-	connShared := SSHConnShared{s, fs, sshConfig}
-
-	// Load or generate a host key.
-	hostKeyPath := s.cfg.SSH.HostKey
-	if hostKeyPath == "" {
-		hostKeyPath = filepath.Join(s.cfg.Config.Dir, "host_key")
+	sshConfig := &ssh.ServerConfig{MaxAuthTries: s.cfg.SSH.MaxAuthTries}
+	if sshConfig.MaxAuthTries == 0 {
+		sshConfig.MaxAuthTries = -1 // 0 means 6 to the library, but unlimited to us.
 	}
-	hostKey, err := LoadOrGenerateHostKey(hostKeyPath)
+	auth.configure(sshConfig)
+	limits := newConnLimiter(s.cfg.SSH.MaxConns, s.cfg.SSH.MaxConnsPerIP)
+	connShared := SSHConnShared{s, fs, sshConfig, auth}
+
+	// Load or generate host keys.
+	hostKeys, err := LoadOrGenerateHostKeys(s.cfg)
 	if err != nil {
-		return fmt.Errorf("ssh: couldn't load or generate host key: %w", err)
+		return fmt.Errorf("ssh: couldn't load or generate host keys: %w", err)
+	}
+	for _, key := range hostKeys {
+		s.L.Info("Host key", zap.String("type", key.PublicKey().Type()),
+			zap.String("fingerprint", key.Fingerprint()), zap.String("path", key.Path))
+		sshConfig.AddHostKey(key)
 	}
-	sshConfig.AddHostKey(hostKey)
 
 	// Listen until the context terminates.
-	l, err := (&net.ListenConfig{}).Listen(ctx, "tcp", s.cfg.SSH.Addr)
+	l, err := server.Listen(ctx, s.cfg, s.cfg.SSH.Addrs...)
 	if err != nil {
 		return fmt.Errorf("ssh: couldn't listen: %w", err)
 	}
@@ -82,6 +116,8 @@ func (s *SSHServer) Run(ctx context.Context, fs afero.Fs) error {
 		}
 	}()
 	s.L.Info("Listening", zap.Stringer("addr", l.Addr()))
+	metrics.Ready("ssh")
+	defer s.shutdown()
 
 	// Accept connections.
 	for {
@@ -94,8 +130,76 @@ func (s *SSHServer) Run(ctx context.Context, fs afero.Fs) error {
 				return fmt.Errorf("accept: %w", err)
 			}
 		}
-		if err := accept(&connShared, rawConn); err != nil {
-			s.L.Warn("Failed to accept connection", zap.Error(err))
+		go serve(&connShared, limits, rawConn)
+	}
+}
+
+// Starts tracking a new connection. Returns false if the server is shutting down.
+func (s *SSHServer) track(rawConn net.Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closing {
+		return false
+	}
+	s.conns[rawConn] = nil
+	s.wg.Add(1)
+	return true
+}
+
+// Records that a connection has finished its handshake. Returns false if the server has
+// started shutting down in the meantime.
+func (s *SSHServer) established(rawConn net.Conn, c *SSHConn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.conns[rawConn] = c
+	return !s.closing
+}
+
+func (s *SSHServer) untrack(rawConn net.Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.conns, rawConn)
+	s.wg.Done()
+}
+
+func (s *SSHServer) isClosing() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closing
+}
+
+// Refuses new sessions, closes idle connections, and waits up to the grace period for the
+// rest to finish what they're doing (eg. downloads), before closing them too.
+func (s *SSHServer) shutdown() {
+	metrics.NotReady("ssh")
+	s.mu.Lock()
+	s.closing = true
+	for rawConn, c := range s.conns {
+		if c == nil || atomic.LoadInt32(&c.sessions) == 0 {
+			rawConn.Close()
 		}
 	}
+	num := len(s.conns)
+	s.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+	grace := s.cfg.SSH.Grace
+	s.L.Info("Gracefully shutting down...", zap.Duration("timeout", grace), zap.Int("conns", num))
+	select {
+	case <-done:
+		return
+	case <-time.After(grace):
+	}
+
+	s.mu.Lock()
+	s.L.Warn("Grace period expired, closing connections", zap.Int("conns", len(s.conns)))
+	for rawConn := range s.conns {
+		rawConn.Close()
+	}
+	s.mu.Unlock()
+	<-done
 }
@@ -0,0 +1,105 @@
+package ssh
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/ssh"
+
+	"github.com/liclac/sharlayan/config"
+)
+
+// Serves a filesystem on a loopback port, and returns a client logged in as the given user;
+// a user who isn't in cfg.Users logs in anonymously, and anyone else with "hunter2".
+func testServer(t *testing.T, cfg *config.Config, fs afero.Fs, user string, handlers ...Handler) *ssh.Client {
+	cfg.Config.Dir = t.TempDir()
+	cfg.SSH.Anonymous = true
+	s := &SSHServer{
+		L:     zap.NewNop(),
+		cfg:   cfg,
+		sub:   map[string]Subsystem{},
+		cmd:   map[string]Command{},
+		conns: map[net.Conn]*SSHConn{},
+	}
+	for _, h := range handlers {
+		switch h := h.(type) {
+		case Subsystem:
+			s.sub[h.ID()] = h
+		case Command:
+			s.cmd[h.ID()] = h
+		}
+	}
+
+	auth, err := newAuthenticator(zap.NewNop(), cfg)
+	require.NoError(t, err)
+	sshConfig := &ssh.ServerConfig{}
+	auth.configure(sshConfig)
+	sshConfig.AddHostKey(testSigner(t))
+	shared := &SSHConnShared{s, fs, sshConfig, auth}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			rawConn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go serve(shared, newConnLimiter(0, 0), rawConn)
+		}
+	}()
+
+	client, err := ssh.Dial("tcp", l.Addr().String(), &ssh.ClientConfig{
+		User:            user,
+		Auth:            []ssh.AuthMethod{ssh.Password("hunter2")},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+func TestShutdown(t *testing.T) {
+	cfg := &config.Config{}
+	cfg.SSH.Grace = 100 * time.Millisecond
+	s := &SSHServer{L: zap.NewNop(), cfg: cfg, conns: map[net.Conn]*SSHConn{}}
+
+	// Tracks a connection until it's closed, returning when that happened.
+	open := func(c *SSHConn) <-chan time.Time {
+		rawConn, peer := net.Pipe()
+		assert.True(t, s.track(rawConn))
+		if c != nil {
+			assert.True(t, s.established(rawConn, c))
+		}
+		closed := make(chan time.Time, 1)
+		go func() {
+			defer peer.Close()
+			_, _ = io.Copy(ioutil.Discard, rawConn)
+			closed <- time.Now()
+			s.untrack(rawConn)
+		}()
+		return closed
+	}
+	handshaking := open(nil)
+	idle := open(&SSHConn{})
+	busy := open(&SSHConn{sessions: 1})
+
+	start := time.Now()
+	s.shutdown()
+	assert.WithinDuration(t, start, <-handshaking, 50*time.Millisecond)
+	assert.WithinDuration(t, start, <-idle, 50*time.Millisecond)
+	assert.WithinDuration(t, start.Add(cfg.SSH.Grace), <-busy, 50*time.Millisecond)
+	assert.Empty(t, s.conns)
+
+	assert.True(t, s.isClosing())
+	rawConn, _ := net.Pipe()
+	assert.False(t, s.track(rawConn), "new connections are refused")
+}
@@ -3,6 +3,11 @@ package ssh
 import (
 	"io"
 	"os"
+	"path"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/pkg/sftp"
 	"github.com/spf13/afero"
@@ -12,24 +17,38 @@ import (
 	"github.com/liclac/sharlayan/config"
 )
 
-type sftpSubsystem struct{}
+type sftpSubsystem struct {
+	inbox *inbox // If uploads are enabled.
+}
 
 func SFTP(cfg *config.Config) Subsystem {
 	if !cfg.SSH.SFTP.Enable {
 		zap.L().Named("ssh.sftp").Debug("Not enabled, skipping...")
 		return nil
 	}
-	return &sftpSubsystem{}
+	s := &sftpSubsystem{}
+	if cfg.SSH.SFTP.Inbox.Enable {
+		dir := cfg.SSH.SFTP.Inbox.Dir
+		if dir == "" {
+			dir = filepath.Join(cfg.Config.Dir, "inbox")
+		}
+		s.inbox = newInbox(zap.L().Named("ssh.inbox"), dir, cfg.SSH.SFTP.Inbox.MaxSize)
+	}
+	return s
 }
 
 func (sftpSubsystem) ID() string {
 	return "sftp"
 }
 
-func (sftpSubsystem) Serve(c *SSHConn, ch ssh.Channel) {
+func (s sftpSubsystem) Serve(c *SSHConn, ch ssh.Channel) {
 	L := c.L.Named("sftp")
 
-	srv := sftp.NewRequestServer(ch, sftpHandlers(c.Server.cfg, L, c.Fs))
+	var ib *inbox
+	if c.User != "" {
+		ib = s.inbox // Anonymous users can't upload anything.
+	}
+	srv := sftp.NewRequestServer(ch, sftpHandlers(c.Server.cfg, L, c.Fs, ib, c.User))
 	defer func() {
 		if err := srv.Close(); err != nil && err != io.EOF {
 			L.Warn("Error closing SFTP server", zap.Error(err))
@@ -46,10 +65,16 @@ type sftpFS struct {
 	afero.Fs
 	cfg *config.Config
 	L   *zap.Logger
+
+	usage *sftpUsage // Computed on first use, for StatVFS.
+	inbox *inbox     // If the user may upload books.
+	user  string
 }
 
-func sftpHandlers(cfg *config.Config, L *zap.Logger, fs afero.Fs) sftp.Handlers {
-	f := sftpFS{fs, cfg, L}
+var _ sftp.StatVFSFileCmder = sftpFS{}
+
+func sftpHandlers(cfg *config.Config, L *zap.Logger, fs afero.Fs, ib *inbox, user string) sftp.Handlers {
+	f := sftpFS{fs, cfg, L, &sftpUsage{}, ib, user}
 	return sftp.Handlers{
 		FileGet:  f,
 		FilePut:  f,
@@ -59,6 +84,7 @@ func sftpHandlers(cfg *config.Config, L *zap.Logger, fs afero.Fs) sftp.Handlers
 }
 
 func (f sftpFS) Fileread(req *sftp.Request) (io.ReaderAt, error) {
+	sftpOperations.Inc(req.Method)
 	switch req.Method {
 	case "Get":
 		if f.cfg.SSH.Trace {
@@ -73,25 +99,51 @@ func (f sftpFS) Fileread(req *sftp.Request) (io.ReaderAt, error) {
 }
 
 func (f sftpFS) Filelist(req *sftp.Request) (sftp.ListerAt, error) {
+	sftpOperations.Inc(req.Method)
 	switch req.Method {
 	case "List":
 		if f.cfg.SSH.Trace {
 			f.L.Debug("[Trace] List", zap.String("path", req.Filepath))
 		}
+		if f.inbox != nil && path.Clean(req.Filepath) == inboxPath {
+			return sftpLister{}, nil // Uploads are private, even from their uploader.
+		}
 		infos, err := afero.ReadDir(f, req.Filepath)
 		if err != nil {
 			return nil, err
 		}
+		if f.inbox != nil && path.Clean(req.Filepath) == "/" {
+			infos = append(infos, inboxDirInfo{})
+		}
 		return sftpLister(infos), nil
 	case "Stat":
 		if f.cfg.SSH.Trace {
 			f.L.Debug("[Trace] Stat", zap.String("path", req.Filepath))
 		}
-		info, err := f.Stat(req.Filepath)
+		var info os.FileInfo
+		var err error
+		switch {
+		case f.inbox != nil && path.Clean(req.Filepath) == inboxPath:
+			info = inboxDirInfo{}
+		case f.inbox != nil && inInbox(req.Filepath):
+			info, err = f.inbox.Stat(f.user, req.Filepath)
+		default:
+			info, err = f.Stat(req.Filepath)
+		}
 		if err != nil {
 			return nil, err
 		}
 		return sftpLister{info}, nil
+	case "Readlink":
+		// Links to book files are presented as the files themselves, and Lstat agrees, so
+		// there's nothing to read; the targets are paths on our disk, not in the tree.
+		if f.cfg.SSH.Trace {
+			f.L.Debug("[Trace] Readlink", zap.String("path", req.Filepath))
+		}
+		if _, err := f.Stat(req.Filepath); err != nil {
+			return nil, err
+		}
+		return nil, &os.PathError{Op: "readlink", Path: req.Filepath, Err: syscall.EINVAL}
 	default:
 		f.L.Warn("Unsupported list command", zap.String("method", req.Method),
 			zap.String("path", req.Filepath), zap.String("target", req.Target))
@@ -100,12 +152,28 @@ func (f sftpFS) Filelist(req *sftp.Request) (sftp.ListerAt, error) {
 }
 
 func (f sftpFS) Filewrite(req *sftp.Request) (io.WriterAt, error) {
+	sftpOperations.Inc(req.Method)
+	if f.inbox != nil && inInbox(req.Filepath) {
+		if f.cfg.SSH.Trace {
+			f.L.Debug("[Trace] Upload", zap.String("path", req.Filepath))
+		}
+		u, err := f.inbox.Create(f.user, req.Filepath)
+		if err != nil {
+			f.L.Debug("Upload refused", zap.String("path", req.Filepath), zap.Error(err))
+			return nil, err
+		}
+		return u, nil
+	}
 	f.L.Debug("Write denied", zap.String("method", req.Method),
 		zap.String("path", req.Filepath), zap.String("target", req.Target))
 	return nil, sftp.ErrSSHFxPermissionDenied
 }
 
 func (f sftpFS) Filecmd(req *sftp.Request) error {
+	sftpOperations.Inc(req.Method)
+	if req.Method == "Setstat" && f.inbox != nil && inInbox(req.Filepath) {
+		return nil // Clients like to set times on uploads; we'd rather keep our own.
+	}
 	switch req.Method {
 	case "Setstat", "Rename", "Rmdir", "Mkdir", "Link", "Symlink", "Remove":
 		f.L.Debug("Write denied", zap.String("method", req.Method),
@@ -118,6 +186,80 @@ func (f sftpFS) Filecmd(req *sftp.Request) error {
 	}
 }
 
+// Answers statvfs@openssh.com requests, which clients use to show disk usage; some (eg.
+// sshfs) won't mount a filesystem without it. The filesystem is read-only and full, unless
+// the user can upload to the inbox, in which case it has room for one more upload.
+func (f sftpFS) StatVFS(req *sftp.Request) (*sftp.StatVFS, error) {
+	sftpOperations.Inc(req.Method)
+	if f.cfg.SSH.Trace {
+		f.L.Debug("[Trace] StatVFS", zap.String("path", req.Filepath))
+	}
+	if _, err := f.Stat(req.Filepath); err != nil && !(f.inbox != nil && path.Clean(req.Filepath) == inboxPath) {
+		return nil, err
+	}
+	files, size := f.usage.get(f.Fs)
+	st := &sftp.StatVFS{
+		Bsize:   sftpBlockSize,
+		Frsize:  sftpBlockSize,
+		Blocks:  (size + sftpBlockSize - 1) / sftpBlockSize,
+		Files:   files,
+		Flag:    sftpFlagReadOnly | sftpFlagNoSUID,
+		Namemax: 255,
+	}
+	if f.inbox != nil {
+		free := uint64(f.inbox.MaxSize)
+		if free == 0 {
+			free = 1 << 40 // Unlimited, but clients want a number.
+		}
+		st.Bfree = free / sftpBlockSize
+		st.Bavail = st.Bfree
+		st.Blocks += st.Bfree
+		st.Flag &^= sftpFlagReadOnly
+	}
+	return st, nil
+}
+
+const (
+	sftpBlockSize = 4096
+
+	// Flags for StatVFS, from statvfs(3).
+	sftpFlagReadOnly = 0x1 // ST_RDONLY
+	sftpFlagNoSUID   = 0x2 // ST_NOSUID
+)
+
+// Counts the files in a filesystem and their total size, the first time it's asked. The tree
+// never changes while it's being served, so there's no need to do it again.
+type sftpUsage struct {
+	once        sync.Once
+	files, size uint64
+}
+
+func (u *sftpUsage) get(fs afero.Fs) (files, size uint64) {
+	u.once.Do(func() {
+		_ = afero.Walk(fs, "/", func(path string, info os.FileInfo, err error) error {
+			if err == nil && info.Mode()&os.ModeSymlink != 0 {
+				info, err = fs.Stat(path) // Walk() doesn't follow links.
+			}
+			if err == nil {
+				u.files++
+				u.size += uint64(info.Size())
+			}
+			return nil
+		})
+	})
+	return u.files, u.size
+}
+
+// The inbox, as it appears in listings; write-only, like a drop box.
+type inboxDirInfo struct{}
+
+func (inboxDirInfo) Name() string       { return path.Base(inboxPath) }
+func (inboxDirInfo) Size() int64        { return 0 }
+func (inboxDirInfo) Mode() os.FileMode  { return os.ModeDir | 0733 }
+func (inboxDirInfo) ModTime() time.Time { return time.Time{} }
+func (inboxDirInfo) IsDir() bool        { return true }
+func (inboxDirInfo) Sys() interface{}   { return nil }
+
 // Implements sftp.ListerAt for a slice of FileInfos.
 type sftpLister []os.FileInfo
 
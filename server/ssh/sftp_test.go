@@ -2,11 +2,19 @@ package ssh
 
 import (
 	"io"
+	"io/ioutil"
 	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
+	"github.com/pkg/sftp"
+	"github.com/spf13/afero"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/liclac/sharlayan/afhack"
+	"github.com/liclac/sharlayan/config"
 )
 
 type testFileInfo struct {
@@ -76,3 +84,83 @@ func Test_sftpLister(t *testing.T) {
 		})
 	}
 }
+
+func TestSFTP(t *testing.T) {
+	// A tree like the one we serve: in-memory pages, and links to book files on disk.
+	bookPath := filepath.Join(t.TempDir(), "Good Omens - Neil Gaiman.epub")
+	require.NoError(t, ioutil.WriteFile(bookPath, []byte("EPUB"), 0644))
+	lfs := afhack.NewLinkFs(afero.NewMemMapFs())
+	require.NoError(t, afero.WriteFile(lfs, "/index.html", []byte("<h1>Home</h1>"), 0644))
+	require.NoError(t, afero.WriteFile(lfs, "/books/2/index.html", []byte("<h1>Good Omens</h1>"), 0644))
+	require.NoError(t, lfs.Symlink(bookPath, "/books/2/2.epub"))
+
+	cfg := &config.Config{}
+	cfg.SSH.SFTP.Enable = true
+	client, err := sftp.NewClient(testServer(t, cfg, afero.NewReadOnlyFs(lfs), "anonymous", SFTP(cfg)))
+	require.NoError(t, err)
+	defer client.Close()
+
+	t.Run("ReadDir", func(t *testing.T) {
+		infos, err := client.ReadDir("/books/2")
+		require.NoError(t, err)
+		var names []string
+		for _, info := range infos {
+			names = append(names, info.Name())
+		}
+		assert.Equal(t, []string{"2.epub", "index.html"}, names)
+	})
+	t.Run("Read", func(t *testing.T) {
+		f, err := client.Open("/books/2/2.epub")
+		require.NoError(t, err)
+		defer f.Close()
+		data, err := ioutil.ReadAll(f)
+		require.NoError(t, err)
+		assert.Equal(t, "EPUB", string(data))
+	})
+	t.Run("Lstat", func(t *testing.T) {
+		info, err := client.Lstat("/books/2/2.epub")
+		require.NoError(t, err)
+		assert.True(t, info.Mode().IsRegular(), "links look like the files they point to")
+		assert.Equal(t, int64(4), info.Size())
+	})
+	t.Run("ReadLink", func(t *testing.T) {
+		_, err := client.ReadLink("/books/2/2.epub")
+		assert.Error(t, err)
+		_, err = client.ReadLink("/books/3")
+		assert.True(t, os.IsNotExist(err), "%v", err)
+	})
+	t.Run("RealPath", func(t *testing.T) {
+		for in, out := range map[string]string{
+			".":                 "/",
+			"":                  "/",
+			"books/2":           "/books/2",
+			"/books/../books/2": "/books/2",
+			"/../..":            "/",
+		} {
+			p, err := client.RealPath(in)
+			require.NoError(t, err, in)
+			assert.Equal(t, out, p, in)
+		}
+	})
+	t.Run("StatVFS", func(t *testing.T) {
+		st, err := client.StatVFS("/")
+		require.NoError(t, err)
+		assert.Equal(t, uint64(sftpFlagReadOnly|sftpFlagNoSUID), st.Flag)
+		assert.Equal(t, uint64(6), st.Files) // Including directories.
+		assert.Equal(t, uint64(1), st.Blocks)
+		assert.Equal(t, uint64(0), st.FreeSpace())
+
+		_, err = client.StatVFS("/nope")
+		assert.Error(t, err)
+	})
+	t.Run("ReadOnly", func(t *testing.T) {
+		_, err := client.Create("/new.txt")
+		assert.Error(t, err)
+		assert.Error(t, client.Mkdir("/new"))
+		assert.Error(t, client.Remove("/index.html"))
+		assert.Error(t, client.Rename("/index.html", "/old.html"))
+		assert.Error(t, client.PosixRename("/index.html", "/old.html"))
+		_, err = client.Stat("/index.html")
+		assert.NoError(t, err)
+	})
+}
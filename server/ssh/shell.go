@@ -0,0 +1,540 @@
+package ssh
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/spf13/afero"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/terminal"
+
+	"github.com/liclac/sharlayan/builder/tree"
+	"github.com/liclac/sharlayan/calibre"
+)
+
+// Payload of a "pty-req" request, see RFC 4254, section 6.2.
+type ptyRequest struct {
+	Term          string
+	Cols, Rows    uint32
+	Width, Height uint32 // In pixels; ignored.
+	Modes         string // Encoded terminal modes; ignored.
+}
+
+// Payload of a "window-change" request, see RFC 4254, section 6.7.
+type windowChange struct {
+	Cols, Rows    uint32
+	Width, Height uint32
+}
+
+// A built-in shell for browsing the library; no OS processes are involved. With a pty, it has
+// a line editor with history and tab completion; without one (eg. `ssh -T`), it just reads
+// commands line by line, so it can be scripted.
+type shell struct {
+	L    *zap.Logger
+	Fs   afero.Fs
+	Meta *calibre.Metadata // May be nil, in which case info and search are unavailable.
+	Cwd  string
+
+	title string
+	term  *terminal.Terminal // Nil without a pty.
+	r     *bufio.Reader      // Nil with a pty.
+	w     io.Writer
+}
+
+type shellCommand struct {
+	Usage string
+	Help  string
+	Run   func(sh *shell, args []string) error
+}
+
+// Returned by the "exit" command to end the session. Any other error returned from a
+// shellCommand is printed, prefixed with the command's name.
+var errExit = fmt.Errorf("exit")
+
+// Set in init(), since "help" refers to it.
+var shellCommands map[string]shellCommand
+
+func init() {
+	shellCommands = map[string]shellCommand{
+		"help":   {"help", "Show this help.", (*shell).help},
+		"ls":     {"ls [-l] [path...]", "List a directory.", (*shell).ls},
+		"cd":     {"cd [path]", "Change directory.", (*shell).cd},
+		"pwd":    {"pwd", "Print the current directory.", (*shell).pwd},
+		"cat":    {"cat file...", "Print a file.", (*shell).cat},
+		"tree":   {"tree [path]", "List a directory recursively.", (*shell).tree},
+		"info":   {"info book", "Show a book, by ID, path or title.", (*shell).info},
+		"search": {"search query...", "Search titles, authors, series and tags.", (*shell).search},
+		"exit":   {"exit", "Log out.", func(*shell, []string) error { return errExit }},
+	}
+}
+
+func newShell(c *SSHConn, ch ssh.Channel, pty *ptyRequest) *shell {
+	sh := &shell{
+		L:     c.L.Named("shell"),
+		Fs:    c.Fs,
+		Meta:  c.Meta,
+		Cwd:   "/",
+		title: c.Server.cfg.HTML.Title,
+		w:     ch,
+	}
+	if pty != nil {
+		sh.term = terminal.NewTerminal(ch, "")
+		sh.term.AutoCompleteCallback = sh.complete
+		sh.Resize(pty.Cols, pty.Rows)
+		sh.w = sh.term
+	} else {
+		sh.r = bufio.NewReader(ch)
+	}
+	return sh
+}
+
+func (sh *shell) Resize(cols, rows uint32) {
+	if cols == 0 || rows == 0 {
+		cols, rows = 80, 24 // Clients without a real terminal (eg. ssh -tt < script) send 0x0.
+	}
+	if sh.term != nil {
+		if err := sh.term.SetSize(int(cols), int(rows)); err != nil {
+			sh.L.Debug("Couldn't resize terminal", zap.Error(err))
+		}
+	}
+}
+
+// Runs the shell until the client logs out or disconnects, returning an exit status.
+func (sh *shell) Run() uint32 {
+	if sh.term != nil {
+		fmt.Fprintf(sh.w, "Welcome to %s! Type 'help' for a list of commands.\n", sh.title)
+	}
+	for {
+		line, err := sh.readLine()
+		if err == io.EOF {
+			return 0
+		} else if err != nil {
+			sh.L.Debug("Couldn't read line", zap.Error(err))
+			return 1
+		}
+		if err := sh.Exec(line); err == errExit {
+			return 0
+		}
+	}
+}
+
+func (sh *shell) readLine() (string, error) {
+	if sh.term != nil {
+		sh.term.SetPrompt(fmt.Sprintf("%s:%s> ", sh.title, sh.Cwd))
+		return sh.term.ReadLine()
+	}
+	line, err := sh.r.ReadString('\n')
+	if err == io.EOF && line != "" {
+		err = nil // Run the last line, even if it doesn't end in a newline.
+	}
+	return line, err
+}
+
+// Runs a single command line. Errors are printed, and only returned for errExit.
+func (sh *shell) Exec(line string) error {
+	args, err := splitArgs(line)
+	if err != nil {
+		fmt.Fprintf(sh.w, "%s\n", err)
+		return nil
+	}
+	if len(args) == 0 {
+		return nil
+	}
+	if args[0] == "logout" || args[0] == "quit" {
+		args[0] = "exit"
+	}
+	cmd, ok := shellCommands[args[0]]
+	if !ok {
+		fmt.Fprintf(sh.w, "%s: command not found; try 'help'\n", args[0])
+		return nil
+	}
+	if err := cmd.Run(sh, args[1:]); err == errExit {
+		return err
+	} else if err != nil {
+		fmt.Fprintf(sh.w, "%s: %s\n", args[0], err)
+	}
+	return nil
+}
+
+// Resolves a path relative to the current directory.
+func (sh *shell) abs(p string) string {
+	if !path.IsAbs(p) {
+		p = path.Join(sh.Cwd, p)
+	}
+	return path.Clean(p)
+}
+
+// Returns a human-readable name for a path, eg. the title for "/books/4", or "".
+func (sh *shell) label(p string) string {
+	if sh.Meta == nil {
+		return ""
+	}
+	parts := strings.Split(strings.Trim(p, "/"), "/")
+	if len(parts) != 2 {
+		return ""
+	}
+	id, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return ""
+	}
+	switch parts[0] {
+	case tree.BookDirInfo.ID:
+		if b := sh.Meta.GetBook(id); b != nil {
+			return b.Title
+		}
+	case tree.AuthorDirInfo.ID:
+		if a := sh.Meta.GetAuthor(id); a != nil {
+			return a.Name
+		}
+	case tree.SeriesDirInfo.ID:
+		if s := sh.Meta.GetSeries(id); s != nil {
+			return s.Name
+		}
+	case tree.TagDirInfo.ID:
+		if t := sh.Meta.GetTag(id); t != nil {
+			return t.Name
+		}
+	}
+	return ""
+}
+
+func (sh *shell) help(args []string) error {
+	names := make([]string, 0, len(shellCommands))
+	for name := range shellCommands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		cmd := shellCommands[name]
+		fmt.Fprintf(sh.w, "  %-20s %s\n", cmd.Usage, cmd.Help)
+	}
+	return nil
+}
+
+func (sh *shell) ls(args []string) error {
+	long := len(args) > 0 && args[0] == "-l"
+	if long {
+		args = args[1:]
+	}
+	if len(args) == 0 {
+		args = []string{"."}
+	}
+	for i, arg := range args {
+		p := sh.abs(arg)
+		info, err := sh.Fs.Stat(p)
+		if err != nil {
+			return fmt.Errorf("%s: no such file or directory", arg)
+		}
+		if !info.IsDir() {
+			sh.lsEntry(path.Dir(p), info, long)
+			continue
+		}
+		if len(args) > 1 {
+			if i > 0 {
+				fmt.Fprintln(sh.w)
+			}
+			fmt.Fprintf(sh.w, "%s:\n", arg)
+		}
+		infos, err := afero.ReadDir(sh.Fs, p)
+		if err != nil {
+			return err
+		}
+		for _, info := range infos {
+			sh.lsEntry(p, info, long)
+		}
+	}
+	return nil
+}
+
+func (sh *shell) lsEntry(dir string, info os.FileInfo, long bool) {
+	name := info.Name()
+	if info.IsDir() {
+		name += "/"
+	}
+	if label := sh.label(path.Join(dir, info.Name())); label != "" {
+		name = fmt.Sprintf("%-8s %s", name, label)
+	}
+	if long {
+		mtime := "                " // In-memory directories have no times.
+		if !info.ModTime().IsZero() {
+			mtime = info.ModTime().Format("2006-01-02 15:04")
+		}
+		fmt.Fprintf(sh.w, "%10d  %s  %s\n", info.Size(), mtime, name)
+	} else {
+		fmt.Fprintln(sh.w, name)
+	}
+}
+
+func (sh *shell) cd(args []string) error {
+	p := "/"
+	if len(args) > 0 {
+		p = sh.abs(args[0])
+	}
+	info, err := sh.Fs.Stat(p)
+	if err != nil {
+		return fmt.Errorf("%s: no such directory", p)
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s: not a directory", p)
+	}
+	sh.Cwd = p
+	return nil
+}
+
+func (sh *shell) pwd(args []string) error {
+	fmt.Fprintln(sh.w, sh.Cwd)
+	return nil
+}
+
+func (sh *shell) cat(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: %s", shellCommands["cat"].Usage)
+	}
+	for _, arg := range args {
+		f, err := sh.Fs.Open(sh.abs(arg))
+		if err != nil {
+			return fmt.Errorf("%s: no such file", arg)
+		}
+		_, err = io.Copy(sh.w, f)
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (sh *shell) tree(args []string) error {
+	p := sh.Cwd
+	if len(args) > 0 {
+		p = sh.abs(args[0])
+	}
+	if _, err := sh.Fs.Stat(p); err != nil {
+		return fmt.Errorf("%s: no such directory", p)
+	}
+	fmt.Fprintln(sh.w, p)
+	return sh.treeDir(p, "")
+}
+
+func (sh *shell) treeDir(dir, prefix string) error {
+	infos, err := afero.ReadDir(sh.Fs, dir)
+	if err != nil {
+		return err
+	}
+	for i, info := range infos {
+		branch, indent := "├── ", "│   "
+		if i == len(infos)-1 {
+			branch, indent = "└── ", "    "
+		}
+		p := path.Join(dir, info.Name())
+		name := info.Name()
+		if label := sh.label(p); label != "" {
+			name += " (" + label + ")"
+		}
+		fmt.Fprintf(sh.w, "%s%s%s\n", prefix, branch, name)
+		if info.IsDir() {
+			if err := sh.treeDir(p, prefix+indent); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (sh *shell) info(args []string) error {
+	if sh.Meta == nil {
+		return fmt.Errorf("no library metadata available")
+	}
+	if len(args) == 0 {
+		return fmt.Errorf("usage: %s", shellCommands["info"].Usage)
+	}
+	book, err := sh.findBook(strings.Join(args, " "))
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(sh.w, "%s\n%s\n", book.Title, strings.Repeat("=", len([]rune(book.Title))))
+	field := func(name, value string) {
+		if value != "" {
+			fmt.Fprintf(sh.w, "%-12s %s\n", name+":", value)
+		}
+	}
+	field("ID", strconv.Itoa(book.ID))
+	field("Path", "/"+tree.Path(tree.ByID, tree.BookDirInfo, tree.BookInfo(book)))
+	var names []string
+	for _, a := range book.Authors {
+		names = append(names, a.Name)
+	}
+	field("Authors", strings.Join(names, ", "))
+	names = nil
+	for _, s := range book.Series {
+		names = append(names, fmt.Sprintf("%s #%g", s.Name, book.SeriesIndex))
+	}
+	field("Series", strings.Join(names, ", "))
+	names = nil
+	for _, t := range book.Tags {
+		names = append(names, t.Name)
+	}
+	field("Tags", strings.Join(names, ", "))
+	if pub := book.Published(); pub != nil {
+		field("Published", pub.Format("2 January 2006"))
+	}
+	if book.Rating.Valid {
+		field("Rating", fmt.Sprintf("%g/5", float64(book.Rating.Int32)/2))
+	}
+	for _, ident := range book.Identifiers {
+		label := calibre.IdentifierTypes[ident.Type].Label
+		if label == "" {
+			label = ident.Type
+		}
+		field(label, ident.Val)
+	}
+	names = nil
+	for _, d := range book.Data {
+		names = append(names, tree.DataInfo(book, d).ID)
+	}
+	field("Files", strings.Join(names, ", "))
+	if book.Comment != "" {
+		fmt.Fprintf(sh.w, "\n%s\n", strings.TrimSpace(book.Comment))
+	}
+	return nil
+}
+
+// Finds a book by ID, path (eg. "/books/4") or title. Titles match if they contain the query,
+// ignoring case; if several do, they're listed, and an error is returned.
+func (sh *shell) findBook(q string) (*calibre.Book, error) {
+	if id, err := strconv.Atoi(q); err == nil {
+		if book := sh.Meta.GetBook(id); book != nil {
+			return book, nil
+		}
+		return nil, fmt.Errorf("no book with ID %d", id)
+	}
+	if parts := strings.Split(strings.Trim(sh.abs(q), "/"), "/"); len(parts) >= 2 && parts[0] == tree.BookDirInfo.ID {
+		if id, err := strconv.Atoi(parts[1]); err == nil {
+			if book := sh.Meta.GetBook(id); book != nil {
+				return book, nil
+			}
+		}
+	}
+	var matches []*calibre.Book
+	for _, book := range sh.Meta.Books {
+		if strings.EqualFold(book.Title, q) {
+			return book, nil
+		}
+		if strings.Contains(strings.ToLower(book.Title), strings.ToLower(q)) {
+			matches = append(matches, book)
+		}
+	}
+	switch len(matches) {
+	case 0:
+		return nil, fmt.Errorf("no book matches %q", q)
+	case 1:
+		return matches[0], nil
+	}
+	for _, book := range matches {
+		sh.printBook(book)
+	}
+	return nil, fmt.Errorf("%d books match %q; use an ID", len(matches), q)
+}
+
+func (sh *shell) search(args []string) error {
+	if sh.Meta == nil {
+		return fmt.Errorf("no library metadata available")
+	}
+	if len(args) == 0 {
+		return fmt.Errorf("usage: %s", shellCommands["search"].Usage)
+	}
+	books := sh.Meta.Search(strings.Join(args, " "))
+	for _, book := range books {
+		sh.printBook(book)
+	}
+	fmt.Fprintf(sh.w, "%d results\n", len(books))
+	return nil
+}
+
+func (sh *shell) printBook(book *calibre.Book) {
+	var authors []string
+	for _, a := range book.Authors {
+		authors = append(authors, a.Name)
+	}
+	fmt.Fprintf(sh.w, "%6d  %s", book.ID, book.Title)
+	if len(authors) > 0 {
+		fmt.Fprintf(sh.w, " - %s", strings.Join(authors, ", "))
+	}
+	fmt.Fprintln(sh.w)
+}
+
+// Tab completion: command names for the first word, paths for the rest. Completes as far as
+// all candidates agree; like most shells, a unique match gets a trailing space (or slash).
+func (sh *shell) complete(line string, pos int, key rune) (string, int, bool) {
+	if key != '\t' {
+		return "", 0, false
+	}
+
+	// Find the start of the current word, skipping escaped spaces.
+	start := 0
+	for i := 0; i < pos; i++ {
+		switch line[i] {
+		case '\\':
+			i++
+		case ' ':
+			start = i + 1
+		}
+	}
+	word := strings.ReplaceAll(line[start:pos], `\ `, " ")
+
+	var prefix string // The part of the word that isn't being completed.
+	var candidates []string
+	if strings.TrimSpace(line[:start]) == "" {
+		for name := range shellCommands {
+			if strings.HasPrefix(name, word) {
+				candidates = append(candidates, name+" ")
+			}
+		}
+	} else {
+		dir, base := path.Split(word)
+		prefix = dir
+		infos, err := afero.ReadDir(sh.Fs, sh.abs(dir+"."))
+		if err != nil {
+			return "", 0, false
+		}
+		for _, info := range infos {
+			if strings.HasPrefix(info.Name(), base) {
+				suffix := " "
+				if info.IsDir() {
+					suffix = "/"
+				}
+				candidates = append(candidates, info.Name()+suffix)
+			}
+		}
+		word = base
+	}
+	if len(candidates) == 0 {
+		return "", 0, false
+	}
+
+	common := candidates[0]
+	for _, c := range candidates[1:] {
+		for !strings.HasPrefix(c, common) {
+			_, size := utf8.DecodeLastRuneInString(common)
+			common = common[:len(common)-size]
+		}
+	}
+	if len(common) <= len(word) {
+		return "", 0, false
+	}
+	insert := strings.ReplaceAll(prefix+common, " ", `\ `)
+	if strings.HasSuffix(common, " ") {
+		insert = insert[:len(insert)-2] + " " // Don't escape the trailing space.
+	}
+	newLine := line[:start] + insert + line[pos:]
+	return newLine, start + len(insert), true
+}
@@ -0,0 +1,104 @@
+package ssh
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/liclac/sharlayan/calibre"
+)
+
+func testShell(t *testing.T) (*shell, *bytes.Buffer) {
+	fs := afero.NewMemMapFs()
+	require.NoError(t, afero.WriteFile(fs, "/index.html", []byte("<h1>Home</h1>"), 0644))
+	require.NoError(t, afero.WriteFile(fs, "/books/1/index.html", []byte("<h1>Guards! Guards!</h1>"), 0644))
+	require.NoError(t, afero.WriteFile(fs, "/books/2/index.html", []byte("<h1>Good Omens</h1>"), 0644))
+	require.NoError(t, afero.WriteFile(fs, "/books/2/2.epub", []byte("EPUB"), 0644))
+	require.NoError(t, afero.WriteFile(fs, "/authors/1/index.html", []byte("<h1>Terry Pratchett</h1>"), 0644))
+
+	pratchett := &calibre.Author{ID: 1, Name: "Terry Pratchett"}
+	gaiman := &calibre.Author{ID: 2, Name: "Neil Gaiman"}
+	meta := &calibre.Metadata{
+		Authors: []*calibre.Author{pratchett, gaiman},
+		Books: []*calibre.Book{
+			{ID: 1, Title: "Guards! Guards!", Authors: []*calibre.Author{pratchett}},
+			{ID: 2, Title: "Good Omens", Authors: []*calibre.Author{pratchett, gaiman},
+				Data: []*calibre.Data{{Format: "EPUB", Name: "Good Omens - Neil Gaiman"}}},
+		},
+	}
+	var out bytes.Buffer
+	return &shell{L: zap.NewNop(), Fs: fs, Meta: meta, Cwd: "/", title: "Test", w: &out}, &out
+}
+
+func TestShell(t *testing.T) {
+	testdata := map[string]struct {
+		lines []string
+		out   string
+	}{
+		"Empty":           {[]string{""}, ""},
+		"Unknown":         {[]string{"rm -rf /"}, "rm: command not found; try 'help'\n"},
+		"ls":              {[]string{"ls"}, "authors/\nbooks/\nindex.html\n"},
+		"ls/Labels":       {[]string{"ls books"}, "1/       Guards! Guards!\n2/       Good Omens\n"},
+		"ls/File":         {[]string{"ls /books/2/2.epub"}, "2.epub\n"},
+		"ls/Missing":      {[]string{"ls nope"}, "ls: nope: no such file or directory\n"},
+		"cd":              {[]string{"cd books/2", "pwd", "ls", "cd ..", "pwd", "cd", "pwd"}, "/books/2\n2.epub\nindex.html\n/books\n/\n"},
+		"cd/File":         {[]string{"cd index.html", "pwd"}, "cd: /index.html: not a directory\n/\n"},
+		"cat":             {[]string{"cat /books/1/index.html"}, "<h1>Guards! Guards!</h1>"},
+		"tree":            {[]string{"tree /books"}, "/books\n├── 1 (Guards! Guards!)\n│   └── index.html\n└── 2 (Good Omens)\n    ├── 2.epub\n    └── index.html\n"},
+		"search":          {[]string{"search gaiman"}, "     2  Good Omens - Terry Pratchett, Neil Gaiman\n1 results\n"},
+		"search/AllWords": {[]string{"search pratchett guards"}, "     1  Guards! Guards! - Terry Pratchett\n1 results\n"},
+		"info/ID":         {[]string{"info 1"}, "Guards! Guards!\n===============\nID:          1\nPath:        /books/1\nAuthors:     Terry Pratchett\n"},
+		"info/Path":       {[]string{"cd /books/2", "info ."}, "Good Omens\n==========\nID:          2\nPath:        /books/2\nAuthors:     Terry Pratchett, Neil Gaiman\nFiles:       2.epub\n"},
+		"info/Title":      {[]string{"info omens"}, "Good Omens\n==========\nID:          2\nPath:        /books/2\nAuthors:     Terry Pratchett, Neil Gaiman\nFiles:       2.epub\n"},
+		"info/Ambiguous":  {[]string{"info g"}, "     1  Guards! Guards! - Terry Pratchett\n     2  Good Omens - Terry Pratchett, Neil Gaiman\ninfo: 2 books match \"g\"; use an ID\n"},
+		"info/Missing":    {[]string{"info 3"}, "info: no book with ID 3\n"},
+	}
+	for name, tdata := range testdata {
+		t.Run(name, func(t *testing.T) {
+			sh, out := testShell(t)
+			for _, line := range tdata.lines {
+				require.NoError(t, sh.Exec(line))
+			}
+			assert.Equal(t, tdata.out, out.String())
+		})
+	}
+}
+
+func TestShellExit(t *testing.T) {
+	sh, _ := testShell(t)
+	for _, line := range []string{"exit", "logout", "quit"} {
+		assert.Equal(t, errExit, sh.Exec(line))
+	}
+}
+
+func TestShellComplete(t *testing.T) {
+	testdata := map[string]struct {
+		cwd, line string
+		newLine   string
+		ok        bool
+	}{
+		"Command":         {"/", "se", "search ", true},
+		"Command/Several": {"/", "c", "", false},
+		"Path":            {"/", "cd bo", "cd books/", true},
+		"Path/Nested":     {"/", "ls books/2/2", "ls books/2/2.epub ", true},
+		"Path/Relative":   {"/books", "ls 2/i", "ls 2/index.html ", true},
+		"Path/Common":     {"/", "ls books/2/", "", false},
+		"Path/Missing":    {"/", "ls nope/", "", false},
+	}
+	for name, tdata := range testdata {
+		t.Run(name, func(t *testing.T) {
+			sh, _ := testShell(t)
+			sh.Cwd = tdata.cwd
+			newLine, pos, ok := sh.complete(tdata.line, len(tdata.line), '\t')
+			assert.Equal(t, tdata.ok, ok)
+			assert.Equal(t, tdata.newLine, newLine)
+			if ok {
+				assert.Equal(t, len(newLine), pos)
+			}
+		})
+	}
+}
@@ -0,0 +1,266 @@
+package server
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/liclac/sharlayan/config"
+)
+
+// How often to check whether the certificate has been replaced on disk.
+const certReloadInterval = 10 * time.Second
+
+// How long a generated certificate is valid for.
+const certValidity = 365 * 24 * time.Hour
+
+// Returns the paths to the configured TLS certificate and key, generating a self-signed pair
+// if neither exists. Unless configured, they're ${config.dir}/tls.crt and tls.key.
+func LoadOrGenerateCertificate(cfg *config.Config) (certPath, keyPath string, err error) {
+	var names []string
+	if u, err := url.Parse(cfg.HTML.URL); err == nil && u.Hostname() != "" {
+		names = append(names, u.Hostname())
+	}
+	return loadOrGenerateCertificate(cfg.HTTP.TLS.Cert, cfg.HTTP.TLS.Key,
+		filepath.Join(cfg.Config.Dir, "tls"), certHosts(cfg.HTTP.Addrs, names...), certValidity)
+}
+
+// Returns a TLS config with the certificate from LoadOrGenerateCertificate, which is reloaded
+// when it changes; for every server that shares it, ie. HTTP, WebDAV and FTP.
+func httpTLSConfig(ctx context.Context, L *zap.Logger, cfg *config.Config) (*tls.Config, error) {
+	certPath, keyPath, err := LoadOrGenerateCertificate(cfg)
+	if err != nil {
+		return nil, err
+	}
+	certs, err := newCertReloader(L, certPath, keyPath)
+	if err != nil {
+		return nil, err
+	}
+	certs.logCert("Certificate")
+	go certs.watch(ctx, certReloadInterval)
+	return &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: certs.GetCertificate,
+	}, nil
+}
+
+// Returns certPath and keyPath, defaulting to base + ".crt" and ".key", after generating a
+// certificate for hosts if neither file exists.
+func loadOrGenerateCertificate(certPath, keyPath, base string, hosts []string, validity time.Duration) (string, string, error) {
+	if certPath == "" {
+		certPath = base + ".crt"
+	}
+	if keyPath == "" {
+		keyPath = base + ".key"
+	}
+	_, certErr := os.Stat(certPath)
+	_, keyErr := os.Stat(keyPath)
+	if os.IsNotExist(certErr) && os.IsNotExist(keyErr) {
+		if err := GenerateCertificate(certPath, keyPath, hosts, validity); err != nil {
+			return "", "", err
+		}
+	}
+	return certPath, keyPath, nil
+}
+
+// Returns the hostnames and IPs a generated certificate should be valid for: "localhost", the
+// hosts we're listening on, if they're specific, and any other names we're known by.
+func certHosts(addrs []string, names ...string) []string {
+	hosts := []string{"localhost"}
+	for _, addr := range addrs {
+		if strings.HasPrefix(addr, unixPrefix) || strings.HasPrefix(addr, systemdPrefix) {
+			continue
+		}
+		if host, _, err := net.SplitHostPort(addr); err == nil && host != "" {
+			if ip := net.ParseIP(host); ip == nil || !ip.IsUnspecified() {
+				hosts = append(hosts, host)
+			}
+		}
+	}
+	return append(hosts, names...)
+}
+
+// Generates a self-signed ECDSA certificate for the given hosts, as PEM files. Browsers will
+// still warn about it, but it's better than nothing, and can be replaced with a real one.
+func GenerateCertificate(certPath, keyPath string, hosts []string, validity time.Duration) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{"sharlayan"}, CommonName: hosts[0]},
+		NotBefore:             now.Add(-time.Hour), // In case of clock skew.
+		NotAfter:              now.Add(validity),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true, // Not a CA; Firefox refuses CA certificates for servers.
+	}
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+		} else {
+			tmpl.DNSNames = append(tmpl.DNSNames, host)
+		}
+	}
+	if len(tmpl.IPAddresses) == 0 {
+		tmpl.IPAddresses = []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback}
+	}
+	certDER, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+	if err != nil {
+		return fmt.Errorf("tls: couldn't create certificate: %w", err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return err
+	}
+
+	for _, path := range []string{certPath, keyPath} {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return err
+		}
+	}
+	if err := writePEM(keyPath, "PRIVATE KEY", keyDER, 0600); err != nil {
+		return err
+	}
+	return writePEM(certPath, "CERTIFICATE", certDER, 0644)
+}
+
+func writePEM(path, typ string, der []byte, perm os.FileMode) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	if err := pem.Encode(f, &pem.Block{Type: typ, Bytes: der}); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// Serves a certificate, and reloads it when the files change, eg. when certbot renews it.
+// If reloading fails, eg. because only one of the files has been replaced so far, the old
+// certificate is kept, and it's tried again later.
+type certReloader struct {
+	L        *zap.Logger
+	CertPath string
+	KeyPath  string
+
+	mu      sync.RWMutex
+	cert    *tls.Certificate
+	modTime time.Time // Latest modification time of either file.
+}
+
+func newCertReloader(L *zap.Logger, certPath, keyPath string) (*certReloader, error) {
+	r := &certReloader{L: L, CertPath: certPath, KeyPath: keyPath}
+	if _, err := r.reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Implements tls.Config.GetCertificate.
+func (r *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cert, nil
+}
+
+// Reloads the certificate if either file has changed since last time. Returns whether it did.
+func (r *certReloader) reload() (bool, error) {
+	var modTime time.Time
+	for _, path := range []string{r.CertPath, r.KeyPath} {
+		info, err := os.Stat(path)
+		if err != nil {
+			return false, fmt.Errorf("tls: %w", err)
+		}
+		if info.ModTime().After(modTime) {
+			modTime = info.ModTime()
+		}
+	}
+	r.mu.RLock()
+	unchanged := r.cert != nil && modTime.Equal(r.modTime)
+	r.mu.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.CertPath, r.KeyPath)
+	if err != nil {
+		return false, fmt.Errorf("tls: couldn't load certificate: %w", err)
+	}
+	if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+		return false, fmt.Errorf("tls: couldn't parse certificate: %w", err)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.cert, r.modTime = &cert, modTime
+	return true, nil
+}
+
+// Checks for changes every interval, until the context expires.
+func (r *certReloader) watch(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			if ok, err := r.reload(); err != nil {
+				r.L.Warn("Couldn't reload certificate, keeping the old one", zap.Error(err))
+			} else if ok {
+				r.logCert("Certificate reloaded")
+			}
+		}
+	}
+}
+
+func (r *certReloader) logCert(msg string) {
+	r.mu.RLock()
+	leaf := r.cert.Leaf
+	r.mu.RUnlock()
+	r.L.Info(msg, zap.String("path", r.CertPath), zap.Strings("names", leaf.DNSNames),
+		zap.Time("expires", leaf.NotAfter))
+}
+
+// Redirects plain HTTP requests to the same URL over HTTPS, on the given port.
+func redirectHandler(port string) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		host := req.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		} else {
+			host = strings.Trim(host, "[]") // Bare IPv6 address.
+		}
+		if port != "443" {
+			host = net.JoinHostPort(host, port)
+		} else if strings.Contains(host, ":") {
+			host = "[" + host + "]"
+		}
+		u := url.URL{Scheme: "https", Host: host, Path: req.URL.Path, RawQuery: req.URL.RawQuery}
+		http.Redirect(rw, req, u.String(), http.StatusPermanentRedirect)
+	})
+}
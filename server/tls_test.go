@@ -0,0 +1,88 @@
+package server
+
+import (
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/liclac/sharlayan/config"
+)
+
+func TestLoadOrGenerateCertificate(t *testing.T) {
+	cfg := &config.Config{}
+	cfg.Config.Dir = t.TempDir()
+	cfg.HTTP.Addrs = []string{"192.0.2.1:3300"}
+	cfg.HTML.URL = "https://books.example.com/library/"
+
+	certPath, keyPath, err := LoadOrGenerateCertificate(cfg)
+	require.NoError(t, err)
+	assert.Equal(t, filepath.Join(cfg.Config.Dir, "tls.crt"), certPath)
+	assert.Equal(t, filepath.Join(cfg.Config.Dir, "tls.key"), keyPath)
+	info, err := os.Stat(keyPath)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	r, err := newCertReloader(zap.NewNop(), certPath, keyPath)
+	require.NoError(t, err)
+	cert, err := r.GetCertificate(nil)
+	require.NoError(t, err)
+	assert.NoError(t, cert.Leaf.VerifyHostname("localhost"))
+	assert.NoError(t, cert.Leaf.VerifyHostname("books.example.com"))
+	assert.NoError(t, cert.Leaf.VerifyHostname("192.0.2.1"))
+	assert.False(t, cert.Leaf.IsCA, "Firefox refuses CA certificates for servers")
+	assert.Equal(t, x509.KeyUsageDigitalSignature, cert.Leaf.KeyUsage)
+
+	// Existing files are left alone.
+	_, _, err = LoadOrGenerateCertificate(cfg)
+	require.NoError(t, err)
+	ok, err := r.reload()
+	require.NoError(t, err)
+	assert.False(t, ok)
+
+	// Replaced ones are picked up.
+	require.NoError(t, GenerateCertificate(certPath, keyPath, []string{"other.example.com"}, certValidity))
+	later := time.Now().Add(time.Minute)
+	require.NoError(t, os.Chtimes(certPath, later, later))
+	ok, err = r.reload()
+	require.NoError(t, err)
+	assert.True(t, ok)
+	cert, err = r.GetCertificate(nil)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"other.example.com"}, cert.Leaf.DNSNames)
+
+	// Broken ones aren't.
+	require.NoError(t, os.Remove(keyPath))
+	_, err = r.reload()
+	assert.Error(t, err)
+	cert2, err := r.GetCertificate(nil)
+	require.NoError(t, err)
+	assert.Equal(t, cert, cert2)
+}
+
+func TestRedirectHandler(t *testing.T) {
+	testdata := map[string]struct {
+		port, url, location string
+	}{
+		"Default":     {"443", "http://example.com/books/?q=1", "https://example.com/books/?q=1"},
+		"Port":        {"8443", "http://example.com:8080/books/", "https://example.com:8443/books/"},
+		"IPv6":        {"8443", "http://[::1]/", "https://[::1]:8443/"},
+		"IPv6/Port":   {"443", "http://[::1]:80/", "https://[::1]/"},
+		"Port/Remove": {"443", "http://example.com:80/", "https://example.com/"},
+	}
+	for name, tdata := range testdata {
+		t.Run(name, func(t *testing.T) {
+			rw := httptest.NewRecorder()
+			redirectHandler(tdata.port).ServeHTTP(rw, httptest.NewRequest("GET", tdata.url, nil))
+			assert.Equal(t, http.StatusPermanentRedirect, rw.Code)
+			assert.Equal(t, tdata.location, rw.Header().Get("Location"))
+		})
+	}
+}
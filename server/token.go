@@ -0,0 +1,110 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/liclac/sharlayan/config"
+)
+
+// Length of a generated token secret.
+const tokenSecretLen = 32
+
+var (
+	errTokenInvalid = errors.New("invalid token")
+	errTokenExpired = errors.New("token has expired")
+)
+
+// Signs and verifies share tokens, which let whoever has a link browse the library as a
+// given user, without a password. Tokens can't be revoked individually; to revoke all of
+// them, delete the secret and restart.
+type ShareTokens struct {
+	secret []byte
+	now    func() time.Time
+}
+
+func NewShareTokens(secret []byte) *ShareTokens {
+	return &ShareTokens{secret: secret, now: time.Now}
+}
+
+// Loads the configured token secret, generating one if it doesn't exist. Unless configured,
+// it's ${config.dir}/token_secret.
+func LoadOrGenerateShareTokens(cfg *config.Config) (*ShareTokens, error) {
+	path := cfg.HTTP.Auth.TokenSecret
+	if path == "" {
+		path = filepath.Join(cfg.Config.Dir, "token_secret")
+	}
+	secret, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		secret = make([]byte, tokenSecretLen)
+		if _, err := rand.Read(secret); err != nil {
+			return nil, err
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return nil, err
+		}
+		if err := ioutil.WriteFile(path, secret, 0600); err != nil {
+			return nil, err
+		}
+	} else if err != nil {
+		return nil, fmt.Errorf("tokens: %w", err)
+	} else if len(secret) < tokenSecretLen {
+		return nil, fmt.Errorf("tokens: %s: secret is too short, need at least %d bytes", path, tokenSecretLen)
+	}
+	return NewShareTokens(secret), nil
+}
+
+// Returns a token for a user, which stops working after the given time; zero never expires.
+func (t *ShareTokens) Sign(user string, expires time.Time) string {
+	var exp int64
+	if !expires.IsZero() {
+		exp = expires.Unix()
+	}
+	payload := []byte(user + "\n" + strconv.FormatInt(exp, 10))
+	return base64.RawURLEncoding.EncodeToString(payload) + "." +
+		base64.RawURLEncoding.EncodeToString(t.mac(payload))
+}
+
+// Returns the user a token was signed for, if it's valid and hasn't expired.
+func (t *ShareTokens) Verify(token string) (string, error) {
+	parts := strings.SplitN(token, ".", 2)
+	if len(parts) != 2 {
+		return "", errTokenInvalid
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return "", errTokenInvalid
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil || !hmac.Equal(sig, t.mac(payload)) {
+		return "", errTokenInvalid
+	}
+	fields := strings.SplitN(string(payload), "\n", 2)
+	if len(fields) != 2 {
+		return "", errTokenInvalid
+	}
+	exp, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return "", errTokenInvalid
+	}
+	if exp != 0 && t.now().Unix() >= exp {
+		return "", errTokenExpired
+	}
+	return fields[0], nil
+}
+
+func (t *ShareTokens) mac(payload []byte) []byte {
+	h := hmac.New(sha256.New, t.secret)
+	h.Write(payload)
+	return h.Sum(nil)
+}
@@ -0,0 +1,51 @@
+package server
+
+import (
+	"context"
+
+	"github.com/spf13/afero"
+
+	"github.com/liclac/sharlayan/calibre"
+)
+
+// A filesystem which can be narrowed down to what a given user may see, eg. acl.Views.
+type UserFs interface {
+	afero.Fs
+	ForUser(user string) (afero.Fs, error)
+}
+
+// Returns the part of a filesystem a user may see; "" is anonymous. Filesystems that don't
+// implement UserFs are returned as-is.
+func ForUser(fs afero.Fs, user string) (afero.Fs, error) {
+	if ufs, ok := fs.(UserFs); ok {
+		return ufs.ForUser(user)
+	}
+	return fs, nil
+}
+
+// A UserFs which also knows what part of the library each user's view contains.
+type MetadataFs interface {
+	UserFs
+	MetadataForUser(user string) (*calibre.Metadata, error)
+}
+
+// Returns the part of the library a user may see, or nil if the filesystem isn't a MetadataFs.
+func MetadataForUser(fs afero.Fs, user string) (*calibre.Metadata, error) {
+	if mfs, ok := fs.(MetadataFs); ok {
+		return mfs.MetadataForUser(user)
+	}
+	return nil, nil
+}
+
+type userKey struct{}
+
+// Returns a context carrying an authenticated user.
+func WithUser(ctx context.Context, user string) context.Context {
+	return context.WithValue(ctx, userKey{}, user)
+}
+
+// Returns the authenticated user from a context, or "" if anonymous.
+func UserFromContext(ctx context.Context) string {
+	user, _ := ctx.Value(userKey{}).(string)
+	return user
+}
@@ -0,0 +1,197 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/spf13/afero"
+	"go.uber.org/zap"
+	"golang.org/x/net/webdav"
+
+	"github.com/liclac/sharlayan/calibre"
+	"github.com/liclac/sharlayan/config"
+	"github.com/liclac/sharlayan/metrics"
+)
+
+// Methods a read-only WebDAV server needs; everything else, including locking, is refused.
+var webdavMethods = []string{"OPTIONS", "GET", "HEAD", "PROPFIND"}
+
+type webdavServer struct {
+	L   *zap.Logger
+	cfg *config.Config
+}
+
+// A read-only WebDAV server, so the library can be mounted as a network drive without an SFTP
+// client, eg. with Windows' "Map network drive" or macOS' "Connect to Server". Users log in the
+// same way as they do over HTTP, see http.auth.*; with webdav.tls.enable, it's served over HTTPS
+// with the same certificate as HTTP, which Windows requires for Basic auth.
+func WebDAV(cfg *config.Config) Server {
+	L := zap.L().Named("webdav")
+	if !cfg.WebDAV.Enable {
+		L.Debug("Not enabled, skipping...")
+		return nil
+	}
+	metrics.NotReady("webdav")
+	return webdavServer{L, cfg}
+}
+
+func (s webdavServer) Run(ctx context.Context, fs afero.Fs) error {
+	auth, err := newHTTPAuth(s.L.Named("auth"), s.cfg)
+	if err != nil {
+		return fmt.Errorf("webdav: %w", err)
+	}
+	srv := &http.Server{
+		Handler:     withRequestID(logRequests(s.L.Named("access"), nil, auth.Wrap(noteUser(s.handler(fs))))),
+		BaseContext: func(net.Listener) context.Context { return ctx },
+	}
+	if s.cfg.WebDAV.TLS.Enable {
+		if srv.TLSConfig, err = httpTLSConfig(ctx, s.L.Named("tls"), s.cfg); err != nil {
+			return fmt.Errorf("webdav: %w", err)
+		}
+	} else if s.cfg.HTTP.Auth.Basic {
+		// Fine behind a reverse proxy that does TLS, but Windows won't send passwords otherwise.
+		s.L.Warn("Passwords will be sent unencrypted; set webdav.tls.enable, or use a reverse proxy")
+	}
+	l, err := Listen(ctx, s.cfg, s.cfg.WebDAV.Addrs...)
+	if err != nil {
+		return fmt.Errorf("webdav: couldn't listen: %w", err)
+	}
+	s.L.Info("Listening", zap.Stringer("addr", l.Addr()), zap.Bool("tls", srv.TLSConfig != nil))
+	metrics.Ready("webdav")
+	defer metrics.NotReady("webdav")
+
+	go func() {
+		<-ctx.Done()
+		metrics.NotReady("webdav")
+		shutdownWith(ctx, s.L, srv, s.cfg.WebDAV.Grace)
+	}()
+	if srv.TLSConfig != nil {
+		err = srv.ServeTLS(l, "", "")
+	} else {
+		err = srv.Serve(l)
+	}
+	if err != nil && err != http.ErrServerClosed {
+		return fmt.Errorf("webdav: server error: %w", err)
+	}
+	return nil
+}
+
+// Serves the part of the filesystem the request's user may see over WebDAV.
+func (s webdavServer) handler(fs afero.Fs) http.Handler {
+	locks := webdav.NewMemLS() // Required, but never used; nothing can be locked.
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if !allowedWebDAVMethod(req.Method) {
+			rw.Header().Set("Allow", strings.Join(webdavMethods, ", "))
+			http.Error(rw, "Read-only", http.StatusMethodNotAllowed)
+			return
+		}
+		if req.Method == "OPTIONS" {
+			// Don't advertise class 2 (locking), or clients will try to lock things.
+			rw.Header().Set("Allow", strings.Join(webdavMethods, ", "))
+			rw.Header().Set("DAV", "1")
+			rw.Header().Set("MS-Author-Via", "DAV")
+			return
+		}
+		userFs, err := ForUser(fs, UserFromContext(req.Context()))
+		if err != nil {
+			s.L.Error("Couldn't get filesystem for user", zap.Error(err))
+			http.Error(rw, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		if typ := calibre.FormatMIMEType(path.Ext(req.URL.Path)); typ != "" {
+			rw.Header().Set("Content-Type", typ) // http.ServeContent would guess.
+		}
+		h := &webdav.Handler{
+			FileSystem: webdavFS{userFs},
+			LockSystem: locks,
+			Logger: func(req *http.Request, err error) {
+				if err != nil && !os.IsNotExist(err) {
+					s.L.Debug("Request failed", zap.String("method", req.Method),
+						zap.String("path", req.URL.Path), zap.Error(err))
+				}
+			},
+		}
+		h.ServeHTTP(rw, req)
+	})
+}
+
+func allowedWebDAVMethod(method string) bool {
+	for _, m := range webdavMethods {
+		if m == method {
+			return true
+		}
+	}
+	return false
+}
+
+// Adapts a read-only afero.Fs to webdav.FileSystem.
+type webdavFS struct{ fs afero.Fs }
+
+func (fs webdavFS) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	return &os.PathError{Op: "mkdir", Path: name, Err: os.ErrPermission}
+}
+
+func (fs webdavFS) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC|os.O_APPEND) != 0 {
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrPermission}
+	}
+	f, err := fs.fs.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return webdavFile{f}, nil
+}
+
+func (fs webdavFS) RemoveAll(ctx context.Context, name string) error {
+	return &os.PathError{Op: "remove", Path: name, Err: os.ErrPermission}
+}
+
+func (fs webdavFS) Rename(ctx context.Context, oldName, newName string) error {
+	return &os.LinkError{Op: "rename", Old: oldName, New: newName, Err: os.ErrPermission}
+}
+
+func (fs webdavFS) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	info, err := fs.fs.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	return webdavFileInfo{info}, nil
+}
+
+type webdavFile struct{ afero.File }
+
+func (f webdavFile) Readdir(count int) ([]os.FileInfo, error) {
+	infos, err := f.File.Readdir(count)
+	for i, info := range infos {
+		infos[i] = webdavFileInfo{info}
+	}
+	return infos, err
+}
+
+func (f webdavFile) Stat() (os.FileInfo, error) {
+	info, err := f.File.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return webdavFileInfo{info}, nil
+}
+
+func (f webdavFile) Write([]byte) (int, error) {
+	return 0, &os.PathError{Op: "write", Path: f.Name(), Err: os.ErrPermission}
+}
+
+// Gives book files their proper MIME types in directory listings, rather than making the
+// webdav package open and sniff every one of them.
+type webdavFileInfo struct{ os.FileInfo }
+
+func (info webdavFileInfo) ContentType(ctx context.Context) (string, error) {
+	if typ := calibre.FormatMIMEType(path.Ext(info.Name())); typ != "" && !info.IsDir() {
+		return typ, nil
+	}
+	return "", webdav.ErrNotImplemented
+}
@@ -0,0 +1,123 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/liclac/sharlayan/config"
+)
+
+func TestWebDAV(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	require.NoError(t, afero.WriteFile(fs, "/index.html", []byte("<p>Hi</p>"), 0644))
+	require.NoError(t, afero.WriteFile(fs, "/books/1/1.azw3", []byte("BOOKMOBI"), 0644))
+	h := webdavServer{zap.NewNop(), &config.Config{}}.handler(afero.NewReadOnlyFs(fs))
+	do := func(method, path, body string, headers map[string]string) (*http.Response, string) {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		rw := httptest.NewRecorder()
+		h.ServeHTTP(rw, req)
+		b, err := ioutil.ReadAll(rw.Result().Body)
+		require.NoError(t, err)
+		return rw.Result(), string(b)
+	}
+
+	t.Run("OPTIONS", func(t *testing.T) {
+		resp, _ := do("OPTIONS", "/", "", nil)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "1", resp.Header.Get("DAV"), "class 2 means locking")
+		assert.Equal(t, "OPTIONS, GET, HEAD, PROPFIND", resp.Header.Get("Allow"))
+	})
+	t.Run("PROPFIND", func(t *testing.T) {
+		resp, body := do("PROPFIND", "/books/1/", "", map[string]string{"Depth": "1"})
+		assert.Equal(t, http.StatusMultiStatus, resp.StatusCode)
+		assert.Contains(t, body, "<D:href>/books/1/1.azw3</D:href>")
+		assert.Contains(t, body, "<D:getcontenttype>application/vnd.amazon.mobi8-ebook</D:getcontenttype>")
+		assert.Contains(t, body, "<D:getcontentlength>8</D:getcontentlength>")
+
+		resp, _ = do("PROPFIND", "/books/2/", "", map[string]string{"Depth": "1"})
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	})
+	t.Run("GET", func(t *testing.T) {
+		resp, body := do("GET", "/books/1/1.azw3", "", nil)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "application/vnd.amazon.mobi8-ebook", resp.Header.Get("Content-Type"))
+		assert.Equal(t, "BOOKMOBI", body)
+
+		resp, body = do("HEAD", "/index.html", "", nil)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "9", resp.Header.Get("Content-Length"))
+		assert.Equal(t, "", body)
+	})
+
+	// Nothing can be changed, or locked.
+	for _, method := range []string{"PUT", "DELETE", "MKCOL", "COPY", "MOVE", "PROPPATCH", "LOCK", "UNLOCK", "POST"} {
+		t.Run(method, func(t *testing.T) {
+			resp, _ := do(method, "/books/1/1.azw3", "BOOKMOBI", map[string]string{"Destination": "/books/1/2.azw3"})
+			assert.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+			assert.Equal(t, "OPTIONS, GET, HEAD, PROPFIND", resp.Header.Get("Allow"))
+		})
+	}
+	exists, err := afero.Exists(fs, "/books/1/2.azw3")
+	require.NoError(t, err)
+	assert.False(t, exists)
+
+	t.Run("ReadOnly", func(t *testing.T) {
+		_, err := webdavFS{fs}.OpenFile(context.Background(), "/books/1/1.azw3", os.O_WRONLY, 0)
+		assert.True(t, os.IsPermission(err), "%v", err)
+	})
+}
+
+func TestWebDAVTLS(t *testing.T) {
+	dir := t.TempDir()
+	cfg := &config.Config{}
+	cfg.Config.Dir = dir
+	cfg.HTTP.Auth.Anonymous = true
+	cfg.WebDAV.Addrs = []string{"unix:" + filepath.Join(dir, "webdav.sock")}
+	cfg.WebDAV.TLS.Enable = true
+	fs := afero.NewMemMapFs()
+	require.NoError(t, afero.WriteFile(fs, "/index.html", []byte("<p>Hi</p>"), 0644))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errC := make(chan error, 1)
+	go func() { errC <- webdavServer{zap.NewNop(), cfg}.Run(ctx, afero.NewReadOnlyFs(fs)) }()
+	defer func() {
+		cancel()
+		assert.NoError(t, <-errC)
+	}()
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", filepath.Join(dir, "webdav.sock"))
+		},
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	}}
+	var resp *http.Response
+	var err error
+	for i := 0; i < 50; i++ { // Wait for it to start listening.
+		if resp, err = client.Get("https://localhost/index.html"); err == nil {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.NotNil(t, resp.TLS)
+}